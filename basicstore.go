@@ -0,0 +1,412 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	_ sessionStore = &basicStore{}
+	_ Store        = &nestedStore{}
+)
+
+// Extend the session store with the optional session store interfaces, for the decorators that
+// wrap it. A session store of another storage that does not implement all of them gets a basicStore.
+func extendStore(st Store) sessionStore {
+	if ss, ok := st.(sessionStore); ok {
+		return ss
+	}
+	return &basicStore{Store: st}
+}
+
+// A session store that implements the optional session store interfaces the session store it wraps
+// does not implement, on top of Store where possible. The others do nothing or return ErrNotSupported,
+// such as Lock, and a session store that does not track its changes is always dirty.
+type basicStore struct {
+	Store
+	// the context of WithContext, when the session store can not be bound to another context
+	ctx context.Context
+}
+
+func (s *basicStore) unwrap() []Store {
+	return []Store{s.Store}
+}
+
+func (s *basicStore) Context() context.Context {
+	if s.ctx != nil {
+		return s.ctx
+	}
+	return s.Store.Context()
+}
+
+func (s *basicStore) WithContext(ctx context.Context) Store {
+	if cb, ok := s.Store.(ContextBinder); ok {
+		return &basicStore{Store: cb.WithContext(ctx)}
+	}
+	return &basicStore{Store: s.Store, ctx: ctx}
+}
+
+func (s *basicStore) Manager() ManagerStore {
+	if ms, ok := s.Store.(ManagedStore); ok {
+		return ms.Manager()
+	}
+	return nil
+}
+
+func (s *basicStore) SetChecked(key string, value interface{}) error {
+	if vs, ok := s.Store.(ValueStore); ok {
+		return vs.SetChecked(key, value)
+	}
+	s.Set(key, value)
+	return nil
+}
+
+func (s *basicStore) SetIfAbsent(key string, value interface{}) (bool, error) {
+	if vs, ok := s.Store.(ValueStore); ok {
+		return vs.SetIfAbsent(key, value)
+	}
+	if _, ok := s.Get(key); ok {
+		return false, nil
+	}
+	s.Set(key, value)
+	return true, nil
+}
+
+func (s *basicStore) SetAll(values map[string]interface{}) error {
+	if vs, ok := s.Store.(ValueStore); ok {
+		return vs.SetAll(values)
+	}
+	for key, value := range values {
+		s.Set(key, value)
+	}
+	return nil
+}
+
+func (s *basicStore) SetTransient(key string, value interface{}) {
+	if vs, ok := s.Store.(ValueStore); ok {
+		vs.SetTransient(key, value)
+	}
+}
+
+func (s *basicStore) SetWithTTLAndCallback(key string, value interface{}, ttl time.Duration, onExpire func(key string, value interface{})) error {
+	if vs, ok := s.Store.(ValueStore); ok {
+		return vs.SetWithTTLAndCallback(key, value, ttl, onExpire)
+	}
+	return ErrNotSupported
+}
+
+func (s *basicStore) SetUUID(key string, id uuid.UUID) error {
+	if vs, ok := s.Store.(ValueStore); ok {
+		return vs.SetUUID(key, id)
+	}
+	s.Set(key, id.String())
+	return nil
+}
+
+func (s *basicStore) GetAny(key string) interface{} {
+	v, _ := s.Get(key)
+	return v
+}
+
+func (s *basicStore) GetFirst(keys ...string) (interface{}, bool) {
+	if vs, ok := s.Store.(ValueStore); ok {
+		return vs.GetFirst(keys...)
+	}
+	for _, key := range keys {
+		if v, ok := s.Get(key); ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func (s *basicStore) GetMany(keys ...string) map[string]interface{} {
+	if vs, ok := s.Store.(ValueStore); ok {
+		return vs.GetMany(keys...)
+	}
+	values := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		if v, ok := s.Get(key); ok {
+			values[key] = v
+		}
+	}
+	return values
+}
+
+func (s *basicStore) GetInto(key string, dst interface{}) error {
+	if vs, ok := s.Store.(ValueStore); ok {
+		return vs.GetInto(key, dst)
+	}
+	return getInto(s.Store, key, dst)
+}
+
+func (s *basicStore) Keys() []string {
+	if vs, ok := s.Store.(ValueStore); ok {
+		return vs.Keys()
+	}
+	return nil
+}
+
+func (s *basicStore) DeletePrefix(prefix string) int {
+	if vs, ok := s.Store.(ValueStore); ok {
+		return vs.DeletePrefix(prefix)
+	}
+	return 0
+}
+
+func (s *basicStore) Pop(key string) (interface{}, bool) {
+	if vs, ok := s.Store.(ValueStore); ok {
+		return vs.Pop(key)
+	}
+	v, ok := s.Get(key)
+	if ok {
+		s.Delete(key)
+	}
+	return v, ok
+}
+
+func (s *basicStore) Replace(values map[string]interface{}) error {
+	if vs, ok := s.Store.(ValueStore); ok {
+		return vs.Replace(values)
+	}
+	return ErrNotSupported
+}
+
+func (s *basicStore) SetTyped(key string, value interface{}) error {
+	if ts, ok := s.Store.(TypedStore); ok {
+		return ts.SetTyped(key, value)
+	}
+	s.Set(key, tagValue(value))
+	return nil
+}
+
+func (s *basicStore) GetTyped(key string) (interface{}, bool) {
+	if ts, ok := s.Store.(TypedStore); ok {
+		return ts.GetTyped(key)
+	}
+	return getTyped(s.Store, key)
+}
+
+func (s *basicStore) AddFlash(message string, categories ...string) error {
+	if fs, ok := s.Store.(FlashStore); ok {
+		return fs.AddFlash(message, categories...)
+	}
+	return ErrNotSupported
+}
+
+func (s *basicStore) Flashes(categories ...string) []string {
+	if fs, ok := s.Store.(FlashStore); ok {
+		return fs.Flashes(categories...)
+	}
+	return nil
+}
+
+func (s *basicStore) SetFlag(name string, on bool) error {
+	if fs, ok := s.Store.(FlagStore); ok {
+		return fs.SetFlag(name, on)
+	}
+	return ErrNotSupported
+}
+
+func (s *basicStore) Flag(name string) bool {
+	if fs, ok := s.Store.(FlagStore); ok {
+		return fs.Flag(name)
+	}
+	return false
+}
+
+func (s *basicStore) Flags() map[string]bool {
+	if fs, ok := s.Store.(FlagStore); ok {
+		return fs.Flags()
+	}
+	return map[string]bool{}
+}
+
+func (s *basicStore) Changes() []Change {
+	if ct, ok := s.Store.(ChangeTracker); ok {
+		return ct.Changes()
+	}
+	return nil
+}
+
+func (s *basicStore) Dirty() bool {
+	if ct, ok := s.Store.(ChangeTracker); ok {
+		return ct.Dirty()
+	}
+	return true
+}
+
+func (s *basicStore) SaveDirty() error {
+	if ct, ok := s.Store.(ChangeTracker); ok {
+		return ct.SaveDirty()
+	}
+	return s.Save()
+}
+
+func (s *basicStore) OnChange(key string, fn func(old, new interface{})) {
+	if ct, ok := s.Store.(ChangeTracker); ok {
+		ct.OnChange(key, fn)
+	}
+}
+
+func (s *basicStore) Version() uint64 {
+	if vs, ok := s.Store.(VersionedStore); ok {
+		return vs.Version()
+	}
+	return 0
+}
+
+func (s *basicStore) SaveIfVersion(expected uint64) error {
+	if vs, ok := s.Store.(VersionedStore); ok {
+		return vs.SaveIfVersion(expected)
+	}
+	return ErrNotSupported
+}
+
+// A session store that does not return the stored session returns itself
+func (s *basicStore) SaveReturn() (Store, error) {
+	if vs, ok := s.Store.(VersionedStore); ok {
+		store, err := vs.SaveReturn()
+		if err != nil {
+			return nil, err
+		}
+		return extendStore(store), nil
+	}
+	if err := s.Save(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *basicStore) Lock(ctx context.Context) (func(), error) {
+	if sl, ok := s.Store.(SessionLocker); ok {
+		return sl.Lock(ctx)
+	}
+	return nil, ErrNotSupported
+}
+
+func (s *basicStore) Rotate(newsid string) error {
+	if r, ok := s.Store.(Rotator); ok {
+		return r.Rotate(newsid)
+	}
+	return ErrNotSupported
+}
+
+// A session store without views of nested session values gets a nestedStore
+func (s *basicStore) SubStore(name string) Store {
+	if ss, ok := s.Store.(SubStorer); ok {
+		return extendStore(ss.SubStore(name))
+	}
+	return &basicStore{Store: &nestedStore{Store: s, name: name}}
+}
+
+func (s *basicStore) CreatedAt() time.Time {
+	if ar, ok := s.Store.(AgeReporter); ok {
+		return ar.CreatedAt()
+	}
+	return time.Time{}
+}
+
+func (s *basicStore) Age() time.Duration {
+	if ar, ok := s.Store.(AgeReporter); ok {
+		return ar.Age()
+	}
+	return 0
+}
+
+func (s *basicStore) SetStream(key string, r io.Reader) error {
+	if ss, ok := s.Store.(StreamStore); ok {
+		return ss.SetStream(key, r)
+	}
+	return setStream(s, key, r)
+}
+
+func (s *basicStore) GetStream(key string) (io.ReadCloser, bool) {
+	if ss, ok := s.Store.(StreamStore); ok {
+		return ss.GetStream(key)
+	}
+	return getStream(s, key)
+}
+
+// The session values are left out, since they can not be listed to redact the secrets
+func (s *basicStore) String() string {
+	if st, ok := s.Store.(fmt.Stringer); ok {
+		return st.String()
+	}
+	return "session ***"
+}
+
+// A view of the session values in a nested map of a session store without SubStore,
+// changing it sets a copy of the nested map. A session value that is not a nested
+// map is left as is, the view then has no values.
+type nestedStore struct {
+	Store
+	name string
+}
+
+// get the nested map, nil if it does not exist yet
+func (s *nestedStore) values() (map[string]interface{}, bool) {
+	v, ok := s.Store.Get(s.name)
+	if !ok {
+		return nil, true
+	}
+	m, ok := v.(map[string]interface{})
+	return m, ok
+}
+
+// change a copy of the nested map and set the session value to it
+func (s *nestedStore) update(fn func(map[string]interface{})) {
+	if m, ok := s.values(); ok {
+		s.Store.Set(s.name, updateNested(m, nil, fn))
+	}
+}
+
+func (s *nestedStore) Set(key string, value interface{}) {
+	s.update(func(m map[string]interface{}) {
+		m[key] = value
+	})
+}
+
+func (s *nestedStore) Get(key string) (interface{}, bool) {
+	m, _ := s.values()
+	v, ok := m[key]
+	return v, ok
+}
+
+func (s *nestedStore) GetString(key string) (string, bool) {
+	return getString(s, key)
+}
+
+func (s *nestedStore) GetInt(key string) (int, bool) {
+	return getInt(s, key)
+}
+
+func (s *nestedStore) GetBool(key string) (bool, bool) {
+	return getBool(s, key)
+}
+
+func (s *nestedStore) GetUUID(key string) (uuid.UUID, bool) {
+	return getUUID(s, key)
+}
+
+func (s *nestedStore) Delete(key string) interface{} {
+	v, ok := s.Get(key)
+	if ok {
+		s.update(func(m map[string]interface{}) {
+			delete(m, key)
+		})
+	}
+	return v
+}
+
+// Clear the values of the view and save the session
+func (s *nestedStore) Flush() error {
+	s.update(func(m map[string]interface{}) {
+		clear(m)
+	})
+	return s.Save()
+}
@@ -0,0 +1,79 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// A session storage of another package, whose session stores only implement Store
+type plainStore struct {
+	ManagerStore
+}
+
+type plainSessionStore struct {
+	Store
+}
+
+func (s *plainStore) Create(ctx context.Context, sid string, expired int64) (Store, error) {
+	store, err := s.ManagerStore.Create(ctx, sid, expired)
+	if err != nil {
+		return nil, err
+	}
+	return &plainSessionStore{Store: store}, nil
+}
+
+func (s *plainStore) Update(ctx context.Context, sid string, expired int64) (Store, error) {
+	store, err := s.ManagerStore.Update(ctx, sid, expired)
+	if err != nil {
+		return nil, err
+	}
+	return &plainSessionStore{Store: store}, nil
+}
+
+func TestBasicStore(t *testing.T) {
+	mstore := NewTimeoutStore(&plainStore{ManagerStore: NewMemoryStore()}, time.Second)
+
+	Convey("Test decorating a session storage without the optional interfaces", t, func() {
+		ctx := context.Background()
+		So(Ping(ctx, mstore), ShouldEqual, ErrNotSupported)
+		_, err := Count(ctx, mstore)
+		So(err, ShouldEqual, ErrNotSupported)
+
+		store, created, err := LoadOrCreate(ctx, mstore, "test_basic_store", 10)
+		So(err, ShouldBeNil)
+		So(created, ShouldBeTrue)
+
+		vs := store.(ValueStore)
+		So(vs.SetChecked("foo", "bar"), ShouldBeNil)
+		ok, err := vs.SetIfAbsent("foo", "baz")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+		So(vs.GetMany("foo", "missing"), ShouldResemble, map[string]interface{}{"foo": "bar"})
+		So(store.(ChangeTracker).Dirty(), ShouldBeTrue)
+
+		_, err = store.(SessionLocker).Lock(ctx)
+		So(err, ShouldEqual, ErrNotSupported)
+		So(store.(Rotator).Rotate("test_basic_store_new"), ShouldEqual, ErrNotSupported)
+
+		sub := store.(SubStorer).SubStore("plugin")
+		sub.Set("count", 1)
+		count, _ := sub.GetInt("count")
+		So(count, ShouldEqual, 1)
+		So(sub.Delete("missing"), ShouldBeNil)
+		So(store.(VersionedStore).SaveIfVersion(0), ShouldEqual, ErrNotSupported)
+		So(store.(ChangeTracker).SaveDirty(), ShouldBeNil)
+
+		store, created, err = LoadOrCreate(ctx, mstore, "test_basic_store", 10)
+		So(err, ShouldBeNil)
+		So(created, ShouldBeFalse)
+		foo, _ := store.GetString("foo")
+		So(foo, ShouldEqual, "bar")
+		plugin, _ := store.Get("plugin")
+		So(plugin, ShouldResemble, map[string]interface{}{"count": 1})
+		So(fmt.Sprint(store), ShouldEqual, "session ***")
+	})
+}
@@ -0,0 +1,75 @@
+package session
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Batch saves multiple session stores together, storages without transactions
+// save the stores one by one and report the partial failures
+type Batch struct {
+	stores []Store
+}
+
+// Create an empty batch of session stores
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Add the session store to the batch
+func (b *Batch) Add(s Store) {
+	b.stores = append(b.stores, s)
+}
+
+// Commit save all session stores of the batch in the order they are added,
+// returns a *BatchError when any of them fails to save
+func (b *Batch) Commit() error {
+	var berr BatchError
+	for _, s := range b.stores {
+		if err := s.Save(); err != nil {
+			if berr.Failed == nil {
+				berr.Failed = make(map[string]error)
+			}
+			berr.Failed[s.SessionID()] = err
+			continue
+		}
+		berr.Saved = append(berr.Saved, s.SessionID())
+	}
+
+	if len(berr.Failed) > 0 {
+		return &berr
+	}
+	return nil
+}
+
+// BatchError reports the session stores of a batch that are saved and those that failed
+type BatchError struct {
+	// Session ids of the saved stores
+	Saved []string
+	// Save errors by session id
+	Failed map[string]error
+}
+
+func (e *BatchError) Error() string {
+	sids := make([]string, 0, len(e.Failed))
+	for sid := range e.Failed {
+		sids = append(sids, sid)
+	}
+	sort.Strings(sids)
+
+	msgs := make([]string, len(sids))
+	for i, sid := range sids {
+		msgs[i] = fmt.Sprintf("%s: %v", sid, e.Failed[sid])
+	}
+	return fmt.Sprintf("Failed to save %d of %d sessions (%s)", len(e.Failed), len(e.Failed)+len(e.Saved), strings.Join(msgs, "; "))
+}
+
+// Unwrap the save errors, for use with errors.Is and errors.As
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed))
+	for _, err := range e.Failed {
+		errs = append(errs, err)
+	}
+	return errs
+}
@@ -0,0 +1,49 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBatch(t *testing.T) {
+	errSave := errors.New("save failed")
+	mstore := NewMemoryStore(WithSaveHook(func(sid string, _ map[string]interface{}) error {
+		if sid == "test_batch_fail" {
+			return errSave
+		}
+		return nil
+	}))
+
+	Convey("Test saving a batch of session stores", t, func() {
+		guest, err := mstore.Create(context.Background(), "test_batch_guest", 10)
+		So(err, ShouldBeNil)
+		user, err := mstore.Create(context.Background(), "test_batch_user", 10)
+		So(err, ShouldBeNil)
+		guest.Set("foo", "bar")
+		user.Set("foo", "baz")
+
+		batch := NewBatch()
+		batch.Add(guest)
+		batch.Add(user)
+		So(batch.Commit(), ShouldBeNil)
+
+		store, err := mstore.Update(context.Background(), "test_batch_user", 10)
+		So(err, ShouldBeNil)
+		foo, _ := store.GetString("foo")
+		So(foo, ShouldEqual, "baz")
+
+		fail, err := mstore.Create(context.Background(), "test_batch_fail", 10)
+		So(err, ShouldBeNil)
+		batch.Add(fail)
+		err = batch.Commit()
+		var berr *BatchError
+		So(errors.As(err, &berr), ShouldBeTrue)
+		So(berr.Saved, ShouldResemble, []string{"test_batch_guest", "test_batch_user"})
+		So(berr.Failed, ShouldResemble, map[string]error{"test_batch_fail": errSave})
+		So(errors.Is(err, errSave), ShouldBeTrue)
+		So(err.Error(), ShouldEqual, "Failed to save 1 of 3 sessions (test_batch_fail: save failed)")
+	})
+}
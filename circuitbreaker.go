@@ -0,0 +1,274 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	_ managerStore = &circuitBreakerStore{}
+	_ sessionStore = &circuitBreakerSessionStore{}
+)
+
+// CBOption configures the circuit breaker store
+type CBOption func(*circuitBreakerStore)
+
+// Set the number of consecutive failures that opens the circuit (default 5)
+func WithFailureThreshold(n int) CBOption {
+	return func(s *circuitBreakerStore) {
+		s.threshold = n
+	}
+}
+
+// Set how long the circuit stays open before a call is let through to probe the storage (default 30s)
+func WithCoolDown(d time.Duration) CBOption {
+	return func(s *circuitBreakerStore) {
+		s.coolDown = d
+	}
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// Create a session storage that fails fast with ErrCircuitOpen after the inner storage failed
+// a number of consecutive times. Once the cool-down period passed a single call probes the
+// storage, which closes the circuit when it succeeds and opens it again when it fails.
+// Session errors such as ErrSessionNotFound are not counted as failures.
+func NewCircuitBreakerStore(inner ManagerStore, opts ...CBOption) ManagerStore {
+	s := &circuitBreakerStore{
+		inner:     inner,
+		threshold: 5,
+		coolDown:  time.Second * 30,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+type circuitBreakerStore struct {
+	inner     ManagerStore
+	threshold int
+	coolDown  time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+// Recorded as the result of a call that panicked
+var errStoragePanic = errors.New("session: storage panicked")
+
+// reports whether the error indicates the storage is failing
+func isFailure(err error) bool {
+	return err != nil && !isNotFound(err) &&
+		!errors.Is(err, ErrSessionExists) &&
+		!errors.Is(err, ErrInvalidTTL) &&
+		!errors.Is(err, ErrVersionConflict) &&
+		!errors.Is(err, ErrNotSupported)
+}
+
+// Check whether a call is allowed, moving an open circuit to half-open after the cool-down
+func (s *circuitBreakerStore) allow() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.state {
+	case circuitOpen:
+		if time.Since(s.openedAt) < s.coolDown {
+			return ErrCircuitOpen
+		}
+		s.state = circuitHalfOpen
+		return nil
+	case circuitHalfOpen:
+		// a probe is in progress
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// Record the result of a call
+func (s *circuitBreakerStore) done(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !isFailure(err) {
+		s.state = circuitClosed
+		s.failures = 0
+		return
+	}
+
+	s.failures++
+	if s.state == circuitHalfOpen || s.failures >= s.threshold {
+		s.state = circuitOpen
+		s.openedAt = time.Now()
+		s.failures = 0
+	}
+}
+
+// Run fn unless the circuit is open
+func withCircuitBreaker[T any](s *circuitBreakerStore, fn func() (T, error)) (T, error) {
+	if err := s.allow(); err != nil {
+		var zero T
+		return zero, err
+	}
+	completed := false
+	defer func() {
+		// a panic of the storage counts as a failure, otherwise a panicking probe would
+		// leave the circuit half-open and reject every call
+		if !completed {
+			s.done(errStoragePanic)
+		}
+	}()
+	v, err := fn()
+	completed = true
+	s.done(err)
+	return v, err
+}
+
+func (s *circuitBreakerStore) wrap(store Store, err error) (Store, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &circuitBreakerSessionStore{sessionStore: extendStore(store), cb: s}, nil
+}
+
+func (s *circuitBreakerStore) Check(ctx context.Context, sid string) (bool, error) {
+	return withCircuitBreaker(s, func() (bool, error) {
+		return s.inner.Check(ctx, sid)
+	})
+}
+
+func (s *circuitBreakerStore) Create(ctx context.Context, sid string, expired int64) (Store, error) {
+	return s.wrap(withCircuitBreaker(s, func() (Store, error) {
+		return s.inner.Create(ctx, sid, expired)
+	}))
+}
+
+func (s *circuitBreakerStore) Update(ctx context.Context, sid string, expired int64) (Store, error) {
+	return s.wrap(withCircuitBreaker(s, func() (Store, error) {
+		return s.inner.Update(ctx, sid, expired)
+	}))
+}
+
+func (s *circuitBreakerStore) LoadOrCreate(ctx context.Context, sid string, expired int64) (Store, bool, error) {
+	var created bool
+	store, err := s.wrap(withCircuitBreaker(s, func() (Store, error) {
+		store, ok, err := LoadOrCreate(ctx, s.inner, sid, expired)
+		created = ok
+		return store, err
+	}))
+	return store, created, err
+}
+
+func (s *circuitBreakerStore) Delete(ctx context.Context, sid string) error {
+	_, err := withCircuitBreaker(s, func() (struct{}, error) {
+		return struct{}{}, s.inner.Delete(ctx, sid)
+	})
+	return err
+}
+
+func (s *circuitBreakerStore) Refresh(ctx context.Context, oldsid, sid string, expired int64) (Store, error) {
+	return s.wrap(withCircuitBreaker(s, func() (Store, error) {
+		return s.inner.Refresh(ctx, oldsid, sid, expired)
+	}))
+}
+
+func (s *circuitBreakerStore) TimeToLive(ctx context.Context, sid string) (time.Duration, error) {
+	return withCircuitBreaker(s, func() (time.Duration, error) {
+		return TimeToLive(ctx, s.inner, sid)
+	})
+}
+
+func (s *circuitBreakerStore) Count(ctx context.Context) (int, error) {
+	return withCircuitBreaker(s, func() (int, error) {
+		return Count(ctx, s.inner)
+	})
+}
+
+func (s *circuitBreakerStore) Ping(ctx context.Context) error {
+	_, err := withCircuitBreaker(s, func() (struct{}, error) {
+		return struct{}{}, Ping(ctx, s.inner)
+	})
+	return err
+}
+
+func (s *circuitBreakerStore) Close() error {
+	return s.inner.Close()
+}
+
+// A session store that saves through the circuit breaker
+type circuitBreakerSessionStore struct {
+	sessionStore
+	cb *circuitBreakerStore
+}
+
+func (s *circuitBreakerSessionStore) Manager() ManagerStore {
+	return s.cb
+}
+
+func (s *circuitBreakerSessionStore) unwrap() []Store {
+	return []Store{s.sessionStore}
+}
+
+func (s *circuitBreakerSessionStore) WithContext(ctx context.Context) Store {
+	return &circuitBreakerSessionStore{sessionStore: extendStore(s.sessionStore.WithContext(ctx)), cb: s.cb}
+}
+
+func (s *circuitBreakerSessionStore) Save() error {
+	_, err := withCircuitBreaker(s.cb, func() (struct{}, error) {
+		return struct{}{}, s.sessionStore.Save()
+	})
+	return err
+}
+
+func (s *circuitBreakerSessionStore) SaveReturn() (Store, error) {
+	return s.cb.wrap(withCircuitBreaker(s.cb, s.sessionStore.SaveReturn))
+}
+
+func (s *circuitBreakerSessionStore) SaveIfVersion(expected uint64) error {
+	_, err := withCircuitBreaker(s.cb, func() (struct{}, error) {
+		return struct{}{}, s.sessionStore.SaveIfVersion(expected)
+	})
+	return err
+}
+
+func (s *circuitBreakerSessionStore) SaveDirty() error {
+	_, err := withCircuitBreaker(s.cb, func() (struct{}, error) {
+		return struct{}{}, s.sessionStore.SaveDirty()
+	})
+	return err
+}
+
+func (s *circuitBreakerSessionStore) Flush() error {
+	_, err := withCircuitBreaker(s.cb, func() (struct{}, error) {
+		return struct{}{}, s.sessionStore.Flush()
+	})
+	return err
+}
+
+func (s *circuitBreakerSessionStore) Rotate(newsid string) error {
+	_, err := withCircuitBreaker(s.cb, func() (struct{}, error) {
+		return struct{}{}, s.sessionStore.Rotate(newsid)
+	})
+	return err
+}
+
+func (s *circuitBreakerSessionStore) SubStore(name string) Store {
+	return subStoreOf(s, s.sessionStore.SubStore(name))
+}
+
+func (s *circuitBreakerSessionStore) Replace(values map[string]interface{}) error {
+	_, err := withCircuitBreaker(s.cb, func() (struct{}, error) {
+		return struct{}{}, s.sessionStore.Replace(values)
+	})
+	return err
+}
@@ -0,0 +1,96 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// A session storage whose Ping fails while down is set
+type flakyStore struct {
+	ManagerStore
+	down   bool
+	panics bool
+	calls  int
+}
+
+var errFlaky = errors.New("storage down")
+
+func (s *flakyStore) Ping(ctx context.Context) error {
+	s.calls++
+	if s.panics {
+		panic(errFlaky)
+	}
+	if s.down {
+		return errFlaky
+	}
+	return Ping(ctx, s.ManagerStore)
+}
+
+func TestCircuitBreakerStore(t *testing.T) {
+	inner := &flakyStore{ManagerStore: NewMemoryStore(), down: true}
+	mstore := NewCircuitBreakerStore(inner, WithFailureThreshold(3), WithCoolDown(time.Millisecond*100))
+
+	Convey("Test circuit breaker storage", t, func() {
+		for i := 0; i < 3; i++ {
+			So(Ping(context.Background(), mstore), ShouldEqual, errFlaky)
+		}
+		So(Ping(context.Background(), mstore), ShouldEqual, ErrCircuitOpen)
+		So(inner.calls, ShouldEqual, 3)
+
+		_, err := mstore.Update(context.Background(), "test_circuit_breaker", 10)
+		So(err, ShouldEqual, ErrCircuitOpen)
+
+		// the probe fails and opens the circuit again
+		time.Sleep(time.Millisecond * 150)
+		So(Ping(context.Background(), mstore), ShouldEqual, errFlaky)
+		So(Ping(context.Background(), mstore), ShouldEqual, ErrCircuitOpen)
+
+		inner.down = false
+		time.Sleep(time.Millisecond * 150)
+		So(Ping(context.Background(), mstore), ShouldBeNil)
+		So(Ping(context.Background(), mstore), ShouldBeNil)
+		So(inner.calls, ShouldEqual, 6)
+
+		// session errors do not open the circuit
+		for i := 0; i < 5; i++ {
+			_, err = mstore.Update(context.Background(), "test_circuit_breaker", 10)
+			So(err, ShouldEqual, ErrSessionNotFound)
+		}
+		store, err := mstore.Create(context.Background(), "test_circuit_breaker", 10)
+		So(err, ShouldBeNil)
+		So(store.(ManagedStore).Manager(), ShouldEqual, mstore)
+		So(store.Save(), ShouldBeNil)
+	})
+}
+
+func TestCircuitBreakerStorePanic(t *testing.T) {
+	inner := &flakyStore{ManagerStore: NewMemoryStore(), down: true}
+	mstore := NewCircuitBreakerStore(inner, WithFailureThreshold(1), WithCoolDown(time.Millisecond*50))
+
+	Convey("Test circuit breaker storage counts a panicking probe as a failure", t, func() {
+		So(Ping(context.Background(), mstore), ShouldEqual, errFlaky)
+		So(Ping(context.Background(), mstore), ShouldEqual, ErrCircuitOpen)
+
+		inner.panics = true
+		time.Sleep(time.Millisecond * 80)
+		So(func() { Ping(context.Background(), mstore) }, ShouldPanicWith, errFlaky)
+		So(Ping(context.Background(), mstore), ShouldEqual, ErrCircuitOpen)
+
+		// the circuit is open again rather than stuck half-open
+		inner.panics, inner.down = false, false
+		time.Sleep(time.Millisecond * 80)
+		So(Ping(context.Background(), mstore), ShouldBeNil)
+	})
+}
+
+func TestCircuitBreakerManagerStore(t *testing.T) {
+	mstore := NewCircuitBreakerStore(NewMemoryStore())
+
+	Convey("Test circuit breaker storage management operations", t, func() {
+		testManagerStore(mstore)
+	})
+}
@@ -0,0 +1,193 @@
+package session
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	_ Codec = gobCodec{}
+	_ Codec = jsonCodec{}
+	_ Codec = &compressedCodec{}
+)
+
+// Serialization of session values for storage
+type Codec interface {
+	// Marshal session values
+	Marshal(values map[string]interface{}) ([]byte, error)
+	// Unmarshal session values
+	Unmarshal(data []byte) (map[string]interface{}, error)
+}
+
+var (
+	// GobCodec serializes session values with encoding/gob,
+	// custom types must be registered with RegisterType
+	GobCodec Codec = gobCodec{}
+	// JSONCodec serializes session values with encoding/json
+	JSONCodec Codec = jsonCodec{}
+)
+
+func init() {
+	RegisterType(map[string][]string{})
+}
+
+// Register the concrete type of v for the gob codec and for the values tagged by SetTyped,
+// custom types stored via Set must be registered before session data is saved or loaded
+func RegisterType(v interface{}) {
+	gob.Register(v)
+	registerTypeName(v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(values map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte) (map[string]interface{}, error) {
+	var values map[string]interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(values map[string]interface{}) ([]byte, error) {
+	return json.Marshal(values)
+}
+
+func (jsonCodec) Unmarshal(data []byte) (map[string]interface{}, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Compression algorithm of serialized session data
+type Compression byte
+
+const (
+	Gzip Compression = iota + 1
+	Zstd
+)
+
+// Compressed data starts with the magic bytes and the compression algorithm, the magic
+// bytes never start gob or JSON data so uncompressed data is still loaded
+var compressionMagic = []byte{0x00, 's', 'z'}
+
+// The default minimum size of serialized data to compress
+const defaultMinCompressSize = 512
+
+// CompressionOption configures the compressed codec
+type CompressionOption func(*compressedCodec)
+
+// Set the minimum size of serialized data to compress, smaller data is stored
+// uncompressed since compressing it does not pay off (defaults to 512 bytes)
+func WithMinCompressSize(n int) CompressionOption {
+	return func(c *compressedCodec) {
+		c.minSize = n
+	}
+}
+
+// Compress the data serialized by the codec, and decompress it before it is deserialized.
+// Data serialized without compression, such as before compression was enabled, is still loaded.
+func WithCompression(codec Codec, compression Compression, opts ...CompressionOption) Codec {
+	c := &compressedCodec{
+		codec:       codec,
+		compression: compression,
+		minSize:     defaultMinCompressSize,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+type compressedCodec struct {
+	codec       Codec
+	compression Compression
+	minSize     int
+	// the zstd encoder and decoder are safe for concurrent use and created on first use
+	zstdEncoder     *zstd.Encoder
+	zstdDecoder     *zstd.Decoder
+	zstdEncoderOnce sync.Once
+	zstdDecoderOnce sync.Once
+}
+
+func (c *compressedCodec) encoder() *zstd.Encoder {
+	c.zstdEncoderOnce.Do(func() {
+		c.zstdEncoder, _ = zstd.NewWriter(nil)
+	})
+	return c.zstdEncoder
+}
+
+func (c *compressedCodec) decoder() *zstd.Decoder {
+	c.zstdDecoderOnce.Do(func() {
+		c.zstdDecoder, _ = zstd.NewReader(nil)
+	})
+	return c.zstdDecoder
+}
+
+func (c *compressedCodec) Marshal(values map[string]interface{}) ([]byte, error) {
+	data, err := c.codec.Marshal(values)
+	if err != nil || len(data) < c.minSize {
+		return data, err
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(compressionMagic)+1+len(data)/2))
+	buf.Write(compressionMagic)
+	buf.WriteByte(byte(c.compression))
+	switch c.compression {
+	case Gzip:
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		return c.encoder().EncodeAll(data, buf.Bytes()), nil
+	}
+	return data, nil
+}
+
+func (c *compressedCodec) Unmarshal(data []byte) (map[string]interface{}, error) {
+	if !bytes.HasPrefix(data, compressionMagic) || len(data) == len(compressionMagic) {
+		return c.codec.Unmarshal(data)
+	}
+
+	compressed := data[len(compressionMagic)+1:]
+	switch Compression(data[len(compressionMagic)]) {
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, ErrInvalidCompression
+		}
+		if data, err = io.ReadAll(r); err != nil {
+			return nil, ErrInvalidCompression
+		}
+	case Zstd:
+		var err error
+		if data, err = c.decoder().DecodeAll(compressed, nil); err != nil {
+			return nil, ErrInvalidCompression
+		}
+	default:
+		return nil, ErrInvalidCompression
+	}
+	return c.codec.Unmarshal(data)
+}
@@ -0,0 +1,113 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type testCodecUser struct {
+	Name string
+	Age  int
+}
+
+type testCodecUnregistered struct {
+	Name string
+}
+
+func TestGobCodec(t *testing.T) {
+	RegisterType(testCodecUser{})
+	mstore := NewMemoryStore(WithCodec(GobCodec))
+
+	Convey("Test gob serialized memory store", t, func() {
+		sid := "test_gob_codec"
+		store, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+
+		store.Set("unregistered", testCodecUnregistered{Name: "foo"})
+		So(store.Save(), ShouldNotBeNil)
+		store.Delete("unregistered")
+
+		store.Set("user", testCodecUser{Name: "foo", Age: 10})
+		So(store.Save(), ShouldBeNil)
+
+		store, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		user, ok := store.Get("user")
+		So(ok, ShouldBeTrue)
+		So(user, ShouldResemble, testCodecUser{Name: "foo", Age: 10})
+	})
+}
+
+func TestJSONCodec(t *testing.T) {
+	mstore := NewMemoryStore(WithCodec(JSONCodec))
+
+	Convey("Test json serialized memory store", t, func() {
+		sid := "test_json_codec"
+		store, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+
+		store.Set("foo", 10)
+		So(store.Save(), ShouldBeNil)
+
+		store, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		foo, ok := store.Get("foo")
+		So(ok, ShouldBeTrue)
+		So(foo, ShouldEqual, float64(10))
+	})
+}
+
+func TestCompressedCodec(t *testing.T) {
+	values := map[string]interface{}{"report": strings.Repeat("session data ", 100), "count": float64(10)}
+
+	Convey("Test compressed codec", t, func() {
+		for _, compression := range []Compression{Gzip, Zstd} {
+			codec := WithCompression(JSONCodec, compression)
+			data, err := codec.Marshal(values)
+			So(err, ShouldBeNil)
+			So(bytes.HasPrefix(data, compressionMagic), ShouldBeTrue)
+			plain, _ := JSONCodec.Marshal(values)
+			So(len(data), ShouldBeLessThan, len(plain))
+
+			decoded, err := codec.Unmarshal(data)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, values)
+
+			// uncompressed data is still loaded
+			decoded, err = codec.Unmarshal(plain)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, values)
+
+			_, err = codec.Unmarshal(append(data[:len(compressionMagic)+1:len(compressionMagic)+1], "broken"...))
+			So(err, ShouldEqual, ErrInvalidCompression)
+		}
+
+		small := map[string]interface{}{"foo": "bar"}
+		data, err := WithCompression(JSONCodec, Gzip).Marshal(small)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `{"foo":"bar"}`)
+
+		data, err = WithCompression(JSONCodec, Zstd, WithMinCompressSize(0)).Marshal(small)
+		So(err, ShouldBeNil)
+		So(bytes.HasPrefix(data, compressionMagic), ShouldBeTrue)
+	})
+
+	mstore := NewMemoryStore(WithCodec(WithCompression(GobCodec, Zstd)))
+
+	Convey("Test compressed serialized memory store", t, func() {
+		sid := "test_compressed_codec"
+		store, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(ValueStore).SetAll(values), ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		store, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		report, _ := store.GetString("report")
+		So(report, ShouldEqual, values["report"])
+	})
+}
@@ -3,12 +3,16 @@ package session
 import (
 	"context"
 	"net/http"
+	"sync/atomic"
 )
 
 // Define the keys in the context
 type (
-	ctxResKey struct{}
-	ctxReqKey struct{}
+	ctxResKey   struct{}
+	ctxReqKey   struct{}
+	ctxStoreKey struct{}
+	ctxAccessed struct{}
+	ctxStarted  struct{}
 )
 
 // returns a new Context that carries value res.
@@ -32,3 +36,33 @@ func FromReqContext(ctx context.Context) (*http.Request, bool) {
 	req, ok := ctx.Value(ctxReqKey{}).(*http.Request)
 	return req, ok
 }
+
+// NewContext returns a new Context that carries value store.
+func NewContext(ctx context.Context, store Store) context.Context {
+	return context.WithValue(ctx, ctxStoreKey{}, store)
+}
+
+// FromContext returns the Store value stored in ctx, if any.
+func FromContext(ctx context.Context) (Store, bool) {
+	store, ok := ctx.Value(ctxStoreKey{}).(Store)
+	if accessed, tracked := ctx.Value(ctxAccessed{}).(*atomic.Bool); ok && tracked {
+		accessed.Store(true)
+	}
+	return store, ok
+}
+
+// Value returns the session value of the Store stored in ctx as a T, if any.
+func Value[T any](ctx context.Context, key string) (T, bool) {
+	var zero T
+	store, ok := FromContext(ctx)
+	if !ok {
+		return zero, false
+	}
+
+	v, ok := store.Get(key)
+	if !ok {
+		return zero, false
+	}
+	t, ok := v.(T)
+	return t, ok
+}
@@ -54,3 +54,32 @@ func TestContext(t *testing.T) {
 		t.Error("Not expected value:", string(buf))
 	}
 }
+
+func TestContextValue(t *testing.T) {
+	store, err := NewMemoryStore().Create(context.Background(), "test_context_value", 10)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	store.Set("foo", "bar")
+
+	if _, ok := Value[string](context.Background(), "foo"); ok {
+		t.Error("Not expected value")
+		return
+	}
+
+	ctx := NewContext(context.Background(), store)
+	if foo, ok := Value[string](ctx, "foo"); !ok || foo != "bar" {
+		t.Error("Not expected value:", foo)
+		return
+	}
+
+	if _, ok := Value[int](ctx, "foo"); ok {
+		t.Error("Not expected value")
+		return
+	}
+
+	if _, ok := Value[string](ctx, "foo2"); ok {
+		t.Error("Not expected value")
+	}
+}
@@ -0,0 +1,310 @@
+package session
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	_ managerStore = &encryptedStore{}
+	_ sessionStore = &encryptedSessionStore{}
+)
+
+// The encrypted session values are stored under a reserved key
+const encryptedKey = "_encrypted"
+
+// EncryptOption configures the encrypted store
+type EncryptOption func(*encryptedStore)
+
+// Derive the encryption key of every session from the master key and the session id,
+// so encrypted session data fails to decrypt when it is moved to another session id
+func WithKeyBinding() EncryptOption {
+	return func(s *encryptedStore) {
+		s.keyBinding = true
+	}
+}
+
+// Create a session storage that encrypts the session values with AES-GCM before they
+// are saved to the inner storage, using a key derived from the master key with HKDF.
+// Session values are serialized with the gob codec, so custom types must be registered with RegisterType.
+func NewEncryptedStore(inner ManagerStore, masterKey []byte, opts ...EncryptOption) ManagerStore {
+	s := &encryptedStore{
+		inner:     inner,
+		masterKey: masterKey,
+		plain:     NewMemoryStore(WithoutGC()).(*memoryStore),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+type encryptedStore struct {
+	inner      ManagerStore
+	masterKey  []byte
+	keyBinding bool
+	// holds the decrypted session values, it never stores sessions
+	plain *memoryStore
+}
+
+// Get the cipher for the session
+func (s *encryptedStore) aead(sid string) (cipher.AEAD, error) {
+	info := "session"
+	if s.keyBinding {
+		info = "session:" + sid
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, s.masterKey, nil, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *encryptedStore) encrypt(sid string, values map[string]interface{}) ([]byte, error) {
+	data, err := GobCodec.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := s.aead(sid)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func (s *encryptedStore) decrypt(sid string, ciphertext []byte) (map[string]interface{}, error) {
+	aead, err := s.aead(sid)
+	if err != nil {
+		return nil, err
+	}
+
+	n := aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, ErrInvalidCiphertext
+	}
+	data, err := aead.Open(nil, ciphertext[:n], ciphertext[n:], nil)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return GobCodec.Unmarshal(data)
+}
+
+// Wrap the session store of the inner storage, decrypting its session values with the key of sid
+func (s *encryptedStore) wrap(ctx context.Context, store Store, sid string, expired int64) (*encryptedSessionStore, error) {
+	var values map[string]interface{}
+	if v, ok := store.Get(encryptedKey); ok {
+		var ciphertext []byte
+		switch t := v.(type) {
+		case []byte:
+			ciphertext = t
+		case string:
+			// storages serializing as JSON store bytes as base64
+			ciphertext, _ = base64.StdEncoding.DecodeString(t)
+		}
+
+		var err error
+		if values, err = s.decrypt(sid, ciphertext); err != nil {
+			return nil, err
+		}
+	}
+
+	inner := extendStore(store)
+	return &encryptedSessionStore{
+		sessionStore: newStore(ctx, s.plain, store.SessionID(), expired, mapOf(values), 0, inner.CreatedAt()),
+		inner:        inner,
+		es:           s,
+	}, nil
+}
+
+func (s *encryptedStore) Check(ctx context.Context, sid string) (bool, error) {
+	return s.inner.Check(ctx, sid)
+}
+
+func (s *encryptedStore) Create(ctx context.Context, sid string, expired int64) (Store, error) {
+	store, err := s.inner.Create(ctx, sid, expired)
+	if err != nil {
+		return nil, err
+	}
+	return s.wrap(ctx, store, sid, expired)
+}
+
+func (s *encryptedStore) Update(ctx context.Context, sid string, expired int64) (Store, error) {
+	store, err := s.inner.Update(ctx, sid, expired)
+	if err != nil {
+		return nil, err
+	}
+	return s.wrap(ctx, store, sid, expired)
+}
+
+func (s *encryptedStore) LoadOrCreate(ctx context.Context, sid string, expired int64) (Store, bool, error) {
+	store, created, err := LoadOrCreate(ctx, s.inner, sid, expired)
+	if err != nil {
+		return nil, false, err
+	}
+	es, err := s.wrap(ctx, store, sid, expired)
+	if err != nil {
+		return nil, false, err
+	}
+	return es, created, nil
+}
+
+func (s *encryptedStore) Delete(ctx context.Context, sid string) error {
+	return s.inner.Delete(ctx, sid)
+}
+
+// With key binding the session values are encrypted again for the new session id
+func (s *encryptedStore) Refresh(ctx context.Context, oldsid, sid string, expired int64) (Store, error) {
+	store, err := s.inner.Refresh(ctx, oldsid, sid, expired)
+	if err != nil {
+		return nil, err
+	}
+	es, err := s.wrap(ctx, store, oldsid, expired)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := store.Get(encryptedKey); ok && s.keyBinding {
+		if err := es.Save(); err != nil {
+			return nil, err
+		}
+	}
+	return es, nil
+}
+
+func (s *encryptedStore) TimeToLive(ctx context.Context, sid string) (time.Duration, error) {
+	return TimeToLive(ctx, s.inner, sid)
+}
+
+func (s *encryptedStore) Count(ctx context.Context) (int, error) {
+	return Count(ctx, s.inner)
+}
+
+func (s *encryptedStore) Ping(ctx context.Context) error {
+	return Ping(ctx, s.inner)
+}
+
+func (s *encryptedStore) Close() error {
+	return s.inner.Close()
+}
+
+// A session store with the decrypted session values, saving encrypts them to the inner session store
+type encryptedSessionStore struct {
+	sessionStore
+	inner sessionStore
+	es    *encryptedStore
+}
+
+func (s *encryptedSessionStore) Manager() ManagerStore {
+	return s.es
+}
+
+func (s *encryptedSessionStore) unwrap() []Store {
+	return []Store{s.sessionStore, s.inner}
+}
+
+func (s *encryptedSessionStore) WithContext(ctx context.Context) Store {
+	return &encryptedSessionStore{sessionStore: extendStore(s.sessionStore.WithContext(ctx)), inner: extendStore(s.inner.WithContext(ctx)), es: s.es}
+}
+
+func (s *encryptedSessionStore) SessionID() string {
+	return s.inner.SessionID()
+}
+
+func (s *encryptedSessionStore) CreatedAt() time.Time {
+	return s.inner.CreatedAt()
+}
+
+func (s *encryptedSessionStore) Age() time.Duration {
+	return s.inner.Age()
+}
+
+func (s *encryptedSessionStore) Version() uint64 {
+	return s.inner.Version()
+}
+
+// Encrypt the session values into the inner session store and save it with fn
+func (s *encryptedSessionStore) save(fn func(sessionStore) error) error {
+	values := sessionValues(s.sessionStore)
+
+	ciphertext, err := s.es.encrypt(s.SessionID(), values)
+	if err != nil {
+		return err
+	}
+	s.inner.DeletePrefix("")
+	if err := s.inner.SetChecked(encryptedKey, ciphertext); err != nil {
+		return err
+	}
+	if err := fn(s.inner); err != nil {
+		return err
+	}
+	clearChanges(s.sessionStore)
+	return nil
+}
+
+func (s *encryptedSessionStore) Save() error {
+	return s.save(sessionStore.Save)
+}
+
+// The encrypted session values are always saved together
+func (s *encryptedSessionStore) SaveDirty() error {
+	return s.save(sessionStore.Save)
+}
+
+func (s *encryptedSessionStore) SaveIfVersion(expected uint64) error {
+	return s.save(func(store sessionStore) error {
+		return store.SaveIfVersion(expected)
+	})
+}
+
+func (s *encryptedSessionStore) SaveReturn() (Store, error) {
+	if err := s.Save(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *encryptedSessionStore) Flush() error {
+	s.sessionStore.DeletePrefix("")
+	return s.Save()
+}
+
+func (s *encryptedSessionStore) Replace(values map[string]interface{}) error {
+	s.sessionStore.DeletePrefix("")
+	if err := s.sessionStore.SetAll(values); err != nil {
+		return err
+	}
+	return s.Save()
+}
+
+// With key binding the session is saved, to encrypt the session values for the new session id
+func (s *encryptedSessionStore) Rotate(newsid string) error {
+	if err := s.inner.Rotate(newsid); err != nil {
+		return err
+	}
+	if s.es.keyBinding {
+		return s.Save()
+	}
+	return nil
+}
+
+func (s *encryptedSessionStore) SubStore(name string) Store {
+	return subStoreOf(s, s.sessionStore.SubStore(name))
+}
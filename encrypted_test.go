@@ -0,0 +1,72 @@
+package session
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEncryptedStore(t *testing.T) {
+	inner := NewMemoryStore()
+	masterKey := []byte("0123456789abcdef0123456789abcdef")
+
+	Convey("Test encrypted storage", t, func() {
+		for _, keyBinding := range []bool{false, true} {
+			var opts []EncryptOption
+			if keyBinding {
+				opts = append(opts, WithKeyBinding())
+			}
+			mstore := NewEncryptedStore(inner, masterKey, opts...)
+
+			store, err := mstore.Create(context.Background(), "test_encrypted", 10)
+			So(err, ShouldBeNil)
+			store.Set("foo", "bar")
+			So(store.Save(), ShouldBeNil)
+
+			raw, err := inner.Update(context.Background(), "test_encrypted", 10)
+			So(err, ShouldBeNil)
+			So(raw.(ValueStore).Keys(), ShouldResemble, []string{encryptedKey})
+			ciphertext, _ := raw.Get(encryptedKey)
+
+			store, err = mstore.Update(context.Background(), "test_encrypted", 10)
+			So(err, ShouldBeNil)
+			foo, _ := store.GetString("foo")
+			So(foo, ShouldEqual, "bar")
+
+			// move the encrypted session data to another session id
+			moved, err := inner.Create(context.Background(), "test_encrypted_moved", 10)
+			So(err, ShouldBeNil)
+			moved.Set(encryptedKey, ciphertext)
+			So(moved.Save(), ShouldBeNil)
+			_, err = mstore.Update(context.Background(), "test_encrypted_moved", 10)
+			if keyBinding {
+				So(err, ShouldEqual, ErrInvalidCiphertext)
+			} else {
+				So(err, ShouldBeNil)
+			}
+
+			store, err = mstore.Refresh(context.Background(), "test_encrypted", "test_encrypted_refreshed", 10)
+			So(err, ShouldBeNil)
+			store, err = mstore.Update(context.Background(), "test_encrypted_refreshed", 10)
+			So(err, ShouldBeNil)
+			foo, _ = store.GetString("foo")
+			So(foo, ShouldEqual, "bar")
+
+			So(store.(Rotator).Rotate("test_encrypted"), ShouldBeNil)
+			So(store.SessionID(), ShouldEqual, "test_encrypted")
+			store, err = mstore.Update(context.Background(), "test_encrypted", 10)
+			So(err, ShouldBeNil)
+			foo, _ = store.GetString("foo")
+			So(foo, ShouldEqual, "bar")
+		}
+	})
+}
+
+func TestEncryptedManagerStore(t *testing.T) {
+	mstore := NewEncryptedStore(NewMemoryStore(), []byte("secret"), WithKeyBinding())
+
+	Convey("Test encrypted storage management operations", t, func() {
+		testManagerStore(mstore)
+	})
+}
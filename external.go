@@ -0,0 +1,49 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The helpers below are for session storages outside of this package, such as the S3 storage of
+// the s3store package. Such a storage keeps the session values of its session stores in a memory
+// storage that never stores the sessions, and decorates the session stores to save the values itself.
+
+var (
+	detachedStorage *memoryStore
+	detachedOnce    sync.Once
+)
+
+// The memory storage that holds the session values of the detached session stores
+func detached() *memoryStore {
+	detachedOnce.Do(func() {
+		detachedStorage = NewMemoryStore(WithoutGC()).(*memoryStore)
+	})
+	return detachedStorage
+}
+
+// NewDetachedStore creates a session store with the values of a session of another storage, held by
+// a memory storage that never stores the session. Saving the session store would store the session
+// in that memory storage, so the storage must decorate it and override every save.
+func NewDetachedStore(ctx context.Context, sid string, expired int64, values map[string]interface{}, version uint64, createdAt time.Time) Store {
+	return newStore(ctx, detached(), sid, expired, mapOf(values), version, createdAt)
+}
+
+// SessionValues gets a copy of the session values to save of a session store created with
+// NewDetachedStore, without the transient values
+func SessionValues(st Store) map[string]interface{} {
+	return sessionValues(st)
+}
+
+// ClearChanges clears the changes of a session store created with NewDetachedStore,
+// after the storage saved its session values
+func ClearChanges(st Store) {
+	clearChanges(st)
+}
+
+// SubStoreOf gets the sub store sub of the session store wrapped by the decorated session store
+// root, bound to root so saving the sub store goes through the decorator
+func SubStoreOf(root Store, sub Store) Store {
+	return subStoreOf(extendStore(root), sub)
+}
@@ -0,0 +1,212 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	_ managerStore = &failoverStore{}
+	_ sessionStore = &failoverSessionStore{}
+)
+
+// FailoverOption configures the failover store
+type FailoverOption func(*failoverStore)
+
+// Set the classifier of the errors of the primary storage that fail over to the secondary storage
+// (defaults to lost connections, timeouts and an open circuit)
+func WithFailoverClassifier(fn func(err error) bool) FailoverOption {
+	return func(s *failoverStore) {
+		s.isUnavailable = fn
+	}
+}
+
+// Skip the primary storage for the cool-down period after it failed over,
+// by default the primary storage is tried first on every call
+func WithPrimaryCoolDown(d time.Duration) FailoverOption {
+	return func(s *failoverStore) {
+		s.coolDown = d
+	}
+}
+
+// Create a session storage that runs every operation on the primary storage, and runs it again on
+// the secondary storage when the primary storage is unavailable. Errors about the session, such as
+// ErrSessionNotFound, are returned as they are. A session store saves to the storage it was loaded
+// from, a save that fails over saves the session values to a new session store of the secondary storage.
+func NewFailoverStore(primary, secondary ManagerStore, opts ...FailoverOption) ManagerStore {
+	s := &failoverStore{
+		primary:       primary,
+		secondary:     secondary,
+		isUnavailable: isUnavailable,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+type failoverStore struct {
+	primary       ManagerStore
+	secondary     ManagerStore
+	isUnavailable func(err error) bool
+	coolDown      time.Duration
+
+	mu          sync.Mutex
+	unhealthyAt time.Time
+}
+
+// reports whether the error indicates the storage is unavailable
+func isUnavailable(err error) bool {
+	return isConnectionError(err) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrCircuitOpen)
+}
+
+// reports whether the primary storage is skipped during its cool-down
+func (s *failoverStore) skipPrimary() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.unhealthyAt.IsZero() && time.Since(s.unhealthyAt) < s.coolDown
+}
+
+func (s *failoverStore) markUnhealthy() {
+	if s.coolDown <= 0 {
+		return
+	}
+	s.mu.Lock()
+	s.unhealthyAt = time.Now()
+	s.mu.Unlock()
+}
+
+// Run fn on the primary storage, and on the secondary storage when the primary storage is unavailable
+func withFailover[T any](s *failoverStore, fn func(mstore ManagerStore) (T, error)) (T, error) {
+	if !s.skipPrimary() {
+		v, err := fn(s.primary)
+		if err == nil || !s.isUnavailable(err) {
+			return v, err
+		}
+		s.markUnhealthy()
+	}
+	return fn(s.secondary)
+}
+
+func (s *failoverStore) wrap(store Store, expired int64, err error) (Store, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &failoverSessionStore{sessionStore: extendStore(store), fs: s, expired: expired}, nil
+}
+
+func (s *failoverStore) Check(ctx context.Context, sid string) (bool, error) {
+	return withFailover(s, func(mstore ManagerStore) (bool, error) {
+		return mstore.Check(ctx, sid)
+	})
+}
+
+func (s *failoverStore) Create(ctx context.Context, sid string, expired int64) (Store, error) {
+	store, err := withFailover(s, func(mstore ManagerStore) (Store, error) {
+		return mstore.Create(ctx, sid, expired)
+	})
+	return s.wrap(store, expired, err)
+}
+
+func (s *failoverStore) Update(ctx context.Context, sid string, expired int64) (Store, error) {
+	store, err := withFailover(s, func(mstore ManagerStore) (Store, error) {
+		return mstore.Update(ctx, sid, expired)
+	})
+	return s.wrap(store, expired, err)
+}
+
+func (s *failoverStore) LoadOrCreate(ctx context.Context, sid string, expired int64) (Store, bool, error) {
+	var created bool
+	store, err := withFailover(s, func(mstore ManagerStore) (Store, error) {
+		store, ok, err := LoadOrCreate(ctx, mstore, sid, expired)
+		created = ok
+		return store, err
+	})
+	store, err = s.wrap(store, expired, err)
+	return store, created, err
+}
+
+func (s *failoverStore) Delete(ctx context.Context, sid string) error {
+	_, err := withFailover(s, func(mstore ManagerStore) (struct{}, error) {
+		return struct{}{}, mstore.Delete(ctx, sid)
+	})
+	return err
+}
+
+func (s *failoverStore) Refresh(ctx context.Context, oldsid, sid string, expired int64) (Store, error) {
+	store, err := withFailover(s, func(mstore ManagerStore) (Store, error) {
+		return mstore.Refresh(ctx, oldsid, sid, expired)
+	})
+	return s.wrap(store, expired, err)
+}
+
+func (s *failoverStore) TimeToLive(ctx context.Context, sid string) (time.Duration, error) {
+	return withFailover(s, func(mstore ManagerStore) (time.Duration, error) {
+		return TimeToLive(ctx, mstore, sid)
+	})
+}
+
+func (s *failoverStore) Count(ctx context.Context) (int, error) {
+	return withFailover(s, func(mstore ManagerStore) (int, error) {
+		return Count(ctx, mstore)
+	})
+}
+
+func (s *failoverStore) Ping(ctx context.Context) error {
+	_, err := withFailover(s, func(mstore ManagerStore) (struct{}, error) {
+		return struct{}{}, Ping(ctx, mstore)
+	})
+	return err
+}
+
+func (s *failoverStore) Close() error {
+	err := s.primary.Close()
+	if serr := s.secondary.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// A session store of the failover storage
+type failoverSessionStore struct {
+	sessionStore
+	fs      *failoverStore
+	expired int64
+}
+
+func (s *failoverSessionStore) Manager() ManagerStore {
+	return s.fs
+}
+
+func (s *failoverSessionStore) unwrap() []Store {
+	return []Store{s.sessionStore}
+}
+
+func (s *failoverSessionStore) WithContext(ctx context.Context) Store {
+	return &failoverSessionStore{sessionStore: extendStore(s.sessionStore.WithContext(ctx)), fs: s.fs, expired: s.expired}
+}
+
+// A save that fails because the storage is unavailable saves the session values to a new
+// session store of the secondary storage, which the store uses from then on
+func (s *failoverSessionStore) Save() error {
+	err := s.sessionStore.Save()
+	if err == nil || !s.fs.isUnavailable(err) {
+		return err
+	}
+	s.fs.markUnhealthy()
+
+	store, err := moveSession(s.Context(), s.sessionStore, s.fs.secondary, s.SessionID(), s.expired, true)
+	if err != nil {
+		return err
+	}
+	s.sessionStore = extendStore(store)
+	return nil
+}
+
+func (s *failoverSessionStore) SubStore(name string) Store {
+	return subStoreOf(s, s.sessionStore.SubStore(name))
+}
@@ -0,0 +1,47 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFailoverStore(t *testing.T) {
+	primary := &fakeConn{ManagerStore: NewMemoryStore()}
+	secondary := NewMemoryStore()
+	mstore := NewFailoverStore(primary, secondary, WithPrimaryCoolDown(time.Millisecond*100))
+
+	Convey("Test failover storage", t, func() {
+		ctx := context.Background()
+		sid := "test_failover"
+		store, err := secondary.Create(ctx, sid, 10)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		// session errors of the primary storage do not fail over
+		_, err = mstore.Update(ctx, sid, 10)
+		So(err, ShouldEqual, ErrSessionNotFound)
+		ok, err := mstore.Check(ctx, sid)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+
+		primary.broken = true
+		ok, err = mstore.Check(ctx, sid)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		// the primary storage is skipped during the cool-down
+		primary.broken = false
+		ok, _ = mstore.Check(ctx, sid)
+		So(ok, ShouldBeTrue)
+		store, err = mstore.Update(ctx, sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(ManagedStore).Manager(), ShouldEqual, mstore)
+
+		time.Sleep(time.Millisecond * 150)
+		ok, _ = mstore.Check(ctx, sid)
+		So(ok, ShouldBeFalse)
+	})
+}
@@ -5,7 +5,9 @@ go 1.21
 require (
 	github.com/bytedance/gopkg v0.0.0-20230728082804-614d0af6619b
 	github.com/google/uuid v1.4.0
+	github.com/klauspost/compress v1.17.7
 	github.com/smartystreets/goconvey v1.6.4
+	golang.org/x/crypto v0.21.0
 )
 
 require (
@@ -0,0 +1,54 @@
+package session
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// The upper bounds of the buckets of the session lifetime histogram
+var lifetimeBounds = [...]time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	2 * time.Hour,
+	6 * time.Hour,
+	12 * time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+	time.Duration(math.MaxInt64),
+}
+
+// Bucket is a bucket of a histogram, Count is the number of observations less than or equal
+// to UpperBound, including those of the buckets with a lower bound like a Prometheus histogram.
+// The UpperBound of the last bucket is the maximum duration, it counts all observations.
+type Bucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// A histogram of durations with the lifetime bounds
+type histogram struct {
+	counts [len(lifetimeBounds)]atomic.Uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(lifetimeBounds), func(i int) bool {
+		return d <= lifetimeBounds[i]
+	})
+	h.counts[i].Add(1)
+}
+
+// Get the cumulative buckets of the histogram
+func (h *histogram) buckets() []Bucket {
+	buckets := make([]Bucket, len(lifetimeBounds))
+	var n uint64
+	for i, bound := range lifetimeBounds {
+		n += h.counts[i].Load()
+		buckets[i] = Bucket{UpperBound: bound, Count: n}
+	}
+	return buckets
+}
@@ -0,0 +1,79 @@
+package session
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+const (
+	// The maximum number of strings in the intern table
+	internTableSize = 4096
+	// The number of shards of the intern table, each with its own lock
+	internShards = 16
+	// Longer strings are not interned, they are rarely shared by sessions, such as tokens
+	maxInternLen = 64
+)
+
+// A table of strings shared by the session values, sharded so concurrent sets of different strings
+// rarely wait for each other, and a string that is found only takes a read lock. When a shard is full
+// an arbitrary string of it is evicted for a new string. An evicted string stays shared by the
+// values set before.
+type internTable struct {
+	seed   maphash.Seed
+	shards [internShards]internShard
+}
+
+type internShard struct {
+	mu      sync.RWMutex
+	size    int
+	strings map[string]string
+}
+
+func newInternTable(size int) *internTable {
+	t := &internTable{seed: maphash.MakeSeed()}
+	for i := range t.shards {
+		t.shards[i].size = size / internShards
+		t.shards[i].strings = make(map[string]string)
+	}
+	return t
+}
+
+// Get the string of the table equal to s, adding s when there is none. A string longer
+// than maxInternLen is returned as is.
+func (t *internTable) intern(s string) string {
+	if len(s) > maxInternLen {
+		return s
+	}
+	shard := &t.shards[maphash.String(t.seed, s)%internShards]
+
+	shard.mu.RLock()
+	interned, ok := shard.strings[s]
+	shard.mu.RUnlock()
+	if ok {
+		return interned
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if interned, ok := shard.strings[s]; ok {
+		return interned
+	}
+	if len(shard.strings) >= shard.size {
+		for key := range shard.strings {
+			delete(shard.strings, key)
+			break
+		}
+	}
+	shard.strings[s] = s
+	return s
+}
+
+func (t *internTable) len() int {
+	var n int
+	for i := range t.shards {
+		t.shards[i].mu.RLock()
+		n += len(t.shards[i].strings)
+		t.shards[i].mu.RUnlock()
+	}
+	return n
+}
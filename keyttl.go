@@ -0,0 +1,243 @@
+package session
+
+import (
+	"encoding/json"
+	"maps"
+	"strings"
+	"time"
+)
+
+// The expiration times of the session values with a TTL are stored under a reserved key,
+// in unix milliseconds by the path of the value joined by "\x00"
+const expiresKey = "_expires"
+
+// A callback of a session value with a TTL
+type keyCallback func(key string, value interface{})
+
+// Get the expiration time in unix milliseconds, read back as a float64 from serializing storages
+func expiresMillis(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	case int:
+		return int64(v), true
+	case json.Number:
+		n, err := v.Int64()
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// reports whether the value of the path is expired by the expiration times
+func pathExpired(expires interface{}, path string, now time.Time) bool {
+	m, ok := expires.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	t, ok := expiresMillis(m[path])
+	return ok && now.UnixMilli() >= t
+}
+
+// Get the value of the path
+func valueAt(values valueMap, path []string) (interface{}, bool) {
+	if len(path) == 1 {
+		return values.get(path[0])
+	}
+	m, _ := values.at(path[0]).(map[string]interface{})
+	for _, name := range path[1 : len(path)-1] {
+		if m, _ = m[name].(map[string]interface{}); m == nil {
+			return nil, false
+		}
+	}
+	v, ok := m[path[len(path)-1]]
+	return v, ok
+}
+
+// The callback is kept by the storage from the moment the value is set, and is called at most once
+func (s *store) SetWithTTLAndCallback(key string, value interface{}, ttl time.Duration, onExpire func(key string, value interface{})) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	key = s.key(key)
+	s.mu.Lock()
+	defer s.unlock()
+
+	if err := s.checkType(key, value); err != nil {
+		return err
+	}
+	if err := s.checkKeys(key, expiresKey); err != nil {
+		return err
+	}
+	s.setValue(key, value)
+	s.setExpires([]string{key}, ttl, onExpire)
+	return nil
+}
+
+// set the expiration time and callback of the value of the path, the caller must hold the lock
+func (s *store) setExpires(path []string, ttl time.Duration, onExpire keyCallback) {
+	p := strings.Join(path, "\x00")
+	expires, _ := s.values.at(expiresKey).(map[string]interface{})
+	expires = maps.Clone(expires)
+	if expires == nil {
+		expires = make(map[string]interface{})
+	}
+	expires[p] = s.mstore.now().Add(ttl).UnixMilli()
+	s.setValue(expiresKey, expires)
+	s.mstore.setKeyCallback(s.SessionID(), p, onExpire)
+}
+
+// clear the expiration time and callback of the value of the path, the caller must hold the lock
+func (s *store) clearExpires(path []string) {
+	p := strings.Join(path, "\x00")
+	expires, _ := s.values.at(expiresKey).(map[string]interface{})
+	if _, ok := expires[p]; !ok {
+		return
+	}
+	s.mstore.takeKeyCallback(s.SessionID(), p)
+	if len(expires) == 1 {
+		s.deleteValue(expiresKey)
+		return
+	}
+	expires = maps.Clone(expires)
+	delete(expires, p)
+	s.setValue(expiresKey, expires)
+}
+
+// reports whether the value of the path is expired, the caller must hold the lock
+func (s *store) expiredLocked(path []string) bool {
+	expires, ok := s.values.get(expiresKey)
+	return ok && pathExpired(expires, strings.Join(path, "\x00"), s.mstore.now())
+}
+
+// Delete the value of the path when it is expired and call its callback without holding the lock
+func (s *store) purgeExpired(path []string) {
+	s.mu.Lock()
+	if !s.expiredLocked(path) {
+		s.unlock()
+		return
+	}
+	// the callback is taken first, since deleting the value clears it
+	fn := s.mstore.takeKeyCallback(s.SessionID(), strings.Join(path, "\x00"))
+	value, ok := valueAt(s.values, path)
+	if len(path) == 1 {
+		s.deleteValue(path[0])
+	} else if top, ok := s.values.at(path[0]).(map[string]interface{}); ok {
+		s.setValue(path[0], deletePath(top, path[1:]))
+	}
+	s.clearExpires(path)
+	s.unlock()
+
+	if ok && fn != nil {
+		fn(path[len(path)-1], value)
+	}
+}
+
+// Set the callback of the value of the path of the session, a nil callback removes it
+func (s *memoryStore) setKeyCallback(sid, path string, fn keyCallback) {
+	s.keyCallbacksMu.Lock()
+	defer s.keyCallbacksMu.Unlock()
+
+	if fn == nil {
+		delete(s.keyCallbacks[sid], path)
+		return
+	}
+	if s.keyCallbacks == nil {
+		s.keyCallbacks = make(map[string]map[string]keyCallback)
+	}
+	if s.keyCallbacks[sid] == nil {
+		s.keyCallbacks[sid] = make(map[string]keyCallback)
+	}
+	s.keyCallbacks[sid][path] = fn
+}
+
+// Get and remove the callback of the value of the path of the session
+func (s *memoryStore) takeKeyCallback(sid, path string) keyCallback {
+	s.keyCallbacksMu.Lock()
+	defer s.keyCallbacksMu.Unlock()
+
+	fns := s.keyCallbacks[sid]
+	fn := fns[path]
+	delete(fns, path)
+	if len(fns) == 0 {
+		delete(s.keyCallbacks, sid)
+	}
+	return fn
+}
+
+// Move the callbacks of the session to the new session id
+func (s *memoryStore) moveKeyCallbacks(oldsid, sid string) {
+	s.keyCallbacksMu.Lock()
+	defer s.keyCallbacksMu.Unlock()
+
+	if fns, ok := s.keyCallbacks[oldsid]; ok {
+		delete(s.keyCallbacks, oldsid)
+		s.keyCallbacks[sid] = fns
+	}
+}
+
+// Remove the callbacks of the session, without calling them
+func (s *memoryStore) dropKeyCallbacks(sid string) {
+	s.keyCallbacksMu.Lock()
+	defer s.keyCallbacksMu.Unlock()
+	delete(s.keyCallbacks, sid)
+}
+
+// Delete the expired values of the stored session and call their callbacks without holding the lock
+func (s *memoryStore) purgeExpiredValues(sid string, item *dataItem) {
+	type purged struct {
+		key   string
+		value interface{}
+		ok    bool
+		fn    keyCallback
+	}
+
+	item.Lock()
+	if !item.expiring || item.removed || item.frozen {
+		item.Unlock()
+		return
+	}
+	expires, _ := item.values.at(expiresKey).(map[string]interface{})
+	now := s.now()
+	var (
+		values  = item.values.toMap()
+		pending []purged
+	)
+	for p := range expires {
+		if !pathExpired(expires, p, now) {
+			continue
+		}
+		path := strings.Split(p, "\x00")
+		value, ok := valueAt(mapOf(values), path)
+		values = deletePath(values, path)
+		pending = append(pending, purged{key: path[len(path)-1], value: value, ok: ok, fn: s.takeKeyCallback(sid, p)})
+	}
+	if len(pending) == 0 {
+		item.Unlock()
+		return
+	}
+
+	values = maps.Clone(values)
+	remaining := maps.Clone(expires)
+	for p := range expires {
+		if pathExpired(expires, p, now) {
+			delete(remaining, p)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(values, expiresKey)
+	} else {
+		values[expiresKey] = remaining
+	}
+	item.values = mapOf(values)
+	item.expiring = len(remaining) > 0
+	item.version++
+	item.Unlock()
+
+	for _, p := range pending {
+		if p.ok && p.fn != nil {
+			p.fn(p.key, p.value)
+		}
+	}
+}
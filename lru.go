@@ -0,0 +1,68 @@
+package session
+
+import "sync"
+
+// The number of entries the lru queue keeps before it drops the entries of earlier accesses
+const lruQueueMinSize = 1024
+
+// An access of a session, stale once the session is accessed again
+type lruEntry struct {
+	item       *dataItem
+	accessedAt int64
+}
+
+// The sessions in the order of their last access, for evicting the least recently used session
+// in constant amortized time. An access appends the session again rather than moving it, the
+// entries of an earlier access or of a session that is no longer stored are skipped.
+type lruQueue struct {
+	mu      sync.Mutex
+	entries []lruEntry
+	head    int
+	// reports whether the entry is of the last access of a stored session
+	live func(lruEntry) bool
+}
+
+func newLRUQueue(live func(lruEntry) bool) *lruQueue {
+	return &lruQueue{live: live}
+}
+
+// Append the access of the session, the entries that are not live are dropped once the
+// queue holds more than twice the number of sessions
+func (q *lruQueue) push(item *dataItem, accessedAt int64, sessions int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.head > len(q.entries)/2 {
+		n := copy(q.entries, q.entries[q.head:])
+		clear(q.entries[n:])
+		q.entries, q.head = q.entries[:n], 0
+	}
+	q.entries = append(q.entries, lruEntry{item: item, accessedAt: accessedAt})
+	if n := len(q.entries); n > lruQueueMinSize && n > sessions*2 {
+		entries := q.entries[:0]
+		for _, e := range q.entries {
+			if q.live(e) {
+				entries = append(entries, e)
+			}
+		}
+		clear(q.entries[len(entries):])
+		q.entries = entries
+	}
+}
+
+// Take the entry of the earliest access, ok is false when the queue is empty
+func (q *lruQueue) pop() (e lruEntry, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.head == len(q.entries) {
+		return lruEntry{}, false
+	}
+	e = q.entries[q.head]
+	q.entries[q.head] = lruEntry{}
+	q.head++
+	if q.head == len(q.entries) {
+		q.entries, q.head = q.entries[:0], 0
+	}
+	return e, true
+}
@@ -0,0 +1,128 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Middleware starts the session of every request and stores it in the request context, so the
+// handler gets it with FromContext. A session the handler got from the context is extended by
+// Touch before the response header is written, unless it is a new session or the request
+// method is skipped by SetSkipTouchMethods. A session that can not be started or touched fails the
+// request with status 500 instead of the response of the handler, unless the touched session no longer
+// exists. The session store, and the session stores that the handler got from Start, Check or Refresh
+// for the request, are released after the handler returned.
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sid, _ := m.sessionID(r)
+		store, err := m.Start(r.Context(), w, r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		defer m.Release(store)
+
+		started := &startedStores{}
+		defer started.release(m)
+
+		accessed := new(atomic.Bool)
+		ctx := NewContext(r.Context(), store)
+		ctx = context.WithValue(ctx, ctxAccessed{}, accessed)
+		ctx = context.WithValue(ctx, ctxStarted{}, started)
+		r = r.WithContext(ctx)
+
+		tw := &touchWriter{ResponseWriter: w}
+		// a new session is not touched, its cookie is set already
+		if _, skip := m.opts.skipTouchMethods[r.Method]; !skip && sid == store.SessionID() {
+			tw.touch = func() error {
+				// the handler may have destroyed or refreshed the session, which is then not touched
+				if !accessed.Load() {
+					return nil
+				}
+				// a session deleted meanwhile, such as by another request, has nothing to extend
+				if err := m.Touch(ctx, w, r, store); err != nil && !errors.Is(err, ErrSessionNotFound) {
+					return err
+				}
+				return nil
+			}
+		}
+
+		next.ServeHTTP(tw, r)
+		tw.writeHeader()
+	})
+}
+
+// The session stores started for a request within Middleware, to release after the request
+type startedStores struct {
+	mu     sync.Mutex
+	stores []Store
+}
+
+func (s *startedStores) add(store Store) {
+	s.mu.Lock()
+	s.stores = append(s.stores, store)
+	s.mu.Unlock()
+}
+
+func (s *startedStores) release(m *Manager) {
+	s.mu.Lock()
+	stores := s.stores
+	s.stores = nil
+	s.mu.Unlock()
+	for _, store := range stores {
+		m.Release(store)
+	}
+}
+
+// Register the session store started for the request, when it is handled within Middleware
+func track(r *http.Request, store Store) Store {
+	if started, ok := r.Context().Value(ctxStarted{}).(*startedStores); ok {
+		started.add(store)
+	}
+	return store
+}
+
+// A response writer that touches the session before the header is written
+type touchWriter struct {
+	http.ResponseWriter
+	touch   func() error
+	written bool
+	// the error touching the session, the response of the handler is then discarded
+	err error
+}
+
+func (w *touchWriter) writeHeader() {
+	if w.written {
+		return
+	}
+	w.written = true
+	if w.touch == nil {
+		return
+	}
+	if w.err = w.touch(); w.err != nil {
+		http.Error(w.ResponseWriter, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+func (w *touchWriter) WriteHeader(code int) {
+	w.writeHeader()
+	if w.err == nil {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *touchWriter) Write(b []byte) (int, error) {
+	w.writeHeader()
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the response writer of the server for http.ResponseController
+func (w *touchWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,78 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The settings of the rate limit of session creation
+type createLimit struct {
+	keyFn  func(ctx context.Context) string
+	limit  int
+	window time.Duration
+}
+
+// A token bucket of a key, refilled with limit tokens per window
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A token bucket rate limiter by the key read from the context
+type rateLimiter struct {
+	createLimit
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(l createLimit) *rateLimiter {
+	return &rateLimiter{createLimit: l, buckets: make(map[string]*tokenBucket)}
+}
+
+// Refill the bucket up to the limit for the time passed since it was last used
+func (r *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	if r.window > 0 {
+		b.tokens += float64(r.limit) * float64(now.Sub(b.last)) / float64(r.window)
+	}
+	if b.tokens > float64(r.limit) {
+		b.tokens = float64(r.limit)
+	}
+	b.last = now
+}
+
+// Take a token of the key of the context, reports whether one was left
+func (r *rateLimiter) allow(ctx context.Context, now time.Time) bool {
+	key := r.keyFn(ctx)
+	if key == "" {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(r.limit), last: now}
+		r.buckets[key] = b
+	}
+	r.refill(b, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Drop the buckets that are full again, they are the same as new buckets
+func (r *rateLimiter) prune(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, b := range r.buckets {
+		r.refill(b, now)
+		if b.tokens >= float64(r.limit) {
+			delete(r.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"time"
+)
+
+// The session id prefix of remember tokens, and the key of the user of a token
+const (
+	rememberPrefix  = "remember:"
+	rememberUserKey = "user_id"
+)
+
+// RememberTokens issues persistent "remember me" tokens, which are stored as sessions
+// of the storage with their own expiration time. A token is redeemed only once, so a new
+// token should be issued whenever one is redeemed. The storage holds a hash of every
+// token rather than the token itself.
+type RememberTokens struct {
+	mstore ManagerStore
+}
+
+// Create remember tokens stored in the session storage
+func NewRememberTokens(mstore ManagerStore) *RememberTokens {
+	return &RememberTokens{mstore: mstore}
+}
+
+// Get the session id of a token
+func rememberSID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return rememberPrefix + hex.EncodeToString(sum[:])
+}
+
+// IssueRememberToken create a token of the user that expires after ttl (whole seconds)
+func (t *RememberTokens) IssueRememberToken(ctx context.Context, userID string, ttl time.Duration) (string, error) {
+	if ttl < time.Second {
+		return "", ErrInvalidTTL
+	}
+
+	var buf [32]byte
+	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf[:])
+
+	store, err := t.mstore.Create(ctx, rememberSID(token), int64(ttl/time.Second))
+	if err != nil {
+		return "", err
+	}
+	if err := extendStore(store).SetChecked(rememberUserKey, userID); err != nil {
+		return "", err
+	}
+	if err := store.Save(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RedeemRememberToken get the user of the token and revoke the token, ok is false when the token
+// is unknown, expired or already redeemed. The token is first moved to a new session id, so of
+// concurrent redemptions only one gets the user with a storage that moves sessions atomically.
+func (t *RememberTokens) RedeemRememberToken(ctx context.Context, token string) (string, bool, error) {
+	redeemed := rememberPrefix + newUUID()
+	store, err := t.mstore.Refresh(ctx, rememberSID(token), redeemed, 1)
+	if err != nil {
+		return "", false, err
+	}
+	if err := t.mstore.Delete(ctx, redeemed); err != nil {
+		return "", false, err
+	}
+
+	userID, ok := store.GetString(rememberUserKey)
+	return userID, ok, nil
+}
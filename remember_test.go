@@ -0,0 +1,74 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRememberTokens(t *testing.T) {
+	clock := &testClock{}
+	mstore := NewMemoryStore(WithClock(clock.now), WithoutGC())
+	tokens := NewRememberTokens(mstore)
+
+	Convey("Test remember tokens", t, func() {
+		ctx := context.Background()
+		token, err := tokens.IssueRememberToken(ctx, "user1", time.Hour)
+		So(err, ShouldBeNil)
+		So(token, ShouldNotBeEmpty)
+
+		// the storage holds a hash of the token
+		ok, _ := mstore.Check(ctx, token)
+		So(ok, ShouldBeFalse)
+		ok, _ = mstore.Check(ctx, rememberSID(token))
+		So(ok, ShouldBeTrue)
+
+		userID, ok, err := tokens.RedeemRememberToken(ctx, token)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+		So(userID, ShouldEqual, "user1")
+
+		_, ok, err = tokens.RedeemRememberToken(ctx, token)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+		n, _ := Count(ctx, mstore)
+		So(n, ShouldEqual, 0)
+
+		_, ok, err = tokens.RedeemRememberToken(ctx, "unknown")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+
+		_, err = tokens.IssueRememberToken(ctx, "user1", time.Millisecond)
+		So(err, ShouldEqual, ErrInvalidTTL)
+
+		token, err = tokens.IssueRememberToken(ctx, "user1", time.Second)
+		So(err, ShouldBeNil)
+		clock.advance(mstore, time.Second*2)
+		_, ok, err = tokens.RedeemRememberToken(ctx, token)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Test remember tokens are redeemed once by concurrent redemptions", t, func() {
+		token, err := tokens.IssueRememberToken(context.Background(), "user2", time.Hour)
+		So(err, ShouldBeNil)
+
+		var wg sync.WaitGroup
+		var redeemed atomic.Int32
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, ok, _ := tokens.RedeemRememberToken(context.Background(), token); ok {
+					redeemed.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		So(redeemed.Load(), ShouldEqual, 1)
+	})
+}
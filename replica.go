@@ -0,0 +1,385 @@
+package session
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytedance/gopkg/collection/skipmap"
+)
+
+var (
+	_ managerStore = &replicaStore{}
+	_ sessionStore = &primaryStore{}
+	_ sessionStore = &replicaReadStore{}
+)
+
+// ReplicaOption configures the replica store
+type ReplicaOption func(*replicaStore)
+
+// Read from the primary for the given duration after a session is written,
+// since the replicas may not have caught up yet (disabled by default)
+func WithReadStaleness(d time.Duration) ReplicaOption {
+	return func(s *replicaStore) {
+		s.staleness = d
+	}
+}
+
+// Create a session storage that reads from the replicas (round-robin)
+// and writes to the primary. Update loads the session from a replica and
+// extends it on the primary, saving it writes the session values to the primary.
+func NewReplicaStore(primary ManagerStore, replicas []ManagerStore, opts ...ReplicaOption) ManagerStore {
+	s := &replicaStore{
+		primary:  primary,
+		replicas: replicas,
+		written:  skipmap.NewString(),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+type replicaStore struct {
+	primary   ManagerStore
+	replicas  []ManagerStore
+	next      uint64
+	staleness time.Duration
+	written   *skipmap.StringMap
+}
+
+// Get the storage to read the session from
+func (s *replicaStore) reader(sid string) ManagerStore {
+	if len(s.replicas) == 0 {
+		return s.primary
+	}
+	if _, ok := s.written.Load(sid); ok {
+		return s.primary
+	}
+	n := atomic.AddUint64(&s.next, 1)
+	return s.replicas[n%uint64(len(s.replicas))]
+}
+
+// Mark the sessions as written, so they are read from the primary during the staleness period
+func (s *replicaStore) markWritten(sids ...string) {
+	if s.staleness <= 0 {
+		return
+	}
+	for _, sid := range sids {
+		sid := sid
+		s.written.Store(sid, struct{}{})
+		time.AfterFunc(s.staleness, func() {
+			s.written.Delete(sid)
+		})
+	}
+}
+
+func (s *replicaStore) Check(ctx context.Context, sid string) (bool, error) {
+	return s.reader(sid).Check(ctx, sid)
+}
+
+func (s *replicaStore) Create(ctx context.Context, sid string, expired int64) (Store, error) {
+	store, err := s.primary.Create(ctx, sid, expired)
+	if err != nil {
+		return nil, err
+	}
+	return &primaryStore{sessionStore: extendStore(store), rs: s}, nil
+}
+
+func (s *replicaStore) Update(ctx context.Context, sid string, expired int64) (Store, error) {
+	mstore := s.reader(sid)
+	store, err := mstore.Update(ctx, sid, expired)
+	if mstore != s.primary && isNotFound(err) {
+		// the replica may not have caught up yet
+		mstore = s.primary
+		store, err = mstore.Update(ctx, sid, expired)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mstore == s.primary {
+		return &primaryStore{sessionStore: extendStore(store), rs: s}, nil
+	}
+	if err := s.touchPrimary(ctx, sid, expired); err != nil {
+		return nil, err
+	}
+	return &replicaReadStore{sessionStore: extendStore(store), rs: s, expired: expired}, nil
+}
+
+// Extend the session on the primary when it is read from a replica, so it does not expire on the
+// primary while it is used. A session that is not on the primary is stored there when it is saved.
+func (s *replicaStore) touchPrimary(ctx context.Context, sid string, expired int64) error {
+	store, err := s.primary.Update(ctx, sid, expired)
+	if isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	pool, _ := s.primary.(StorePool)
+	releaseStore(store, pool)
+	return nil
+}
+
+func (s *replicaStore) LoadOrCreate(ctx context.Context, sid string, expired int64) (Store, bool, error) {
+	store, created, err := LoadOrCreate(ctx, s.primary, sid, expired)
+	if err != nil {
+		return nil, false, err
+	}
+	s.markWritten(sid)
+	return &primaryStore{sessionStore: extendStore(store), rs: s}, created, nil
+}
+
+func (s *replicaStore) Delete(ctx context.Context, sid string) error {
+	if err := s.primary.Delete(ctx, sid); err != nil {
+		return err
+	}
+	s.markWritten(sid)
+	return nil
+}
+
+func (s *replicaStore) Refresh(ctx context.Context, oldsid, sid string, expired int64) (Store, error) {
+	store, err := s.primary.Refresh(ctx, oldsid, sid, expired)
+	if err != nil {
+		return nil, err
+	}
+	s.markWritten(oldsid, sid)
+	return &primaryStore{sessionStore: extendStore(store), rs: s}, nil
+}
+
+func (s *replicaStore) TimeToLive(ctx context.Context, sid string) (time.Duration, error) {
+	return TimeToLive(ctx, s.reader(sid), sid)
+}
+
+// The sessions are counted on the primary, since the replicas may not have caught up yet
+func (s *replicaStore) Count(ctx context.Context) (int, error) {
+	return Count(ctx, s.primary)
+}
+
+func (s *replicaStore) Ping(ctx context.Context) error {
+	if err := Ping(ctx, s.primary); err != nil {
+		return err
+	}
+	for _, replica := range s.replicas {
+		if err := Ping(ctx, replica); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *replicaStore) Close() error {
+	err := s.primary.Close()
+	for _, replica := range s.replicas {
+		if cerr := replica.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// A session store of the primary
+type primaryStore struct {
+	sessionStore
+	rs *replicaStore
+}
+
+func (s *primaryStore) Manager() ManagerStore {
+	return s.rs
+}
+
+func (s *primaryStore) unwrap() []Store {
+	return []Store{s.sessionStore}
+}
+
+func (s *primaryStore) WithContext(ctx context.Context) Store {
+	return &primaryStore{sessionStore: extendStore(s.sessionStore.WithContext(ctx)), rs: s.rs}
+}
+
+func (s *primaryStore) Save() error {
+	if err := s.sessionStore.Save(); err != nil {
+		return err
+	}
+	s.rs.markWritten(s.SessionID())
+	return nil
+}
+
+func (s *primaryStore) SaveReturn() (Store, error) {
+	store, err := s.sessionStore.SaveReturn()
+	if err != nil {
+		return nil, err
+	}
+	s.rs.markWritten(s.SessionID())
+	return &primaryStore{sessionStore: extendStore(store), rs: s.rs}, nil
+}
+
+func (s *primaryStore) SaveDirty() error {
+	if err := s.sessionStore.SaveDirty(); err != nil {
+		return err
+	}
+	s.rs.markWritten(s.SessionID())
+	return nil
+}
+
+func (s *primaryStore) SaveIfVersion(expected uint64) error {
+	if err := s.sessionStore.SaveIfVersion(expected); err != nil {
+		return err
+	}
+	s.rs.markWritten(s.SessionID())
+	return nil
+}
+
+func (s *primaryStore) Replace(values map[string]interface{}) error {
+	if err := s.sessionStore.Replace(values); err != nil {
+		return err
+	}
+	s.rs.markWritten(s.SessionID())
+	return nil
+}
+
+func (s *primaryStore) Rotate(newsid string) error {
+	oldsid := s.SessionID()
+	if err := s.sessionStore.Rotate(newsid); err != nil {
+		return err
+	}
+	s.rs.markWritten(oldsid, newsid)
+	return nil
+}
+
+func (s *primaryStore) Flush() error {
+	if err := s.sessionStore.Flush(); err != nil {
+		return err
+	}
+	s.rs.markWritten(s.SessionID())
+	return nil
+}
+
+func (s *primaryStore) SubStore(name string) Store {
+	return subStoreOf(s, s.sessionStore.SubStore(name))
+}
+
+// A session store loaded from a replica, saving writes the session values to the primary
+type replicaReadStore struct {
+	sessionStore
+	rs      *replicaStore
+	expired int64
+}
+
+func (s *replicaReadStore) Manager() ManagerStore {
+	return s.rs
+}
+
+func (s *replicaReadStore) unwrap() []Store {
+	return []Store{s.sessionStore}
+}
+
+func (s *replicaReadStore) WithContext(ctx context.Context) Store {
+	return &replicaReadStore{sessionStore: extendStore(s.sessionStore.WithContext(ctx)), rs: s.rs, expired: s.expired}
+}
+
+func (s *replicaReadStore) Save() error {
+	return s.save(sessionStore.Save)
+}
+
+// The returned store is read from the primary
+func (s *replicaReadStore) SaveReturn() (Store, error) {
+	var saved Store
+	err := s.save(func(store sessionStore) error {
+		var err error
+		saved, err = store.SaveReturn()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &primaryStore{sessionStore: extendStore(saved), rs: s.rs}, nil
+}
+
+// The version is checked against the primary, while the session is read with the version of the replica
+func (s *replicaReadStore) SaveIfVersion(expected uint64) error {
+	return s.save(func(store sessionStore) error {
+		return store.SaveIfVersion(expected)
+	})
+}
+
+func (s *replicaReadStore) save(fn func(sessionStore) error) error {
+	values := sessionValues(s.sessionStore)
+
+	store, err := s.rs.primary.Create(s.Context(), s.SessionID(), s.expired)
+	if err != nil {
+		return err
+	}
+	if err := copyValues(store, values); err != nil {
+		return err
+	}
+	if err := fn(extendStore(store)); err != nil {
+		return err
+	}
+	s.rs.markWritten(s.SessionID())
+	clearChanges(s.sessionStore)
+	return nil
+}
+
+func (s *replicaReadStore) SaveDirty() error {
+	return s.Save()
+}
+
+// Replace the session values on the primary, the session store then uses the session of the primary
+// since the session values read from the replica are shared with the replica
+func (s *replicaReadStore) Replace(values map[string]interface{}) error {
+	store, err := s.rs.primary.Create(s.Context(), s.SessionID(), s.expired)
+	if err != nil {
+		return err
+	}
+	primary := extendStore(store)
+	if err := primary.Replace(values); err != nil {
+		return err
+	}
+	s.rs.markWritten(s.SessionID())
+	s.sessionStore = primary
+	return nil
+}
+
+// Move the session on the primary, the session store read from the replica only changes its id
+// since the replica must not be written. A session store that can not be renamed is replaced by
+// the session store of the primary, with the session values read from the replica.
+func (s *replicaReadStore) Rotate(newsid string) error {
+	oldsid := s.SessionID()
+	store, err := s.rs.primary.Refresh(s.Context(), oldsid, newsid, s.expired)
+	if err != nil {
+		return err
+	}
+	s.rs.markWritten(oldsid, newsid)
+	if renameStore(s.sessionStore, newsid) {
+		releaseStore(store, nil)
+		return nil
+	}
+	if err := copyValues(store, sessionValues(s.sessionStore)); err != nil {
+		return err
+	}
+	clearChanges(s.sessionStore)
+	s.sessionStore = extendStore(store)
+	return nil
+}
+
+// Clear the session values on the primary, the session store then uses the session of the primary
+// since the session values read from the replica are shared with the replica
+func (s *replicaReadStore) Flush() error {
+	store, err := s.rs.primary.Create(s.Context(), s.SessionID(), s.expired)
+	if err != nil {
+		return err
+	}
+	if err := copyValues(store, sessionValues(s.sessionStore)); err != nil {
+		return err
+	}
+	if err := store.Flush(); err != nil {
+		return err
+	}
+	s.rs.markWritten(s.SessionID())
+	clearChanges(s.sessionStore)
+	s.sessionStore = extendStore(store)
+	return nil
+}
+
+func (s *replicaReadStore) SubStore(name string) Store {
+	return subStoreOf(s, s.sessionStore.SubStore(name))
+}
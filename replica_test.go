@@ -0,0 +1,129 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReplicaStore(t *testing.T) {
+	primary, replica := NewMemoryStore(), NewMemoryStore()
+	mstore := NewReplicaStore(primary, []ManagerStore{replica}, WithReadStaleness(time.Millisecond*100))
+
+	Convey("Test replica storage reads and writes", t, func() {
+		sid := "test_replica_store"
+		store, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		So(store.Save(), ShouldBeNil)
+		So(store.(ManagedStore).Manager(), ShouldEqual, mstore)
+
+		exists, err := mstore.Check(context.Background(), sid)
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeTrue)
+
+		time.Sleep(time.Millisecond * 200)
+		exists, err = mstore.Check(context.Background(), sid)
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+
+		store, err = replica.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		store.Set("foo", "baz")
+		So(store.Save(), ShouldBeNil)
+
+		store, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		foo, ok := store.Get("foo")
+		So(ok, ShouldBeTrue)
+		So(foo, ShouldEqual, "baz")
+
+		store.Set("foo2", "bar2")
+		So(store.Save(), ShouldBeNil)
+
+		store, err = primary.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		foo2, ok := store.Get("foo2")
+		So(ok, ShouldBeTrue)
+		So(foo2, ShouldEqual, "bar2")
+
+		So(Ping(context.Background(), mstore), ShouldBeNil)
+		So(mstore.Delete(context.Background(), sid), ShouldBeNil)
+		exists, err = primary.Check(context.Background(), sid)
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+	})
+
+	Convey("Test replica storage extends the session on the primary when read from a replica", t, func() {
+		ctx := context.Background()
+		sid := "test_replica_store_touch"
+		for _, ms := range []ManagerStore{primary, replica} {
+			store, err := ms.Create(ctx, sid, 10)
+			So(err, ShouldBeNil)
+			store.Set("foo", "bar")
+			So(store.Save(), ShouldBeNil)
+		}
+
+		store, err := mstore.Update(ctx, sid, 3600)
+		So(err, ShouldBeNil)
+		_, ok := store.(*replicaReadStore)
+		So(ok, ShouldBeTrue)
+		ttl, err := TimeToLive(ctx, primary, sid)
+		So(err, ShouldBeNil)
+		So(ttl, ShouldBeGreaterThan, time.Second*10)
+
+		// flushing does not change the session of the replica
+		So(store.Flush(), ShouldBeNil)
+		So(store.(ValueStore).Keys(), ShouldBeEmpty)
+		store, err = replica.Update(ctx, sid, 10)
+		So(err, ShouldBeNil)
+		foo, _ := store.GetString("foo")
+		So(foo, ShouldEqual, "bar")
+		store, err = primary.Update(ctx, sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(ValueStore).Keys(), ShouldBeEmpty)
+	})
+
+	Convey("Test replica storage rotates the session on the primary only", t, func() {
+		ctx := context.Background()
+		sid, newsid := "test_replica_store_rotate", "test_replica_store_rotated"
+		for _, ms := range []ManagerStore{primary, replica} {
+			store, err := ms.Create(ctx, sid, 10)
+			So(err, ShouldBeNil)
+			store.Set("foo", "bar")
+			So(store.Save(), ShouldBeNil)
+		}
+
+		store, err := mstore.Update(ctx, sid, 10)
+		So(err, ShouldBeNil)
+		store.Set("foo2", "bar2")
+		So(store.(Rotator).Rotate(newsid), ShouldBeNil)
+		So(store.SessionID(), ShouldEqual, newsid)
+
+		exists, err := replica.Check(ctx, sid)
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeTrue)
+		exists, err = replica.Check(ctx, newsid)
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+		exists, err = primary.Check(ctx, sid)
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+
+		So(store.Save(), ShouldBeNil)
+		store, err = primary.Update(ctx, newsid, 10)
+		So(err, ShouldBeNil)
+		foo2, _ := store.GetString("foo2")
+		So(foo2, ShouldEqual, "bar2")
+	})
+}
+
+func TestReplicaManagerStore(t *testing.T) {
+	mstore := NewReplicaStore(NewMemoryStore(), nil)
+
+	Convey("Test replica storage management operations without replicas", t, func() {
+		testManagerStore(mstore)
+	})
+}
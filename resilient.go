@@ -0,0 +1,293 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	_ managerStore = &resilientStore{}
+	_ sessionStore = &resilientSessionStore{}
+)
+
+// ResilientOption configures the resilient store
+type ResilientOption func(*resilientStore)
+
+// Set the classifier of the errors that indicate the connection to the storage is lost
+// (defaults to closed connections, resets, refused connections and network errors)
+func WithConnectionErrorClassifier(fn func(err error) bool) ResilientOption {
+	return func(s *resilientStore) {
+		s.isConnErr = fn
+	}
+}
+
+// Set the number of times an operation is retried after reconnecting (default 3)
+func WithMaxRetries(n int) ResilientOption {
+	return func(s *resilientStore) {
+		s.maxRetries = n
+	}
+}
+
+// Set the delay before the first reconnect, which doubles for every next attempt up to max
+// (defaults to 100ms and 5s)
+func WithBackoff(initial, max time.Duration) ResilientOption {
+	return func(s *resilientStore) {
+		s.initialBackoff = initial
+		s.maxBackoff = max
+	}
+}
+
+// Create a session storage that builds the inner storage with the factory when it is first used,
+// and rebuilds it when an operation fails because the connection to the storage is lost. The
+// operation is then retried on the new storage, waiting with exponential backoff before every
+// reconnect. A session store saves through the storage it was loaded from, a save that loses the
+// connection saves the session values to a new session store of the rebuilt storage.
+func NewResilientStore(factory func() (ManagerStore, error), opts ...ResilientOption) ManagerStore {
+	s := &resilientStore{
+		factory:        factory,
+		isConnErr:      isConnectionError,
+		maxRetries:     3,
+		initialBackoff: time.Millisecond * 100,
+		maxBackoff:     time.Second * 5,
+		sleep:          sleepContext,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+type resilientStore struct {
+	factory        func() (ManagerStore, error)
+	isConnErr      func(err error) bool
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	sleep          func(ctx context.Context, d time.Duration) error
+
+	mu     sync.Mutex
+	inner  ManagerStore
+	gen    uint64
+	closed bool
+}
+
+// reports whether the error indicates the connection to the storage is lost
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.As(err, &netErr)
+}
+
+// Wait for the duration or until the context is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Get the inner storage and its generation, building it when there is none
+func (s *resilientStore) get() (ManagerStore, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, 0, ErrStoreClosed
+	}
+	if s.inner == nil {
+		inner, err := s.factory()
+		if err != nil {
+			return nil, 0, err
+		}
+		s.inner = inner
+		s.gen++
+	}
+	return s.inner, s.gen, nil
+}
+
+// Drop the inner storage of the generation, unless it was rebuilt already by another operation
+func (s *resilientStore) reset(gen uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inner != nil && s.gen == gen {
+		s.inner.Close()
+		s.inner = nil
+	}
+}
+
+// Get the delay before the reconnect attempt
+func (s *resilientStore) backoff(attempt int) time.Duration {
+	d := s.initialBackoff
+	for i := 0; i < attempt && d < s.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.maxBackoff {
+		d = s.maxBackoff
+	}
+	return d
+}
+
+// Run fn on the inner storage, rebuilding the storage and retrying when the connection is lost.
+// Failing to build the storage is retried as well.
+func withReconnect[T any](ctx context.Context, s *resilientStore, fn func(inner ManagerStore) (T, error)) (T, error) {
+	for attempt := 0; ; attempt++ {
+		inner, gen, err := s.get()
+		var v T
+		if err == nil {
+			v, err = fn(inner)
+			if err == nil || !s.isConnErr(err) {
+				return v, err
+			}
+			s.reset(gen)
+		} else if errors.Is(err, ErrStoreClosed) {
+			return v, err
+		}
+
+		if attempt >= s.maxRetries {
+			return v, err
+		}
+		if serr := s.sleep(ctx, s.backoff(attempt)); serr != nil {
+			return v, serr
+		}
+	}
+}
+
+func (s *resilientStore) wrap(store Store, expired int64, err error) (Store, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &resilientSessionStore{sessionStore: extendStore(store), rs: s, expired: expired}, nil
+}
+
+func (s *resilientStore) Check(ctx context.Context, sid string) (bool, error) {
+	return withReconnect(ctx, s, func(inner ManagerStore) (bool, error) {
+		return inner.Check(ctx, sid)
+	})
+}
+
+func (s *resilientStore) Create(ctx context.Context, sid string, expired int64) (Store, error) {
+	store, err := withReconnect(ctx, s, func(inner ManagerStore) (Store, error) {
+		return inner.Create(ctx, sid, expired)
+	})
+	return s.wrap(store, expired, err)
+}
+
+func (s *resilientStore) Update(ctx context.Context, sid string, expired int64) (Store, error) {
+	store, err := withReconnect(ctx, s, func(inner ManagerStore) (Store, error) {
+		return inner.Update(ctx, sid, expired)
+	})
+	return s.wrap(store, expired, err)
+}
+
+func (s *resilientStore) LoadOrCreate(ctx context.Context, sid string, expired int64) (Store, bool, error) {
+	var created bool
+	store, err := withReconnect(ctx, s, func(inner ManagerStore) (Store, error) {
+		store, ok, err := LoadOrCreate(ctx, inner, sid, expired)
+		created = ok
+		return store, err
+	})
+	store, err = s.wrap(store, expired, err)
+	return store, created, err
+}
+
+func (s *resilientStore) Delete(ctx context.Context, sid string) error {
+	_, err := withReconnect(ctx, s, func(inner ManagerStore) (struct{}, error) {
+		return struct{}{}, inner.Delete(ctx, sid)
+	})
+	return err
+}
+
+func (s *resilientStore) Refresh(ctx context.Context, oldsid, sid string, expired int64) (Store, error) {
+	store, err := withReconnect(ctx, s, func(inner ManagerStore) (Store, error) {
+		return inner.Refresh(ctx, oldsid, sid, expired)
+	})
+	return s.wrap(store, expired, err)
+}
+
+func (s *resilientStore) TimeToLive(ctx context.Context, sid string) (time.Duration, error) {
+	return withReconnect(ctx, s, func(inner ManagerStore) (time.Duration, error) {
+		return TimeToLive(ctx, inner, sid)
+	})
+}
+
+func (s *resilientStore) Count(ctx context.Context) (int, error) {
+	return withReconnect(ctx, s, func(inner ManagerStore) (int, error) {
+		return Count(ctx, inner)
+	})
+}
+
+func (s *resilientStore) Ping(ctx context.Context) error {
+	_, err := withReconnect(ctx, s, func(inner ManagerStore) (struct{}, error) {
+		return struct{}{}, Ping(ctx, inner)
+	})
+	return err
+}
+
+func (s *resilientStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.inner == nil {
+		return nil
+	}
+	err := s.inner.Close()
+	s.inner = nil
+	return err
+}
+
+// A session store of the resilient storage
+type resilientSessionStore struct {
+	sessionStore
+	rs      *resilientStore
+	expired int64
+}
+
+func (s *resilientSessionStore) Manager() ManagerStore {
+	return s.rs
+}
+
+func (s *resilientSessionStore) unwrap() []Store {
+	return []Store{s.sessionStore}
+}
+
+func (s *resilientSessionStore) WithContext(ctx context.Context) Store {
+	return &resilientSessionStore{sessionStore: extendStore(s.sessionStore.WithContext(ctx)), rs: s.rs, expired: s.expired}
+}
+
+// A save that loses the connection saves the session values to a new session store
+// of the rebuilt storage, which the store uses from then on
+func (s *resilientSessionStore) Save() error {
+	err := s.sessionStore.Save()
+	if err == nil || !s.rs.isConnErr(err) {
+		return err
+	}
+
+	store, err := withReconnect(s.Context(), s.rs, func(inner ManagerStore) (Store, error) {
+		return moveSession(s.Context(), s.sessionStore, inner, s.SessionID(), s.expired, true)
+	})
+	if err != nil {
+		return err
+	}
+	s.sessionStore = extendStore(store)
+	return nil
+}
+
+func (s *resilientSessionStore) SubStore(name string) Store {
+	return subStoreOf(s, s.sessionStore.SubStore(name))
+}
@@ -0,0 +1,96 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// A connection to a shared session storage, which fails with io.EOF once it is broken
+type fakeConn struct {
+	ManagerStore
+	broken bool
+	closed bool
+}
+
+func (c *fakeConn) Check(ctx context.Context, sid string) (bool, error) {
+	if c.broken {
+		return false, io.EOF
+	}
+	return c.ManagerStore.Check(ctx, sid)
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	if c.broken {
+		return io.EOF
+	}
+	return Ping(ctx, c.ManagerStore)
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestResilientStore(t *testing.T) {
+	Convey("Test resilient storage", t, func() {
+		ctx := context.Background()
+		backend := NewMemoryStore()
+		var (
+			conns      []*fakeConn
+			factoryErr error
+			delays     []time.Duration
+		)
+		mstore := NewResilientStore(func() (ManagerStore, error) {
+			if factoryErr != nil {
+				return nil, factoryErr
+			}
+			conn := &fakeConn{ManagerStore: backend}
+			conns = append(conns, conn)
+			return conn, nil
+		}, WithMaxRetries(2), WithBackoff(time.Millisecond*10, time.Millisecond*15)).(*resilientStore)
+		mstore.sleep = func(_ context.Context, d time.Duration) error {
+			delays = append(delays, d)
+			return nil
+		}
+
+		// the storage is built when it is first used
+		So(conns, ShouldBeEmpty)
+		store, err := mstore.Create(ctx, "test_resilient", 10)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+		So(store.(ManagedStore).Manager(), ShouldEqual, mstore)
+		So(conns, ShouldHaveLength, 1)
+
+		conns[0].broken = true
+		ok, err := mstore.Check(ctx, "test_resilient")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+		So(conns, ShouldHaveLength, 2)
+		So(conns[0].closed, ShouldBeTrue)
+		So(delays, ShouldResemble, []time.Duration{time.Millisecond * 10})
+
+		// building the storage is retried with backoff until the retries run out
+		conns[1].broken = true
+		factoryErr = errors.New("connection refused")
+		delays = nil
+		So(mstore.Ping(ctx), ShouldEqual, factoryErr)
+		So(delays, ShouldResemble, []time.Duration{time.Millisecond * 10, time.Millisecond * 15})
+
+		factoryErr = nil
+		So(mstore.Ping(ctx), ShouldBeNil)
+		So(conns, ShouldHaveLength, 3)
+
+		// other errors are not retried
+		_, err = mstore.Update(ctx, "test_resilient_missing", 10)
+		So(err, ShouldEqual, ErrSessionNotFound)
+		So(conns, ShouldHaveLength, 3)
+
+		So(mstore.Close(), ShouldBeNil)
+		So(mstore.Ping(ctx), ShouldEqual, ErrStoreClosed)
+	})
+}
@@ -0,0 +1,568 @@
+// Package s3store provides a session storage that stores every session as an object in an S3 bucket.
+package s3store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/mbict/session"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	_ session.ManagerStore = &s3Store{}
+	_ session.LoadCreator  = &s3Store{}
+	_ session.TTLReporter  = &s3Store{}
+	_ session.Counter      = &s3Store{}
+	_ session.Pinger       = &s3Store{}
+	_ detachedStore        = &s3SessionStore{}
+	_ s3API                = &s3.Client{}
+)
+
+// The object metadata with the expiration time (unix seconds, absent when the
+// session never expires), the creation time and the version of a session
+const (
+	s3ExpiresAtKey = "expires-at"
+	s3CreatedAtKey = "created-at"
+	s3VersionKey   = "version"
+)
+
+// The metadata of a session object
+type s3Metadata struct {
+	expiredAt time.Time
+	createdAt time.Time
+	version   uint64
+}
+
+// The S3 operations used by the S3 store
+type s3API interface {
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+}
+
+// Option configures the S3 store
+type Option func(*s3Store)
+
+// Prefix the object keys of the sessions, such as "sessions/" (no prefix by default)
+func WithKeyPrefix(prefix string) Option {
+	return func(s *s3Store) {
+		s.prefix = prefix
+	}
+}
+
+// Set the expiration time of a session created or loaded with a zero expiration time
+// (defaults to two hours, the session expiration time of the manager)
+func WithDefaultTTL(d time.Duration) Option {
+	return func(s *s3Store) {
+		s.defaultTTL = d
+	}
+}
+
+// Set the codec of the session values (defaults to session.GobCodec)
+func WithCodec(codec session.Codec) Option {
+	return func(s *s3Store) {
+		s.codec = codec
+	}
+}
+
+// Create a session storage that stores every session as an object in the S3 bucket, with the
+// expiration time in the object metadata. Expired objects are not deleted by the store, so
+// the bucket should have a lifecycle rule expiring objects older than the longest session.
+// Loading a session copies its object in place to extend the expiration time.
+func NewS3Store(client *s3.Client, bucket string, opts ...Option) session.ManagerStore {
+	return newS3Store(client, bucket, opts...)
+}
+
+func newS3Store(client s3API, bucket string, opts ...Option) *s3Store {
+	s := &s3Store{
+		client:     client,
+		bucket:     bucket,
+		codec:      session.GobCodec,
+		clock:      time.Now,
+		defaultTTL: defaultTTL,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+type s3Store struct {
+	client s3API
+	bucket string
+	prefix string
+	codec  session.Codec
+	clock  func() time.Time
+	// the expiration time of a zero expiration time
+	defaultTTL time.Duration
+	loads      singleflight.Group
+}
+
+// The values and object metadata of a session, shared by concurrent loads
+type s3Session struct {
+	values map[string]interface{}
+	md     s3Metadata
+}
+
+func (s *s3Store) key(sid string) *string {
+	return aws.String(s.prefix + sid)
+}
+
+// reports whether the error is a missing object
+func isS3NotFound(err error) bool {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		switch ae.ErrorCode() {
+		case "NotFound", "NoSuchKey":
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap an error of the S3 client with the operation, so errors.Is and errors.As still match it.
+// A missing object also matches session.ErrSessionNotFound.
+func s3Error(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if isS3NotFound(err) {
+		return fmt.Errorf("%w: s3store: %s: %w", session.ErrSessionNotFound, op, err)
+	}
+	return fmt.Errorf("s3store: %s: %w", op, err)
+}
+
+// The default expiration time of the sessions, as the session expiration time of the manager
+const defaultTTL = 2 * time.Hour
+
+// Validate the expiration time (in seconds), a zero expiration time is the default expiration
+// time and a negative expiration time other than NoExpiry returns ErrInvalidTTL
+func (s *s3Store) normalizeExpired(expired int64) (int64, error) {
+	if expired == 0 {
+		expired = int64(s.defaultTTL / time.Second)
+	}
+	if expired <= 0 && expired != session.NoExpiry {
+		return 0, session.ErrInvalidTTL
+	}
+	return expired, nil
+}
+
+// Get the expiration time of a session that expires in expired seconds,
+// the zero time for a session that never expires
+func expiresAt(now time.Time, expired int64) time.Time {
+	if expired == session.NoExpiry {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(expired) * time.Second)
+}
+
+// reports whether the expiration time has passed
+func isExpired(now, expiredAt time.Time) bool {
+	return !expiredAt.IsZero() && !expiredAt.After(now)
+}
+
+// reports whether the session does not exist or is expired
+func isNotFound(err error) bool {
+	return errors.Is(err, session.ErrSessionNotFound) || errors.Is(err, session.ErrSessionExpired)
+}
+
+// Get the object metadata of a session
+func (s *s3Store) metadata(expired int64, md s3Metadata) map[string]string {
+	m := map[string]string{
+		s3CreatedAtKey: strconv.FormatInt(md.createdAt.Unix(), 10),
+		s3VersionKey:   strconv.FormatUint(md.version, 10),
+	}
+	if t := expiresAt(s.clock(), expired); !t.IsZero() {
+		m[s3ExpiresAtKey] = strconv.FormatInt(t.Unix(), 10)
+	}
+	return m
+}
+
+// parse a unix time of the object metadata, the zero time when it is absent
+func parseUnix(m map[string]string, key string) (time.Time, error) {
+	v, ok := m[key]
+	if !ok {
+		return time.Time{}, nil
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// Parse the object metadata of a session, returns ErrSessionExpired when it is expired
+func (s *s3Store) parseMetadata(m map[string]string) (s3Metadata, error) {
+	var md s3Metadata
+	var err error
+	if md.expiredAt, err = parseUnix(m, s3ExpiresAtKey); err != nil {
+		return s3Metadata{}, err
+	}
+	if isExpired(s.clock(), md.expiredAt) {
+		return s3Metadata{}, session.ErrSessionExpired
+	}
+	if md.createdAt, err = parseUnix(m, s3CreatedAtKey); err != nil {
+		return s3Metadata{}, err
+	}
+	md.version, _ = strconv.ParseUint(m[s3VersionKey], 10, 64)
+	return md, nil
+}
+
+// Get the object metadata of the active session
+func (s *s3Store) head(ctx context.Context, sid string) (s3Metadata, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: s.key(sid)})
+	if err != nil {
+		return s3Metadata{}, s3Error("head object", err)
+	}
+	return s.parseMetadata(out.Metadata)
+}
+
+// Get the values and object metadata of the active session
+func (s *s3Store) get(ctx context.Context, sid string) (map[string]interface{}, s3Metadata, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: s.key(sid)})
+	if err != nil {
+		return nil, s3Metadata{}, s3Error("get object", err)
+	}
+	defer out.Body.Close()
+
+	md, err := s.parseMetadata(out.Metadata)
+	if err != nil {
+		return nil, s3Metadata{}, err
+	}
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, s3Metadata{}, s3Error("get object", err)
+	}
+	values, err := s.codec.Unmarshal(data)
+	if err != nil {
+		return nil, s3Metadata{}, err
+	}
+	return values, md, nil
+}
+
+// Get the values and object metadata of the active session, concurrent loads of the same session
+// share a single request. The request is not canceled with the context of the caller that started
+// it, waiting for it returns early when the context is done.
+func (s *s3Store) load(ctx context.Context, sid string) (map[string]interface{}, s3Metadata, error) {
+	ch := s.loads.DoChan(sid, func() (interface{}, error) {
+		values, md, err := s.get(context.WithoutCancel(ctx), sid)
+		return s3Session{values: values, md: md}, err
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, s3Metadata{}, res.Err
+		}
+		ss := res.Val.(s3Session)
+		// every session store gets its own values
+		return maps.Clone(ss.values), ss.md, nil
+	case <-ctx.Done():
+		return nil, s3Metadata{}, ctx.Err()
+	}
+}
+
+// Store the session values with the object metadata
+func (s *s3Store) put(ctx context.Context, sid string, values map[string]interface{}, expired int64, md s3Metadata) error {
+	data, err := s.codec.Marshal(values)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      s.key(sid),
+		Body:     bytes.NewReader(data),
+		Metadata: s.metadata(expired, md),
+	})
+	return s3Error("put object", err)
+}
+
+// Copy the session object to sid with a new expiration time, copying it in place extends the expiration time
+func (s *s3Store) copy(ctx context.Context, oldsid, sid string, expired int64, md s3Metadata) error {
+	_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               s.key(sid),
+		CopySource:        aws.String(url.PathEscape(s.bucket + "/" + s.prefix + oldsid)),
+		Metadata:          s.metadata(expired, md),
+		MetadataDirective: types.MetadataDirectiveReplace,
+	})
+	return s3Error("copy object", err)
+}
+
+// A zero creation time is the current time, for a session that is not stored yet
+func (s *s3Store) newSessionStore(ctx context.Context, sid string, expired int64, values map[string]interface{}, md s3Metadata) *s3SessionStore {
+	if md.createdAt.IsZero() {
+		md.createdAt = s.clock()
+	}
+	ss := &s3SessionStore{
+		detachedStore: session.NewDetachedStore(ctx, sid, expired, values, md.version, md.createdAt).(detachedStore),
+		s3:            s,
+		expired:       expired,
+		createdAt:     md.createdAt,
+	}
+	ss.version.Store(md.version)
+	return ss
+}
+
+func (s *s3Store) Check(ctx context.Context, sid string) (bool, error) {
+	_, err := s.head(ctx, sid)
+	if isNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *s3Store) Create(ctx context.Context, sid string, expired int64) (session.Store, error) {
+	expired, err := s.normalizeExpired(expired)
+	if err != nil {
+		return nil, err
+	}
+	return s.newSessionStore(ctx, sid, expired, nil, s3Metadata{}), nil
+}
+
+func (s *s3Store) Update(ctx context.Context, sid string, expired int64) (session.Store, error) {
+	expired, err := s.normalizeExpired(expired)
+	if err != nil {
+		return nil, err
+	}
+	values, md, err := s.load(ctx, sid)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.copy(ctx, sid, sid, expired, md); err != nil {
+		return nil, err
+	}
+	return s.newSessionStore(ctx, sid, expired, values, md), nil
+}
+
+// Loading and creating the session is not atomic, so concurrent requests may both create it
+func (s *s3Store) LoadOrCreate(ctx context.Context, sid string, expired int64) (session.Store, bool, error) {
+	store, err := s.Update(ctx, sid, expired)
+	if isNotFound(err) {
+		store, err = s.Create(ctx, sid, expired)
+		return store, true, err
+	} else if err != nil {
+		return nil, false, err
+	}
+	return store, false, nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, sid string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: s.key(sid)})
+	return s3Error("delete object", err)
+}
+
+// Copy the session object to the new session id and delete the old one,
+// the session is created again under the new session id
+func (s *s3Store) Refresh(ctx context.Context, oldsid, sid string, expired int64) (session.Store, error) {
+	expired, err := s.normalizeExpired(expired)
+	if err != nil {
+		return nil, err
+	}
+	values, md, err := s.get(ctx, oldsid)
+	if isNotFound(err) {
+		return s.newSessionStore(ctx, sid, expired, nil, s3Metadata{}), nil
+	} else if err != nil {
+		return nil, err
+	}
+	md.createdAt = s.clock()
+	if err := s.copy(ctx, oldsid, sid, expired, md); err != nil {
+		return nil, err
+	}
+	if err := s.Delete(ctx, oldsid); err != nil {
+		return nil, err
+	}
+	return s.newSessionStore(ctx, sid, expired, values, md), nil
+}
+
+func (s *s3Store) TimeToLive(ctx context.Context, sid string) (time.Duration, error) {
+	md, err := s.head(ctx, sid)
+	if errors.Is(err, session.ErrSessionExpired) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if md.expiredAt.IsZero() {
+		return session.InfiniteTTL, nil
+	}
+	return md.expiredAt.Sub(s.clock()), nil
+}
+
+// Counts the session objects by listing the bucket, which includes
+// the expired sessions that are not yet removed by a lifecycle rule
+func (s *s3Store) Count(ctx context.Context) (int, error) {
+	var n int
+	p := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return 0, s3Error("list objects", err)
+		}
+		n += len(out.Contents)
+	}
+	return n, nil
+}
+
+func (s *s3Store) Ping(ctx context.Context) error {
+	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	return s3Error("head bucket", err)
+}
+
+// The client is owned by the caller, so there is nothing to release
+func (s *s3Store) Close() error {
+	return nil
+}
+
+// The optional session store interfaces of a session store created with session.NewDetachedStore
+type detachedStore interface {
+	session.Store
+	session.ContextBinder
+	session.ManagedStore
+	session.ValueStore
+	session.TypedStore
+	session.FlashStore
+	session.FlagStore
+	session.ChangeTracker
+	session.VersionedStore
+	session.SessionLocker
+	session.Rotator
+	session.SubStorer
+	session.AgeReporter
+	session.StreamStore
+	fmt.Stringer
+}
+
+// A session store of the S3 storage, saving puts the session object
+type s3SessionStore struct {
+	detachedStore
+	s3        *s3Store
+	expired   int64
+	version   atomic.Uint64
+	createdAt time.Time
+}
+
+func (s *s3SessionStore) Manager() session.ManagerStore {
+	return s.s3
+}
+
+func (s *s3SessionStore) WithContext(ctx context.Context) session.Store {
+	c := &s3SessionStore{detachedStore: s.detachedStore.WithContext(ctx).(detachedStore), s3: s.s3, expired: s.expired, createdAt: s.createdAt}
+	c.version.Store(s.version.Load())
+	return c
+}
+
+func (s *s3SessionStore) Version() uint64 {
+	return s.version.Load()
+}
+
+func (s *s3SessionStore) CreatedAt() time.Time {
+	return s.createdAt
+}
+
+func (s *s3SessionStore) Age() time.Duration {
+	return s.s3.clock().Sub(s.createdAt)
+}
+
+func (s *s3SessionStore) save(version uint64) error {
+	values := session.SessionValues(s.detachedStore)
+
+	md := s3Metadata{createdAt: s.createdAt, version: version + 1}
+	if err := s.s3.put(s.Context(), s.SessionID(), values, s.expired, md); err != nil {
+		return err
+	}
+	s.version.Store(version + 1)
+	session.ClearChanges(s.detachedStore)
+	return nil
+}
+
+// The version of the stored session is read before the save, so the save does not check it
+func (s *s3SessionStore) Save() error {
+	md, err := s.s3.head(s.Context(), s.SessionID())
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return s.save(md.version)
+}
+
+// The session object is always written as a whole
+func (s *s3SessionStore) SaveDirty() error {
+	return s.Save()
+}
+
+// The version is compared to the stored version before the session object is written,
+// so a concurrent save in between is not detected
+func (s *s3SessionStore) SaveIfVersion(expected uint64) error {
+	md, err := s.s3.head(s.Context(), s.SessionID())
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	if md.version != expected {
+		return session.ErrVersionConflict
+	}
+	return s.save(md.version)
+}
+
+func (s *s3SessionStore) SaveReturn() (session.Store, error) {
+	if err := s.Save(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *s3SessionStore) Flush() error {
+	s.detachedStore.DeletePrefix("")
+	return s.Save()
+}
+
+func (s *s3SessionStore) Replace(values map[string]interface{}) error {
+	s.detachedStore.DeletePrefix("")
+	if err := s.detachedStore.SetAll(values); err != nil {
+		return err
+	}
+	return s.Save()
+}
+
+// A session that is not saved yet only changes the id,
+// a moved session is created again under the new id
+func (s *s3SessionStore) Rotate(newsid string) error {
+	oldsid := s.SessionID()
+	md := s3Metadata{createdAt: s.s3.clock(), version: s.Version()}
+	err := s.s3.copy(s.Context(), oldsid, newsid, s.expired, md)
+	if err == nil {
+		if err = s.s3.Delete(s.Context(), oldsid); err == nil {
+			s.createdAt = md.createdAt
+		}
+	} else if isNotFound(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.detachedStore.Rotate(newsid)
+}
+
+func (s *s3SessionStore) SubStore(name string) session.Store {
+	return session.SubStoreOf(s, s.detachedStore.SubStore(name))
+}
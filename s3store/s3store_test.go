@@ -0,0 +1,290 @@
+package s3store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/mbict/session"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeS3Object struct {
+	data     []byte
+	metadata map[string]string
+}
+
+// An in-memory bucket of S3 objects
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string]fakeS3Object
+	// the number of object gets, a get waits for block when it is set
+	gets  int
+	block chan struct{}
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: make(map[string]fakeS3Object)}
+}
+
+func (f *fakeS3) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	if aws.ToString(params.Bucket) != f.bucket {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{Metadata: maps.Clone(obj.metadata)}, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	f.gets++
+	block := f.block
+	f.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{
+		Body:     io.NopCloser(bytes.NewReader(obj.data)),
+		Metadata: maps.Clone(obj.metadata),
+	}, nil
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[aws.ToString(params.Key)] = fakeS3Object{data: data, metadata: params.Metadata}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	source, err := url.PathUnescape(aws.ToString(params.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[strings.TrimPrefix(source, f.bucket+"/")]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	f.objects[aws.ToString(params.Key)] = fakeS3Object{data: obj.data, metadata: params.Metadata}
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &s3.ListObjectsV2Output{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) {
+			out.Contents = append(out.Contents, types.Object{Key: aws.String(key)})
+		}
+	}
+	return out, nil
+}
+
+func TestS3Store(t *testing.T) {
+	client := newFakeS3("sessions")
+	now := time.Now().Truncate(time.Second)
+	mstore := newS3Store(client, "sessions", WithKeyPrefix("app/"), WithCodec(session.JSONCodec))
+	mstore.clock = func() time.Time { return now }
+
+	Convey("Test S3 storage operation", t, func() {
+		ctx := context.Background()
+		So(mstore.Ping(ctx), ShouldBeNil)
+
+		sid := "test_s3_store"
+		store, err := mstore.Create(ctx, sid, 10)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		So(store.Save(), ShouldBeNil)
+		So(store.(session.VersionedStore).Version(), ShouldEqual, 1)
+		So(client.objects, ShouldContainKey, "app/"+sid)
+
+		ok, err := mstore.Check(ctx, sid)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+		n, err := mstore.Count(ctx)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+
+		store, err = mstore.Update(ctx, sid, 20)
+		So(err, ShouldBeNil)
+		foo, _ := store.GetString("foo")
+		So(foo, ShouldEqual, "bar")
+		So(store.(session.VersionedStore).Version(), ShouldEqual, 1)
+		ttl, err := mstore.TimeToLive(ctx, sid)
+		So(err, ShouldBeNil)
+		So(ttl, ShouldEqual, time.Second*20)
+
+		stale, err := mstore.Update(ctx, sid, 20)
+		So(err, ShouldBeNil)
+		So(store.(session.VersionedStore).SaveIfVersion(1), ShouldBeNil)
+		So(stale.(session.VersionedStore).SaveIfVersion(1), ShouldEqual, session.ErrVersionConflict)
+
+		newsid := "test_s3_store_new"
+		store, err = mstore.Refresh(ctx, sid, newsid, 10)
+		So(err, ShouldBeNil)
+		So(store.SessionID(), ShouldEqual, newsid)
+		foo, _ = store.GetString("foo")
+		So(foo, ShouldEqual, "bar")
+		ok, _ = mstore.Check(ctx, sid)
+		So(ok, ShouldBeFalse)
+
+		So(store.(session.Rotator).Rotate(sid), ShouldBeNil)
+		So(store.SessionID(), ShouldEqual, sid)
+		ok, _ = mstore.Check(ctx, newsid)
+		So(ok, ShouldBeFalse)
+
+		now = now.Add(time.Second * 11)
+		ok, err = mstore.Check(ctx, sid)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+		_, err = mstore.Update(ctx, sid, 10)
+		So(err, ShouldEqual, session.ErrSessionExpired)
+		_, created, err := mstore.LoadOrCreate(ctx, sid, 10)
+		So(err, ShouldBeNil)
+		So(created, ShouldBeTrue)
+
+		So(mstore.Delete(ctx, sid), ShouldBeNil)
+		// errors of the client are wrapped, so both the session error and the client error match
+		_, err = mstore.Update(ctx, sid, 10)
+		So(errors.Is(err, session.ErrSessionNotFound), ShouldBeTrue)
+		var nf *types.NoSuchKey
+		So(errors.As(err, &nf), ShouldBeTrue)
+		_, err = mstore.TimeToLive(ctx, sid)
+		So(errors.Is(err, session.ErrSessionNotFound), ShouldBeTrue)
+	})
+}
+
+func TestS3StoreExpiration(t *testing.T) {
+	client := newFakeS3("sessions")
+	now := time.Now().Truncate(time.Second)
+	mstore := newS3Store(client, "sessions", WithDefaultTTL(time.Minute))
+	mstore.clock = func() time.Time { return now }
+
+	Convey("Test S3 storage expiration times", t, func() {
+		ctx := context.Background()
+		sid := "test_s3_expiration"
+
+		// a zero expiration time is the default expiration time
+		store, err := mstore.Create(ctx, sid, 0)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+		ttl, err := mstore.TimeToLive(ctx, sid)
+		So(err, ShouldBeNil)
+		So(ttl, ShouldEqual, time.Minute)
+
+		now = now.Add(time.Second * 30)
+		_, err = mstore.Update(ctx, sid, 0)
+		So(err, ShouldBeNil)
+		ttl, err = mstore.TimeToLive(ctx, sid)
+		So(err, ShouldBeNil)
+		So(ttl, ShouldEqual, time.Minute)
+
+		store, err = mstore.Create(ctx, "test_s3_no_expiry", session.NoExpiry)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+		ttl, err = mstore.TimeToLive(ctx, "test_s3_no_expiry")
+		So(err, ShouldBeNil)
+		So(ttl, ShouldEqual, session.InfiniteTTL)
+
+		// a negative expiration time is rejected
+		_, err = mstore.Create(ctx, sid, -10)
+		So(err, ShouldEqual, session.ErrInvalidTTL)
+		_, err = mstore.Update(ctx, sid, -10)
+		So(err, ShouldEqual, session.ErrInvalidTTL)
+		_, err = mstore.Refresh(ctx, sid, "test_s3_expiration_new", -10)
+		So(err, ShouldEqual, session.ErrInvalidTTL)
+		_, _, err = mstore.LoadOrCreate(ctx, sid, -10)
+		So(err, ShouldEqual, session.ErrInvalidTTL)
+		ok, _ := mstore.Check(ctx, sid)
+		So(ok, ShouldBeTrue)
+	})
+}
+
+func TestS3StoreSharedLoads(t *testing.T) {
+	client := newFakeS3("sessions")
+	mstore := newS3Store(client, "sessions")
+
+	Convey("Test S3 storage concurrent loads share a single request", t, func() {
+		sid := "test_s3_shared_loads"
+		store, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		So(store.Save(), ShouldBeNil)
+
+		release := make(chan struct{})
+		client.mu.Lock()
+		client.block = release
+		client.mu.Unlock()
+
+		// a waiting load returns when its context is done, without canceling the shared request
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+		_, err = mstore.Update(ctx, sid, 10)
+		So(err, ShouldResemble, context.DeadlineExceeded)
+
+		stores := make(chan session.Store, 3)
+		for i := 0; i < 3; i++ {
+			go func() {
+				store, err := mstore.Update(context.Background(), sid, 10)
+				if err != nil {
+					t.Error(err)
+				}
+				stores <- store
+			}()
+		}
+		time.Sleep(time.Millisecond * 50)
+		close(release)
+		first, second := <-stores, <-stores
+		<-stores
+
+		client.mu.Lock()
+		So(client.gets, ShouldEqual, 1)
+		client.mu.Unlock()
+		foo, _ := first.GetString("foo")
+		So(foo, ShouldEqual, "bar")
+		first.Set("foo", "baz")
+		foo, _ = second.GetString("foo")
+		So(foo, ShouldEqual, "bar")
+	})
+}
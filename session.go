@@ -11,14 +11,40 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/bytedance/gopkg/collection/skipmap"
 )
 
 // Version # of session
 const Version = "3.1.4"
 
 var (
-	ErrInvalidSessionID = errors.New("Invalid session id")
+	ErrInvalidSessionID   = errors.New("Invalid session id")
+	ErrSessionNotFound    = errors.New("Session not found")
+	ErrTooManyKeys        = errors.New("Too many keys in session")
+	ErrSessionExists      = errors.New("Session already exists")
+	ErrSessionExpired     = errors.New("Session expired")
+	ErrStoreClosed        = errors.New("Session store closed")
+	ErrInvalidTTL         = errors.New("Invalid session expiration time")
+	ErrTypeMismatch       = errors.New("Session value has the wrong type")
+	ErrKeyNotFound        = errors.New("Session key not found")
+	ErrVersionConflict    = errors.New("Session version conflict")
+	ErrCircuitOpen        = errors.New("Session store circuit open")
+	ErrInvalidCiphertext  = errors.New("Session data can not be decrypted")
+	ErrInvalidCompression = errors.New("Session data can not be decompressed")
+	ErrSessionFrozen      = errors.New("Session is frozen")
+	ErrRateLimited        = errors.New("Too many sessions created")
+	ErrInvalidEnumValue   = errors.New("Session value is not a valid enum value")
+	ErrSessionDeleted     = errors.New("Session deleted")
+	ErrSessionRotated     = errors.New("Session id was rotated")
+	ErrStoreFull          = errors.New("Session store is full")
+	ErrWeakSessionID      = errors.New("Session id is too weak")
+	ErrValueTooLarge      = errors.New("Session value is too large")
+	ErrReservedKey        = errors.New("Session key is reserved")
+	ErrNotSupported       = errors.New("Operation not supported by the session storage")
 )
 
 // Define the handler to get the session id
@@ -52,6 +78,9 @@ type options struct {
 	enableSIDInHTTPHeader   bool
 	sessionNameInHTTPHeader string
 	store                   ManagerStore
+	rollingIDs              bool
+	rollingGrace            time.Duration
+	skipTouchMethods        map[string]struct{}
 }
 
 type Option func(*options)
@@ -149,6 +178,26 @@ func SetStore(store ManagerStore) Option {
 	}
 }
 
+// Rotate the session id on every save (rolling tokens), the old session id
+// remains valid for the grace period to tolerate overlapping requests
+func SetRollingIDs(grace time.Duration) Option {
+	return func(o *options) {
+		o.rollingIDs = true
+		o.rollingGrace = grace
+	}
+}
+
+// Do not extend the session in Middleware for requests with these methods, such as HEAD
+// or GET for read-only requests
+func SetSkipTouchMethods(methods ...string) Option {
+	return func(o *options) {
+		o.skipTouchMethods = make(map[string]struct{}, len(methods))
+		for _, method := range methods {
+			o.skipTouchMethods[method] = struct{}{}
+		}
+	}
+}
+
 // Create a session management instance
 func NewManager(opt ...Option) *Manager {
 	opts := defaultOptions
@@ -163,12 +212,25 @@ func NewManager(opt ...Option) *Manager {
 	if opts.store == nil {
 		opts.store = NewMemoryStore()
 	}
-	return &Manager{opts: &opts}
+	return &Manager{
+		opts:   &opts,
+		rolled: skipmap.NewString(),
+	}
 }
 
 // A session management instance, including start and destroy operations
 type Manager struct {
 	opts *options
+	// the session ids rolled from within the grace period, with the session id they were rolled to
+	rolled *skipmap.StringMap
+	// the unix time in nanoseconds the rolled session ids past their grace period are deleted next
+	rolledSweep atomic.Int64
+}
+
+// The session id a session id was rolled to, until the end of the grace period
+type rolledSID struct {
+	sid   string
+	until time.Time
 }
 
 func (m *Manager) getContext(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
@@ -233,12 +295,63 @@ func (m *Manager) sessionID(r *http.Request) (string, error) {
 	}
 
 	if cookieValue != "" {
-		return m.decodeSessionID(cookieValue)
+		sid, err := m.decodeSessionID(cookieValue)
+		if err != nil {
+			return "", err
+		}
+		return m.rolledSessionID(sid), nil
 	}
 
 	return "", nil
 }
 
+// returns the session id that sid was rolled to, if it is within the grace period,
+// following the session ids it was rolled to in turn since then, until one is seen again
+func (m *Manager) rolledSessionID(sid string) string {
+	now := time.Now()
+	var seen map[string]struct{}
+	for v, ok := m.rolled.Load(sid); ok; v, ok = m.rolled.Load(sid) {
+		rolled := v.(rolledSID)
+		if !rolled.until.After(now) {
+			break
+		}
+		if seen == nil {
+			seen = make(map[string]struct{})
+		}
+		seen[sid] = struct{}{}
+		if _, ok := seen[rolled.sid]; ok {
+			break
+		}
+		sid = rolled.sid
+	}
+	return sid
+}
+
+// Keep the session id rolled from for the grace period, the session ids past their grace period
+// are deleted at most once per grace period
+func (m *Manager) rollSessionID(oldsid, sid string, grace time.Duration) {
+	now := time.Now()
+	m.rolled.Store(oldsid, rolledSID{sid: sid, until: now.Add(grace)})
+
+	next := m.rolledSweep.Load()
+	if now.UnixNano() < next || !m.rolledSweep.CompareAndSwap(next, now.Add(grace).UnixNano()) {
+		return
+	}
+	m.rolled.Range(func(key string, v interface{}) bool {
+		if !v.(rolledSID).until.After(now) {
+			m.rolled.Delete(key)
+		}
+		return true
+	})
+}
+
+func (m *Manager) wrapStore(store Store, w http.ResponseWriter, r *http.Request) Store {
+	if m.opts.rollingIDs {
+		store = &rollingStore{sessionStore: extendStore(store), m: m, w: w, r: r, lock: &rollingLock{}}
+	}
+	return track(r, store)
+}
+
 func (m *Manager) encodeSessionID(sid string) string {
 	b := base64.StdEncoding.EncodeToString([]byte(sid))
 	s := fmt.Sprintf("%s.%s", b, m.signature(sid))
@@ -282,8 +395,7 @@ func (m *Manager) setCookie(sessionID string, w http.ResponseWriter, r *http.Req
 			cookie.Expires = time.Now().Add(time.Duration(v) * time.Second)
 		}
 
-		http.SetCookie(w, cookie)
-		r.AddCookie(cookie)
+		replaceCookie(w, r, cookie)
 	}
 
 	if m.opts.enableSIDInHTTPHeader {
@@ -293,6 +405,32 @@ func (m *Manager) setCookie(sessionID string, w http.ResponseWriter, r *http.Req
 	}
 }
 
+// Set the cookie on the response and the request, replacing the cookie of the same name
+// set earlier, such as by Start before the session id is rolled on save
+func replaceCookie(w http.ResponseWriter, r *http.Request, cookie *http.Cookie) {
+	h := w.Header()
+	var setCookies []string
+	for _, v := range h.Values("Set-Cookie") {
+		if !strings.HasPrefix(v, cookie.Name+"=") {
+			setCookies = append(setCookies, v)
+		}
+	}
+	h.Del("Set-Cookie")
+	for _, v := range setCookies {
+		h.Add("Set-Cookie", v)
+	}
+	http.SetCookie(w, cookie)
+
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != cookie.Name {
+			r.AddCookie(c)
+		}
+	}
+	r.AddCookie(cookie)
+}
+
 // Check will only resume a session, not create it if it doesn't exists
 func (m *Manager) Check(ctx context.Context, w http.ResponseWriter, r *http.Request) (Store, error) {
 	ctx = m.getContext(ctx, w, r)
@@ -303,15 +441,31 @@ func (m *Manager) Check(ctx context.Context, w http.ResponseWriter, r *http.Requ
 	}
 
 	if sid != "" {
-		if exists, err := m.opts.store.Check(ctx, sid); err != nil {
+		if exists, err := m.opts.store.Check(ctx, sid); err != nil && !isRejected(err) {
 			return nil, err
 		} else if exists {
-			return m.opts.store.Update(ctx, sid, m.opts.expired)
+			store, err := m.opts.store.Update(ctx, sid, m.opts.expired)
+			if err == nil {
+				return m.wrapStore(store, w, r), nil
+			} else if !isNotFound(err) && !isRejected(err) {
+				return nil, err
+			}
 		}
 	}
 	return nil, nil
 }
 
+// reports whether err means the session does not exist (anymore)
+func isNotFound(err error) bool {
+	return errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrSessionExpired)
+}
+
+// reports whether err means the storage does not accept the session id of the request,
+// such as a session id that was rotated or is too weak, so a new session is started instead
+func isRejected(err error) bool {
+	return errors.Is(err, ErrSessionRotated) || errors.Is(err, ErrWeakSessionID)
+}
+
 // Start a session and return to session storage
 func (m *Manager) Start(ctx context.Context, w http.ResponseWriter, r *http.Request) (Store, error) {
 	ctx = m.getContext(ctx, w, r)
@@ -322,10 +476,15 @@ func (m *Manager) Start(ctx context.Context, w http.ResponseWriter, r *http.Requ
 	}
 
 	if sid != "" {
-		if exists, err := m.opts.store.Check(ctx, sid); err != nil {
+		if exists, err := m.opts.store.Check(ctx, sid); err != nil && !isRejected(err) {
 			return nil, err
 		} else if exists {
-			return m.opts.store.Update(ctx, sid, m.opts.expired)
+			store, err := m.opts.store.Update(ctx, sid, m.opts.expired)
+			if err == nil {
+				return m.wrapStore(store, w, r), nil
+			} else if !isNotFound(err) && !isRejected(err) {
+				return nil, err
+			}
 		}
 	}
 
@@ -336,28 +495,78 @@ func (m *Manager) Start(ctx context.Context, w http.ResponseWriter, r *http.Requ
 	}
 
 	m.setCookie(store.SessionID(), w, r)
-	return store, nil
+	return m.wrapStore(store, w, r), nil
+}
+
+// Release the session store of Start, Check or Refresh after the request is handled, so the
+// storage can reuse it for another request (when it implements StorePool). The session stores
+// of a decorator storage release the session stores they wrap, releasing a store again is ignored.
+// Within Middleware this is not needed, the session stores that Start, Check and Refresh return
+// for the request are released after the handler returned.
+// The store and any references to it must not be used after it is released.
+func (m *Manager) Release(store Store) {
+	pool, _ := m.opts.store.(StorePool)
+	releaseStore(store, pool)
 }
 
 // Refresh and return session storage
 func (m *Manager) Refresh(ctx context.Context, w http.ResponseWriter, r *http.Request) (Store, error) {
 	ctx = m.getContext(ctx, w, r)
 
-	oldSID, err := m.sessionID(r)
+	oldSID, sid, err := m.refreshSIDs(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	store, err := m.opts.store.Refresh(ctx, oldSID, sid, m.opts.expired)
 	if err != nil {
 		return nil, err
+	}
+
+	m.setCookie(store.SessionID(), w, r)
+	return track(r, store), nil
+}
+
+// RefreshChecked refresh the session like Refresh, refreshed reports whether the session of the request
+// existed and was moved to the new session id, rather than a new empty session was created
+func (m *Manager) RefreshChecked(ctx context.Context, w http.ResponseWriter, r *http.Request) (store Store, refreshed bool, err error) {
+	ctx = m.getContext(ctx, w, r)
+
+	oldSID, sid, err := m.refreshSIDs(ctx, r)
+	if err != nil {
+		return nil, false, err
+	}
+	store, refreshed, err = RefreshChecked(ctx, m.opts.store, oldSID, sid, m.opts.expired)
+	if err != nil {
+		return nil, false, err
+	}
+
+	m.setCookie(store.SessionID(), w, r)
+	return track(r, store), refreshed, nil
+}
+
+// Get the session id of the request to refresh and the new session id
+func (m *Manager) refreshSIDs(ctx context.Context, r *http.Request) (oldSID, sid string, err error) {
+	oldSID, err = m.sessionID(r)
+	if err != nil {
+		return "", "", err
 	} else if oldSID == "" {
 		oldSID = m.opts.sessionID(ctx)
 	}
+	return oldSID, m.opts.sessionID(ctx), nil
+}
 
-	sid := m.opts.sessionID(ctx)
-	store, err := m.opts.store.Refresh(ctx, oldSID, sid, m.opts.expired)
+// Touch extend the lifetime of the session in the storage and of the session cookie
+func (m *Manager) Touch(ctx context.Context, w http.ResponseWriter, r *http.Request, store Store) error {
+	ctx = m.getContext(ctx, w, r)
+
+	touched, err := m.opts.store.Update(ctx, store.SessionID(), m.opts.expired)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	m.Release(touched)
 
 	m.setCookie(store.SessionID(), w, r)
-	return store, nil
+	return nil
 }
 
 // Destroy a session
@@ -391,7 +600,7 @@ func (m *Manager) Destroy(ctx context.Context, w http.ResponseWriter, r *http.Re
 		return nil
 	}
 
-	if exists, err := m.opts.store.Check(ctx, sid); err != nil {
+	if exists, err := m.opts.store.Check(ctx, sid); err != nil && !isRejected(err) {
 		return err
 	} else if !exists {
 		return nil
@@ -404,3 +613,141 @@ func (m *Manager) Destroy(ctx context.Context, w http.ResponseWriter, r *http.Re
 
 	return nil
 }
+
+// A session store that rotates its session id on every save
+type rollingStore struct {
+	sessionStore
+	m    *Manager
+	w    http.ResponseWriter
+	r    *http.Request
+	lock *rollingLock
+}
+
+// The lock of the session held through the rolling store, it moves along with the session id
+type rollingLock struct {
+	mu     sync.Mutex
+	unlock func()
+}
+
+func (s *rollingStore) unwrap() []Store {
+	return []Store{s.sessionStore}
+}
+
+func (s *rollingStore) WithContext(ctx context.Context) Store {
+	return &rollingStore{sessionStore: extendStore(s.sessionStore.WithContext(ctx)), m: s.m, w: s.w, r: s.r, lock: s.lock}
+}
+
+// Lock the session, the session id it is rolled to is locked in its place until unlocked
+func (s *rollingStore) Lock(ctx context.Context) (func(), error) {
+	unlock, err := s.sessionStore.Lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.mu.Lock()
+	s.lock.unlock = unlock
+	s.lock.mu.Unlock()
+	return func() {
+		s.lock.mu.Lock()
+		defer s.lock.mu.Unlock()
+		if s.lock.unlock != nil {
+			s.lock.unlock()
+			s.lock.unlock = nil
+		}
+	}, nil
+}
+
+// The session store is rotated in place so it keeps its transient values and change listeners,
+// a session store that can not rotate is replaced by the session store of the refreshed session
+func (s *rollingStore) roll() error {
+	ctx := s.sessionStore.Context()
+	oldSID := s.sessionStore.SessionID()
+	sid := s.m.opts.sessionID(ctx)
+
+	err := s.sessionStore.Rotate(sid)
+	if err == ErrNotSupported {
+		var store Store
+		if store, err = s.m.opts.store.Refresh(ctx, oldSID, sid, s.m.opts.expired); err == nil {
+			s.sessionStore = extendStore(store)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.relock(ctx); err != nil {
+		return err
+	}
+
+	if grace := s.m.opts.rollingGrace; grace > 0 {
+		s.m.rollSessionID(oldSID, sid, grace)
+	}
+	s.m.setCookie(sid, s.w, s.r)
+	return nil
+}
+
+// Lock the rolled session id when the lock of the old session id is held, then unlock the old one
+func (s *rollingStore) relock(ctx context.Context) error {
+	s.lock.mu.Lock()
+	defer s.lock.mu.Unlock()
+
+	if s.lock.unlock == nil {
+		return nil
+	}
+	unlock, err := s.sessionStore.Lock(ctx)
+	if err != nil {
+		return err
+	}
+	s.lock.unlock()
+	s.lock.unlock = unlock
+	return nil
+}
+
+// Save session data and rotate the session id,
+// must be called before the response header is written
+func (s *rollingStore) Save() error {
+	if err := s.sessionStore.Save(); err != nil {
+		return err
+	}
+	return s.roll()
+}
+
+func (s *rollingStore) SaveDirty() error {
+	if err := s.sessionStore.SaveDirty(); err != nil {
+		return err
+	}
+	return s.roll()
+}
+
+func (s *rollingStore) SaveReturn() (Store, error) {
+	if err := s.Save(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *rollingStore) SaveIfVersion(expected uint64) error {
+	if err := s.sessionStore.SaveIfVersion(expected); err != nil {
+		return err
+	}
+	return s.roll()
+}
+
+// Replace all session data and rotate the session id
+func (s *rollingStore) Replace(values map[string]interface{}) error {
+	if err := s.sessionStore.Replace(values); err != nil {
+		return err
+	}
+	return s.roll()
+}
+
+// Clear all session data and rotate the session id
+func (s *rollingStore) Flush() error {
+	if err := s.sessionStore.Flush(); err != nil {
+		return err
+	}
+	return s.roll()
+}
+
+func (s *rollingStore) SubStore(name string) Store {
+	return subStoreOf(s, s.sessionStore.SubStore(name))
+}
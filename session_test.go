@@ -1,11 +1,13 @@
 package session
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -200,3 +202,451 @@ func TestSessionRefresh(t *testing.T) {
 		So(string(buf), ShouldEqual, "bar:true")
 	})
 }
+
+func TestSessionRollingIDs(t *testing.T) {
+	cookieName := "test_session_rolling"
+
+	manager := NewManager(
+		SetCookieName(cookieName),
+		SetRollingIDs(time.Millisecond*200),
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store, err := manager.Start(r.Context(), w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if r.URL.Query().Get("check") == "1" {
+			foo, ok := store.Get("foo")
+			fmt.Fprintf(w, "%v:%v", foo, ok)
+			return
+		}
+
+		store.Set("foo", "bar")
+		if r.URL.Query().Get("dirty") == "1" {
+			err = store.(ChangeTracker).SaveDirty()
+		} else {
+			err = store.Save()
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	save := func(cookie *http.Cookie, query string) *http.Cookie {
+		req, err := http.NewRequest("GET", ts.URL+query, nil)
+		So(err, ShouldBeNil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		So(err, ShouldBeNil)
+		So(res, ShouldNotBeNil)
+		res.Body.Close()
+		So(res.Cookies(), ShouldHaveLength, 1)
+		So(res.Cookies()[0].Name, ShouldEqual, cookieName)
+		return res.Cookies()[0]
+	}
+
+	check := func(cookie *http.Cookie) string {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s?check=1", ts.URL), nil)
+		So(err, ShouldBeNil)
+		req.AddCookie(cookie)
+
+		res, err := http.DefaultClient.Do(req)
+		So(err, ShouldBeNil)
+		So(res, ShouldNotBeNil)
+
+		buf, err := io.ReadAll(res.Body)
+		So(err, ShouldBeNil)
+		res.Body.Close()
+		return string(buf)
+	}
+
+	Convey("Test session rolling ids", t, func() {
+		oldCookie := save(nil, "")
+		cookie := save(oldCookie, "")
+		So(cookie.Value, ShouldNotEqual, oldCookie.Value)
+
+		So(check(cookie), ShouldEqual, "bar:true")
+		So(check(oldCookie), ShouldEqual, "bar:true")
+
+		time.Sleep(time.Millisecond * 300)
+		So(check(oldCookie), ShouldEqual, "<nil>:false")
+		So(check(cookie), ShouldEqual, "bar:true")
+	})
+
+	Convey("Test session rolling ids follow the ids rolled to in turn", t, func() {
+		first := save(nil, "")
+		second := save(first, "?dirty=1")
+		So(second.Value, ShouldNotEqual, first.Value)
+		third := save(second, "")
+		So(third.Value, ShouldNotEqual, second.Value)
+
+		So(check(first), ShouldEqual, "bar:true")
+		So(check(second), ShouldEqual, "bar:true")
+		So(check(third), ShouldEqual, "bar:true")
+	})
+}
+
+func TestSessionRollingStore(t *testing.T) {
+	mstore := NewMemoryStore()
+	manager := NewManager(
+		SetCookieName("test_session_rolling_store"),
+		SetStore(mstore),
+		SetRollingIDs(time.Minute),
+	)
+
+	Convey("Test session rolling ids keep the state of the session store", t, func() {
+		ctx := context.Background()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		st, err := manager.Start(ctx, w, r)
+		So(err, ShouldBeNil)
+		So(st.Save(), ShouldBeNil)
+
+		var changes []interface{}
+		st.(ChangeTracker).OnChange("foo", func(old, new interface{}) {
+			changes = append(changes, new)
+		})
+		st.(ValueStore).SetTransient("csrf", "abc")
+		unlock, err := st.(SessionLocker).Lock(ctx)
+		So(err, ShouldBeNil)
+
+		oldSID := st.SessionID()
+		st.Set("foo", "bar")
+		So(st.Save(), ShouldBeNil)
+		So(st.SessionID(), ShouldNotEqual, oldSID)
+		csrf, _ := st.GetString("csrf")
+		So(csrf, ShouldEqual, "abc")
+		st.Set("foo", "baz")
+		So(changes, ShouldResemble, []interface{}{"bar", "baz"})
+
+		// the rolled session id is locked in place of the old one
+		lockCtx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+		_, err = mstore.(*memoryStore).lock(lockCtx, st.SessionID())
+		cancel()
+		So(err, ShouldNotBeNil)
+		release, err := mstore.(*memoryStore).lock(ctx, oldSID)
+		So(err, ShouldBeNil)
+		release()
+
+		unlock()
+		release, err = mstore.(*memoryStore).lock(ctx, st.SessionID())
+		So(err, ShouldBeNil)
+		release()
+	})
+
+	Convey("Test session rolling ids that are rolled back to an earlier id", t, func() {
+		manager.rollSessionID("test_rolling_a", "test_rolling_b", time.Minute)
+		manager.rollSessionID("test_rolling_b", "test_rolling_a", time.Minute)
+		So(manager.rolledSessionID("test_rolling_a"), ShouldEqual, "test_rolling_b")
+		So(manager.rolledSessionID("test_rolling_c"), ShouldEqual, "test_rolling_c")
+	})
+
+	Convey("Test session rolling ids past their grace period are deleted", t, func() {
+		manager := NewManager(SetRollingIDs(time.Millisecond * 10))
+		manager.rollSessionID("test_rolling_old", "test_rolling_new", time.Millisecond*10)
+		So(manager.rolledSessionID("test_rolling_old"), ShouldEqual, "test_rolling_new")
+
+		time.Sleep(time.Millisecond * 20)
+		So(manager.rolledSessionID("test_rolling_old"), ShouldEqual, "test_rolling_old")
+		manager.rollSessionID("test_rolling_new", "test_rolling_newer", time.Millisecond*10)
+		So(manager.rolled.Len(), ShouldEqual, 1)
+	})
+}
+
+func TestSessionRelease(t *testing.T) {
+	manager := NewManager(
+		SetCookieName("test_session_release"),
+		SetStore(NewMemoryStore()),
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store, err := manager.Start(r.Context(), w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer manager.Release(store)
+
+		count, _ := store.GetInt("count")
+		store.Set("count", count+1)
+		if err := store.Save(); err != nil {
+			t.Error(err)
+			return
+		}
+		fmt.Fprint(w, count+1)
+	}))
+	defer ts.Close()
+
+	Convey("Test session release of stores after the request", t, func() {
+		res, err := http.Get(ts.URL)
+		So(err, ShouldBeNil)
+		cookie := res.Cookies()[0]
+
+		for i := 2; i <= 3; i++ {
+			req, err := http.NewRequest("GET", ts.URL, nil)
+			So(err, ShouldBeNil)
+			req.AddCookie(cookie)
+			res, err = http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			buf, err := io.ReadAll(res.Body)
+			So(err, ShouldBeNil)
+			So(string(buf), ShouldEqual, fmt.Sprint(i))
+		}
+	})
+}
+
+func TestSessionReleaseDecorated(t *testing.T) {
+	mstore := NewMemoryStore()
+	manager := NewManager(
+		SetCookieName("test_session_release_decorated"),
+		SetStore(NewTimeoutStore(mstore, time.Second)),
+		SetRollingIDs(time.Second),
+	)
+
+	Convey("Test session release of the stores wrapped by decorator storages", t, func() {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		st, err := manager.Start(r.Context(), w, r)
+		So(err, ShouldBeNil)
+		inner := st.(*rollingStore).sessionStore.(*timeoutSessionStore).sessionStore.(*store)
+
+		manager.Release(st)
+		So(inner.released, ShouldBeTrue)
+	})
+}
+
+func TestSessionMiddlewareRelease(t *testing.T) {
+	manager := NewManager(
+		SetCookieName("test_session_middleware_release"),
+	)
+
+	var started []*store
+	handler := manager.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st, _ := FromContext(r.Context())
+		refreshed, err := manager.Refresh(r.Context(), w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		started = []*store{st.(*store), refreshed.(*store)}
+	}))
+
+	Convey("Test session middleware releases the stores started for the request", t, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		So(started, ShouldHaveLength, 2)
+		So(started[0].released, ShouldBeTrue)
+		So(started[1].released, ShouldBeTrue)
+	})
+}
+
+func TestSessionMiddleware(t *testing.T) {
+	cookieName := "test_session_middleware"
+	manager := NewManager(
+		SetCookieName(cookieName),
+		SetSkipTouchMethods(http.MethodHead),
+	)
+
+	handler := manager.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("access") != "1" {
+			fmt.Fprint(w, "ok")
+			return
+		}
+
+		store, ok := FromContext(r.Context())
+		if !ok {
+			t.Error("no session in the context")
+			return
+		}
+		store.Set("foo", "bar")
+		if err := store.Save(); err != nil {
+			t.Error(err)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+
+	serve := func(method, target string, cookie *http.Cookie) *http.Response {
+		req := httptest.NewRequest(method, target, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	Convey("Test session middleware", t, func() {
+		res := serve(http.MethodGet, "/?access=1", nil)
+		So(res.StatusCode, ShouldEqual, http.StatusOK)
+		So(res.Cookies(), ShouldHaveLength, 1)
+		cookie := res.Cookies()[0]
+		So(cookie.Name, ShouldEqual, cookieName)
+
+		// a session that is accessed is touched, which sets the cookie again
+		res = serve(http.MethodGet, "/?access=1", cookie)
+		So(res.Cookies(), ShouldHaveLength, 1)
+		So(res.Cookies()[0].Value, ShouldEqual, cookie.Value)
+
+		res = serve(http.MethodGet, "/", cookie)
+		So(res.Cookies(), ShouldBeEmpty)
+
+		res = serve(http.MethodHead, "/?access=1", cookie)
+		So(res.Cookies(), ShouldBeEmpty)
+	})
+}
+
+func TestSessionMiddlewareTouchError(t *testing.T) {
+	mstore := NewMemoryStore()
+	manager := NewManager(
+		SetCookieName("test_session_middleware_touch_error"),
+		SetStore(mstore),
+	)
+
+	handler := manager.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store, _ := FromContext(r.Context())
+		store.Set("foo", "bar")
+		switch r.URL.Query().Get("fail") {
+		case "deleted":
+			mstore.Delete(r.Context(), store.SessionID())
+		case "closed":
+			mstore.Close()
+		}
+		fmt.Fprint(w, "ok")
+	}))
+
+	serve := func(target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	Convey("Test session middleware fails the request when the session can not be touched", t, func() {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		store, err := manager.Start(r.Context(), w, r)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+		cookie := w.Result().Cookies()[0]
+
+		rec := serve("/?fail=deleted", cookie)
+		So(rec.Code, ShouldEqual, http.StatusOK)
+		So(rec.Body.String(), ShouldEqual, "ok")
+
+		w = httptest.NewRecorder()
+		store, err = manager.Start(r.Context(), w, r)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+		rec = serve("/?fail=closed", w.Result().Cookies()[0])
+		So(rec.Code, ShouldEqual, http.StatusInternalServerError)
+		So(rec.Body.String(), ShouldNotContainSubstring, "ok")
+	})
+}
+
+func TestSessionRefreshChecked(t *testing.T) {
+	cookieName := "test_session_refresh_checked"
+	manager := NewManager(SetCookieName(cookieName))
+
+	Convey("Test session refresh reports whether the session existed", t, func() {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		store, refreshed, err := manager.RefreshChecked(r.Context(), w, r)
+		So(err, ShouldBeNil)
+		So(refreshed, ShouldBeFalse)
+		store.Set("foo", "bar")
+		So(store.Save(), ShouldBeNil)
+
+		sid := store.SessionID()
+		cookie := w.Result().Cookies()[0]
+
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		store, refreshed, err = manager.RefreshChecked(r.Context(), w, r)
+		So(err, ShouldBeNil)
+		So(refreshed, ShouldBeTrue)
+		So(store.SessionID(), ShouldNotEqual, sid)
+		foo, _ := store.GetString("foo")
+		So(foo, ShouldEqual, "bar")
+	})
+}
+
+func TestSessionStartRotatedSessionID(t *testing.T) {
+	cookieName := "test_session_start_rotated"
+	manager := NewManager(
+		SetCookieName(cookieName),
+		SetStore(NewMemoryStore(WithRotatedRetention(time.Minute, 100))),
+	)
+
+	Convey("Test session start with a rotated session id starts a new session", t, func() {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		store, err := manager.Start(r.Context(), w, r)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+		cookie := w.Result().Cookies()[0]
+
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		refreshed, err := manager.Refresh(r.Context(), w, r)
+		So(err, ShouldBeNil)
+
+		// a second tab still sends the old session id
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		checked, err := manager.Check(r.Context(), w, r)
+		So(err, ShouldBeNil)
+		So(checked, ShouldBeNil)
+		started, err := manager.Start(r.Context(), w, r)
+		So(err, ShouldBeNil)
+		So(started.SessionID(), ShouldNotEqual, store.SessionID())
+		So(started.SessionID(), ShouldNotEqual, refreshed.SessionID())
+		So(w.Result().Cookies(), ShouldNotBeEmpty)
+		So(manager.Destroy(r.Context(), httptest.NewRecorder(), r), ShouldBeNil)
+	})
+}
+
+func TestSessionStartWeakSessionID(t *testing.T) {
+	cookieName := "test_session_start_weak"
+	mstore := NewMemoryStore()
+	manager := NewManager(
+		SetCookieName(cookieName),
+		SetStore(mstore),
+		SetSessionID(func(_ context.Context) string { return "weak" }),
+	)
+
+	Convey("Test session start with a weak session id starts a new session once it is rejected", t, func() {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		store, err := manager.Start(r.Context(), w, r)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+		cookie := w.Result().Cookies()[0]
+
+		// the minimum entropy is enabled on the live storage
+		mstore.(*memoryStore).opts.minIDBytes = 16
+		manager.opts.sessionID = func(_ context.Context) string { return newUUID() }
+
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		store, err = manager.Start(r.Context(), w, r)
+		So(err, ShouldBeNil)
+		So(store.SessionID(), ShouldNotEqual, "weak")
+		So(w.Result().Cookies(), ShouldNotBeEmpty)
+	})
+}
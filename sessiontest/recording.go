@@ -0,0 +1,109 @@
+package sessiontest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mbict/session"
+)
+
+var (
+	_ session.ManagerStore = &RecordingStore{}
+	_ session.LoadCreator  = &RecordingStore{}
+	_ session.TTLReporter  = &RecordingStore{}
+	_ session.Counter      = &RecordingStore{}
+	_ session.Pinger       = &RecordingStore{}
+)
+
+// Call is a recorded call of a session storage. SID is the session id of the call,
+// for Refresh the new session id with OldSID the session id it was refreshed from.
+type Call struct {
+	Method  string
+	SID     string
+	OldSID  string
+	Expired int64
+	Err     error
+}
+
+// RecordingStore is a session storage that records the Check, Create, Update, Delete and Refresh
+// calls before delegating them to the wrapped storage, the other calls are delegated only.
+type RecordingStore struct {
+	session.ManagerStore
+	mu    sync.Mutex
+	calls []Call
+}
+
+// NewRecordingStore wraps the session storage, or a new memory store when it is nil
+func NewRecordingStore(inner session.ManagerStore) *RecordingStore {
+	if inner == nil {
+		inner = session.NewMemoryStore()
+	}
+	return &RecordingStore{ManagerStore: inner}
+}
+
+func (s *RecordingStore) record(call Call) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, call)
+}
+
+// Calls returns the recorded calls in the order they returned
+func (s *RecordingStore) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// Reset forgets the recorded calls
+func (s *RecordingStore) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = nil
+}
+
+func (s *RecordingStore) Check(ctx context.Context, sid string) (bool, error) {
+	ok, err := s.ManagerStore.Check(ctx, sid)
+	s.record(Call{Method: "Check", SID: sid, Err: err})
+	return ok, err
+}
+
+func (s *RecordingStore) Create(ctx context.Context, sid string, expired int64) (session.Store, error) {
+	store, err := s.ManagerStore.Create(ctx, sid, expired)
+	s.record(Call{Method: "Create", SID: sid, Expired: expired, Err: err})
+	return store, err
+}
+
+func (s *RecordingStore) Update(ctx context.Context, sid string, expired int64) (session.Store, error) {
+	store, err := s.ManagerStore.Update(ctx, sid, expired)
+	s.record(Call{Method: "Update", SID: sid, Expired: expired, Err: err})
+	return store, err
+}
+
+func (s *RecordingStore) Delete(ctx context.Context, sid string) error {
+	err := s.ManagerStore.Delete(ctx, sid)
+	s.record(Call{Method: "Delete", SID: sid, Err: err})
+	return err
+}
+
+func (s *RecordingStore) Refresh(ctx context.Context, oldsid, sid string, expired int64) (session.Store, error) {
+	store, err := s.ManagerStore.Refresh(ctx, oldsid, sid, expired)
+	s.record(Call{Method: "Refresh", SID: sid, OldSID: oldsid, Expired: expired, Err: err})
+	return store, err
+}
+
+func (s *RecordingStore) LoadOrCreate(ctx context.Context, sid string, expired int64) (session.Store, bool, error) {
+	return session.LoadOrCreate(ctx, s.ManagerStore, sid, expired)
+}
+
+func (s *RecordingStore) TimeToLive(ctx context.Context, sid string) (time.Duration, error) {
+	return session.TimeToLive(ctx, s.ManagerStore, sid)
+}
+
+func (s *RecordingStore) Count(ctx context.Context) (int, error) {
+	return session.Count(ctx, s.ManagerStore)
+}
+
+func (s *RecordingStore) Ping(ctx context.Context) error {
+	return session.Ping(ctx, s.ManagerStore)
+}
@@ -0,0 +1,52 @@
+// Package sessiontest provides helpers for testing code that uses sessions.
+package sessiontest
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mbict/session"
+)
+
+// Clock is a clock for a session storage that runs with the real time,
+// moved ahead by the durations it is advanced
+type Clock struct {
+	offset atomic.Int64
+}
+
+// Now gets the current time of the clock, pass it to session.WithClock
+func (c *Clock) Now() time.Time {
+	return time.Now().Add(time.Duration(c.offset.Load()))
+}
+
+// Advance moves the clock forward
+func (c *Clock) Advance(d time.Duration) {
+	c.offset.Add(int64(d))
+}
+
+// The clocks of the memory stores created by NewMemoryStore
+var clocks sync.Map
+
+// NewMemoryStore creates a memory store with a Clock, so AdvanceClock can move it forward
+func NewMemoryStore(opt ...session.MemoryStoreOption) session.ManagerStore {
+	clock := &Clock{}
+	store := session.NewMemoryStore(append(opt, session.WithClock(clock.Now))...)
+	clocks.Store(store, clock)
+	return store
+}
+
+// AdvanceClock moves the clock of the session storage forward and synchronously
+// runs a gc sweep, so expired sessions are gone without sleeping.
+// It panics when the storage is not created with NewMemoryStore.
+func AdvanceClock(store session.ManagerStore, d time.Duration) {
+	clock, ok := clocks.Load(store)
+	if !ok {
+		panic("sessiontest: session storage is not created with sessiontest.NewMemoryStore")
+	}
+	clock.(*Clock).Advance(d)
+	if _, err := store.(session.ExpiredDeleter).DeleteExpired(context.Background()); err != nil {
+		panic("sessiontest: " + err.Error())
+	}
+}
@@ -0,0 +1,77 @@
+package sessiontest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mbict/session"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAdvanceClock(t *testing.T) {
+	var evicted []string
+	mstore := NewMemoryStore(session.WithoutGC(), session.WithBeforeEvict(func(sid string, _ map[string]interface{}) {
+		evicted = append(evicted, sid)
+	}))
+
+	Convey("Test advancing the clock of a session storage", t, func() {
+		store, err := mstore.Create(context.Background(), "test_advance_clock", 10)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		AdvanceClock(mstore, time.Second*5)
+		ttl, err := session.TimeToLive(context.Background(), mstore, "test_advance_clock")
+		So(err, ShouldBeNil)
+		So(ttl, ShouldBeLessThanOrEqualTo, time.Second*5)
+		So(evicted, ShouldBeEmpty)
+
+		AdvanceClock(mstore, time.Second*5)
+		So(evicted, ShouldResemble, []string{"test_advance_clock"})
+		exists, err := mstore.Check(context.Background(), "test_advance_clock")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+
+		So(func() { AdvanceClock(session.NewTimeoutStore(mstore, time.Second), time.Second) }, ShouldPanic)
+		So(func() { AdvanceClock(session.NewMemoryStore(), time.Second) }, ShouldPanic)
+	})
+}
+
+func TestRecordingStore(t *testing.T) {
+	mstore := NewRecordingStore(nil)
+
+	Convey("Test recording the calls of a session storage", t, func() {
+		ctx := context.Background()
+		store, err := mstore.Create(ctx, "test_recording", 10)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		exists, err := mstore.Check(ctx, "test_recording")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeTrue)
+		_, err = mstore.Update(ctx, "test_recording", 20)
+		So(err, ShouldBeNil)
+		_, err = mstore.Refresh(ctx, "test_recording", "test_recording_new", 30)
+		So(err, ShouldBeNil)
+		So(mstore.Delete(ctx, "test_recording_new"), ShouldBeNil)
+		_, err = mstore.Update(ctx, "test_recording_new", 10)
+		So(err, ShouldEqual, session.ErrSessionNotFound)
+
+		// other calls are delegated without recording
+		n, err := session.Count(ctx, mstore)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 0)
+
+		So(mstore.Calls(), ShouldResemble, []Call{
+			{Method: "Create", SID: "test_recording", Expired: 10},
+			{Method: "Check", SID: "test_recording"},
+			{Method: "Update", SID: "test_recording", Expired: 20},
+			{Method: "Refresh", SID: "test_recording_new", OldSID: "test_recording", Expired: 30},
+			{Method: "Delete", SID: "test_recording_new"},
+			{Method: "Update", SID: "test_recording_new", Expired: 10, Err: session.ErrSessionNotFound},
+		})
+
+		mstore.Reset()
+		So(mstore.Calls(), ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,245 @@
+package session
+
+import (
+	"context"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	_ managerStore = &shardedStore{}
+	_ sessionStore = &shardSessionStore{}
+)
+
+// The default number of points of every shard on the hash ring
+const defaultReplicaCount = 100
+
+// ShardOption configures the sharded store
+type ShardOption func(*shardedStore)
+
+// Set the number of points of every shard on the hash ring, more points spread
+// the sessions more evenly over the shards (defaults to 100)
+func WithReplicaCount(n int) ShardOption {
+	return func(s *shardedStore) {
+		s.replicas = n
+	}
+}
+
+// Create a session storage that spreads the sessions over the shards by consistent hashing of
+// the session id, so adding a shard only moves a fraction of the sessions to the new shard.
+// Shards are identified by their position, so new shards must be added at the end.
+func NewShardedStore(shards []ManagerStore, opts ...ShardOption) ManagerStore {
+	s := &shardedStore{
+		shards:   shards,
+		replicas: defaultReplicaCount,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+
+	for i := range shards {
+		for j := 0; j < s.replicas; j++ {
+			s.ring = append(s.ring, ringPoint{
+				hash:  crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "-" + strconv.Itoa(j))),
+				shard: i,
+			})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool {
+		return s.ring[i].hash < s.ring[j].hash
+	})
+	return s
+}
+
+// A point of a shard on the hash ring
+type ringPoint struct {
+	hash  uint32
+	shard int
+}
+
+type shardedStore struct {
+	shards   []ManagerStore
+	replicas int
+	ring     []ringPoint
+}
+
+// Get the position of the shard of the session, the shard of the first point
+// on the ring after the hash of the session id
+func (s *shardedStore) shardIndex(sid string) int {
+	h := crc32.ChecksumIEEE([]byte(sid))
+	i := sort.Search(len(s.ring), func(i int) bool {
+		return s.ring[i].hash >= h
+	})
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.ring[i].shard
+}
+
+func (s *shardedStore) shard(sid string) ManagerStore {
+	return s.shards[s.shardIndex(sid)]
+}
+
+func (s *shardedStore) wrap(store Store, expired int64) Store {
+	return &shardSessionStore{sessionStore: extendStore(store), ss: s, expired: expired}
+}
+
+func (s *shardedStore) Check(ctx context.Context, sid string) (bool, error) {
+	return s.shard(sid).Check(ctx, sid)
+}
+
+func (s *shardedStore) Create(ctx context.Context, sid string, expired int64) (Store, error) {
+	store, err := s.shard(sid).Create(ctx, sid, expired)
+	if err != nil {
+		return nil, err
+	}
+	return s.wrap(store, expired), nil
+}
+
+func (s *shardedStore) Update(ctx context.Context, sid string, expired int64) (Store, error) {
+	store, err := s.shard(sid).Update(ctx, sid, expired)
+	if err != nil {
+		return nil, err
+	}
+	return s.wrap(store, expired), nil
+}
+
+func (s *shardedStore) LoadOrCreate(ctx context.Context, sid string, expired int64) (Store, bool, error) {
+	store, created, err := LoadOrCreate(ctx, s.shard(sid), sid, expired)
+	if err != nil {
+		return nil, false, err
+	}
+	return s.wrap(store, expired), created, nil
+}
+
+func (s *shardedStore) Delete(ctx context.Context, sid string) error {
+	return s.shard(sid).Delete(ctx, sid)
+}
+
+// A session moved to another shard is saved on the new shard before it is deleted from the old shard
+func (s *shardedStore) Refresh(ctx context.Context, oldsid, sid string, expired int64) (Store, error) {
+	from, to := s.shard(oldsid), s.shard(sid)
+	if s.shardIndex(oldsid) == s.shardIndex(sid) {
+		store, err := to.Refresh(ctx, oldsid, sid, expired)
+		if err != nil {
+			return nil, err
+		}
+		return s.wrap(store, expired), nil
+	}
+
+	old, err := from.Update(ctx, oldsid, expired)
+	if isNotFound(err) {
+		return s.Create(ctx, sid, expired)
+	} else if err != nil {
+		return nil, err
+	}
+	store, err := moveSession(ctx, old, to, sid, expired, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := from.Delete(ctx, oldsid); err != nil {
+		return nil, err
+	}
+	return s.wrap(store, expired), nil
+}
+
+// Copy the session values of the session store to a new session store of the storage, saving it if save is set
+func moveSession(ctx context.Context, old Store, mstore ManagerStore, sid string, expired int64, save bool) (Store, error) {
+	values := sessionValues(old)
+
+	store, err := mstore.Create(ctx, sid, expired)
+	if err != nil {
+		return nil, err
+	}
+	if err := copyValues(store, values); err != nil {
+		return nil, err
+	}
+	if save {
+		if err := store.Save(); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+func (s *shardedStore) TimeToLive(ctx context.Context, sid string) (time.Duration, error) {
+	return TimeToLive(ctx, s.shard(sid), sid)
+}
+
+func (s *shardedStore) Count(ctx context.Context) (int, error) {
+	var n int
+	for _, shard := range s.shards {
+		c, err := Count(ctx, shard)
+		if err != nil {
+			return 0, err
+		}
+		n += c
+	}
+	return n, nil
+}
+
+func (s *shardedStore) Ping(ctx context.Context) error {
+	for _, shard := range s.shards {
+		if err := Ping(ctx, shard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedStore) Close() error {
+	var err error
+	for _, shard := range s.shards {
+		if cerr := shard.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// A session store of a shard, rotating it may move the session to another shard
+type shardSessionStore struct {
+	sessionStore
+	ss      *shardedStore
+	expired int64
+}
+
+func (s *shardSessionStore) Manager() ManagerStore {
+	return s.ss
+}
+
+func (s *shardSessionStore) unwrap() []Store {
+	return []Store{s.sessionStore}
+}
+
+func (s *shardSessionStore) WithContext(ctx context.Context) Store {
+	return &shardSessionStore{sessionStore: extendStore(s.sessionStore.WithContext(ctx)), ss: s.ss, expired: s.expired}
+}
+
+// A session moved to another shard is saved on the new shard, unless it is not saved yet,
+// and the store then uses the session store of the new shard
+func (s *shardSessionStore) Rotate(newsid string) error {
+	from, to := s.ss.shard(s.SessionID()), s.ss.shard(newsid)
+	if s.ss.shardIndex(s.SessionID()) == s.ss.shardIndex(newsid) {
+		return s.sessionStore.Rotate(newsid)
+	}
+
+	saved := s.Version() > 0
+	store, err := moveSession(s.Context(), s.sessionStore, to, newsid, s.expired, saved)
+	if err != nil {
+		return err
+	}
+	if saved {
+		if err := from.Delete(s.Context(), s.SessionID()); err != nil {
+			return err
+		}
+	}
+	s.sessionStore = extendStore(store)
+	return nil
+}
+
+func (s *shardSessionStore) SubStore(name string) Store {
+	return subStoreOf(s, s.sessionStore.SubStore(name))
+}
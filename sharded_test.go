@@ -0,0 +1,85 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Find a session id of the shard
+func shardSID(mstore ManagerStore, shard int, prefix string) string {
+	for i := 0; ; i++ {
+		sid := fmt.Sprintf("%s_%d", prefix, i)
+		if mstore.(*shardedStore).shardIndex(sid) == shard {
+			return sid
+		}
+	}
+}
+
+func TestShardedStore(t *testing.T) {
+	shards := []ManagerStore{NewMemoryStore(), NewMemoryStore(), NewMemoryStore()}
+	mstore := NewShardedStore(shards, WithReplicaCount(50))
+
+	Convey("Test sharded storage routes sessions to shards", t, func() {
+		ctx := context.Background()
+		sid := shardSID(mstore, 1, "test_sharded")
+		store, err := mstore.Create(ctx, sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(ManagedStore).Manager(), ShouldEqual, mstore)
+		store.Set("foo", "bar")
+		So(store.(FlagStore).SetFlag("beta", true), ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		ok, _ := shards[1].Check(ctx, sid)
+		So(ok, ShouldBeTrue)
+		ok, _ = mstore.Check(ctx, sid)
+		So(ok, ShouldBeTrue)
+		n, err := Count(ctx, mstore)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+
+		// refresh to a session id of another shard
+		newsid := shardSID(mstore, 2, "test_sharded_refresh")
+		store, err = mstore.Refresh(ctx, sid, newsid, 10)
+		So(err, ShouldBeNil)
+		foo, _ := store.GetString("foo")
+		So(foo, ShouldEqual, "bar")
+		So(store.(FlagStore).Flag("beta"), ShouldBeTrue)
+		ok, _ = shards[1].Check(ctx, sid)
+		So(ok, ShouldBeFalse)
+		ok, _ = shards[2].Check(ctx, newsid)
+		So(ok, ShouldBeTrue)
+
+		// rotate to a session id of another shard
+		rotated := shardSID(mstore, 0, "test_sharded_rotate")
+		So(store.(Rotator).Rotate(rotated), ShouldBeNil)
+		So(store.SessionID(), ShouldEqual, rotated)
+		store.Set("baz", "qux")
+		So(store.Save(), ShouldBeNil)
+		ok, _ = shards[2].Check(ctx, newsid)
+		So(ok, ShouldBeFalse)
+		store, err = shards[0].Update(ctx, rotated, 10)
+		So(err, ShouldBeNil)
+		So(store.(ValueStore).Keys(), ShouldHaveLength, 2)
+
+		So(mstore.Delete(ctx, rotated), ShouldBeNil)
+		n, _ = Count(ctx, mstore)
+		So(n, ShouldEqual, 0)
+		So(Ping(ctx, mstore), ShouldBeNil)
+	})
+
+	Convey("Test sharded storage remaps a fraction of the sessions when a shard is added", t, func() {
+		more := NewShardedStore(append(shards[:3:3], NewMemoryStore()), WithReplicaCount(50)).(*shardedStore)
+		var moved int
+		for i := 0; i < 1000; i++ {
+			sid := fmt.Sprintf("test_sharded_%d", i)
+			if mstore.(*shardedStore).shardIndex(sid) != more.shardIndex(sid) {
+				moved++
+			}
+		}
+		So(moved, ShouldBeGreaterThan, 100)
+		So(moved, ShouldBeLessThan, 400)
+	})
+}
@@ -0,0 +1,129 @@
+package session
+
+import (
+	"maps"
+	"sort"
+)
+
+// A map that holds a single entry inline and allocates a map once a second key is set. Most
+// sessions change a single key, such as the user id, so tracking their changes does not allocate.
+// The zero value is an empty map.
+type smallMap[V any] struct {
+	key   string
+	value V
+	one   bool
+	m     map[string]V
+}
+
+func (m *smallMap[V]) get(key string) (V, bool) {
+	if m.m != nil {
+		v, ok := m.m[key]
+		return v, ok
+	}
+	if m.one && m.key == key {
+		return m.value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// get the value of the key, the zero value when it is not set
+func (m *smallMap[V]) at(key string) V {
+	v, _ := m.get(key)
+	return v
+}
+
+func (m *smallMap[V]) set(key string, value V) {
+	if m.m != nil {
+		m.m[key] = value
+		return
+	}
+	if !m.one || m.key == key {
+		m.key, m.value, m.one = key, value, true
+		return
+	}
+
+	m.m = make(map[string]V, 2)
+	m.m[m.key] = m.value
+	m.m[key] = value
+	m.clearInline()
+}
+
+func (m *smallMap[V]) delete(key string) {
+	if m.m != nil {
+		delete(m.m, key)
+	} else if m.one && m.key == key {
+		m.clearInline()
+	}
+}
+
+func (m *smallMap[V]) clearInline() {
+	var zero V
+	m.key, m.value, m.one = "", zero, false
+}
+
+// The session values of a session store and of its stored session. A session with a single key
+// holds it inline, so it does not allocate a map. The values are handed between the session store
+// and the stored session by value, so the map of a session with more keys is shared by them.
+type valueMap = smallMap[interface{}]
+
+// Wrap the map, a nil map is an empty map
+func mapOf[V any](m map[string]V) smallMap[V] {
+	return smallMap[V]{m: m}
+}
+
+// Get the entries as a map, the inline entry is copied to a new map
+func (m *smallMap[V]) toMap() map[string]V {
+	if m.m != nil {
+		return m.m
+	}
+	c := make(map[string]V, 1)
+	if m.one {
+		c[m.key] = m.value
+	}
+	return c
+}
+
+// Get a copy that does not share the map
+func (m smallMap[V]) clone() smallMap[V] {
+	if m.m != nil {
+		m.m = maps.Clone(m.m)
+	}
+	return m
+}
+
+// remove all entries, a map that was allocated is kept for reuse
+func (m *smallMap[V]) clear() {
+	clear(m.m)
+	m.clearInline()
+}
+
+func (m *smallMap[V]) len() int {
+	if m.m != nil {
+		return len(m.m)
+	}
+	if m.one {
+		return 1
+	}
+	return 0
+}
+
+func (m *smallMap[V]) each(fn func(key string, value V)) {
+	if m.m != nil {
+		for key, value := range m.m {
+			fn(key, value)
+		}
+	} else if m.one {
+		fn(m.key, m.value)
+	}
+}
+
+// get the sorted keys
+func (m *smallMap[V]) keys() []string {
+	keys := make([]string, 0, m.len())
+	m.each(func(key string, _ V) {
+		keys = append(keys, key)
+	})
+	sort.Strings(keys)
+	return keys
+}
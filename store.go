@@ -1,8 +1,22 @@
 package session
 
 import (
+	"bytes"
+	"container/heap"
 	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bytedance/gopkg/collection/skipmap"
@@ -10,18 +24,35 @@ import (
 )
 
 var (
-	_   ManagerStore = &memoryStore{}
-	_   Store        = &store{}
-	now              = time.Now
+	_ managerStore       = &memoryStore{}
+	_ SessionLister      = &memoryStore{}
+	_ DefaultTTLStore    = &memoryStore{}
+	_ ExpiredDeleter     = &memoryStore{}
+	_ ConditionalDeleter = &memoryStore{}
+	_ ExpiringLister     = &memoryStore{}
+	_ BulkLoader         = &memoryStore{}
+	_ Promoter           = &memoryStore{}
+	_ StorePool          = &memoryStore{}
+	_ ExpirationNotifier = &memoryStore{}
+	_ ExclusiveCreator   = &memoryStore{}
+	_ Dumper             = &memoryStore{}
+	_ Freezer            = &memoryStore{}
+	_ LifetimeReporter   = &memoryStore{}
+	_ RefreshCreator     = &memoryStore{}
+	_ IdleReaper         = &memoryStore{}
+	_ sessionStore       = &store{}
 )
 
 // Management of session storage, including creation, update, and delete operations
 type ManagerStore interface {
 	// Check the session store exists
 	Check(ctx context.Context, sid string) (bool, error)
-	// Create a session store and specify the expiration time (in seconds)
+	// Create a session store and specify the expiration time (in seconds, or NoExpiry), zero is the
+	// default expiration time of the storage and a negative expiration time returns ErrInvalidTTL
 	Create(ctx context.Context, sid string, expired int64) (Store, error)
-	// Update a session store and specify the expiration time (in seconds)
+	// Update a session store and specify the expiration time (in seconds),
+	// returns ErrSessionNotFound or ErrSessionExpired if there is no active session store,
+	// use LoadOrCreate to create it then
 	Update(ctx context.Context, sid string, expired int64) (Store, error)
 	// Delete a session store
 	Delete(ctx context.Context, sid string) error
@@ -31,23 +62,341 @@ type ManagerStore interface {
 	Close() error
 }
 
+// Updating a session store or creating it when there is none, in a single step
+type LoadCreator interface {
+	// Update a session store if it exists or create it otherwise,
+	// the returned bool reports whether the session store was created
+	LoadOrCreate(ctx context.Context, sid string, expired int64) (Store, bool, error)
+}
+
+// LoadOrCreate update the session store of the storage if it exists or create it otherwise, the returned
+// bool reports whether the session store was created. A storage that is not a LoadCreator is updated
+// first, so a session that is created in between is created again.
+func LoadOrCreate(ctx context.Context, mstore ManagerStore, sid string, expired int64) (Store, bool, error) {
+	if lc, ok := mstore.(LoadCreator); ok {
+		return lc.LoadOrCreate(ctx, sid, expired)
+	}
+
+	store, err := mstore.Update(ctx, sid, expired)
+	if isNotFound(err) {
+		store, err = mstore.Create(ctx, sid, expired)
+		return store, err == nil, err
+	} else if err != nil {
+		return nil, false, err
+	}
+	return store, false, nil
+}
+
+// Reporting the remaining lifetime of the sessions
+type TTLReporter interface {
+	// Get the remaining lifetime of a session store (zero or negative when expired,
+	// InfiniteTTL when it never expires)
+	TimeToLive(ctx context.Context, sid string) (time.Duration, error)
+}
+
+// TimeToLive get the remaining lifetime of the session store of the storage,
+// returns ErrNotSupported when the storage is not a TTLReporter
+func TimeToLive(ctx context.Context, mstore ManagerStore, sid string) (time.Duration, error) {
+	if r, ok := mstore.(TTLReporter); ok {
+		return r.TimeToLive(ctx, sid)
+	}
+	return 0, ErrNotSupported
+}
+
+// Counting the stored sessions
+type Counter interface {
+	// Count get the number of stored sessions. A storage that removes expired sessions in the
+	// background may still count the sessions that expired since, see the storage for details
+	Count(ctx context.Context) (int, error)
+}
+
+// Count get the number of sessions stored by the storage,
+// returns ErrNotSupported when the storage is not a Counter
+func Count(ctx context.Context, mstore ManagerStore) (int, error) {
+	if c, ok := mstore.(Counter); ok {
+		return c.Count(ctx)
+	}
+	return 0, ErrNotSupported
+}
+
+// Checking the session storage is reachable
+type Pinger interface {
+	// Ping check the storage is reachable
+	Ping(ctx context.Context) error
+}
+
+// Ping check the storage is reachable, returns ErrNotSupported when the storage is not a Pinger
+func Ping(ctx context.Context, mstore ManagerStore) error {
+	if p, ok := mstore.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return ErrNotSupported
+}
+
+// The storages of this package implement ManagerStore with the optional interfaces that the
+// decorators forward to the storages they decorate
+type managerStore interface {
+	ManagerStore
+	LoadCreator
+	TTLReporter
+	Counter
+	Pinger
+}
+
+// Paging through the active sessions of a session storage
+type SessionLister interface {
+	// List at most limit active session ids in lexicographic order starting after cursor,
+	// nextCursor is empty when there are no more sessions
+	ListSessions(ctx context.Context, cursor string, limit int) (sids []string, nextCursor string, err error)
+}
+
+// Creating and updating session stores with the default expiration time of the storage
+type DefaultTTLStore interface {
+	// Create a session store with the default expiration time
+	CreateDefault(ctx context.Context, sid string) (Store, error)
+	// Update a session store with the default expiration time
+	UpdateDefault(ctx context.Context, sid string) (Store, error)
+}
+
+// Deleting the expired sessions of a session storage on demand
+type ExpiredDeleter interface {
+	// Delete all expired session stores and return the number deleted
+	DeleteExpired(ctx context.Context) (int, error)
+}
+
+// Finding the sessions that expire soon
+type ExpiringLister interface {
+	// ExpiringWithin get the ids of the active sessions that expire within d, ordered by expiration time
+	ExpiringWithin(ctx context.Context, d time.Duration) ([]string, error)
+}
+
+// Deleting the sessions that match a predicate
+type ConditionalDeleter interface {
+	// DeleteWhere delete all sessions for which pred returns true and return the number deleted,
+	// it scans all sessions so it is O(n) in the number of sessions
+	DeleteWhere(ctx context.Context, pred func(sid string, values map[string]interface{}, expiresAt time.Time) bool) (int, error)
+}
+
+// Finding and deleting the sessions that are not accessed for a while, even if they are not expired
+type IdleReaper interface {
+	// IdleSince get the ids of the active sessions that were not accessed within d, least recently accessed first
+	IdleSince(ctx context.Context, d time.Duration) ([]string, error)
+	// ReapIdle delete the active sessions that were not accessed within d and return the number deleted
+	ReapIdle(ctx context.Context, d time.Duration) (int, error)
+}
+
+// Notifying about sessions that are expired or deleted
+type ExpirationNotifier interface {
+	// Expirations get a channel that receives the session id of every expired or deleted session,
+	// the oldest notifications are dropped when the channel is full
+	Expirations() <-chan string
+}
+
+// Creating session stores that must not exist yet
+type ExclusiveCreator interface {
+	// Create a session store, returns ErrSessionExists if an active session store exists
+	CreateExclusive(ctx context.Context, sid string, expired int64) (Store, error)
+}
+
+// Refreshing a session store or creating it when there is none, in a single step
+type RefreshCreator interface {
+	// Move the active session store to the new session id, or create a session store with the new
+	// session id when there is no active session store, refreshed reports whether it was moved.
+	// Moving to the session id of another session returns ErrSessionExists.
+	RefreshOrCreate(ctx context.Context, oldsid, sid string, expired int64) (store Store, refreshed bool, err error)
+}
+
+// RefreshChecked refresh the session of the storage like Refresh, refreshed reports whether the old session
+// existed and its values were moved to the new session id rather than a new empty session was created.
+// A storage that is not a RefreshCreator is checked for the old session first, so a session that
+// expires or is deleted in between is reported as refreshed.
+func RefreshChecked(ctx context.Context, mstore ManagerStore, oldsid, sid string, expired int64) (store Store, refreshed bool, err error) {
+	if rc, ok := mstore.(RefreshCreator); ok {
+		return rc.RefreshOrCreate(ctx, oldsid, sid, expired)
+	}
+
+	exists, err := mstore.Check(ctx, oldsid)
+	if err != nil {
+		return nil, false, err
+	}
+	store, err = mstore.Refresh(ctx, oldsid, sid, expired)
+	if err != nil {
+		return nil, false, err
+	}
+	return store, exists, nil
+}
+
+// Capturing and restoring all sessions of a session storage
+type Dumper interface {
+	// Dump serialize all sessions including their expiration time
+	Dump() ([]byte, error)
+	// Restore the sessions of a dump, expired sessions are skipped
+	Restore(data []byte) error
+}
+
+// SessionData is a session to load in bulk
+type SessionData struct {
+	Values map[string]interface{}
+	// The zero time for the default expiration time of the storage
+	ExpiresAt time.Time
+}
+
+// Loading sessions in bulk, such as when migrating from another session system
+type BulkLoader interface {
+	// BulkLoad store the sessions by session id, replacing existing sessions and skipping expired ones.
+	// The sessions are checked like saved sessions, a session that is rejected fails the load
+	BulkLoad(ctx context.Context, sessions map[string]SessionData) error
+}
+
+// Promoting anonymous sessions to authenticated sessions
+type Promoter interface {
+	// Promote mark the active session as authenticated and set its expiration time,
+	// the session keeps its session id unless a new session id is given
+	Promote(ctx context.Context, sid string, newExpired int64, opt ...PromoteOption) (Store, error)
+}
+
+// PromoteOption configures the promotion of a session
+type PromoteOption func(*promoteOptions)
+
+type promoteOptions struct {
+	newsid string
+}
+
+// Move the promoted session to a new session id, to protect against session fixation
+func WithNewSessionID(newsid string) PromoteOption {
+	return func(o *promoteOptions) {
+		o.newsid = newsid
+	}
+}
+
+// Storage that reuses released session stores, to reduce allocations
+type StorePool interface {
+	// Release return the session store for reuse, it must not be used afterwards
+	Release(store Store)
+}
+
+// Session store of a decorator storage, that wraps the session stores of the storages it decorates
+type storeWrapper interface {
+	// get the wrapped session stores
+	unwrap() []Store
+}
+
+// Release the session store to the pool of its storage, a decorator session store releases the
+// session stores it wraps instead. Session stores of a memory storage return to their own storage,
+// any others to pool when it is not nil.
+func releaseStore(st Store, pool StorePool) {
+	switch s := st.(type) {
+	case *store:
+		s.mstore.Release(s)
+	case storeWrapper:
+		for _, inner := range s.unwrap() {
+			releaseStore(inner, pool)
+		}
+	default:
+		if pool != nil {
+			pool.Release(st)
+		}
+	}
+}
+
+// Session stores with values that can be streamed, such as large blobs. A storage that
+// persists blobs separately can stream them to and from the storage instead of memory.
+type StreamStore interface {
+	// SetStream set session value to the data read from r, call save function to take effect
+	SetStream(key string, r io.Reader) error
+	// GetStream get a reader of session value set by SetStream
+	GetStream(key string) (io.ReadCloser, bool)
+}
+
+// SessionStatus is the state of a stored session
+type SessionStatus int
+
+const (
+	StatusNotFound SessionStatus = iota
+	StatusActive
+	StatusExpired
+	StatusFrozen
+	StatusDeleted
+)
+
+func (s SessionStatus) String() string {
+	switch s {
+	case StatusActive:
+		return "active"
+	case StatusExpired:
+		return "expired"
+	case StatusFrozen:
+		return "frozen"
+	case StatusDeleted:
+		return "deleted"
+	}
+	return "not found"
+}
+
+// Freezing sessions, such as the sessions of a suspended account. A frozen session is
+// treated as not found, but its data is kept and it does not expire until it is unfrozen
+// or deleted. Saving or rotating a frozen session or creating a session with its id fails with ErrSessionFrozen.
+type Freezer interface {
+	// Freeze the active session
+	Freeze(ctx context.Context, sid string) error
+	// Unfreeze the frozen session, it expires after the lifetime it had left when it was frozen
+	Unfreeze(ctx context.Context, sid string) error
+	// Status get the state of the session
+	Status(ctx context.Context, sid string) (SessionStatus, error)
+}
+
+// Reporting how long sessions live before they expire or are deleted
+type LifetimeReporter interface {
+	// LifetimeHistogram get the histogram of the age of the sessions when they were removed
+	LifetimeHistogram() []Bucket
+}
+
+// ChangeOp is the operation of a change of a session value
+type ChangeOp int
+
+const (
+	ChangeCreate ChangeOp = iota
+	ChangeUpdate
+	ChangeDelete
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangeCreate:
+		return "create"
+	case ChangeUpdate:
+		return "update"
+	}
+	return "delete"
+}
+
+// Change is a change of a session value, Old is nil for a created value and New is nil for a deleted value
+type Change struct {
+	Key      string
+	Old, New interface{}
+	Op       ChangeOp
+}
+
 // A session id storage operation
 type Store interface {
 	// Get a session storage context
 	Context() context.Context
 	// Get the current session id
 	SessionID() string
-	// Set session value, call save function to take effect
+	// Set session value, call save function to take effect. A storage may reject the value,
+	// such as the memory storage for a key beyond the maximum number of keys, see SetChecked
 	Set(key string, value interface{})
-	// Get session value
+	// Get session value, the bool reports whether the key is set, also when it is set to nil
 	Get(key string) (interface{}, bool)
-	// GetString get session value as a string
+	// GetString get session value as a string, the typed getters report false for a key that is
+	// not set and for a value of another type, including nil, use Get to tell those apart
 	GetString(key string) (string, bool)
 	// GetInt get session value as a integer
 	GetInt(key string) (int, bool)
 	// GetBool get session value as a boolean
 	GetBool(key string) (bool, bool)
-	// GetUUID get session value as a UUID
+	// GetUUID get session value as a UUID, parsing the string form, the 16 bytes of the UUID
+	// and those bytes base64 encoded (as a JSON storage returns them)
 	GetUUID(key string) (uuid.UUID, bool)
 	// Delete session value, call save function to take effect
 	Delete(key string) interface{}
@@ -57,223 +406,3576 @@ type Store interface {
 	Flush() error
 }
 
-// Create a new session storage (memory)
-func NewMemoryStore() ManagerStore {
-	mstore := &memoryStore{
-		ticker: time.NewTicker(time.Second),
-		data:   skipmap.NewString(),
+// Session stores that can be bound to another context
+type ContextBinder interface {
+	// WithContext return a shallow copy of the session store bound to the context for its
+	// operations, such as the calls of the storage when saving. Like http.Request.WithContext
+	// the session store itself keeps its context, the copy shares its session values.
+	WithContext(ctx context.Context) Store
+}
+
+// Session stores that know the storage they belong to
+type ManagedStore interface {
+	// Get the session storage management the store belongs to
+	Manager() ManagerStore
+}
+
+// Session stores with more ways to set, get and delete session values
+type ValueStore interface {
+	// SetChecked set session value like Set, and return the error when the value is rejected,
+	// such as ErrTooManyKeys, ErrReservedKey or ErrTypeMismatch. Call save function to take effect
+	SetChecked(key string, value interface{}) error
+	// SetIfAbsent set session value only if the key does not exist,
+	// returns true if the value was set
+	SetIfAbsent(key string, value interface{}) (bool, error)
+	// SetAll set multiple session values, either all or none are set
+	SetAll(values map[string]interface{}) error
+	// SetTransient set session value for the lifetime of the session store only, it is not saved
+	// and it is set until it is deleted or set by Set. Saving deletes a stored value of the key.
+	SetTransient(key string, value interface{})
+	// SetWithTTLAndCallback set session value that expires after ttl, onExpire is called with the
+	// key and value when the expired value is deleted, by a get of the key or by the gc
+	SetWithTTLAndCallback(key string, value interface{}, ttl time.Duration, onExpire func(key string, value interface{})) error
+	// SetUUID set session value as a UUID in its canonical string form, which every codec keeps as it is
+	SetUUID(key string, id uuid.UUID) error
+	// GetAny get session value, nil if the key is not set
+	GetAny(key string) interface{}
+	// GetFirst get the session value of the first key that is set
+	GetFirst(keys ...string) (interface{}, bool)
+	// GetMany get the session values of the keys that are set, read at the same point in time
+	GetMany(keys ...string) map[string]interface{}
+	// GetInto store the session value in the value pointed to by dst, a generic map or
+	// JSON bytes (as read from a serializing storage) are decoded into dst as JSON.
+	// A nil value sets dst to its zero value, a key that is not set returns ErrKeyNotFound.
+	GetInto(key string, dst interface{}) error
+	// Keys get the keys of all session values
+	Keys() []string
+	// DeletePrefix delete all session values whose key starts with prefix and return the number deleted,
+	// call save function to take effect
+	DeletePrefix(prefix string) int
+	// Pop get and delete session value atomically, call save function to take effect
+	Pop(key string) (interface{}, bool)
+	// Replace all session values with a copy of values and save the session
+	Replace(values map[string]interface{}) error
+}
+
+// Session stores with values that keep their type in serializing storages
+type TypedStore interface {
+	// SetTyped set session value tagged with the name of its type, so GetTyped and the typed getters
+	// get the value of the same type after a serializing storage changed it (such as an int to a
+	// float64 by JSON). The tag adds the type name and two keys to the stored size of the value.
+	SetTyped(key string, value interface{}) error
+	// GetTyped get session value, a value set by SetTyped is converted back to its type
+	GetTyped(key string) (interface{}, bool)
+}
+
+// Session stores with flash messages, which are read once
+type FlashStore interface {
+	// AddFlash add a flash message with an optional category, call save function to take effect
+	AddFlash(message string, categories ...string) error
+	// Flashes get and clear the flash messages of the categories (all if none given)
+	Flashes(categories ...string) []string
+}
+
+// Session stores with feature flags
+type FlagStore interface {
+	// SetFlag turn the feature flag of the session on or off, call save function to take effect
+	SetFlag(name string, on bool) error
+	// Flag reports whether the feature flag of the session is on
+	Flag(name string) bool
+	// Flags get the feature flags of the session that are on
+	Flags() map[string]bool
+}
+
+// Session stores that track the changes of the session values
+type ChangeTracker interface {
+	// Changes get the changes of the session values made by this session store since it was loaded
+	// or last saved, sorted by key. Setting a value that is deleted again is not a change.
+	Changes() []Change
+	// Dirty reports whether session values were changed since the session was loaded or last saved
+	Dirty() bool
+	// SaveDirty save only the session values changed since the last save
+	// (storages without partial writes save all session data)
+	SaveDirty() error
+	// OnChange register a callback invoked when the value of the key is changed through this store,
+	// such as by Set or Delete, with the old and new value (nil when absent). It is called
+	// after the change once the store is unlocked, and the callbacks are not persisted.
+	OnChange(key string, fn func(old, new interface{}))
+}
+
+// Session stores with the version of the stored session, for optimistic locking
+type VersionedStore interface {
+	// Version get the version of the session when it was loaded or last saved by this store,
+	// the version increases on every save and is 0 for a session that is not saved yet
+	Version() uint64
+	// SaveIfVersion save the session only if the stored version still equals expected,
+	// otherwise it returns ErrVersionConflict
+	SaveIfVersion(expected uint64) error
+	// SaveReturn save session data and return a store with the session data as it is stored,
+	// including changes made while saving such as by save hooks
+	SaveReturn() (Store, error)
+}
+
+// Session stores with a lock of the session
+type SessionLocker interface {
+	// Lock acquire the lock of the session, held by at most one session store at a time,
+	// until unlock is called. It returns the context error when the context is done first.
+	// The lock does not block the other operations of the session stores.
+	Lock(ctx context.Context) (unlock func(), err error)
+}
+
+// Session stores that can move their session to a new session id
+type Rotator interface {
+	// Rotate move the session to a new session id, the store then uses the new session id.
+	// It returns ErrSessionExists when there is a session with the new session id.
+	Rotate(newsid string) error
+}
+
+// Session stores with views of nested session values
+type SubStorer interface {
+	// SubStore get a view of the session values stored in a nested map under the key name,
+	// the nested map is created by the first change. Saving the view saves the session.
+	// Changing the view returns ErrTypeMismatch when a value on its path is not a nested map.
+	SubStore(name string) Store
+}
+
+// Session stores that know when their session was created
+type AgeReporter interface {
+	// CreatedAt get the time the session was created, a session moved to a new session id
+	// by Refresh or Rotate is created again
+	CreatedAt() time.Time
+	// Age get the time since the session was created
+	Age() time.Duration
+}
+
+// The session stores of this package implement Store with all the optional session store
+// interfaces, and the decorators forward them to the session stores they wrap. String gets
+// a representation of the session for logging, with the secrets redacted.
+type sessionStore interface {
+	Store
+	ContextBinder
+	ManagedStore
+	ValueStore
+	TypedStore
+	FlashStore
+	FlagStore
+	ChangeTracker
+	VersionedStore
+	SessionLocker
+	Rotator
+	SubStorer
+	AgeReporter
+	StreamStore
+	fmt.Stringer
+}
+
+// Logger used by the memory store to report unexpected errors
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type memoryOptions struct {
+	logger      Logger
+	maxKeys     int
+	defaultTTL  time.Duration
+	sortedKeys  bool
+	beforeEvict func(sid string, values map[string]interface{})
+	disableGC   bool
+	maxUserSIDs int
+	userKey     string
+	codec       Codec
+	saveHooks   []func(sid string, values map[string]interface{}) error
+	slidingKeys map[string]struct{}
+	maxTTL      time.Duration
+	keySchema   map[string]reflect.Kind
+	clock       func() time.Time
+	copyOnGet   bool
+	redactKeys  map[string]struct{}
+	showSID     bool
+	ignoreCase  bool
+	mergeOnSave bool
+
+	refreshThreshold time.Duration
+	onNearExpiry     func(s Store)
+	loadValidator    func(values map[string]interface{}) error
+	concurrentValues bool
+	gcWorkers        int
+	setValidation    bool
+	createLimit      *createLimit
+	enums            map[string][]interface{}
+	internStrings    bool
+	internKeys       map[string]struct{}
+	tombstoneWindow  time.Duration
+	rotatedWindow    time.Duration
+	maxRotated       int
+	maxSessions      int
+	fullPolicy       RejectOrEvict
+	stickyFlags      map[string]struct{}
+	closeTimeout     time.Duration
+	minIDBytes       int
+	maxValueBytes    int
+}
+
+// MemoryStoreOption configures the memory store
+type MemoryStoreOption func(*memoryOptions)
+
+// Set the logger for reporting errors (defaults to the standard logger)
+func WithLogger(logger Logger) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.logger = logger
 	}
+}
 
-	go mstore.gc()
-	return mstore
+// Set the maximum number of keys per session (unlimited by default)
+func WithMaxKeys(n int) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.maxKeys = n
+	}
 }
 
-type dataItem struct {
-	sid       string
-	expiredAt time.Time
-	values    map[string]interface{}
+// Set the expiration time used by CreateDefault and UpdateDefault, and for a zero expiration time
+// (defaults to the session expiration time of the manager)
+func WithDefaultTTL(d time.Duration) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.defaultTTL = d
+	}
 }
 
-func newDataItem(sid string, values map[string]interface{}, expired int64) *dataItem {
-	return &dataItem{
-		sid:       sid,
-		expiredAt: now().Add(time.Duration(expired) * time.Second),
-		values:    values,
+// Return the session keys in lexicographic order (unspecified order by default)
+func WithSortedKeys() MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.sortedKeys = true
 	}
 }
 
-type memoryStore struct {
-	ticker *time.Ticker
-	data   *skipmap.StringMap
+// Set a callback invoked when a session is evicted, because it expired or to make room for another
+// session, with its final values. It runs just before the session is deleted, while it still exists,
+// on the goroutine that evicts it: the gc or a request that found the session expired or needed room.
+// It is called without the lock of the session so it may use the store, but should return quickly.
+// A session saved while the callback runs is not evicted.
+func WithBeforeEvict(fn func(sid string, values map[string]interface{})) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.beforeEvict = fn
+	}
 }
 
-func (s *memoryStore) gc() {
-	for range s.ticker.C {
-		s.data.Range(func(key string, value interface{}) bool {
-			if item, ok := value.(*dataItem); ok && item.expiredAt.Before(now()) {
-				s.data.Delete(key)
-			}
-			return true
-		})
+// Do not start the background gc, expired sessions are then only removed
+// when they are accessed or by calling DeleteExpired
+func WithoutGC() MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.disableGC = true
 	}
 }
 
-func (s *memoryStore) save(sid string, values map[string]interface{}, expired int64) {
-	if dt, ok := s.data.Load(sid); ok {
-		dt.(*dataItem).values = values
-		return
+// Set the maximum number of sessions per user, identified by the session value of userKey,
+// the oldest session of a user is evicted when a save exceeds the maximum
+func WithMaxSessionsPerUser(n int, userKey string) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.maxUserSIDs = n
+		o.userKey = userKey
 	}
+}
 
-	s.data.Store(sid, newDataItem(sid, values, expired))
+// Serialize session values with the codec on save, so the memory store
+// behaves like a storage that persists serialized data
+func WithCodec(codec Codec) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.codec = codec
+	}
 }
 
-func (s *memoryStore) Check(ctx context.Context, sid string) (bool, error) {
-	dt, ok := s.data.Load(sid)
-	if !ok {
-		return false, nil
+// Add a hook that runs before session values are saved, it may modify the values
+// and a non-nil error aborts the save. Hooks run in the order they are added.
+func WithSaveHook(fn func(sid string, values map[string]interface{}) error) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.saveHooks = append(o.saveHooks, fn)
 	}
+}
 
-	if item, ok := dt.(*dataItem); ok && item.expiredAt.After(now()) {
-		return true, nil
+// Extend the session expiration time whenever one of the keys is read
+func WithSlidingOnGet(keys ...string) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		if o.slidingKeys == nil {
+			o.slidingKeys = make(map[string]struct{})
+		}
+		for _, key := range keys {
+			o.slidingKeys[key] = struct{}{}
+		}
 	}
-	return false, nil
 }
 
-func (s *memoryStore) Create(ctx context.Context, sid string, expired int64) (Store, error) {
-	return newStore(ctx, s, sid, expired, nil), nil
+// Set the maximum expiration time, longer expiration times are clamped to it
+func WithMaxTTL(d time.Duration) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.maxTTL = d
+	}
 }
 
-func (s *memoryStore) Update(ctx context.Context, sid string, expired int64) (Store, error) {
-	dt, ok := s.data.Load(sid)
-	if !ok {
-		return newStore(ctx, s, sid, expired, nil), nil
+// Validate the kind of the values set for the keys in the schema, Set returns
+// ErrTypeMismatch when it does not match. Keys not in the schema are unrestricted.
+func WithKeySchema(schema map[string]reflect.Kind) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.keySchema = schema
 	}
+}
 
-	item := dt.(*dataItem)
-	item.expiredAt = now().Add(time.Duration(expired) * time.Second)
-	s.data.Store(sid, item)
-	return newStore(ctx, s, sid, expired, item.values), nil
+// Set the valid values of the key, setting another value returns ErrInvalidEnumValue.
+// The values are compared to the values set to the key of the session, not of a sub store.
+func WithEnum(key string, valid ...interface{}) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		if o.enums == nil {
+			o.enums = make(map[string][]interface{})
+		}
+		o.enums[key] = valid
+	}
 }
 
-func (s *memoryStore) delete(sid string) {
-	s.data.Delete(sid)
+// Share equal string values set to sessions, so many sessions with the same role or tenant
+// id keep a single copy of the string. Only the values of the keys are shared when keys are
+// given, and only strings up to 64 bytes. The table holds up to 4096 strings, when it is full
+// a string is evicted for a new string.
+//
+// In BenchmarkStringInterning of 100k sessions with two 32 byte strings out of 100 distinct
+// values each, the 6.4MB of string copies shrink to the 200 distinct strings, which saves 64
+// of the 1400 bytes per session. With unique strings the table saves nothing and costs 3 bytes
+// per session, and the lookups make setting them about a quarter slower.
+func WithStringInterning(keys ...string) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.internStrings = true
+		if len(keys) > 0 && o.internKeys == nil {
+			o.internKeys = make(map[string]struct{})
+		}
+		for _, key := range keys {
+			o.internKeys[key] = struct{}{}
+		}
+	}
 }
 
-func (s *memoryStore) Delete(_ context.Context, sid string) error {
-	s.delete(sid)
-	return nil
+// Keep a tombstone of a deleted session for the window, so the deletion can be propagated
+// to replicas. Saving or loading a session with the id of a tombstone returns ErrSessionDeleted,
+// which prevents a stale copy of the session from being stored again during the window.
+// Status reports StatusDeleted for a tombstone, the gc removes the tombstone after the window.
+func WithTombstones(window time.Duration) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.tombstoneWindow = window
+	}
 }
 
-func (s *memoryStore) Refresh(ctx context.Context, oldsid, sid string, expired int64) (Store, error) {
-	dt, ok := s.data.Load(oldsid)
-	if !ok {
-		return newStore(ctx, s, sid, expired, nil), nil
+// RejectOrEvict is what the memory store does with a new session when the maximum number of sessions is reached
+type RejectOrEvict int
+
+const (
+	// RejectNewSessions rejects new sessions with ErrStoreFull, the stored sessions are kept
+	RejectNewSessions RejectOrEvict = iota
+	// EvictLeastRecentlyUsed evicts the session that was accessed the longest ago
+	EvictLeastRecentlyUsed
+)
+
+// Set the maximum number of sessions of the whole storage, the policy decides whether a new session
+// is rejected or the least recently used session is evicted when the maximum is reached. Create
+// rejects new sessions as soon as the maximum is reached, with eviction the session is evicted when a
+// new session is stored. A new session reserves its slot before it is stored, so concurrent saves
+// never exceed the maximum. Expired sessions that are not evicted yet are swept to make room, at most
+// once a second, before a new session is rejected. The sessions are kept in the order of their access
+// for eviction, which takes constant time, frozen sessions are never evicted.
+func WithGlobalMaxSessions(n int, policy RejectOrEvict) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.maxSessions = n
+		o.fullPolicy = policy
 	}
+}
 
-	item := dt.(*dataItem)
-	newItem := newDataItem(sid, item.values, expired)
-	s.data.Store(sid, newItem)
-	s.delete(oldsid)
-	return newStore(ctx, s, sid, expired, newItem.values), nil
+// Retain the session ids that were refreshed away by Refresh or Rotate for the window, Check and
+// Update reject a retained session id with ErrSessionRotated, so a leaked session id can not be
+// replayed right after it was rotated, the Manager then starts a new session for the request. At most
+// max session ids are retained, when full the session id with the earliest end of its window is dropped.
+// The gc removes the session ids after the window.
+func WithRotatedRetention(window time.Duration, max int) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.rotatedWindow = window
+		o.maxRotated = max
+	}
 }
 
-func (s *memoryStore) Close() error {
-	s.ticker.Stop()
-	return nil
+// Keep the feature flags with the names when the session is flushed
+func WithStickyFlags(names ...string) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		if o.stickyFlags == nil {
+			o.stickyFlags = make(map[string]struct{})
+		}
+		for _, name := range names {
+			o.stickyFlags[name] = struct{}{}
+		}
+	}
 }
 
-func newStore(ctx context.Context, mstore *memoryStore, sid string, expired int64, values map[string]interface{}) *store {
-	if values == nil {
-		values = make(map[string]interface{})
+// Set the maximum time Close waits for the saves, deletes and refreshes in progress to complete
+// before the storage is closed (defaults to 5 seconds)
+func WithCloseTimeout(d time.Duration) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.closeTimeout = d
 	}
+}
 
-	return &store{
-		mstore:  mstore,
-		ctx:     ctx,
-		sid:     sid,
-		expired: expired,
-		values:  values,
+// Reject session ids that decode to less than n bytes, or that mostly repeat a single character,
+// with ErrWeakSessionID from Check, Create, Update, LoadOrCreate, Refresh and Rotate. The Manager
+// starts a new session for a request with a weak session id, so existing sessions with weak session
+// ids are replaced when it is enabled. Hex session ids (including UUIDs) and base64 session ids are
+// decoded, other session ids count as they are.
+func WithMinIDEntropy(n int) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.minIDBytes = n
 	}
 }
 
-type store struct {
-	sync.RWMutex
-	mstore  *memoryStore
-	ctx     context.Context
-	sid     string
-	expired int64
-	values  map[string]interface{}
+// Set the clock used for session expiration times (defaults to time.Now)
+func WithClock(clock func() time.Time) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.clock = clock
+	}
 }
 
-func (s *store) Context() context.Context {
-	return s.ctx
+// Return a deep copy of the session values from Get and the typed getters, so
+// changing a returned slice or map does not change the session (values are shared by default)
+func WithCopyOnGet() MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.copyOnGet = true
+	}
 }
 
-func (s *store) SessionID() string {
-	return s.sid
+// Replace the values of the keys with "***" in the string representation of a session
+func WithRedactedKeys(keys ...string) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		if o.redactKeys == nil {
+			o.redactKeys = make(map[string]struct{})
+		}
+		for _, key := range keys {
+			o.redactKeys[key] = struct{}{}
+		}
+	}
 }
 
-func (s *store) Set(key string, value interface{}) {
-	s.Lock()
-	s.values[key] = value
-	s.Unlock()
+// Show the session id in the string representation of a session,
+// it is redacted by default since the session id is a secret
+func WithShowSID() MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.showSID = true
+	}
 }
 
-func (s *store) Get(key string) (interface{}, bool) {
-	s.RLock()
-	val, ok := s.values[key]
-	s.RUnlock()
-	return val, ok
+// Match session keys case-insensitively by converting them to lower case,
+// so Keys returns the lower case keys (keys are case-sensitive by default)
+func WithCaseInsensitiveKeys() MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.ignoreCase = true
+	}
 }
 
-func (s *store) GetString(key string) (string, bool) {
-	if v, ok := s.Get(key); ok {
-		str, ok := v.(string)
-		return str, ok
+// Merge the changed session values into the stored session values on save, instead of
+// replacing them, so concurrent requests changing different keys do not lose updates.
+// Every store then holds its own copy of the session values.
+func WithMergeOnSave() MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.mergeOnSave = true
 	}
-	return "", false
 }
 
-func (s *store) GetBool(key string) (bool, bool) {
-	if v, ok := s.Get(key); ok {
-		b, ok := v.(bool)
-		return b, ok
+// Call onNearExpiry with the loaded session when Update finds that the session expires within d,
+// it is called before Update returns so it can extend the session such as by saving it
+func WithRefreshThreshold(d time.Duration, onNearExpiry func(s Store)) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.refreshThreshold = d
+		o.onNearExpiry = onNearExpiry
 	}
-	return false, false
 }
 
-func (s *store) GetInt(key string) (int, bool) {
-	if v, ok := s.Get(key); ok {
-		i, ok := v.(int)
-		return i, ok
+// Validate the session values loaded by Update, a session with invalid values is treated as not found
+func WithLoadValidator(fn func(values map[string]interface{}) error) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.loadValidator = fn
 	}
-	return 0, false
 }
 
-func (s *store) GetUUID(key string) (uuid.UUID, bool) {
-	if v, ok := s.Get(key); ok {
-		switch t := v.(type) {
-		case uuid.UUID:
-			return t, true
-		case string:
-			if id, err := uuid.Parse(t); err == nil {
-				return id, true
-			}
-		case []byte:
-			if id, err := uuid.FromBytes(t); err == nil {
-				return id, true
-			}
-		}
+// Keep a copy of the session values in a sync.Map, so Get does not lock the session store.
+// It suits sessions that are read by many goroutines at once, at the cost of slower changes.
+func WithConcurrentValues() MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.concurrentValues = true
 	}
-	return uuid.Nil, false
 }
 
-func (s *store) Delete(key string) interface{} {
-	s.RLock()
-	v, ok := s.values[key]
-	s.RUnlock()
+// Sweep the expired sessions with n goroutines, for stores with so many sessions that a
+// single goroutine falls behind. The callback of WithBeforeEvict is then called concurrently.
+func WithGCWorkers(n int) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.gcWorkers = n
+	}
+}
 
-	if ok {
-		s.Lock()
-		delete(s.values, key)
-		s.Unlock()
+// Reject a value that takes more than n bytes serialized with its key by the codec with ErrValueTooLarge,
+// leaving the session unchanged. Booleans and numbers are not checked, and without a codec set by
+// WithCodec no values are checked.
+func WithMaxValueBytes(n int) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.maxValueBytes = n
 	}
-	return v
 }
 
-func (s *store) Flush() error {
-	s.Lock()
-	s.values = make(map[string]interface{})
-	s.Unlock()
+// Check that the codec can serialize the values when they are set, so Set returns the error
+// of the codec rather than Save. It serializes every value that is set, so it is costly.
+// Without a codec set by WithCodec the values are not checked.
+func WithSetValidation() MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.setValidation = true
+	}
+}
 
-	return s.Save()
+// Limit the sessions created with the same key, such as the client IP, to limit sessions per window.
+// Create returns ErrRateLimited when the limit is exceeded. The key is read from the context of
+// Create by keyFn, sessions created with an empty key are not limited.
+func WithCreateRateLimit(keyFn func(ctx context.Context) string, limit int, window time.Duration) MemoryStoreOption {
+	return func(o *memoryOptions) {
+		o.createLimit = &createLimit{keyFn: keyFn, limit: limit, window: window}
+	}
 }
 
-func (s *store) Save() error {
-	s.RLock()
-	values := s.values
-	s.RUnlock()
+// convert the keys of the map to lower case
+func lowerKeys[V any](m map[string]V) map[string]V {
+	if m == nil {
+		return nil
+	}
+	lower := make(map[string]V, len(m))
+	for key, v := range m {
+		lower[strings.ToLower(key)] = v
+	}
+	return lower
+}
 
-	s.mstore.save(s.sid, values, s.expired)
-	return nil
+// Create a new session storage (memory)
+func NewMemoryStore(opt ...MemoryStoreOption) ManagerStore {
+	opts := memoryOptions{
+		logger:       log.Default(),
+		clock:        time.Now,
+		defaultTTL:   time.Duration(defaultOptions.expired) * time.Second,
+		closeTimeout: defaultCloseTimeout,
+	}
+	for _, o := range opt {
+		o(&opts)
+	}
+	if opts.ignoreCase {
+		opts.userKey = strings.ToLower(opts.userKey)
+		opts.slidingKeys = lowerKeys(opts.slidingKeys)
+		opts.internKeys = lowerKeys(opts.internKeys)
+		opts.keySchema = lowerKeys(opts.keySchema)
+		opts.redactKeys = lowerKeys(opts.redactKeys)
+		opts.enums = lowerKeys(opts.enums)
+	}
+
+	mstore := &memoryStore{
+		opts:        &opts,
+		data:        skipmap.NewString(),
+		expirations: make(chan string, expirationsSize),
+		users:       make(map[string][]string),
+		drained:     make(chan struct{}),
+	}
+	if opts.createLimit != nil {
+		mstore.limiter = newRateLimiter(*opts.createLimit)
+	}
+	if opts.maxSessions > 0 && opts.fullPolicy == EvictLeastRecentlyUsed {
+		mstore.lru = newLRUQueue(mstore.lruLive)
+	}
+	if opts.internStrings {
+		mstore.interned = newInternTable(internTableSize)
+	}
+	if opts.tombstoneWindow > 0 {
+		mstore.tombstones = skipmap.NewString()
+	}
+	if opts.rotatedWindow > 0 && opts.maxRotated > 0 {
+		mstore.rotated = skipmap.NewString()
+	}
+
+	if !opts.disableGC {
+		mstore.ticker = time.NewTicker(time.Second)
+		mstore.stop = make(chan struct{})
+		go mstore.gc()
+	}
+	return mstore
+}
+
+type dataItem struct {
+	sync.Mutex
+	sid       string
+	createdAt time.Time
+	expiredAt time.Time
+	values    valueMap
+	removed   bool
+	version   uint64
+	frozen    bool
+	// the remaining lifetime of a frozen session, zero if it never expires
+	frozenTTL time.Duration
+	// the unix time in nanoseconds the session was last loaded, saved or accessed by a get or set
+	lastAccessedAt atomic.Int64
+	// whether there are session values with a TTL, the values are then not shared with session stores
+	expiring bool
+}
+
+// NoExpiry is the expiration time of a session that never expires, such sessions
+// are never collected by the gc and remain in memory until they are deleted
+const NoExpiry int64 = -1
+
+// InfiniteTTL is the time to live of a session that never expires
+const InfiniteTTL time.Duration = math.MaxInt64
+
+// Get the expiration time of a session that expires in expired seconds,
+// the zero time for a session that never expires
+func expiresAt(now time.Time, expired int64) time.Time {
+	if expired == NoExpiry {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(expired) * time.Second)
+}
+
+// reports whether the expiration time has passed
+func isExpired(now, expiredAt time.Time) bool {
+	return !expiredAt.IsZero() && !expiredAt.After(now)
+}
+
+func (s *memoryStore) newDataItem(sid string, values valueMap, expired int64) *dataItem {
+	now := s.now()
+	item := &dataItem{
+		sid:       sid,
+		createdAt: now,
+		expiredAt: expiresAt(now, expired),
+		values:    values,
+	}
+	item.lastAccessedAt.Store(now.UnixNano())
+	return item
+}
+
+// reports whether the item is expired, a frozen item does not expire, the caller must hold the lock
+func (i *dataItem) expired(now time.Time) bool {
+	return !i.frozen && isExpired(now, i.expiredAt)
+}
+
+// reports whether the item is neither removed, frozen nor expired
+func (i *dataItem) active(now time.Time) bool {
+	i.Lock()
+	defer i.Unlock()
+	return !i.removed && !i.frozen && !i.expired(now)
+}
+
+func (i *dataItem) getValues() valueMap {
+	i.Lock()
+	defer i.Unlock()
+	return i.values
+}
+
+// The number of buffered expiration notifications
+const expirationsSize = 1024
+
+// The default maximum time Close waits for the writes in progress
+const defaultCloseTimeout = 5 * time.Second
+
+type memoryStore struct {
+	opts        *memoryOptions
+	ticker      *time.Ticker
+	data        *skipmap.StringMap
+	expirations chan string
+	usersMu     sync.Mutex
+	users       map[string][]string
+	closed      atomic.Bool
+	pool        sync.Pool
+	locksMu     sync.Mutex
+	locks       map[string]*sessionLock
+	sweepMu     sync.Mutex
+	frozen      atomic.Int64
+	// the slots reserved for new sessions, the least recently used sessions when they are evicted,
+	// and the unix time in nanoseconds of the last sweep to free slots for new sessions
+	reserved    atomic.Int64
+	lru         *lruQueue
+	fullSweptAt atomic.Int64
+	limiter     *rateLimiter
+	lifetimes   histogram
+	interned    *internTable
+	// the expiration times of the tombstones of deleted sessions by session id
+	tombstones *skipmap.StringMap
+	// the end of the retention window of the refreshed away session ids by session id
+	rotated   *skipmap.StringMap
+	rotatedMu sync.Mutex
+	// the number of writes in progress, drained is closed once there are none after Close
+	writes     atomic.Int64
+	drained    chan struct{}
+	drainedSet atomic.Bool
+	stop       chan struct{}
+	// the callbacks of the session values with a TTL by session id and path
+	keyCallbacksMu sync.Mutex
+	keyCallbacks   map[string]map[string]keyCallback
+}
+
+// A lock of a session, held by at most one session store at a time
+type sessionLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+// Acquire the lock of the session, waiting until it is released or the context is done
+func (s *memoryStore) lock(ctx context.Context, sid string) (func(), error) {
+	s.locksMu.Lock()
+	if s.locks == nil {
+		s.locks = make(map[string]*sessionLock)
+	}
+	l, ok := s.locks[sid]
+	if !ok {
+		l = &sessionLock{ch: make(chan struct{}, 1)}
+		s.locks[sid] = l
+	}
+	l.refs++
+	s.locksMu.Unlock()
+
+	// drop the lock once nobody holds or waits for it
+	release := func() {
+		s.locksMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(s.locks, sid)
+		}
+		s.locksMu.Unlock()
+	}
+
+	select {
+	case l.ch <- struct{}{}:
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.ch
+			release()
+		})
+	}, nil
+}
+
+// Get the current time of the store clock
+func (s *memoryStore) now() time.Time {
+	return s.opts.clock()
+}
+
+// reports why an operation can not start, the store is closed or the context is done
+func (s *memoryStore) unavailable(ctx context.Context) error {
+	if s.closed.Load() {
+		return ErrStoreClosed
+	}
+	return ctx.Err()
+}
+
+func (s *memoryStore) gc() {
+	for {
+		select {
+		case <-s.ticker.C:
+			s.sweep()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Start a write, it returns false once the storage is closed. The write is counted before
+// the closed flag is checked, so either Close waits for it or the write sees the flag.
+func (s *memoryStore) beginWrite() bool {
+	s.writes.Add(1)
+	if s.closed.Load() {
+		s.endWrite()
+		return false
+	}
+	return true
+}
+
+// Complete a write, signaling Close when it is the last write it waits for
+func (s *memoryStore) endWrite() {
+	if s.writes.Add(-1) == 0 && s.closed.Load() {
+		s.signalDrained()
+	}
+}
+
+// Signal that no writes are in progress after Close, both the last write and Close may
+// find the writes drained, only the first one closes the channel
+func (s *memoryStore) signalDrained() {
+	if s.drainedSet.CompareAndSwap(false, true) {
+		close(s.drained)
+	}
+}
+
+// Delete all expired sessions and return the number deleted, a sweep waits
+// for the running sweep so the workers of two sweeps never overlap
+func (s *memoryStore) sweep() int {
+	s.sweepMu.Lock()
+	defer s.sweepMu.Unlock()
+
+	if s.limiter != nil {
+		s.limiter.prune(s.now())
+	}
+	s.sweepTombstones()
+	s.sweepRotated()
+	if s.opts.gcWorkers > 1 {
+		return s.sweepParallel(s.opts.gcWorkers)
+	}
+	var n int
+	s.data.Range(func(key string, value interface{}) bool {
+		if s.sweepItem(key, value) {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// Store a tombstone of the deleted session
+func (s *memoryStore) tombstone(sid string) {
+	if s.tombstones != nil {
+		s.tombstones.Store(sid, s.now().Add(s.opts.tombstoneWindow))
+	}
+}
+
+// reports whether there is a tombstone of the session
+func (s *memoryStore) tombstoned(sid string) bool {
+	if s.tombstones == nil {
+		return false
+	}
+	v, ok := s.tombstones.Load(sid)
+	return ok && v.(time.Time).After(s.now())
+}
+
+// Remove the new item just stored when the session was deleted in the meantime, a Delete stores its
+// tombstone before it looks for the session, so it either finds the item or its tombstone is found here
+func (s *memoryStore) discardTombstoned(sid string, item *dataItem) bool {
+	if !s.tombstoned(sid) {
+		return false
+	}
+	item.Lock()
+	if !item.removed {
+		item.removed = true
+		s.data.Delete(sid)
+	}
+	item.Unlock()
+	return true
+}
+
+// Delete the tombstones after their window
+func (s *memoryStore) sweepTombstones() {
+	if s.tombstones == nil {
+		return
+	}
+	now := s.now()
+	s.tombstones.Range(func(sid string, value interface{}) bool {
+		if !value.(time.Time).After(now) {
+			s.tombstones.Delete(sid)
+		}
+		return true
+	})
+}
+
+// Retain the refreshed away session id, dropping the session id with the earliest
+// end of its window when the maximum is reached
+func (s *memoryStore) retainRotated(sid string) {
+	if s.rotated == nil {
+		return
+	}
+
+	s.rotatedMu.Lock()
+	defer s.rotatedMu.Unlock()
+
+	if s.rotated.Len() >= s.opts.maxRotated {
+		s.sweepRotated()
+	}
+	for s.rotated.Len() >= s.opts.maxRotated {
+		var (
+			oldest string
+			until  time.Time
+		)
+		s.rotated.Range(func(sid string, value interface{}) bool {
+			if t := value.(time.Time); oldest == "" || t.Before(until) {
+				oldest, until = sid, t
+			}
+			return true
+		})
+		s.rotated.Delete(oldest)
+	}
+	s.rotated.Store(sid, s.now().Add(s.opts.rotatedWindow))
+}
+
+// reports whether the session id was refreshed away during the retention window
+func (s *memoryStore) wasRotated(sid string) bool {
+	if s.rotated == nil {
+		return false
+	}
+	v, ok := s.rotated.Load(sid)
+	return ok && v.(time.Time).After(s.now())
+}
+
+// Delete the refreshed away session ids after their window
+func (s *memoryStore) sweepRotated() {
+	if s.rotated == nil {
+		return
+	}
+	now := s.now()
+	s.rotated.Range(func(sid string, value interface{}) bool {
+		if !value.(time.Time).After(now) {
+			s.rotated.Delete(sid)
+		}
+		return true
+	})
+}
+
+// reports whether the maximum number of sessions of the storage is reached
+func (s *memoryStore) full() bool {
+	return s.opts.maxSessions > 0 && int64(s.data.Len())+s.reserved.Load() >= int64(s.opts.maxSessions)
+}
+
+// Reserve a slot for a new session when the number of sessions is limited, reports whether a slot
+// is reserved, which the caller releases with unreserve once the session is stored or not. When the
+// maximum is reached a slot is freed depending on the policy, ErrStoreFull is returned when there is none.
+func (s *memoryStore) reserve() (bool, error) {
+	if s.opts.maxSessions <= 0 {
+		return false, nil
+	}
+	for {
+		// the reservations are read before the sessions, so a reservation of a session that is
+		// stored in between is counted twice rather than not at all
+		reserved := s.reserved.Load()
+		if int64(s.data.Len())+reserved < int64(s.opts.maxSessions) {
+			if s.reserved.CompareAndSwap(reserved, reserved+1) {
+				return true, nil
+			}
+			continue
+		}
+		if !s.reclaim() {
+			return false, ErrStoreFull
+		}
+	}
+}
+
+// Release the slot of reserve
+func (s *memoryStore) unreserve(reserved bool) {
+	if reserved {
+		s.reserved.Add(-1)
+	}
+}
+
+// reports whether there is room for a new session, freeing a slot when the maximum is reached
+func (s *memoryStore) hasRoom() bool {
+	for s.full() {
+		if !s.reclaim() {
+			return false
+		}
+	}
+	return true
+}
+
+// Free a slot for a new session, by evicting the least recently used session or sweeping the
+// expired sessions depending on the policy, reports whether a session was removed
+func (s *memoryStore) reclaim() bool {
+	if s.lru != nil {
+		for {
+			e, ok := s.lru.pop()
+			if !ok {
+				return false
+			}
+			// a frozen session is dropped from the queue until it is unfrozen
+			if s.lruLive(e) && s.evict(e.item.sid, e.item, false) {
+				return true
+			}
+		}
+	}
+
+	// expired sessions are counted until they are evicted, so they are swept to free their slots,
+	// at most once a second since sweeping visits all sessions
+	now := s.now().UnixNano()
+	last := s.fullSweptAt.Load()
+	if now-last < int64(time.Second) || !s.fullSweptAt.CompareAndSwap(last, now) {
+		return false
+	}
+	return s.sweep() > 0
+}
+
+// Record the access of the stored session, and queue it for the eviction of the least recently used session
+func (s *memoryStore) accessed(item *dataItem, now int64) {
+	item.lastAccessedAt.Store(now)
+	if s.lru != nil {
+		s.lru.push(item, now, s.data.Len())
+	}
+}
+
+// reports whether the entry of the lru queue is of the last access of a stored session
+func (s *memoryStore) lruLive(e lruEntry) bool {
+	dt, ok := s.data.Load(e.item.sid)
+	return ok && dt.(*dataItem) == e.item && e.item.lastAccessedAt.Load() == e.accessedAt
+}
+
+// Check the strength of the session id, if a minimum is configured
+func (s *memoryStore) checkSessionID(sid string) error {
+	if n := s.opts.minIDBytes; n > 0 && weakSessionID(sid, n) {
+		return ErrWeakSessionID
+	}
+	return nil
+}
+
+// The number of sessions handed to a gc worker at once
+const sweepBatchSize = 256
+
+type sweepEntry struct {
+	sid   string
+	value interface{}
+}
+
+// Delete the expired sessions with the workers, the skipmap is ordered by the hash of
+// the session id so every batch of consecutive sessions covers a range of hashes
+func (s *memoryStore) sweepParallel(workers int) int {
+	var (
+		wg      sync.WaitGroup
+		n       atomic.Int64
+		batches = make(chan []sweepEntry, workers)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				for _, e := range batch {
+					if s.sweepItem(e.sid, e.value) {
+						n.Add(1)
+					}
+				}
+			}
+		}()
+	}
+
+	batch := make([]sweepEntry, 0, sweepBatchSize)
+	s.data.Range(func(key string, value interface{}) bool {
+		batch = append(batch, sweepEntry{sid: key, value: value})
+		if len(batch) == sweepBatchSize {
+			batches <- batch
+			batch = make([]sweepEntry, 0, sweepBatchSize)
+		}
+		return true
+	})
+	if len(batch) > 0 {
+		batches <- batch
+	}
+	close(batches)
+	wg.Wait()
+	return int(n.Load())
+}
+
+// A panic while processing one session must not stop the gc
+func (s *memoryStore) sweepItem(key string, value interface{}) (evicted bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.opts.logger.Printf("[ERROR] session gc: recovered from panic: %v", r)
+		}
+	}()
+
+	if item, ok := value.(*dataItem); ok {
+		if s.evict(key, item, true) {
+			return true
+		}
+		s.purgeExpiredValues(key, item)
+	}
+	return false
+}
+
+// Evict the session, optionally only when it is expired. The callback of WithBeforeEvict is called
+// without the lock of the item so it may use the store, the session is kept when it is saved meanwhile.
+func (s *memoryStore) evict(sid string, item *dataItem, expiredOnly bool) bool {
+	var version *uint64
+	if fn := s.opts.beforeEvict; fn != nil {
+		values, v, ok := s.evictable(item, expiredOnly)
+		if !ok {
+			return false
+		}
+		fn(sid, values)
+		version = &v
+	}
+	if !s.remove(sid, item, expiredOnly, version) {
+		return false
+	}
+	s.unindexUser(sid, item.values)
+	s.notifyExpired(sid)
+	return true
+}
+
+// Whether the item may be evicted, with a copy of its values and its version
+func (s *memoryStore) evictable(item *dataItem, expiredOnly bool) (map[string]interface{}, uint64, bool) {
+	item.Lock()
+	defer item.Unlock()
+
+	if item.removed || item.frozen || (expiredOnly && !item.expired(s.now())) {
+		return nil, 0, false
+	}
+	return item.values.toMap(), item.version, true
+}
+
+// Remove the item from the data, a concurrent save then stores a new item. The item is only
+// removed when it still has the given version, if any.
+func (s *memoryStore) remove(sid string, item *dataItem, expiredOnly bool, version *uint64) bool {
+	item.Lock()
+	defer item.Unlock()
+
+	if item.removed || item.frozen || (expiredOnly && !item.expired(s.now())) {
+		return false
+	}
+	if version != nil && item.version != *version {
+		return false
+	}
+	item.removed = true
+	s.data.Delete(sid)
+	s.observeLifetime(item)
+	s.dropKeyCallbacks(sid)
+	return true
+}
+
+// Record the age of the removed session, the caller must hold the lock of the item
+func (s *memoryStore) observeLifetime(item *dataItem) {
+	s.lifetimes.observe(s.now().Sub(item.createdAt))
+}
+
+// The ages of the sessions are recorded when they are deleted or evicted, a refreshed
+// session is not removed but its age starts over.
+func (s *memoryStore) LifetimeHistogram() []Bucket {
+	return s.lifetimes.buckets()
+}
+
+// Get the user of the session values when the sessions per user are limited
+func (s *memoryStore) userID(values valueMap) (string, bool) {
+	if s.opts.maxUserSIDs <= 0 {
+		return "", false
+	}
+	v, ok := values.get(s.opts.userKey)
+	if !ok || v == nil {
+		return "", false
+	}
+	return fmt.Sprint(v), true
+}
+
+// Add the session to the sessions of its user and evict the oldest sessions over the maximum
+func (s *memoryStore) indexUser(sid string, values valueMap) {
+	user, ok := s.userID(values)
+	if !ok {
+		return
+	}
+
+	s.usersMu.Lock()
+	var (
+		sids  []string
+		found bool
+	)
+	for _, id := range s.users[user] {
+		if id == sid {
+			found = true
+			sids = append(sids, id)
+			continue
+		}
+		// drop the sessions that are gone or belong to another user by now
+		if dt, ok := s.data.Load(id); ok {
+			if u, ok := s.userID(dt.(*dataItem).getValues()); ok && u == user {
+				sids = append(sids, id)
+			}
+		}
+	}
+	if !found {
+		sids = append(sids, sid)
+	}
+
+	var evicted []string
+	if n := len(sids) - s.opts.maxUserSIDs; n > 0 {
+		evicted, sids = sids[:n], sids[n:]
+	}
+	s.users[user] = sids
+	s.usersMu.Unlock()
+
+	for _, id := range evicted {
+		if dt, ok := s.data.Load(id); ok {
+			s.evict(id, dt.(*dataItem), false)
+		}
+	}
+}
+
+// Remove the session from the sessions of its user
+func (s *memoryStore) unindexUser(sid string, values valueMap) {
+	user, ok := s.userID(values)
+	if !ok {
+		return
+	}
+
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+
+	sids := s.users[user]
+	for i, id := range sids {
+		if id == sid {
+			sids = append(sids[:i:i], sids[i+1:]...)
+			break
+		}
+	}
+	if len(sids) == 0 {
+		delete(s.users, user)
+	} else {
+		s.users[user] = sids
+	}
+}
+
+// Send an expiration notification without blocking, dropping the oldest when full
+func (s *memoryStore) notifyExpired(sid string) {
+	for {
+		select {
+		case s.expirations <- sid:
+			return
+		default:
+		}
+
+		select {
+		case <-s.expirations:
+		default:
+		}
+	}
+}
+
+func (s *memoryStore) Expirations() <-chan string {
+	return s.expirations
+}
+
+// Load an active session, an expired session is evicted
+func (s *memoryStore) load(sid string) (*dataItem, error) {
+	dt, ok := s.data.Load(sid)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	item := dt.(*dataItem)
+	if s.evict(sid, item, true) {
+		return nil, ErrSessionExpired
+	} else if !item.active(s.now()) {
+		return nil, ErrSessionNotFound
+	}
+	return item, nil
+}
+
+// Round trip the session values through the codec, if any
+func (s *memoryStore) encode(values valueMap) (valueMap, error) {
+	if s.opts.codec == nil {
+		return values, nil
+	}
+
+	data, err := s.opts.codec.Marshal(values.toMap())
+	if err != nil {
+		return valueMap{}, err
+	}
+	m, err := s.opts.codec.Unmarshal(data)
+	return mapOf(m), err
+}
+
+// Save the session values and return the stored values with their new version, when expected
+// is not nil the save fails with ErrVersionConflict unless the stored version equals expected.
+// Saving always resets the expiration time, so a session saved during a gc sweep
+// can not be collected because of its previous expiration time
+func (s *memoryStore) save(sid string, values valueMap, expired int64, expected *uint64) (valueMap, uint64, error) {
+	if !s.beginWrite() {
+		return valueMap{}, 0, ErrStoreClosed
+	}
+	defer s.endWrite()
+
+	// the hooks may modify the values, so they get the values as a single map
+	if len(s.opts.saveHooks) > 0 {
+		m := values.toMap()
+		for _, fn := range s.opts.saveHooks {
+			if err := fn(sid, m); err != nil {
+				return valueMap{}, 0, err
+			}
+		}
+		values = mapOf(m)
+	}
+
+	values, err := s.encode(values)
+	if err != nil {
+		return valueMap{}, 0, err
+	}
+	// the gc deletes the expired values with a TTL, so the values are not shared with the session store
+	_, expiring := values.get(expiresKey)
+	if expiring {
+		values = values.clone()
+	}
+
+	for {
+		dt, ok := s.data.Load(sid)
+		if !ok {
+			if expected != nil && *expected != 0 {
+				return valueMap{}, 0, ErrVersionConflict
+			}
+			if s.tombstoned(sid) {
+				return valueMap{}, 0, ErrSessionDeleted
+			}
+			reserved, err := s.reserve()
+			if err != nil {
+				return valueMap{}, 0, err
+			}
+			item := s.newDataItem(sid, values, expired)
+			item.version = 1
+			item.expiring = expiring
+			_, loaded := s.data.LoadOrStore(sid, item)
+			s.unreserve(reserved)
+			if loaded {
+				// saved concurrently, try again against the stored session
+				continue
+			}
+			s.accessed(item, item.createdAt.UnixNano())
+			if s.discardTombstoned(sid, item) {
+				return valueMap{}, 0, ErrSessionDeleted
+			}
+			s.indexUser(sid, values)
+			return values, item.version, nil
+		}
+
+		item := dt.(*dataItem)
+		item.Lock()
+		if item.removed {
+			// the removed session is already deleted from the map
+			item.Unlock()
+			continue
+		}
+		// checked with the item locked, so a Delete that stored its tombstone afterwards removes this save
+		if s.tombstoned(sid) {
+			item.Unlock()
+			return valueMap{}, 0, ErrSessionDeleted
+		}
+		if item.frozen {
+			item.Unlock()
+			return valueMap{}, 0, ErrSessionFrozen
+		}
+		if expected != nil && item.version != *expected {
+			item.Unlock()
+			return valueMap{}, 0, ErrVersionConflict
+		}
+		item.values = values
+		item.expiring = expiring
+		item.expiredAt = expiresAt(s.now(), expired)
+		s.accessed(item, s.now().UnixNano())
+		item.version++
+		version := item.version
+		item.Unlock()
+		s.indexUser(sid, values)
+		return values, version, nil
+	}
+}
+
+// Get a copy of the stored session values with the changed keys of values applied,
+// and the version of the stored session values
+func (s *memoryStore) merge(sid string, values valueMap, changed *smallMap[struct{}]) (valueMap, uint64) {
+	var (
+		merged  valueMap
+		version uint64
+	)
+	if item, err := s.load(sid); err == nil {
+		item.Lock()
+		if !item.removed {
+			merged = item.values.clone()
+			version = item.version
+		}
+		item.Unlock()
+	}
+
+	changed.each(func(key string, _ struct{}) {
+		if value, ok := values.get(key); ok {
+			merged.set(key, value)
+		} else {
+			merged.delete(key)
+		}
+	})
+	return merged, version
+}
+
+// Extend the expiration time of an active session
+func (s *memoryStore) touch(sid string, expired int64) {
+	dt, ok := s.data.Load(sid)
+	if !ok {
+		return
+	}
+
+	item := dt.(*dataItem)
+	item.Lock()
+	if !item.removed && !item.frozen && !item.expired(s.now()) {
+		item.expiredAt = expiresAt(s.now(), expired)
+	}
+	item.Unlock()
+}
+
+// Validate the expiration time (in seconds) and clamp it to the maximum. A zero expiration time is
+// the default expiration time, as for an expiration time that is not configured, while a negative
+// expiration time other than NoExpiry is a mistake such as a clock skew and returns ErrInvalidTTL.
+func (s *memoryStore) normalizeExpired(expired int64) (int64, error) {
+	if expired == 0 {
+		expired = s.defaultExpired()
+	}
+	if expired <= 0 && expired != NoExpiry {
+		return 0, ErrInvalidTTL
+	}
+	if max := int64(s.opts.maxTTL / time.Second); max > 0 && (expired > max || expired == NoExpiry) {
+		expired = max
+	}
+	return expired, nil
+}
+
+func (s *memoryStore) Check(ctx context.Context, sid string) (bool, error) {
+	if err := s.unavailable(ctx); err != nil {
+		return false, err
+	}
+	if s.wasRotated(sid) {
+		return false, ErrSessionRotated
+	}
+	if err := s.checkSessionID(sid); err != nil {
+		return false, err
+	}
+
+	_, err := s.load(sid)
+	return err == nil, nil
+}
+
+func (s *memoryStore) Create(ctx context.Context, sid string, expired int64) (Store, error) {
+	if err := s.unavailable(ctx); err != nil {
+		return nil, err
+	}
+
+	expired, err := s.normalizeExpired(expired)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkSessionID(sid); err != nil {
+		return nil, err
+	}
+	if s.limiter != nil && !s.limiter.allow(ctx, s.now()) {
+		return nil, ErrRateLimited
+	}
+	if s.opts.fullPolicy == RejectNewSessions && !s.hasRoom() {
+		return nil, ErrStoreFull
+	}
+	return newStore(ctx, s, sid, expired, valueMap{}, 0, time.Time{}), nil
+}
+
+func (s *memoryStore) Update(ctx context.Context, sid string, expired int64) (Store, error) {
+	if err := s.unavailable(ctx); err != nil {
+		return nil, err
+	}
+
+	expired, err := s.normalizeExpired(expired)
+	if err != nil {
+		return nil, err
+	}
+	if s.wasRotated(sid) {
+		return nil, ErrSessionRotated
+	}
+	if err := s.checkSessionID(sid); err != nil {
+		return nil, err
+	}
+
+	item, err := s.load(sid)
+	if err != nil {
+		return nil, err
+	}
+
+	item.Lock()
+	if item.removed {
+		item.Unlock()
+		return nil, ErrSessionNotFound
+	}
+	if fn := s.opts.loadValidator; fn != nil {
+		if err := fn(item.values.toMap()); err != nil {
+			item.Unlock()
+			s.opts.logger.Printf("[WARN] session: invalid session values: %v", err)
+			return nil, ErrSessionNotFound
+		}
+	}
+	now := s.now()
+	nearExpiry := !item.expiredAt.IsZero() && item.expiredAt.Sub(now) < s.opts.refreshThreshold
+	item.expiredAt = expiresAt(now, expired)
+	s.accessed(item, now.UnixNano())
+	store := newStore(ctx, s, sid, expired, item.values, item.version, item.createdAt)
+	item.Unlock()
+
+	if nearExpiry && s.opts.onNearExpiry != nil {
+		s.opts.onNearExpiry(store)
+	}
+	return store, nil
+}
+
+// Atomically store a new session unless an active session exists, optionally
+// updating the expiration time of the active session. Returns the stored session
+// and whether the new session was stored. A frozen session is neither loaded nor replaced.
+func (s *memoryStore) loadOrStore(sid string, expired int64, update bool) (*dataItem, bool, error) {
+	if err := s.checkSessionID(sid); err != nil {
+		return nil, false, err
+	}
+	for {
+		var reserved bool
+		if _, ok := s.data.Load(sid); !ok {
+			var err error
+			if reserved, err = s.reserve(); err != nil {
+				return nil, false, err
+			}
+		}
+		if s.tombstoned(sid) {
+			s.unreserve(reserved)
+			return nil, false, ErrSessionDeleted
+		}
+		newItem := s.newDataItem(sid, valueMap{}, expired)
+		dt, loaded := s.data.LoadOrStore(sid, newItem)
+		s.unreserve(reserved)
+		if !loaded {
+			if s.discardTombstoned(sid, newItem) {
+				return nil, false, ErrSessionDeleted
+			}
+			s.accessed(newItem, newItem.createdAt.UnixNano())
+			return newItem, true, nil
+		}
+
+		item := dt.(*dataItem)
+		item.Lock()
+		if item.frozen && !item.removed {
+			item.Unlock()
+			return nil, false, ErrSessionFrozen
+		}
+		if !item.removed && !item.expired(s.now()) {
+			if update {
+				item.expiredAt = expiresAt(s.now(), expired)
+			}
+			s.accessed(item, s.now().UnixNano())
+			item.Unlock()
+			return item, false, nil
+		}
+		item.Unlock()
+
+		// the stale session is evicted before trying again
+		s.evict(sid, item, false)
+	}
+}
+
+func (s *memoryStore) LoadOrCreate(ctx context.Context, sid string, expired int64) (Store, bool, error) {
+	if err := s.unavailable(ctx); err != nil {
+		return nil, false, err
+	}
+
+	expired, err := s.normalizeExpired(expired)
+	if err != nil {
+		return nil, false, err
+	}
+
+	item, created, err := s.loadOrStore(sid, expired, true)
+	if err != nil {
+		return nil, false, err
+	}
+	item.Lock()
+	defer item.Unlock()
+	return newStore(ctx, s, sid, expired, item.values, item.version, item.createdAt), created, nil
+}
+
+func (s *memoryStore) CreateExclusive(ctx context.Context, sid string, expired int64) (Store, error) {
+	if err := s.unavailable(ctx); err != nil {
+		return nil, err
+	}
+
+	expired, err := s.normalizeExpired(expired)
+	if err != nil {
+		return nil, err
+	}
+
+	item, created, err := s.loadOrStore(sid, expired, false)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, ErrSessionExists
+	}
+	return newStore(ctx, s, sid, expired, item.values, 0, item.createdAt), nil
+}
+
+func (s *memoryStore) defaultExpired() int64 {
+	return int64(s.opts.defaultTTL / time.Second)
+}
+
+func (s *memoryStore) CreateDefault(ctx context.Context, sid string) (Store, error) {
+	return s.Create(ctx, sid, s.defaultExpired())
+}
+
+func (s *memoryStore) UpdateDefault(ctx context.Context, sid string) (Store, error) {
+	return s.Update(ctx, sid, s.defaultExpired())
+}
+
+// With tombstones the tombstone is stored before the session is looked up, a concurrent save checks
+// the tombstone while it holds the lock of the session or right after it stored a new session,
+// so the save either finds the tombstone or its session is found and deleted here
+func (s *memoryStore) Delete(ctx context.Context, sid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !s.beginWrite() {
+		return ErrStoreClosed
+	}
+	defer s.endWrite()
+	s.tombstone(sid)
+
+	if dt, ok := s.data.Load(sid); ok {
+		item := dt.(*dataItem)
+		item.Lock()
+		removed := item.removed
+		if !removed {
+			item.removed = true
+			s.data.Delete(sid)
+			if item.frozen {
+				s.frozen.Add(-1)
+			}
+			s.observeLifetime(item)
+		}
+		item.Unlock()
+		s.dropKeyCallbacks(sid)
+
+		if !removed {
+			s.unindexUser(sid, item.values)
+			s.notifyExpired(sid)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Refresh(ctx context.Context, oldsid, sid string, expired int64) (Store, error) {
+	store, _, err := s.RefreshOrCreate(ctx, oldsid, sid, expired)
+	return store, err
+}
+
+// The old session is checked and moved while it is locked, so it can not expire or be
+// deleted in between. A new session store is not saved until it is saved by the caller.
+func (s *memoryStore) RefreshOrCreate(ctx context.Context, oldsid, sid string, expired int64) (Store, bool, error) {
+	if !s.beginWrite() {
+		return nil, false, ErrStoreClosed
+	}
+	defer s.endWrite()
+
+	expired, err := s.normalizeExpired(expired)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := s.checkSessionID(sid); err != nil {
+		return nil, false, err
+	}
+
+	newItem, err := s.move(oldsid, sid, expired)
+	if err != nil {
+		return nil, false, err
+	}
+	if newItem == nil {
+		return newStore(ctx, s, sid, expired, valueMap{}, 0, time.Time{}), false, nil
+	}
+	return newStore(ctx, s, sid, expired, newItem.values, newItem.version, newItem.createdAt), true, nil
+}
+
+// Move the active session to the new session id, returns nil if there is no active session and
+// ErrSessionExists if there is an active or frozen session with the new session id. Moving a
+// session to its own session id only updates its expiration time.
+func (s *memoryStore) move(oldsid, sid string, expired int64) (*dataItem, error) {
+	item, err := s.load(oldsid)
+	if err != nil {
+		return nil, nil
+	}
+	if oldsid == sid {
+		item.Lock()
+		defer item.Unlock()
+		if item.removed || item.frozen || item.expired(s.now()) {
+			return nil, nil
+		}
+		item.expiredAt = expiresAt(s.now(), expired)
+		return item, nil
+	}
+
+	// an expired session with the new session id is evicted, so it does not count as existing
+	if dt, ok := s.data.Load(sid); ok {
+		s.evict(sid, dt.(*dataItem), true)
+	}
+
+	item.Lock()
+	// the session may have expired or been frozen after it was loaded
+	if item.removed || item.frozen || item.expired(s.now()) {
+		item.Unlock()
+		return nil, nil
+	}
+	newItem := s.newDataItem(sid, item.values, expired)
+	newItem.version = item.version
+	newItem.expiring = item.expiring
+	if _, loaded := s.data.LoadOrStore(sid, newItem); loaded {
+		item.Unlock()
+		return nil, ErrSessionExists
+	}
+	item.removed = true
+	s.data.Delete(oldsid)
+	item.Unlock()
+	s.accessed(newItem, newItem.createdAt.UnixNano())
+
+	s.retainRotated(oldsid)
+	s.moveKeyCallbacks(oldsid, sid)
+	s.indexUser(sid, newItem.values)
+	return newItem, nil
+}
+
+func (s *memoryStore) TimeToLive(ctx context.Context, sid string) (time.Duration, error) {
+	if err := s.unavailable(ctx); err != nil {
+		return 0, err
+	}
+
+	dt, ok := s.data.Load(sid)
+	if !ok {
+		return 0, ErrSessionNotFound
+	}
+
+	item := dt.(*dataItem)
+	item.Lock()
+	defer item.Unlock()
+	if item.expiredAt.IsZero() {
+		return InfiniteTTL, nil
+	}
+	return item.expiredAt.Sub(s.now()), nil
+}
+
+// The skipmap is ordered by key hash, so every page is a full scan that keeps
+// only the limit+1 lexicographically smallest session ids after cursor
+func (s *memoryStore) ListSessions(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	if err := s.unavailable(ctx); err != nil {
+		return nil, "", err
+	}
+
+	h := &sidHeap{}
+	s.data.Range(func(key string, value interface{}) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		if key <= cursor {
+			return true
+		}
+		if item, ok := value.(*dataItem); !ok || !item.active(s.now()) {
+			return true
+		}
+		if limit <= 0 || h.Len() <= limit {
+			heap.Push(h, key)
+		} else if key < (*h)[0] {
+			(*h)[0] = key
+			heap.Fix(h, 0)
+		}
+		return true
+	})
+
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	sids := []string(*h)
+	sort.Strings(sids)
+	if limit <= 0 || len(sids) <= limit {
+		return sids, "", nil
+	}
+	sids = sids[:limit]
+	return sids, sids[limit-1], nil
+}
+
+// A max-heap of session ids
+type sidHeap []string
+
+func (h sidHeap) Len() int            { return len(h) }
+func (h sidHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h sidHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sidHeap) Push(x interface{}) { *h = append(*h, x.(string)) }
+func (h *sidHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+func (s *memoryStore) DeleteExpired(ctx context.Context) (int, error) {
+	if err := s.unavailable(ctx); err != nil {
+		return 0, err
+	}
+	return s.sweep(), nil
+}
+
+// There is no index by expiration time, since it would have to be updated on every save,
+// so it scans all sessions and is O(n) in the number of sessions
+func (s *memoryStore) ExpiringWithin(ctx context.Context, d time.Duration) ([]string, error) {
+	if err := s.unavailable(ctx); err != nil {
+		return nil, err
+	}
+
+	type expiring struct {
+		sid       string
+		expiredAt time.Time
+	}
+	var items []expiring
+	now := s.now()
+	deadline := now.Add(d)
+	s.data.Range(func(sid string, value interface{}) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		item, ok := value.(*dataItem)
+		if !ok {
+			return true
+		}
+
+		item.Lock()
+		if !item.removed && !item.frozen && !item.expiredAt.IsZero() && item.expiredAt.After(now) && !item.expiredAt.After(deadline) {
+			items = append(items, expiring{sid: sid, expiredAt: item.expiredAt})
+		}
+		item.Unlock()
+		return true
+	})
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].expiredAt.Before(items[j].expiredAt)
+	})
+	sids := make([]string, len(items))
+	for i, item := range items {
+		sids[i] = item.sid
+	}
+	return sids, nil
+}
+
+// The predicate is called with the session locked, so it must not call back into the store.
+// Sessions that never expire are passed the zero time.
+func (s *memoryStore) DeleteWhere(ctx context.Context, pred func(sid string, values map[string]interface{}, expiresAt time.Time) bool) (int, error) {
+	if err := s.unavailable(ctx); err != nil {
+		return 0, err
+	}
+
+	return s.deleteWhere(ctx, func(sid string, item *dataItem) bool {
+		return pred(sid, item.values.toMap(), item.expiredAt)
+	})
+}
+
+// Delete the active sessions for which pred returns true, pred is called with the session locked.
+// Once the context is done the remaining sessions are kept, with the error of the context.
+func (s *memoryStore) deleteWhere(ctx context.Context, pred func(sid string, item *dataItem) bool) (int, error) {
+	var n int
+	s.data.Range(func(sid string, value interface{}) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		item, ok := value.(*dataItem)
+		if !ok {
+			return true
+		}
+
+		item.Lock()
+		matched := !item.removed && !item.frozen && !item.expired(s.now()) && pred(sid, item)
+		if matched {
+			item.removed = true
+			s.data.Delete(sid)
+			s.observeLifetime(item)
+		}
+		item.Unlock()
+
+		if matched {
+			s.unindexUser(sid, item.values)
+			s.dropKeyCallbacks(sid)
+			s.notifyExpired(sid)
+			n++
+		}
+		return true
+	})
+	return n, ctx.Err()
+}
+
+// The access time is recorded by loading or saving the session and by the gets and sets of
+// its session stores, at most once per second per session store
+func (s *memoryStore) IdleSince(ctx context.Context, d time.Duration) ([]string, error) {
+	if err := s.unavailable(ctx); err != nil {
+		return nil, err
+	}
+
+	type idle struct {
+		sid        string
+		accessedAt int64
+	}
+	var items []idle
+	now := s.now()
+	cutoff := now.Add(-d).UnixNano()
+	s.data.Range(func(sid string, value interface{}) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		item, ok := value.(*dataItem)
+		if !ok {
+			return true
+		}
+
+		item.Lock()
+		if t := item.lastAccessedAt.Load(); !item.removed && !item.frozen && !item.expired(now) && t < cutoff {
+			items = append(items, idle{sid: sid, accessedAt: t})
+		}
+		item.Unlock()
+		return true
+	})
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].accessedAt < items[j].accessedAt
+	})
+	sids := make([]string, len(items))
+	for i, item := range items {
+		sids[i] = item.sid
+	}
+	return sids, nil
+}
+
+// The access time is checked again while the session is locked, so a session accessed
+// in the meantime is kept
+func (s *memoryStore) ReapIdle(ctx context.Context, d time.Duration) (int, error) {
+	if err := s.unavailable(ctx); err != nil {
+		return 0, err
+	}
+
+	cutoff := s.now().Add(-d).UnixNano()
+	return s.deleteWhere(ctx, func(_ string, item *dataItem) bool {
+		return item.lastAccessedAt.Load() < cutoff
+	})
+}
+
+// A session of a dump, custom value types must be registered with RegisterType
+type dumpItem struct {
+	SID       string
+	ExpiredAt time.Time
+	Values    map[string]interface{}
+}
+
+func (s *memoryStore) Dump() ([]byte, error) {
+	var items []dumpItem
+	s.data.Range(func(key string, value interface{}) bool {
+		item := value.(*dataItem)
+		item.Lock()
+		if !item.removed {
+			items = append(items, dumpItem{
+				SID:       key,
+				ExpiredAt: item.expiredAt,
+				Values:    item.values.toMap(),
+			})
+		}
+		item.Unlock()
+		return true
+	})
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(items); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *memoryStore) Restore(data []byte) error {
+	if s.closed.Load() {
+		return ErrStoreClosed
+	}
+
+	var items []dumpItem
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&items); err != nil {
+		return err
+	}
+
+	for _, di := range items {
+		s.restore(di.SID, di.Values, di.ExpiredAt)
+	}
+	return nil
+}
+
+func (s *memoryStore) Promote(ctx context.Context, sid string, newExpired int64, opt ...PromoteOption) (Store, error) {
+	var opts promoteOptions
+	for _, o := range opt {
+		o(&opts)
+	}
+
+	var store Store
+	var err error
+	if opts.newsid != "" && opts.newsid != sid {
+		// checked and moved in one step, so the session can not expire or be deleted in between
+		var refreshed bool
+		store, refreshed, err = s.RefreshOrCreate(ctx, sid, opts.newsid, newExpired)
+		if err == nil && !refreshed {
+			err = ErrSessionNotFound
+		}
+	} else {
+		store, err = s.Update(ctx, sid, newExpired)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.(ValueStore).SetChecked(authenticatedKey, true); err != nil {
+		return nil, err
+	}
+	if err := store.Save(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Only session stores of the memory storage itself are reused, others are ignored, as is
+// releasing a session store again before it is reused.
+// The session values are not cleared, since they may be shared with the stored session.
+func (s *memoryStore) Release(released Store) {
+	st, ok := released.(*store)
+	if !ok || st.mstore != s {
+		return
+	}
+
+	st.mu.Lock()
+	if st.released {
+		st.mu.Unlock()
+		return
+	}
+	st.released = true
+	st.ctx = nil
+	st.values = valueMap{}
+	st.listeners = nil
+	st.changes = nil
+	st.dirty.clear()
+	st.original.clear()
+	st.mu.Unlock()
+	s.pool.Put(st)
+}
+
+// Store the session with its expiration time, unless it is expired
+func (s *memoryStore) restore(sid string, values map[string]interface{}, expiredAt time.Time) {
+	if isExpired(s.now(), expiredAt) || s.tombstoned(sid) {
+		return
+	}
+	item := &dataItem{
+		sid:       sid,
+		createdAt: s.now(),
+		expiredAt: expiredAt,
+		values:    mapOf(values),
+	}
+	_, item.expiring = values[expiresKey]
+	s.data.Store(sid, item)
+	s.accessed(item, item.createdAt.UnixNano())
+	s.indexUser(sid, item.values)
+}
+
+// Every session is stored like a save, so it passes the save hooks, the codec, the maximum
+// TTL and the global maximum of sessions. The expiration time is rounded up to whole seconds.
+// Loading stops at the first session that can not be stored, deleted sessions are skipped.
+func (s *memoryStore) BulkLoad(ctx context.Context, sessions map[string]SessionData) error {
+	if err := s.unavailable(ctx); err != nil {
+		return err
+	}
+
+	now := s.now()
+	for sid, sd := range sessions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// zero is the default expiration time
+		var expired int64
+		if !sd.ExpiresAt.IsZero() {
+			ttl := sd.ExpiresAt.Sub(now)
+			if ttl <= 0 {
+				continue
+			}
+			expired = int64((ttl + time.Second - 1) / time.Second)
+		}
+		expired, err := s.normalizeExpired(expired)
+		if err != nil {
+			return err
+		}
+		if _, _, err := s.save(sid, mapOf(maps.Clone(sd.Values)), expired, nil); err != nil && err != ErrSessionDeleted {
+			return err
+		}
+	}
+	return nil
+}
+
+// The skipmap keeps the number of sessions, so counting takes constant time. Every removal
+// from the skipmap goes through an eviction, a delete or a move, which keeps the count exact
+// for the stored sessions. Frozen sessions are not counted.
+//
+// Expired sessions are counted until they are evicted: by the gc, which sweeps them every
+// second, or when they are accessed. Without the gc they are counted until DeleteExpired
+// runs, call it before counting for the number of active sessions.
+func (s *memoryStore) Count(ctx context.Context) (int, error) {
+	if err := s.unavailable(ctx); err != nil {
+		return 0, err
+	}
+	return s.data.Len() - int(s.frozen.Load()), nil
+}
+
+// reports whether the session is frozen
+func (s *memoryStore) isFrozen(sid string) bool {
+	dt, ok := s.data.Load(sid)
+	if !ok {
+		return false
+	}
+	item := dt.(*dataItem)
+	item.Lock()
+	defer item.Unlock()
+	return item.frozen && !item.removed
+}
+
+func (s *memoryStore) Freeze(ctx context.Context, sid string) error {
+	if err := s.unavailable(ctx); err != nil {
+		return err
+	}
+
+	dt, ok := s.data.Load(sid)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	item := dt.(*dataItem)
+	item.Lock()
+	defer item.Unlock()
+
+	if item.frozen {
+		return nil
+	}
+	now := s.now()
+	if item.removed || item.expired(now) {
+		return ErrSessionNotFound
+	}
+	item.frozen = true
+	if !item.expiredAt.IsZero() {
+		item.frozenTTL = item.expiredAt.Sub(now)
+	}
+	s.frozen.Add(1)
+	return nil
+}
+
+func (s *memoryStore) Unfreeze(ctx context.Context, sid string) error {
+	if err := s.unavailable(ctx); err != nil {
+		return err
+	}
+
+	dt, ok := s.data.Load(sid)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	item := dt.(*dataItem)
+	item.Lock()
+	defer item.Unlock()
+
+	if item.removed {
+		return ErrSessionNotFound
+	}
+	if !item.frozen {
+		return nil
+	}
+	item.frozen = false
+	if !item.expiredAt.IsZero() {
+		item.expiredAt = s.now().Add(item.frozenTTL)
+	}
+	item.frozenTTL = 0
+	s.frozen.Add(-1)
+	// queued again for the eviction of the least recently used session
+	s.accessed(item, s.now().UnixNano())
+	return nil
+}
+
+func (s *memoryStore) Status(ctx context.Context, sid string) (SessionStatus, error) {
+	if err := s.unavailable(ctx); err != nil {
+		return StatusNotFound, err
+	}
+
+	dt, ok := s.data.Load(sid)
+	if !ok {
+		if s.tombstoned(sid) {
+			return StatusDeleted, nil
+		}
+		return StatusNotFound, nil
+	}
+	item := dt.(*dataItem)
+	item.Lock()
+	defer item.Unlock()
+
+	switch {
+	case item.removed:
+		if s.tombstoned(sid) {
+			return StatusDeleted, nil
+		}
+		return StatusNotFound, nil
+	case item.frozen:
+		return StatusFrozen, nil
+	case item.expired(s.now()):
+		return StatusExpired, nil
+	}
+	return StatusActive, nil
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	if err := s.unavailable(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close first waits for the saves, deletes and refreshes in progress, at most the close timeout,
+// so the last writes are not lost. New writes are rejected with ErrStoreClosed while waiting.
+func (s *memoryStore) Close() error {
+	if s.closed.Swap(true) {
+		return nil
+	}
+	if s.writes.Load() == 0 {
+		s.signalDrained()
+	}
+
+	timer := time.NewTimer(s.opts.closeTimeout)
+	select {
+	case <-s.drained:
+	case <-timer.C:
+		s.opts.logger.Printf("[WARN] session: closed with writes in progress after %v", s.opts.closeTimeout)
+	}
+	timer.Stop()
+
+	if s.ticker != nil {
+		s.ticker.Stop()
+		close(s.stop)
+	}
+	return nil
+}
+
+// Get a session store, reusing a released store when available
+// A zero creation time is the current time, for a session that is not stored yet
+func newStore(ctx context.Context, mstore *memoryStore, sid string, expired int64, values valueMap, version uint64, createdAt time.Time) *store {
+	s, ok := mstore.pool.Get().(*store)
+	if !ok {
+		s = &store{mstore: mstore}
+	}
+	s.reset(ctx, sid, expired, values)
+	s.version = version
+	if !createdAt.IsZero() {
+		s.createdAt = createdAt
+	}
+	return s
+}
+
+type store struct {
+	mu     sync.RWMutex
+	mstore *memoryStore
+	ctx    context.Context
+	// the session id, changed with the lock held and read without it by SessionID
+	sid     atomic.Pointer[string]
+	expired int64
+	values  valueMap
+	dirty   smallMap[struct{}]
+	version uint64
+	// the creation time of the session, kept by the store since it does not change
+	createdAt time.Time
+	// copy of the values for reads without locking, only with concurrent values. Resetting the
+	// values swaps in a new copy, so a read never sees a copy that is cleared and filled again
+	reads atomic.Pointer[sync.Map]
+	// the unix time in nanoseconds the access of the session was last recorded
+	accessedAt atomic.Int64
+	// change callbacks by key, and the changes to report on unlock
+	listeners map[string][]func(old, new interface{})
+	changes   []valueChange
+	// the paths of the transient values by their joined path
+	transient map[string][]string
+	// the values of the changed keys as they were loaded or last saved
+	original smallMap[originalValue]
+	// whether the store is released to the pool of the memory storage
+	released bool
+}
+
+// A session value as it was before it was changed, ok is false when the key was not set
+type originalValue struct {
+	value interface{}
+	ok    bool
+}
+
+// A change of a session value to report to the callbacks
+type valueChange struct {
+	old, new interface{}
+	fns      []func(old, new interface{})
+}
+
+// Reset reinitialize the store for a session, such as when it is reused after it is released
+func (s *store) Reset(ctx context.Context, sid string, expired int64, values map[string]interface{}) {
+	s.reset(ctx, sid, expired, mapOf(values))
+}
+
+// reinitialize the store for the session values, a single value is held inline without a map
+func (s *store) reset(ctx context.Context, sid string, expired int64, values valueMap) {
+	if _, expiring := values.get(expiresKey); expiring || s.mstore.opts.mergeOnSave || s.mstore.opts.concurrentValues {
+		values = values.clone()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.released = false
+	s.ctx = ctx
+	s.sid.Store(&sid)
+	s.expired = expired
+	s.version = 0
+	s.createdAt = s.mstore.now()
+	s.listeners = nil
+	s.changes = nil
+	s.transient = nil
+	s.original.clear()
+	s.dirty.clear()
+	s.accessedAt.Store(0)
+	s.resetValues(values)
+}
+
+// The access time of a session is recorded at most once per second per session store
+const accessResolution = time.Second
+
+// record the access of the stored session by a get or set
+func (s *store) access() {
+	now := s.mstore.now().UnixNano()
+	if now-s.accessedAt.Load() < int64(accessResolution) {
+		return
+	}
+	s.accessedAt.Store(now)
+	if dt, ok := s.mstore.data.Load(s.SessionID()); ok {
+		s.mstore.accessed(dt.(*dataItem), now)
+	}
+}
+
+func (s *store) Context() context.Context {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ctx
+}
+
+func (s *store) WithContext(ctx context.Context) Store {
+	return &ctxStore{sessionStore: s, ctx: ctx}
+}
+
+// A session store of the memory storage bound to another context, the memory storage does
+// not keep the context of a save, so only the context of the session store changes
+type ctxStore struct {
+	sessionStore
+	ctx context.Context
+}
+
+func (s *ctxStore) Context() context.Context {
+	return s.ctx
+}
+
+func (s *ctxStore) unwrap() []Store {
+	return []Store{s.sessionStore}
+}
+
+func (s *ctxStore) WithContext(ctx context.Context) Store {
+	return &ctxStore{sessionStore: s.sessionStore, ctx: ctx}
+}
+
+func (s *ctxStore) SaveReturn() (Store, error) {
+	store, err := s.sessionStore.SaveReturn()
+	if err != nil {
+		return nil, err
+	}
+	return store.(ContextBinder).WithContext(s.ctx), nil
+}
+
+func (s *ctxStore) SubStore(name string) Store {
+	return subStoreOf(s, s.sessionStore.SubStore(name))
+}
+
+// Get the session store of the memory storage, also when it is bound to another context
+func asStore(st Store) (*store, bool) {
+	if c, ok := st.(*ctxStore); ok {
+		st = c.sessionStore
+	}
+	s, ok := st.(*store)
+	return s, ok
+}
+
+func (s *store) SessionID() string {
+	return *s.sid.Load()
+}
+
+func (s *store) Manager() ManagerStore {
+	return s.mstore
+}
+
+// checks that adding the new keys does not exceed the maximum number of keys
+func (s *store) checkKeys(keys ...string) error {
+	max := s.mstore.opts.maxKeys
+	if max <= 0 {
+		return nil
+	}
+
+	n := s.values.len()
+	for _, key := range reservedKeys {
+		if _, ok := s.values.get(key); ok {
+			n--
+		}
+	}
+	for _, key := range keys {
+		if _, ok := s.values.get(key); !ok && !reservedKey(key) {
+			n++
+		}
+	}
+	if n > max {
+		return ErrTooManyKeys
+	}
+	return nil
+}
+
+// The keys of the metadata of the session, they can not be set and are left out of the keys,
+// the formatted session values and the maximum number of keys
+var reservedKeys = [...]string{expiresKey, flagsKey}
+
+// reports whether the key is reserved for the metadata of the session
+func reservedKey(key string) bool {
+	for _, k := range reservedKeys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
+
+// checks that the key is not reserved, the kind of a value against the key schema,
+// and whether the codec can serialize it
+func (s *store) checkType(key string, value interface{}) error {
+	if reservedKey(key) {
+		return ErrReservedKey
+	}
+	if kind, ok := s.mstore.opts.keySchema[key]; ok && reflect.ValueOf(untagValue(value)).Kind() != kind {
+		return ErrTypeMismatch
+	}
+	if valid, ok := s.mstore.opts.enums[key]; ok && !isEnumValue(untagValue(value), valid) {
+		return ErrInvalidEnumValue
+	}
+	return s.checkSerializable(key, value)
+}
+
+// reports whether the value is one of the valid values
+func isEnumValue(value interface{}, valid []interface{}) bool {
+	if value != nil && !reflect.TypeOf(value).Comparable() {
+		return false
+	}
+	for _, v := range valid {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// checks whether the codec can serialize the value, by serializing it when set values are validated
+func (s *store) checkSerializable(key string, value interface{}) error {
+	opts := s.mstore.opts
+	checkSize := opts.maxValueBytes > 0 && !isScalar(value)
+	if (!opts.setValidation && !checkSize) || opts.codec == nil {
+		return nil
+	}
+	data, err := opts.codec.Marshal(map[string]interface{}{key: value})
+	if err != nil {
+		return err
+	}
+	if checkSize && len(data) > opts.maxValueBytes {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// reports whether the value is a boolean or number, which are too small to check their size
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return true
+	}
+	return false
+}
+
+// record the change of a session value for the callbacks of the key, the caller must hold the lock
+func (s *store) recordChange(key string, old, new interface{}) {
+	s.recordOriginal(key)
+	if fns := s.listeners[key]; len(fns) > 0 && !reflect.DeepEqual(old, new) {
+		s.changes = append(s.changes, valueChange{old: old, new: new, fns: fns})
+	}
+}
+
+// record the changes of the session values replaced by values, the caller must hold the lock
+func (s *store) recordReset(values valueMap) {
+	s.values.each(func(key string, _ interface{}) {
+		s.recordOriginal(key)
+	})
+	values.each(func(key string, _ interface{}) {
+		s.recordOriginal(key)
+	})
+	for key := range s.listeners {
+		s.recordChange(key, s.values.at(key), values.at(key))
+	}
+}
+
+// record the value of the key before its first change, the caller must hold the lock
+func (s *store) recordOriginal(key string) {
+	if _, ok := s.original.get(key); ok {
+		return
+	}
+	v, ok := s.values.get(key)
+	s.original.set(key, originalValue{value: v, ok: ok})
+}
+
+func (s *store) Changes() []Change {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var changes []Change
+	s.original.each(func(key string, orig originalValue) {
+		v, ok := s.values.get(key)
+		switch {
+		case !orig.ok && ok:
+			changes = append(changes, Change{Key: key, New: v, Op: ChangeCreate})
+		case orig.ok && ok:
+			changes = append(changes, Change{Key: key, Old: orig.value, New: v, Op: ChangeUpdate})
+		case orig.ok && !ok:
+			changes = append(changes, Change{Key: key, Old: orig.value, Op: ChangeDelete})
+		}
+	})
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
+
+// unlock the store and invoke the callbacks of the recorded changes,
+// so the callbacks can use the store
+func (s *store) unlock() {
+	changes := s.changes
+	s.changes = nil
+	s.mu.Unlock()
+
+	for _, c := range changes {
+		for _, fn := range c.fns {
+			fn(c.old, c.new)
+		}
+	}
+}
+
+// reports whether the string values of the key are interned
+func (s *memoryStore) internedKey(key string) bool {
+	if s.opts.internKeys == nil {
+		return true
+	}
+	_, ok := s.opts.internKeys[key]
+	return ok
+}
+
+// set a session value and mark it as changed, the caller must hold the lock
+func (s *store) setValue(key string, value interface{}) {
+	if str, ok := value.(string); ok && s.mstore.interned != nil && s.mstore.internedKey(key) {
+		value = s.mstore.interned.intern(str)
+	}
+	delete(s.transient, key)
+	if key != expiresKey {
+		s.clearExpires([]string{key})
+	}
+	s.recordChange(key, s.values.at(key), value)
+	s.values.set(key, value)
+	s.dirty.set(key, struct{}{})
+	if reads := s.reads.Load(); reads != nil {
+		reads.Store(key, value)
+	}
+}
+
+// delete a session value and mark it as changed, the caller must hold the lock
+func (s *store) deleteValue(key string) {
+	delete(s.transient, key)
+	if key != expiresKey {
+		s.clearExpires([]string{key})
+	}
+	s.recordChange(key, s.values.at(key), nil)
+	s.values.delete(key)
+	s.dirty.set(key, struct{}{})
+	if reads := s.reads.Load(); reads != nil {
+		reads.Delete(key)
+	}
+}
+
+// replace all session values, the caller must hold the lock
+func (s *store) resetValues(values valueMap) {
+	s.values = values
+	if s.mstore.opts.concurrentValues {
+		reads := &sync.Map{}
+		values.each(func(key string, value interface{}) {
+			reads.Store(key, value)
+		})
+		s.reads.Store(reads)
+	}
+}
+
+// normalize the session key for case-insensitive keys
+func (s *store) key(key string) string {
+	if s.mstore.opts.ignoreCase {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+// A value that is rejected is logged and not set
+func (s *store) Set(key string, value interface{}) {
+	if err := s.SetChecked(key, value); err != nil {
+		s.mstore.opts.logger.Printf("[WARN] session: value %q not set: %v", key, err)
+	}
+}
+
+func (s *store) SetChecked(key string, value interface{}) error {
+	key = s.key(key)
+	s.mu.Lock()
+	defer s.unlock()
+
+	if err := s.checkType(key, value); err != nil {
+		return err
+	}
+	if err := s.checkKeys(key); err != nil {
+		return err
+	}
+	s.setValue(key, value)
+	s.access()
+	return nil
+}
+
+func (s *store) SetIfAbsent(key string, value interface{}) (bool, error) {
+	key = s.key(key)
+	s.mu.Lock()
+	defer s.unlock()
+
+	if _, ok := s.values.get(key); ok {
+		s.access()
+		return false, nil
+	}
+	if err := s.checkType(key, value); err != nil {
+		return false, err
+	}
+	if err := s.checkKeys(key); err != nil {
+		return false, err
+	}
+	s.setValue(key, value)
+	s.access()
+	return true, nil
+}
+
+func (s *store) SetAll(values map[string]interface{}) error {
+	return s.setAll(values, false)
+}
+
+// set the session values, the reserved keys are only set when metadata is set
+func (s *store) setAll(values map[string]interface{}, metadata bool) error {
+	if s.mstore.opts.ignoreCase {
+		values = lowerKeys(values)
+	}
+	s.mu.Lock()
+	defer s.unlock()
+
+	keys := make([]string, 0, len(values))
+	for key, value := range values {
+		if metadata && reservedKey(key) {
+			continue
+		}
+		if err := s.checkType(key, value); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	if err := s.checkKeys(keys...); err != nil {
+		return err
+	}
+
+	for key, value := range values {
+		s.setValue(key, value)
+	}
+	s.access()
+	return nil
+}
+
+func (s *store) Get(key string) (interface{}, bool) {
+	key = s.key(key)
+	var val interface{}
+	var ok, expired bool
+	if reads := s.reads.Load(); reads != nil {
+		val, ok = reads.Load(key)
+		if ok {
+			expires, _ := reads.Load(expiresKey)
+			expired = pathExpired(expires, key, s.mstore.now())
+		}
+	} else {
+		s.mu.RLock()
+		val, ok = s.values.get(key)
+		expired = ok && s.expiredLocked([]string{key})
+		s.mu.RUnlock()
+	}
+	s.access()
+	if expired {
+		s.purgeExpired([]string{key})
+		return nil, false
+	}
+
+	if _, sliding := s.mstore.opts.slidingKeys[key]; sliding {
+		s.mstore.touch(s.SessionID(), s.expired)
+	}
+	if ok && s.mstore.opts.copyOnGet {
+		val = deepCopy(val)
+	}
+	return val, ok
+}
+
+func (s *store) GetAny(key string) interface{} {
+	v, _ := s.Get(key)
+	return v
+}
+
+func (s *store) GetFirst(keys ...string) (interface{}, bool) {
+	for _, key := range keys {
+		if v, ok := s.Get(key); ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// The values are read while holding the read lock once, so no Set can change some of them in between.
+// Expired values are left out and purged like Get does.
+func (s *store) GetMany(keys ...string) map[string]interface{} {
+	values := make(map[string]interface{}, len(keys))
+	var expired []string
+	var sliding bool
+	s.mu.RLock()
+	for _, key := range keys {
+		k := s.key(key)
+		if val, ok := s.values.get(k); ok && !reservedKey(k) {
+			if s.expiredLocked([]string{k}) {
+				expired = append(expired, k)
+			} else {
+				values[key] = val
+			}
+		}
+		if _, ok := s.mstore.opts.slidingKeys[k]; ok {
+			sliding = true
+		}
+	}
+	s.mu.RUnlock()
+
+	s.access()
+	for _, k := range expired {
+		s.purgeExpired([]string{k})
+	}
+	if sliding {
+		s.mstore.touch(s.SessionID(), s.expired)
+	}
+	if s.mstore.opts.copyOnGet {
+		for key, val := range values {
+			values[key] = deepCopy(val)
+		}
+	}
+	return values
+}
+
+func (s *store) SetTyped(key string, value interface{}) error {
+	return s.SetChecked(key, tagValue(value))
+}
+
+func (s *store) SetTransient(key string, value interface{}) {
+	key = s.key(key)
+	s.mu.Lock()
+	defer s.unlock()
+
+	s.setValue(key, value)
+	s.markTransient([]string{key})
+}
+
+// mark the value of the path as transient, the caller must hold the lock
+func (s *store) markTransient(path []string) {
+	if s.transient == nil {
+		s.transient = make(map[string][]string)
+	}
+	s.transient[strings.Join(path, "\x00")] = path
+}
+
+// unmark the value of the path as transient, the caller must hold the lock
+func (s *store) unmarkTransient(path []string) {
+	delete(s.transient, strings.Join(path, "\x00"))
+}
+
+// get the session values without the transient values, the caller must hold the lock
+func (s *store) persistentValues() valueMap {
+	if len(s.transient) == 0 {
+		return s.values
+	}
+	values := s.values.toMap()
+	for _, path := range s.transient {
+		values = deletePath(values, path)
+	}
+	return mapOf(values)
+}
+
+// copy the maps on the path and delete the value of the path from the copy
+func deletePath(m map[string]interface{}, path []string) map[string]interface{} {
+	if len(path) == 1 {
+		if _, ok := m[path[0]]; !ok {
+			return m
+		}
+		c := maps.Clone(m)
+		delete(c, path[0])
+		return c
+	}
+	sub, ok := m[path[0]].(map[string]interface{})
+	if !ok {
+		return m
+	}
+	c := maps.Clone(m)
+	c[path[0]] = deletePath(sub, path[1:])
+	return c
+}
+
+// copy the value of the path in src to dst, dst is changed in place
+func copyPath(dst, src map[string]interface{}, path []string) {
+	m := src
+	for _, name := range path[:len(path)-1] {
+		if m, _ = m[name].(map[string]interface{}); m == nil {
+			return
+		}
+	}
+	v, ok := m[path[len(path)-1]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = v
+		return
+	}
+	sub, _ := dst[path[0]].(map[string]interface{})
+	dst[path[0]] = updateNested(sub, path[1:len(path)-1], func(c map[string]interface{}) {
+		c[path[len(path)-1]] = v
+	})
+}
+
+// Clear the changes of the session store after a decorator saved its values
+func clearChanges(st Store) {
+	if s, ok := asStore(st); ok {
+		s.mu.Lock()
+		s.original.clear()
+		s.dirty.clear()
+		s.mu.Unlock()
+	}
+}
+
+// Change the id of the session store without moving the stored session, whether it could
+func renameStore(st Store, sid string) bool {
+	s, ok := asStore(st)
+	if !ok {
+		return false
+	}
+	s.mu.Lock()
+	s.sid.Store(&sid)
+	s.mu.Unlock()
+	return true
+}
+
+// Get the values to save of the session store, without the transient values
+func sessionValues(st Store) map[string]interface{} {
+	if s, ok := asStore(st); ok {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		values := s.persistentValues().clone()
+		return values.toMap()
+	}
+
+	values := make(map[string]interface{})
+	for _, key := range extendStore(st).Keys() {
+		if v, ok := st.Get(key); ok {
+			values[key] = v
+		}
+	}
+	return values
+}
+
+// Set the session values of another session, taken with sessionValues, including the metadata of the
+// session that SetAll rejects. The decorator session stores pass SetAll through to the session store
+// they embed, a session store of another kind only gets the values that are not reserved.
+func copyValues(st Store, values map[string]interface{}) error {
+	for {
+		w, ok := st.(storeWrapper)
+		if !ok {
+			break
+		}
+		st = w.unwrap()[0]
+	}
+	if s, ok := st.(*store); ok {
+		return s.setAll(values, true)
+	}
+
+	plain := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		if !reservedKey(key) {
+			plain[key] = value
+		}
+	}
+	return extendStore(st).SetAll(plain)
+}
+
+func (s *store) GetTyped(key string) (interface{}, bool) {
+	return getTyped(s, key)
+}
+
+// The data is buffered in memory, tagged with its type so it is read back as bytes from any codec
+func (s *store) SetStream(key string, r io.Reader) error {
+	return setStream(s, key, r)
+}
+
+func setStream(s TypedStore, key string, r io.Reader) error {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(r); err != nil {
+		return err
+	}
+	return s.SetTyped(key, buf.Bytes())
+}
+
+func (s *store) GetStream(key string) (io.ReadCloser, bool) {
+	return getStream(s, key)
+}
+
+func getStream(g getter, key string) (io.ReadCloser, bool) {
+	v, ok := getTyped(g, key)
+	if !ok {
+		return nil, false
+	}
+	data, ok := v.([]byte)
+	if !ok {
+		return nil, false
+	}
+	return io.NopCloser(bytes.NewReader(data)), true
+}
+
+// Session values to read with the typed getters
+type getter interface {
+	Get(key string) (interface{}, bool)
+}
+
+func (s *store) GetString(key string) (string, bool) {
+	return getString(s, key)
+}
+
+func getString(g getter, key string) (string, bool) {
+	if v, ok := getTyped(g, key); ok {
+		str, ok := v.(string)
+		return str, ok
+	}
+	return "", false
+}
+
+func (s *store) GetBool(key string) (bool, bool) {
+	return getBool(s, key)
+}
+
+func getBool(g getter, key string) (bool, bool) {
+	if v, ok := getTyped(g, key); ok {
+		b, ok := v.(bool)
+		return b, ok
+	}
+	return false, false
+}
+
+func (s *store) GetInt(key string) (int, bool) {
+	return getInt(s, key)
+}
+
+func getInt(g getter, key string) (int, bool) {
+	if v, ok := getTyped(g, key); ok {
+		i, ok := v.(int)
+		return i, ok
+	}
+	return 0, false
+}
+
+func (s *store) SetUUID(key string, id uuid.UUID) error {
+	return s.SetChecked(key, id.String())
+}
+
+func (s *store) GetUUID(key string) (uuid.UUID, bool) {
+	return getUUID(s, key)
+}
+
+func getUUID(g getter, key string) (uuid.UUID, bool) {
+	if v, ok := getTyped(g, key); ok {
+		switch t := v.(type) {
+		case uuid.UUID:
+			return t, true
+		case string:
+			return parseUUID(t)
+		case []byte:
+			if id, err := uuid.FromBytes(t); err == nil {
+				return id, true
+			}
+			if id, err := uuid.ParseBytes(t); err == nil {
+				return id, true
+			}
+		}
+	}
+	return uuid.Nil, false
+}
+
+// Parse the string form of a UUID, or the base64 encoding of its bytes
+// as JSON encodes a UUID stored as bytes
+func parseUUID(s string) (uuid.UUID, bool) {
+	if id, err := uuid.Parse(s); err == nil {
+		return id, true
+	}
+	if len(s) == base64.StdEncoding.EncodedLen(16) {
+		if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+			if id, err := uuid.FromBytes(b); err == nil {
+				return id, true
+			}
+		}
+	}
+	return uuid.Nil, false
+}
+
+func (s *store) GetInto(key string, dst interface{}) error {
+	return getInto(s, key, dst)
+}
+
+func getInto(g getter, key string, dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return &json.InvalidUnmarshalError{Type: reflect.TypeOf(dst)}
+	}
+
+	v, ok := getTyped(g, key)
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	elem := rv.Elem()
+	if v == nil {
+		elem.Set(reflect.Zero(elem.Type()))
+		return nil
+	}
+	if val := reflect.ValueOf(v); val.Type().AssignableTo(elem.Type()) {
+		elem.Set(val)
+		return nil
+	}
+
+	switch t := v.(type) {
+	case []byte:
+		return json.Unmarshal(t, dst)
+	case map[string]interface{}:
+		data, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, dst)
+	}
+	return ErrTypeMismatch
+}
+
+func (s *store) Keys() []string {
+	s.mu.RLock()
+	keys := make([]string, 0, s.values.len())
+	s.values.each(func(key string, _ interface{}) {
+		if !reservedKey(key) {
+			keys = append(keys, key)
+		}
+	})
+	s.mu.RUnlock()
+
+	if s.mstore.opts.sortedKeys {
+		sort.Strings(keys)
+	}
+	return keys
+}
+
+func (s *store) Delete(key string) interface{} {
+	key = s.key(key)
+	s.mu.Lock()
+	defer s.unlock()
+
+	v, ok := s.values.get(key)
+	if ok {
+		s.deleteValue(key)
+	}
+	return v
+}
+
+func (s *store) DeletePrefix(prefix string) int {
+	prefix = s.key(prefix)
+	s.mu.Lock()
+	defer s.unlock()
+
+	var keys []string
+	s.values.each(func(key string, _ interface{}) {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	})
+	for _, key := range keys {
+		s.deleteValue(key)
+	}
+	return len(keys)
+}
+
+func (s *store) Pop(key string) (interface{}, bool) {
+	key = s.key(key)
+	s.mu.Lock()
+	defer s.unlock()
+
+	v, ok := s.values.get(key)
+	if ok {
+		s.deleteValue(key)
+	}
+	return v, ok
+}
+
+// The authenticated flag of promoted sessions is stored under a reserved key
+const authenticatedKey = "_authenticated"
+
+// Authenticated reports whether the session is promoted to an authenticated session
+func Authenticated(s Store) bool {
+	ok, _ := s.GetBool(authenticatedKey)
+	return ok
+}
+
+// Flash messages are stored by category under a reserved key
+const flashKey = "_flashes"
+
+// Get a copy of the flash messages by category, read back as a map[string]interface{}
+// holding []interface{} from serializing storages. The copy is changed and set again,
+// since the stored map may be shared with the stored session.
+func flashMessages(v interface{}) map[string][]string {
+	flashes := make(map[string][]string)
+	switch v := v.(type) {
+	case map[string][]string:
+		for category, messages := range v {
+			flashes[category] = append([]string(nil), messages...)
+		}
+	case map[string]interface{}:
+		for category, messages := range v {
+			if names := flagNames(messages); len(names) > 0 {
+				flashes[category] = append([]string(nil), names...)
+			}
+		}
+	}
+	return flashes
+}
+
+func (s *store) AddFlash(message string, categories ...string) error {
+	var category string
+	if len(categories) > 0 {
+		category = categories[0]
+	}
+
+	s.mu.Lock()
+	defer s.unlock()
+
+	if _, ok := s.values.get(flashKey); !ok {
+		if err := s.checkKeys(flashKey); err != nil {
+			return err
+		}
+	}
+	flashes := flashMessages(s.values.at(flashKey))
+	flashes[category] = append(flashes[category], message)
+	s.setValue(flashKey, flashes)
+	return nil
+}
+
+func (s *store) Flashes(categories ...string) []string {
+	s.mu.Lock()
+	defer s.unlock()
+
+	v, ok := s.values.get(flashKey)
+	if !ok {
+		return nil
+	}
+	flashes := flashMessages(v)
+
+	if len(categories) == 0 {
+		for category := range flashes {
+			categories = append(categories, category)
+		}
+		sort.Strings(categories)
+	}
+
+	var messages []string
+	for _, category := range categories {
+		messages = append(messages, flashes[category]...)
+		delete(flashes, category)
+	}
+	if len(flashes) == 0 {
+		s.deleteValue(flashKey)
+	} else {
+		s.setValue(flashKey, flashes)
+	}
+	return messages
+}
+
+// Feature flags are stored under a reserved key as the sorted names of the flags that are on
+const flagsKey = "_flags"
+
+// Get the names of the feature flags that are on, read back as a []interface{} from serializing storages
+func flagNames(v interface{}) []string {
+	switch v := v.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		names := make([]string, 0, len(v))
+		for _, name := range v {
+			if name, ok := name.(string); ok {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+// The names of the flags are copied, since they may be shared with the stored session
+func (s *store) SetFlag(name string, on bool) error {
+	s.mu.Lock()
+	defer s.unlock()
+
+	names := flagNames(s.values.at(flagsKey))
+	i := sort.SearchStrings(names, name)
+	if found := i < len(names) && names[i] == name; found == on {
+		return nil
+	}
+
+	if !on {
+		if len(names) == 1 {
+			s.deleteValue(flagsKey)
+			return nil
+		}
+		flags := make([]string, 0, len(names)-1)
+		s.setValue(flagsKey, append(append(flags, names[:i]...), names[i+1:]...))
+		return nil
+	}
+
+	if len(names) == 0 {
+		if err := s.checkKeys(flagsKey); err != nil {
+			return err
+		}
+	}
+	flags := make([]string, 0, len(names)+1)
+	flags = append(append(append(flags, names[:i]...), name), names[i:]...)
+	s.setValue(flagsKey, flags)
+	return nil
+}
+
+func (s *store) Flag(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := flagNames(s.values.at(flagsKey))
+	i := sort.SearchStrings(names, name)
+	return i < len(names) && names[i] == name
+}
+
+func (s *store) Flags() map[string]bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := flagNames(s.values.at(flagsKey))
+	flags := make(map[string]bool, len(names))
+	for _, name := range names {
+		flags[name] = true
+	}
+	return flags
+}
+
+// Sticky feature flags that are on are kept
+func (s *store) Flush() error {
+	s.mu.Lock()
+	s.values.each(func(key string, _ interface{}) {
+		s.dirty.set(key, struct{}{})
+	})
+	var sticky []string
+	for _, name := range flagNames(s.values.at(flagsKey)) {
+		if _, ok := s.mstore.opts.stickyFlags[name]; ok {
+			sticky = append(sticky, name)
+		}
+	}
+	s.recordReset(valueMap{})
+	s.transient = nil
+	s.resetValues(valueMap{})
+	s.mstore.dropKeyCallbacks(s.SessionID())
+	if len(sticky) > 0 {
+		s.setValue(flagsKey, sticky)
+	}
+	s.unlock()
+
+	return s.Save()
+}
+
+func (s *store) Save() error {
+	_, err := s.saveVersion(nil)
+	return err
+}
+
+func (s *store) SaveIfVersion(expected uint64) error {
+	_, err := s.saveVersion(&expected)
+	return err
+}
+
+func (s *store) SaveReturn() (Store, error) {
+	values, err := s.saveVersion(nil)
+	if err != nil {
+		return nil, err
+	}
+	return newStore(s.Context(), s.mstore, s.SessionID(), s.expired, values, s.Version(), s.CreatedAt()), nil
+}
+
+// Save the session values and return the stored values
+func (s *store) saveVersion(expected *uint64) (valueMap, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveLocked(expected)
+}
+
+// Save the session values and return the stored values, the caller must hold the lock
+func (s *store) saveLocked(expected *uint64) (valueMap, error) {
+	if s.mstore.opts.mergeOnSave && expected == nil {
+		return s.saveMerged()
+	}
+
+	values, version, err := s.mstore.save(s.SessionID(), s.persistentValues(), s.expired, expected)
+	if err != nil {
+		return valueMap{}, err
+	}
+	s.version = version
+	s.dirty.clear()
+	s.original.clear()
+	return values, nil
+}
+
+// Save the changed values merged into the stored values, merging again
+// when the session is saved concurrently, the caller must hold the lock
+func (s *store) saveMerged() (valueMap, error) {
+	for {
+		merged, version := s.mstore.merge(s.SessionID(), s.persistentValues(), &s.dirty)
+		values, version, err := s.mstore.save(s.SessionID(), merged, s.expired, &version)
+		if err == ErrVersionConflict {
+			continue
+		} else if err != nil {
+			return valueMap{}, err
+		}
+		current := values.clone()
+		if len(s.transient) > 0 {
+			dst, src := current.toMap(), s.values.toMap()
+			for _, path := range s.transient {
+				copyPath(dst, src, path)
+			}
+			current = mapOf(dst)
+		}
+		s.resetValues(current)
+		s.version = version
+		s.dirty.clear()
+		s.original.clear()
+		return values, nil
+	}
+}
+
+func (s *store) Lock(ctx context.Context) (func(), error) {
+	return s.mstore.lock(ctx, s.SessionID())
+}
+
+func (s *store) Replace(values map[string]interface{}) error {
+	if s.mstore.opts.ignoreCase {
+		values = lowerKeys(values)
+	} else {
+		values = maps.Clone(values)
+	}
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+
+	s.mu.Lock()
+	defer s.unlock()
+
+	for key, value := range values {
+		if err := s.checkType(key, value); err != nil {
+			return err
+		}
+	}
+	if max := s.mstore.opts.maxKeys; max > 0 && len(values) > max {
+		return ErrTooManyKeys
+	}
+
+	s.values.each(func(key string, _ interface{}) {
+		s.dirty.set(key, struct{}{})
+	})
+	for key := range values {
+		s.dirty.set(key, struct{}{})
+	}
+	s.recordReset(mapOf(values))
+	s.transient = nil
+	s.resetValues(mapOf(values))
+	_, err := s.saveLocked(nil)
+	return err
+}
+
+func (s *store) OnChange(key string, fn func(old, new interface{})) {
+	key = s.key(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listeners == nil {
+		s.listeners = make(map[string][]func(old, new interface{}))
+	}
+	s.listeners[key] = append(s.listeners[key], fn)
+}
+
+// A frozen session is not moved and returns ErrSessionFrozen
+func (s *store) Rotate(newsid string) error {
+	if !s.mstore.beginWrite() {
+		return ErrStoreClosed
+	}
+	defer s.mstore.endWrite()
+
+	if err := s.mstore.checkSessionID(newsid); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sid := s.SessionID()
+	if newsid == sid {
+		return nil
+	}
+	// a session that is not saved yet only changes the id,
+	// a moved session is created again under the new id
+	item, err := s.mstore.move(sid, newsid, s.expired)
+	if err != nil {
+		return err
+	}
+	if item != nil {
+		s.createdAt = item.createdAt
+	} else if s.mstore.isFrozen(sid) {
+		return ErrSessionFrozen
+	} else {
+		// the callbacks of the values of a session that is not saved yet are not moved along by move
+		s.mstore.moveKeyCallbacks(sid, newsid)
+	}
+	s.sid.Store(&newsid)
+	return nil
+}
+
+func (s *store) SubStore(name string) Store {
+	return &subStore{sessionStore: s, s: s, path: []string{s.key(name)}}
+}
+
+func (s *store) String() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return formatSession(s.mstore.opts, s.SessionID(), s.values.toMap())
+}
+
+// The JSON representation of a session, ExpiresAt is nil when the session never expires
+type sessionJSON struct {
+	SID       string                 `json:"sid"`
+	ExpiresAt *time.Time             `json:"expires_at"`
+	Values    map[string]interface{} `json:"values"`
+}
+
+// MarshalJSON encodes the session with the secrets redacted like String. The expiration time
+// of a session that is not saved yet is the time it would expire when it is saved now.
+func (s *store) MarshalJSON() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	opts := s.mstore.opts
+	sj := sessionJSON{SID: s.SessionID(), Values: make(map[string]interface{}, s.values.len())}
+	if !opts.showSID {
+		sj.SID = "***"
+	}
+	s.values.each(func(key string, v interface{}) {
+		if reservedKey(key) {
+			return
+		}
+		if _, ok := opts.redactKeys[key]; ok {
+			v = "***"
+		}
+		sj.Values[key] = v
+	})
+
+	expiredAt := expiresAt(s.mstore.now(), s.expired)
+	if dt, ok := s.mstore.data.Load(s.SessionID()); ok {
+		item := dt.(*dataItem)
+		item.Lock()
+		if !item.removed {
+			expiredAt = item.expiredAt
+		}
+		item.Unlock()
+	}
+	if !expiredAt.IsZero() {
+		sj.ExpiresAt = &expiredAt
+	}
+	return json.Marshal(sj)
+}
+
+// Format the session values with the secrets redacted
+func formatSession(opts *memoryOptions, name string, values map[string]interface{}) string {
+	if !opts.showSID {
+		name = "***"
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		if !reservedKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "session %s {", name)
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		if _, ok := opts.redactKeys[key]; ok {
+			fmt.Fprintf(&b, "%s: ***", key)
+		} else {
+			fmt.Fprintf(&b, "%s: %v", key, values[key])
+		}
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func (s *store) CreatedAt() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.createdAt
+}
+
+func (s *store) Age() time.Duration {
+	return s.mstore.now().Sub(s.CreatedAt())
+}
+
+func (s *store) Version() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.version
+}
+
+// The memory storage has no partial writes, so all session data is saved
+func (s *store) SaveDirty() error {
+	return s.Save()
+}
+
+// Deleting a key that is not set does not change the session
+func (s *store) Dirty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.dirty.len() > 0
 }
@@ -2,9 +2,24 @@ package session
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 
+	"github.com/google/uuid"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -33,6 +48,15 @@ func testStore(store Store) {
 	So(ok, ShouldBeTrue)
 	So(foo2, ShouldEqual, "bar2")
 
+	store.Set("foo3", "bar3")
+	foo3, ok := store.(ValueStore).Pop("foo3")
+	So(ok, ShouldBeTrue)
+	So(foo3, ShouldEqual, "bar3")
+
+	foo3, ok = store.(ValueStore).Pop("foo3")
+	So(ok, ShouldBeFalse)
+	So(foo3, ShouldBeNil)
+
 	err = store.Flush()
 	So(err, ShouldBeNil)
 
@@ -70,6 +94,7 @@ func testManagerStore(mstore ManagerStore) {
 	foo, ok := store.Get("foo")
 	So(ok, ShouldBeTrue)
 	So(foo, ShouldEqual, "bar")
+	So(store.(ManagedStore).Manager(), ShouldEqual, mstore)
 
 	newsid := "test_manager_store2"
 	store, err = mstore.Refresh(context.Background(), sid, newsid, 10)
@@ -84,6 +109,9 @@ func testManagerStore(mstore ManagerStore) {
 	So(exists, ShouldBeFalse)
 	So(err, ShouldBeNil)
 
+	err = Ping(context.Background(), mstore)
+	So(err, ShouldBeNil)
+
 	err = mstore.Delete(context.Background(), newsid)
 	So(err, ShouldBeNil)
 
@@ -92,6 +120,327 @@ func testManagerStore(mstore ManagerStore) {
 	So(err, ShouldBeNil)
 }
 
+func TestStoreSetIfAbsent(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test set value only if absent", t, func() {
+		store, err := mstore.Create(context.Background(), "test_set_if_absent", 10)
+		So(err, ShouldBeNil)
+
+		ok, err := store.(ValueStore).SetIfAbsent("foo", "bar")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		ok, err = store.(ValueStore).SetIfAbsent("foo", "baz")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+
+		foo, ok := store.Get("foo")
+		So(ok, ShouldBeTrue)
+		So(foo, ShouldEqual, "bar")
+	})
+}
+
+func TestStoreFlashes(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test flash messages", t, func() {
+		sid := "test_flashes"
+		store, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+
+		So(store.(FlashStore).AddFlash("hello"), ShouldBeNil)
+		So(store.(FlashStore).AddFlash("failed", "error"), ShouldBeNil)
+		So(store.(FlashStore).AddFlash("saved", "info"), ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		store, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(FlashStore).Flashes("error"), ShouldResemble, []string{"failed"})
+		So(store.(FlashStore).Flashes("error"), ShouldBeEmpty)
+		So(store.(FlashStore).Flashes(), ShouldResemble, []string{"hello", "saved"})
+		So(store.(FlashStore).Flashes(), ShouldBeEmpty)
+
+		_, ok := store.Get(flashKey)
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestStoreFlashesJSON(t *testing.T) {
+	mstore := NewMemoryStore(WithCodec(JSONCodec))
+
+	Convey("Test flash messages read back from a serializing storage", t, func() {
+		sid := "test_flashes_json"
+		store, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(FlashStore).AddFlash("hello"), ShouldBeNil)
+		So(store.(FlashStore).AddFlash("failed", "error"), ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		store, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(FlashStore).AddFlash("saved", "info"), ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		store, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(FlashStore).Flashes("error"), ShouldResemble, []string{"failed"})
+		So(store.Save(), ShouldBeNil)
+
+		store, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(FlashStore).Flashes(), ShouldResemble, []string{"hello", "saved"})
+		So(store.(FlashStore).Flashes(), ShouldBeEmpty)
+	})
+}
+
+func TestStoreSortedKeys(t *testing.T) {
+	mstore := NewMemoryStore(WithSortedKeys())
+
+	Convey("Test sorted session keys", t, func() {
+		store, err := mstore.Create(context.Background(), "test_sorted_keys", 10)
+		So(err, ShouldBeNil)
+
+		for _, key := range []string{"c", "a", "d", "b"} {
+			store.Set(key, key)
+		}
+		So(store.(ValueStore).Keys(), ShouldResemble, []string{"a", "b", "c", "d"})
+	})
+}
+
+func TestStoreDirty(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test tracking changed session values", t, func() {
+		sid := "test_dirty"
+		vstore, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+
+		vstore.Set("foo", "bar")
+		vstore.Set("foo2", "bar2")
+		vstore.Delete("foo2")
+		So(vstore.(*store).dirty.keys(), ShouldResemble, []string{"foo", "foo2"})
+
+		So(vstore.(ChangeTracker).SaveDirty(), ShouldBeNil)
+		So(vstore.(*store).dirty.keys(), ShouldBeEmpty)
+
+		vstore, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		foo, ok := vstore.Get("foo")
+		So(ok, ShouldBeTrue)
+		So(foo, ShouldEqual, "bar")
+	})
+}
+
+func TestStoreDeletePrefix(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test deleting session values by prefix", t, func() {
+		store, err := mstore.Create(context.Background(), "test_delete_prefix", 10)
+		So(err, ShouldBeNil)
+
+		So(store.(ValueStore).SetAll(map[string]interface{}{"cart:1": 1, "cart:2": 2, "user": "foo"}), ShouldBeNil)
+		So(store.(ValueStore).DeletePrefix("cart:"), ShouldEqual, 2)
+		So(store.(ValueStore).DeletePrefix("cart:"), ShouldEqual, 0)
+		So(store.(ValueStore).Keys(), ShouldResemble, []string{"user"})
+	})
+}
+
+func TestStoreMaxKeys(t *testing.T) {
+	mstore := NewMemoryStore(WithMaxKeys(2))
+
+	Convey("Test maximum number of keys per session", t, func() {
+		store, err := mstore.Create(context.Background(), "test_max_keys", 10)
+		So(err, ShouldBeNil)
+
+		store.Set("foo", "bar")
+		So(store.(ValueStore).SetAll(map[string]interface{}{"foo": "baz", "foo2": "bar2", "foo3": "bar3"}), ShouldEqual, ErrTooManyKeys)
+
+		foo, _ := store.Get("foo")
+		So(foo, ShouldEqual, "bar")
+		_, ok := store.Get("foo2")
+		So(ok, ShouldBeFalse)
+
+		store.Set("foo2", "bar2")
+		So(store.(ValueStore).SetChecked("foo3", "bar3"), ShouldEqual, ErrTooManyKeys)
+
+		ok, err = store.(ValueStore).SetIfAbsent("foo3", "bar3")
+		So(err, ShouldEqual, ErrTooManyKeys)
+		So(ok, ShouldBeFalse)
+
+		store.Set("foo", "baz")
+		foo, _ = store.Get("foo")
+		So(foo, ShouldEqual, "baz")
+	})
+
+	Convey("Test the metadata of the session does not count toward the maximum number of keys", t, func() {
+		store, err := mstore.Create(context.Background(), "test_max_keys_metadata", 10)
+		So(err, ShouldBeNil)
+
+		store.Set("foo", "bar")
+		So(store.(ValueStore).SetWithTTLAndCallback("token", "abc", time.Minute, nil), ShouldBeNil)
+		So(store.(FlagStore).SetFlag("beta", true), ShouldBeNil)
+		So(store.(ValueStore).SetChecked("foo2", "bar2"), ShouldEqual, ErrTooManyKeys)
+	})
+}
+
+func TestStoreReservedKeys(t *testing.T) {
+	mstore := NewMemoryStore(WithCodec(JSONCodec))
+
+	Convey("Test the metadata keys of the session can not be set", t, func() {
+		store, err := mstore.Create(context.Background(), "test_reserved_keys", 10)
+		So(err, ShouldBeNil)
+
+		So(store.(ValueStore).SetChecked(flagsKey, []interface{}{"beta"}), ShouldEqual, ErrReservedKey)
+		So(store.(ValueStore).SetAll(map[string]interface{}{"foo": "bar", expiresKey: map[string]interface{}{}}), ShouldEqual, ErrReservedKey)
+		_, ok := store.Get("foo")
+		So(ok, ShouldBeFalse)
+		ok, err = store.(ValueStore).SetIfAbsent(flagsKey, "beta")
+		So(err, ShouldEqual, ErrReservedKey)
+		So(ok, ShouldBeFalse)
+		So(store.(ValueStore).Replace(map[string]interface{}{flagsKey: "beta"}), ShouldEqual, ErrReservedKey)
+		So(store.(ValueStore).SetWithTTLAndCallback(expiresKey, "abc", time.Minute, nil), ShouldEqual, ErrReservedKey)
+		So(store.(SubStorer).SubStore(flagsKey).(ValueStore).SetChecked("beta", true), ShouldEqual, ErrReservedKey)
+		So(store.(FlagStore).Flags(), ShouldBeEmpty)
+	})
+
+	Convey("Test the metadata keys of the session are left out of its values", t, func() {
+		store, err := mstore.Create(context.Background(), "test_reserved_keys_hidden", 10)
+		So(err, ShouldBeNil)
+
+		store.Set("foo", "bar")
+		So(store.(ValueStore).SetWithTTLAndCallback("token", "abc", time.Minute, nil), ShouldBeNil)
+		So(store.(FlagStore).SetFlag("beta", true), ShouldBeNil)
+
+		keys := store.(ValueStore).Keys()
+		sort.Strings(keys)
+		So(keys, ShouldResemble, []string{"foo", "token"})
+		So(store.(ValueStore).GetMany("foo", flagsKey, expiresKey), ShouldResemble, map[string]interface{}{"foo": "bar"})
+		So(fmt.Sprint(store), ShouldNotContainSubstring, flagsKey)
+		So(fmt.Sprint(store), ShouldNotContainSubstring, expiresKey)
+		data, err := json.Marshal(store)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldNotContainSubstring, flagsKey)
+		So(string(data), ShouldNotContainSubstring, expiresKey)
+		So(store.(FlagStore).Flag("beta"), ShouldBeTrue)
+	})
+}
+
+func TestMemoryStoreTimeToLive(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test memory store time to live", t, func() {
+		_, err := TimeToLive(context.Background(), mstore, "test_ttl")
+		So(err, ShouldEqual, ErrSessionNotFound)
+
+		store, err := mstore.Create(context.Background(), "test_ttl", 10)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		ttl, err := TimeToLive(context.Background(), mstore, "test_ttl")
+		So(err, ShouldBeNil)
+		So(ttl, ShouldBeGreaterThan, time.Second*9)
+		So(ttl, ShouldBeLessThanOrEqualTo, time.Second*10)
+	})
+}
+
+func TestMemoryStoreDefaultTTL(t *testing.T) {
+	mstore := NewMemoryStore(WithDefaultTTL(time.Minute))
+
+	Convey("Test memory store default expiration", t, func() {
+		store, err := mstore.(DefaultTTLStore).CreateDefault(context.Background(), "test_default_ttl")
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		ttl, err := TimeToLive(context.Background(), mstore, "test_default_ttl")
+		So(err, ShouldBeNil)
+		So(ttl, ShouldBeGreaterThan, time.Second*59)
+		So(ttl, ShouldBeLessThanOrEqualTo, time.Minute)
+
+		store, err = mstore.(DefaultTTLStore).UpdateDefault(context.Background(), "test_default_ttl")
+		So(err, ShouldBeNil)
+		So(store.SessionID(), ShouldEqual, "test_default_ttl")
+	})
+}
+
+func TestMemoryStoreLoadOrCreate(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test memory store load or create", t, func() {
+		sid := "test_load_or_create"
+		store, created, err := LoadOrCreate(context.Background(), mstore, sid, 10)
+		So(err, ShouldBeNil)
+		So(created, ShouldBeTrue)
+		store.Set("foo", "bar")
+		So(store.Save(), ShouldBeNil)
+
+		store, created, err = LoadOrCreate(context.Background(), mstore, sid, 10)
+		So(err, ShouldBeNil)
+		So(created, ShouldBeFalse)
+
+		foo, ok := store.Get("foo")
+		So(ok, ShouldBeTrue)
+		So(foo, ShouldEqual, "bar")
+	})
+}
+
+func TestMemoryStoreCreateExclusive(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test memory store exclusive create", t, func() {
+		sid := "test_create_exclusive"
+		store, err := mstore.(ExclusiveCreator).CreateExclusive(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		So(store.Save(), ShouldBeNil)
+
+		store, err = mstore.(ExclusiveCreator).CreateExclusive(context.Background(), sid, 10)
+		So(err, ShouldEqual, ErrSessionExists)
+		So(store, ShouldBeNil)
+	})
+}
+
+func TestMemoryStoreSaveHook(t *testing.T) {
+	errNoUser := errors.New("no user")
+	var calls []string
+	mstore := NewMemoryStore(
+		WithSaveHook(func(sid string, values map[string]interface{}) error {
+			calls = append(calls, "strip")
+			for key, value := range values {
+				if value == nil {
+					delete(values, key)
+				}
+			}
+			return nil
+		}),
+		WithSaveHook(func(sid string, values map[string]interface{}) error {
+			calls = append(calls, "validate")
+			if _, ok := values["user_id"]; !ok {
+				return errNoUser
+			}
+			return nil
+		}),
+	)
+
+	Convey("Test memory store save hooks", t, func() {
+		sid := "test_save_hook"
+		store, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+
+		store.Set("foo", nil)
+		So(store.Save(), ShouldEqual, errNoUser)
+		So(calls, ShouldResemble, []string{"strip", "validate"})
+
+		exists, err := mstore.Check(context.Background(), sid)
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+
+		store.Set("user_id", 1)
+		So(store.Save(), ShouldBeNil)
+		So(store.(ValueStore).Keys(), ShouldResemble, []string{"user_id"})
+	})
+}
+
 func TestManagerMemoryStore(t *testing.T) {
 	mstore := NewMemoryStore()
 
@@ -132,3 +481,2778 @@ func TestMemoryStoreWithExpired(t *testing.T) {
 		testStoreWithExpired(mstore)
 	})
 }
+
+func TestMemoryStoreListSessions(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test paging through memory store sessions", t, func() {
+		for _, sid := range []string{"c", "a", "e", "b", "d"} {
+			store, err := mstore.Create(context.Background(), sid, 10)
+			So(err, ShouldBeNil)
+			So(store.Save(), ShouldBeNil)
+		}
+
+		lister := mstore.(SessionLister)
+		sids, cursor, err := lister.ListSessions(context.Background(), "", 2)
+		So(err, ShouldBeNil)
+		So(sids, ShouldResemble, []string{"a", "b"})
+		So(cursor, ShouldEqual, "b")
+
+		sids, cursor, err = lister.ListSessions(context.Background(), cursor, 2)
+		So(err, ShouldBeNil)
+		So(sids, ShouldResemble, []string{"c", "d"})
+		So(cursor, ShouldEqual, "d")
+
+		sids, cursor, err = lister.ListSessions(context.Background(), cursor, 2)
+		So(err, ShouldBeNil)
+		So(sids, ShouldResemble, []string{"e"})
+		So(cursor, ShouldBeEmpty)
+	})
+}
+
+type testLogger struct {
+	logs []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.logs = append(l.logs, fmt.Sprintf(format, v...))
+}
+
+func TestMemoryStoreGCRecover(t *testing.T) {
+	logger := &testLogger{}
+	mstore := NewMemoryStore(WithLogger(logger)).(*memoryStore)
+	mstore.Close()
+
+	Convey("Test memory store gc keeps running after a panic", t, func() {
+		mstore.data.Store("test_gc_panic", (*dataItem)(nil))
+		for i := 0; i < 10; i++ {
+			sid := fmt.Sprintf("test_gc_expired_%d", i)
+			mstore.data.Store(sid, mstore.newDataItem(sid, valueMap{}, -10))
+		}
+
+		mstore.sweep()
+		So(mstore.data.Len(), ShouldEqual, 1)
+		So(len(logger.logs), ShouldEqual, 1)
+	})
+}
+
+func TestMemoryStoreBeforeEvict(t *testing.T) {
+	evicted := make(map[string]interface{})
+	var mstore *memoryStore
+	mstore = NewMemoryStore(WithBeforeEvict(func(sid string, values map[string]interface{}) {
+		_, exists := mstore.data.Load(sid)
+		evicted[sid] = exists
+		evicted[sid+"_foo"] = values["foo"]
+	})).(*memoryStore)
+	mstore.Close()
+
+	Convey("Test memory store callback before eviction", t, func() {
+		mstore.data.Store("test_evict", mstore.newDataItem("test_evict", mapOf(map[string]interface{}{"foo": "bar"}), -10))
+		mstore.data.Store("test_keep", mstore.newDataItem("test_keep", mapOf(map[string]interface{}{"foo": "baz"}), 10))
+
+		mstore.sweep()
+		So(evicted, ShouldResemble, map[string]interface{}{"test_evict": true, "test_evict_foo": "bar"})
+		So(mstore.data.Len(), ShouldEqual, 1)
+	})
+	Convey("Test memory store callback before eviction by a request may use the store", t, func() {
+		var errs []error
+		var mstore *memoryStore
+		mstore = NewMemoryStore(WithoutGC(), WithBeforeEvict(func(sid string, values map[string]interface{}) {
+			errs = append(errs, mstore.Freeze(context.Background(), sid))
+		})).(*memoryStore)
+		defer mstore.Close()
+
+		mstore.data.Store("test_evict_request", mstore.newDataItem("test_evict_request", valueMap{}, -10))
+		_, err := mstore.Update(context.Background(), "test_evict_request", 10)
+		So(err, ShouldNotBeNil)
+		So(errs, ShouldResemble, []error{ErrSessionNotFound})
+	})
+}
+
+func TestMemoryStoreWithoutGC(t *testing.T) {
+	mstore := NewMemoryStore(WithoutGC()).(*memoryStore)
+
+	Convey("Test memory store without gc", t, func() {
+		So(mstore.ticker, ShouldBeNil)
+
+		mstore.data.Store("test_without_gc", mstore.newDataItem("test_without_gc", valueMap{}, -10))
+		mstore.data.Store("test_without_gc2", mstore.newDataItem("test_without_gc2", valueMap{}, -10))
+		mstore.data.Store("test_without_gc3", mstore.newDataItem("test_without_gc3", valueMap{}, 10))
+
+		exists, err := mstore.Check(context.Background(), "test_without_gc")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+		So(mstore.data.Len(), ShouldEqual, 2)
+
+		n, err := mstore.DeleteExpired(context.Background())
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+		So(mstore.data.Len(), ShouldEqual, 1)
+		So(mstore.Close(), ShouldBeNil)
+	})
+}
+
+func TestMemoryStoreExpirations(t *testing.T) {
+	mstore := NewMemoryStore(WithoutGC()).(*memoryStore)
+
+	Convey("Test memory store expiration notifications", t, func() {
+		mstore.data.Store("test_expirations", mstore.newDataItem("test_expirations", valueMap{}, -10))
+		store, err := mstore.Create(context.Background(), "test_expirations2", 10)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		_, err = mstore.DeleteExpired(context.Background())
+		So(err, ShouldBeNil)
+		So(mstore.Delete(context.Background(), "test_expirations2"), ShouldBeNil)
+
+		expirations := mstore.Expirations()
+		So(<-expirations, ShouldEqual, "test_expirations")
+		So(<-expirations, ShouldEqual, "test_expirations2")
+
+		for i := 0; i < expirationsSize+1; i++ {
+			mstore.notifyExpired(fmt.Sprintf("test_expirations_%d", i))
+		}
+		So(len(expirations), ShouldEqual, expirationsSize)
+		So(<-expirations, ShouldEqual, "test_expirations_1")
+	})
+}
+
+func TestMemoryStoreMaxSessionsPerUser(t *testing.T) {
+	mstore := NewMemoryStore(WithoutGC(), WithMaxSessionsPerUser(2, "user_id")).(*memoryStore)
+
+	Convey("Test memory store maximum sessions per user", t, func() {
+		for _, sid := range []string{"test_user_1", "test_user_2", "test_user_3"} {
+			store, err := mstore.Create(context.Background(), sid, 10)
+			So(err, ShouldBeNil)
+			store.Set("user_id", 1)
+			So(store.Save(), ShouldBeNil)
+		}
+
+		store, err := mstore.Create(context.Background(), "test_user_other", 10)
+		So(err, ShouldBeNil)
+		store.Set("user_id", 2)
+		So(store.Save(), ShouldBeNil)
+
+		exists, err := mstore.Check(context.Background(), "test_user_1")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+		So(<-mstore.Expirations(), ShouldEqual, "test_user_1")
+
+		for _, sid := range []string{"test_user_2", "test_user_3", "test_user_other"} {
+			exists, err := mstore.Check(context.Background(), sid)
+			So(err, ShouldBeNil)
+			So(exists, ShouldBeTrue)
+		}
+	})
+}
+
+func TestMemoryStoreSaveDuringGC(t *testing.T) {
+	mstore := NewMemoryStore(WithoutGC()).(*memoryStore)
+
+	Convey("Test memory store save resets the expiration before a gc sweep", t, func() {
+		sid := "test_save_during_gc"
+		mstore.data.Store(sid, mstore.newDataItem(sid, valueMap{}, 0))
+
+		store := newStore(context.Background(), mstore, sid, 10, valueMap{}, 0, time.Time{})
+		store.Set("foo", "bar")
+		So(store.Save(), ShouldBeNil)
+
+		n, err := mstore.DeleteExpired(context.Background())
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 0)
+
+		exists, err := mstore.Check(context.Background(), sid)
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeTrue)
+	})
+}
+
+func TestMemoryStoreSaveSlidesExpiration(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test memory store repeated saves keep the session alive", t, func() {
+		sid := "test_save_slides_expiration"
+		store, err := mstore.Create(context.Background(), sid, 1)
+		So(err, ShouldBeNil)
+
+		for i := 0; i < 5; i++ {
+			store.Set("foo", i)
+			So(store.Save(), ShouldBeNil)
+			time.Sleep(time.Millisecond * 300)
+		}
+
+		exists, err := mstore.Check(context.Background(), sid)
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeTrue)
+	})
+}
+
+func TestMemoryStoreErrors(t *testing.T) {
+	mstore := NewMemoryStore(WithoutGC()).(*memoryStore)
+
+	Convey("Test memory store errors", t, func() {
+		_, err := mstore.Update(context.Background(), "test_errors", 10)
+		So(errors.Is(err, ErrSessionNotFound), ShouldBeTrue)
+
+		mstore.data.Store("test_errors", mstore.newDataItem("test_errors", valueMap{}, -10))
+		_, err = mstore.Update(context.Background(), "test_errors", 10)
+		So(errors.Is(err, ErrSessionExpired), ShouldBeTrue)
+
+		store, err := mstore.Create(context.Background(), "test_errors", 10)
+		So(err, ShouldBeNil)
+
+		So(mstore.Close(), ShouldBeNil)
+		So(mstore.Close(), ShouldBeNil)
+		So(store.Save(), ShouldEqual, ErrStoreClosed)
+		So(mstore.Ping(context.Background()), ShouldEqual, ErrStoreClosed)
+
+		_, err = mstore.Check(context.Background(), "test_errors")
+		So(err, ShouldEqual, ErrStoreClosed)
+		_, err = mstore.Create(context.Background(), "test_errors", 10)
+		So(err, ShouldEqual, ErrStoreClosed)
+	})
+}
+
+func TestMemoryStoreSlidingOnGet(t *testing.T) {
+	mstore := NewMemoryStore(WithSlidingOnGet("last_seen"))
+
+	Convey("Test memory store sliding expiration on get", t, func() {
+		sid := "test_sliding_on_get"
+		store, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(ValueStore).SetAll(map[string]interface{}{"last_seen": 1, "config": 2}), ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		dt, _ := mstore.(*memoryStore).data.Load(sid)
+		item := dt.(*dataItem)
+		item.Lock()
+		item.expiredAt = mstore.(*memoryStore).now().Add(time.Second)
+		item.Unlock()
+
+		store.Get("config")
+		ttl, err := TimeToLive(context.Background(), mstore, sid)
+		So(err, ShouldBeNil)
+		So(ttl, ShouldBeLessThanOrEqualTo, time.Second)
+
+		store.Get("last_seen")
+		ttl, err = TimeToLive(context.Background(), mstore, sid)
+		So(err, ShouldBeNil)
+		So(ttl, ShouldBeGreaterThan, time.Second*9)
+	})
+}
+
+func TestMemoryStoreDumpRestore(t *testing.T) {
+	mstore := NewMemoryStore(WithoutGC()).(*memoryStore)
+
+	Convey("Test memory store dump and restore", t, func() {
+		store, err := mstore.Create(context.Background(), "test_dump", 10)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		So(store.Save(), ShouldBeNil)
+		mstore.data.Store("test_dump_expired", mstore.newDataItem("test_dump_expired", valueMap{}, -10))
+
+		data, err := mstore.Dump()
+		So(err, ShouldBeNil)
+
+		restored := NewMemoryStore(WithoutGC())
+		So(restored.(Dumper).Restore(data), ShouldBeNil)
+		So(restored.(*memoryStore).data.Len(), ShouldEqual, 1)
+
+		store, err = restored.Update(context.Background(), "test_dump", 10)
+		So(err, ShouldBeNil)
+		foo, ok := store.Get("foo")
+		So(ok, ShouldBeTrue)
+		So(foo, ShouldEqual, "bar")
+	})
+}
+
+func TestMemoryStoreMaxTTL(t *testing.T) {
+	mstore := NewMemoryStore(WithMaxTTL(time.Minute), WithDefaultTTL(time.Second*30))
+
+	Convey("Test memory store maximum expiration time", t, func() {
+		for _, c := range []struct {
+			sid     string
+			expired int64
+			ttl     time.Duration
+		}{
+			{"test_max_ttl_clamp", 3600, time.Minute},
+			{"test_max_ttl_keep", 10, time.Second * 10},
+			{"test_max_ttl_zero", 0, time.Second * 30},
+		} {
+			store, err := mstore.Create(context.Background(), c.sid, c.expired)
+			So(err, ShouldBeNil)
+			So(store.Save(), ShouldBeNil)
+
+			ttl, err := TimeToLive(context.Background(), mstore, c.sid)
+			So(err, ShouldBeNil)
+			So(ttl, ShouldBeGreaterThan, c.ttl-time.Second)
+			So(ttl, ShouldBeLessThanOrEqualTo, c.ttl)
+		}
+
+		_, err := mstore.Refresh(context.Background(), "test_max_ttl_keep", "test_max_ttl_refresh", 3600)
+		So(err, ShouldBeNil)
+		ttl, err := TimeToLive(context.Background(), mstore, "test_max_ttl_refresh")
+		So(err, ShouldBeNil)
+		So(ttl, ShouldBeLessThanOrEqualTo, time.Minute)
+	})
+}
+
+func TestMemoryStoreInvalidTTL(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test memory store rejects invalid expiration times", t, func() {
+		for _, expired := range []int64{-2, -3600} {
+			_, err := mstore.Create(context.Background(), "test_invalid_ttl", expired)
+			So(err, ShouldEqual, ErrInvalidTTL)
+			_, err = mstore.Update(context.Background(), "test_invalid_ttl", expired)
+			So(err, ShouldEqual, ErrInvalidTTL)
+			_, err = mstore.Refresh(context.Background(), "test_invalid_ttl", "test_invalid_ttl2", expired)
+			So(err, ShouldEqual, ErrInvalidTTL)
+		}
+	})
+}
+
+func TestMemoryStoreNoExpiry(t *testing.T) {
+	mstore := NewMemoryStore(WithoutGC()).(*memoryStore)
+
+	Convey("Test memory store sessions that never expire", t, func() {
+		sid := "test_no_expiry"
+		store, err := mstore.Create(context.Background(), sid, NoExpiry)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		So(store.Save(), ShouldBeNil)
+
+		ttl, err := mstore.TimeToLive(context.Background(), sid)
+		So(err, ShouldBeNil)
+		So(ttl, ShouldEqual, InfiniteTTL)
+
+		n, err := mstore.DeleteExpired(context.Background())
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 0)
+
+		store, err = mstore.Update(context.Background(), sid, NoExpiry)
+		So(err, ShouldBeNil)
+		foo, ok := store.Get("foo")
+		So(ok, ShouldBeTrue)
+		So(foo, ShouldEqual, "bar")
+
+		data, err := mstore.Dump()
+		So(err, ShouldBeNil)
+		restored := NewMemoryStore(WithoutGC())
+		So(restored.(Dumper).Restore(data), ShouldBeNil)
+		exists, err := restored.Check(context.Background(), sid)
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeTrue)
+	})
+}
+
+func TestMemoryStoreKeySchema(t *testing.T) {
+	mstore := NewMemoryStore(WithKeySchema(map[string]reflect.Kind{
+		"user_id": reflect.Int,
+		"roles":   reflect.Slice,
+	}))
+
+	Convey("Test memory store validates values against the key schema", t, func() {
+		store, err := mstore.Create(context.Background(), "test_key_schema", 10)
+		So(err, ShouldBeNil)
+
+		store.Set("user_id", 42)
+		So(store.(ValueStore).SetChecked("user_id", "42"), ShouldEqual, ErrTypeMismatch)
+		So(store.(ValueStore).SetChecked("user_id", nil), ShouldEqual, ErrTypeMismatch)
+		store.Set("roles", []string{"admin"})
+		store.Set("other", "anything")
+
+		ok, err := store.(ValueStore).SetIfAbsent("roles", "admin")
+		So(ok, ShouldBeFalse)
+		So(err, ShouldBeNil)
+		store.Delete("roles")
+		ok, err = store.(ValueStore).SetIfAbsent("roles", "admin")
+		So(ok, ShouldBeFalse)
+		So(err, ShouldEqual, ErrTypeMismatch)
+
+		So(store.(ValueStore).SetAll(map[string]interface{}{"user_id": 7, "roles": "admin"}), ShouldEqual, ErrTypeMismatch)
+		userID, _ := store.Get("user_id")
+		So(userID, ShouldEqual, 42)
+	})
+}
+
+// A clock for the memory store that runs with the real time, moved forward by advance
+type testClock struct {
+	offset atomic.Int64
+}
+
+func (c *testClock) now() time.Time {
+	return time.Now().Add(time.Duration(c.offset.Load()))
+}
+
+// move the clock forward and run a gc sweep of the memory store, returns the number of sessions evicted
+func (c *testClock) advance(mstore ManagerStore, d time.Duration) int {
+	c.offset.Add(int64(d))
+	return mstore.(*memoryStore).sweep()
+}
+
+func TestMemoryStoreClock(t *testing.T) {
+	current := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mstore := NewMemoryStore(WithoutGC(), WithClock(func() time.Time { return current }))
+
+	Convey("Test memory store with an injected clock", t, func() {
+		store, err := mstore.Create(context.Background(), "test_clock", 10)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		current = current.Add(time.Second * 4)
+		ttl, err := TimeToLive(context.Background(), mstore, "test_clock")
+		So(err, ShouldBeNil)
+		So(ttl, ShouldEqual, time.Second*6)
+
+		current = current.Add(time.Second * 5)
+		n, err := mstore.(ExpiredDeleter).DeleteExpired(context.Background())
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 0)
+		current = current.Add(time.Second)
+		n, _ = mstore.(ExpiredDeleter).DeleteExpired(context.Background())
+		So(n, ShouldEqual, 1)
+		exists, err := mstore.Check(context.Background(), "test_clock")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+	})
+}
+
+func TestMemoryStoreGetInto(t *testing.T) {
+	type profile struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+	mstore := NewMemoryStore()
+
+	Convey("Test memory store get session value into a destination", t, func() {
+		store, err := mstore.Create(context.Background(), "test_get_into", 10)
+		So(err, ShouldBeNil)
+		So(store.(ValueStore).SetAll(map[string]interface{}{
+			"profile": profile{Name: "foo", Age: 42},
+			"map":     map[string]interface{}{"name": "bar", "age": 7},
+			"json":    []byte(`{"name":"baz","age":3}`),
+			"count":   1,
+		}), ShouldBeNil)
+
+		var p profile
+		So(store.(ValueStore).GetInto("profile", &p), ShouldBeNil)
+		So(p, ShouldResemble, profile{Name: "foo", Age: 42})
+		So(store.(ValueStore).GetInto("map", &p), ShouldBeNil)
+		So(p, ShouldResemble, profile{Name: "bar", Age: 7})
+		So(store.(ValueStore).GetInto("json", &p), ShouldBeNil)
+		So(p, ShouldResemble, profile{Name: "baz", Age: 3})
+
+		var raw []byte
+		So(store.(ValueStore).GetInto("json", &raw), ShouldBeNil)
+		So(string(raw), ShouldEqual, `{"name":"baz","age":3}`)
+
+		So(store.(ValueStore).GetInto("count", &p), ShouldEqual, ErrTypeMismatch)
+		So(store.(ValueStore).GetInto("missing", &p), ShouldEqual, ErrKeyNotFound)
+		So(store.(ValueStore).GetInto("profile", p), ShouldNotBeNil)
+	})
+}
+
+func TestMemoryStoreNilValue(t *testing.T) {
+	Convey("Test memory store tells a nil value from a key that is not set", t, func() {
+		for _, opts := range [][]MemoryStoreOption{nil, {WithCodec(JSONCodec)}, {WithConcurrentValues()}} {
+			mstore := NewMemoryStore(opts...)
+			store, err := mstore.Create(context.Background(), "test_nil_value", 10)
+			So(err, ShouldBeNil)
+			store.Set("nil", nil)
+
+			v, ok := store.Get("nil")
+			So(v, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			v, ok = store.Get("missing")
+			So(v, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+
+			So(store.Save(), ShouldBeNil)
+			store, err = mstore.Update(context.Background(), "test_nil_value", 10)
+			So(err, ShouldBeNil)
+			_, ok = store.Get("nil")
+			So(ok, ShouldBeTrue)
+			_, ok = store.(TypedStore).GetTyped("nil")
+			So(ok, ShouldBeTrue)
+			_, ok = store.(TypedStore).GetTyped("missing")
+			So(ok, ShouldBeFalse)
+
+			// the typed getters report false for nil, it is not a string
+			_, ok = store.GetString("nil")
+			So(ok, ShouldBeFalse)
+
+			p := new(int)
+			So(store.(ValueStore).GetInto("nil", &p), ShouldBeNil)
+			So(p, ShouldBeNil)
+			So(store.(ValueStore).GetInto("missing", &p), ShouldEqual, ErrKeyNotFound)
+
+			sub := store.(SubStorer).SubStore("sub")
+			sub.Set("nil", nil)
+			_, ok = sub.Get("nil")
+			So(ok, ShouldBeTrue)
+			_, ok = sub.Get("missing")
+			So(ok, ShouldBeFalse)
+		}
+	})
+}
+
+func TestMemoryStoreUUID(t *testing.T) {
+	id := uuid.New()
+
+	Convey("Test memory store UUID session values", t, func() {
+		for _, opts := range [][]MemoryStoreOption{nil, {WithCodec(JSONCodec)}} {
+			mstore := NewMemoryStore(opts...)
+			store, err := mstore.Create(context.Background(), "test_uuid", 10)
+			So(err, ShouldBeNil)
+			So(store.(ValueStore).SetUUID("id", id), ShouldBeNil)
+			store.Set("raw", id)
+			store.Set("bytes", id[:])
+			So(store.Save(), ShouldBeNil)
+
+			store, err = mstore.Update(context.Background(), "test_uuid", 10)
+			So(err, ShouldBeNil)
+			v, _ := store.Get("id")
+			So(v, ShouldEqual, id.String())
+			for _, key := range []string{"id", "raw", "bytes"} {
+				got, ok := store.GetUUID(key)
+				So(ok, ShouldBeTrue)
+				So(got, ShouldEqual, id)
+			}
+		}
+
+		store, err := NewMemoryStore().Create(context.Background(), "test_uuid", 10)
+		So(err, ShouldBeNil)
+		store.Set("invalid", "not a uuid")
+		store.Set("short", base64.StdEncoding.EncodeToString([]byte("too short")))
+		_, ok := store.GetUUID("invalid")
+		So(ok, ShouldBeFalse)
+		_, ok = store.GetUUID("short")
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestMemoryStoreCopyOnGet(t *testing.T) {
+	type item struct {
+		Tags []string
+	}
+	mstore := NewMemoryStore(WithCopyOnGet())
+
+	Convey("Test memory store copies values on get", t, func() {
+		store, err := mstore.Create(context.Background(), "test_copy_on_get", 10)
+		So(err, ShouldBeNil)
+		So(store.(ValueStore).SetAll(map[string]interface{}{
+			"roles": []string{"admin"},
+			"prefs": map[string]interface{}{"theme": "dark", "langs": []string{"en"}},
+			"item":  &item{Tags: []string{"a"}},
+		}), ShouldBeNil)
+
+		roles, _ := store.Get("roles")
+		roles.([]string)[0] = "guest"
+		prefs, _ := store.Get("prefs")
+		prefs.(map[string]interface{})["theme"] = "light"
+		prefs.(map[string]interface{})["langs"].([]string)[0] = "nl"
+		it, _ := store.Get("item")
+		it.(*item).Tags[0] = "b"
+
+		roles, _ = store.Get("roles")
+		So(roles, ShouldResemble, []string{"admin"})
+		prefs, _ = store.Get("prefs")
+		So(prefs, ShouldResemble, map[string]interface{}{"theme": "dark", "langs": []string{"en"}})
+		it, _ = store.Get("item")
+		So(it, ShouldResemble, &item{Tags: []string{"a"}})
+	})
+
+	Convey("Test memory store copies values with cycles on get", t, func() {
+		type node struct {
+			Name string
+			Next *node
+		}
+		store, err := mstore.Create(context.Background(), "test_copy_on_get_cycles", 10)
+		So(err, ShouldBeNil)
+		n := &node{Name: "a"}
+		n.Next = n
+		m := map[string]interface{}{"name": "m"}
+		m["self"] = m
+		So(store.(ValueStore).SetAll(map[string]interface{}{"node": n, "map": m}), ShouldBeNil)
+
+		v, _ := store.Get("node")
+		c := v.(*node)
+		So(c, ShouldNotPointTo, n)
+		So(c.Next, ShouldPointTo, c)
+		v, _ = store.Get("map")
+		cm := v.(map[string]interface{})
+		cm["name"] = "changed"
+		So(cm["self"].(map[string]interface{})["name"], ShouldEqual, "changed")
+		So(m["name"], ShouldEqual, "m")
+	})
+}
+
+func TestMemoryStoreSaveIfVersion(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test memory store optimistic concurrency with session versions", t, func() {
+		sid := "test_save_if_version"
+		store, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(VersionedStore).Version(), ShouldEqual, 0)
+		So(store.(VersionedStore).SaveIfVersion(0), ShouldBeNil)
+		So(store.(VersionedStore).Version(), ShouldEqual, 1)
+
+		first, err := mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		second, err := mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(first.(VersionedStore).Version(), ShouldEqual, 1)
+		So(second.(VersionedStore).Version(), ShouldEqual, 1)
+
+		So(second.Save(), ShouldBeNil)
+		So(second.(VersionedStore).Version(), ShouldEqual, 2)
+		So(first.(VersionedStore).SaveIfVersion(first.(VersionedStore).Version()), ShouldEqual, ErrVersionConflict)
+		So(first.(VersionedStore).Version(), ShouldEqual, 1)
+
+		store, err = mstore.Refresh(context.Background(), sid, "test_save_if_version2", 10)
+		So(err, ShouldBeNil)
+		So(store.(VersionedStore).Version(), ShouldEqual, 2)
+		So(store.(VersionedStore).SaveIfVersion(2), ShouldBeNil)
+		So(store.(VersionedStore).Version(), ShouldEqual, 3)
+
+		store, err = mstore.Create(context.Background(), "test_save_if_version3", 10)
+		So(err, ShouldBeNil)
+		So(store.(VersionedStore).SaveIfVersion(1), ShouldEqual, ErrVersionConflict)
+	})
+}
+
+func TestMemoryStoreDeleteWhere(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test memory store delete sessions matching a predicate", t, func() {
+		for sid, tenant := range map[string]string{"test_delete_where1": "foo", "test_delete_where2": "bar", "test_delete_where3": "foo"} {
+			store, err := mstore.Create(context.Background(), sid, 10)
+			So(err, ShouldBeNil)
+			store.Set("tenant", tenant)
+			So(store.Save(), ShouldBeNil)
+		}
+
+		n, err := mstore.(ConditionalDeleter).DeleteWhere(context.Background(), func(sid string, values map[string]interface{}, expiresAt time.Time) bool {
+			So(expiresAt.IsZero(), ShouldBeFalse)
+			return values["tenant"] == "foo"
+		})
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+
+		for sid, exists := range map[string]bool{"test_delete_where1": false, "test_delete_where2": true, "test_delete_where3": false} {
+			ok, err := mstore.Check(context.Background(), sid)
+			So(err, ShouldBeNil)
+			So(ok, ShouldEqual, exists)
+		}
+	})
+}
+
+func TestMemoryStoreSaveReturn(t *testing.T) {
+	mstore := NewMemoryStore(WithCodec(JSONCodec), WithSaveHook(func(sid string, values map[string]interface{}) error {
+		values["saved_by"] = "hook"
+		return nil
+	}))
+
+	Convey("Test memory store save returning the stored session", t, func() {
+		store, err := mstore.Create(context.Background(), "test_save_return", 10)
+		So(err, ShouldBeNil)
+		store.Set("count", 1)
+
+		saved, err := store.(VersionedStore).SaveReturn()
+		So(err, ShouldBeNil)
+		So(saved.SessionID(), ShouldEqual, "test_save_return")
+		So(saved.(VersionedStore).Version(), ShouldEqual, 1)
+		count, _ := saved.Get("count")
+		So(count, ShouldEqual, float64(1))
+		savedBy, _ := saved.GetString("saved_by")
+		So(savedBy, ShouldEqual, "hook")
+	})
+}
+
+func TestMemoryStoreExpiringWithin(t *testing.T) {
+	clock := &testClock{}
+	mstore := NewMemoryStore(WithClock(clock.now), WithoutGC())
+
+	Convey("Test memory store sessions expiring within a duration", t, func() {
+		for sid, expired := range map[string]int64{
+			"test_expiring_within1": 20,
+			"test_expiring_within2": 5,
+			"test_expiring_within3": 60,
+			"test_expiring_within4": NoExpiry,
+		} {
+			store, err := mstore.Create(context.Background(), sid, expired)
+			So(err, ShouldBeNil)
+			So(store.Save(), ShouldBeNil)
+		}
+
+		sids, err := mstore.(ExpiringLister).ExpiringWithin(context.Background(), time.Second*30)
+		So(err, ShouldBeNil)
+		So(sids, ShouldResemble, []string{"test_expiring_within2", "test_expiring_within1"})
+
+		clock.advance(mstore, time.Second*10)
+		sids, err = mstore.(ExpiringLister).ExpiringWithin(context.Background(), time.Second*30)
+		So(err, ShouldBeNil)
+		So(sids, ShouldResemble, []string{"test_expiring_within1"})
+	})
+}
+
+func TestMemoryStoreString(t *testing.T) {
+	Convey("Test memory store string representation of a session", t, func() {
+		mstore := NewMemoryStore(WithRedactedKeys("token"))
+		store, err := mstore.Create(context.Background(), "test_string", 10)
+		So(err, ShouldBeNil)
+		So(store.(ValueStore).SetAll(map[string]interface{}{"user": "foo", "token": "secret", "age": 42}), ShouldBeNil)
+		So(fmt.Sprint(store), ShouldEqual, "session *** {age: 42, token: ***, user: foo}")
+
+		mstore = NewMemoryStore(WithShowSID())
+		store, err = mstore.Create(context.Background(), "test_string", 10)
+		So(err, ShouldBeNil)
+		store.Set("token", "secret")
+		So(fmt.Sprint(store), ShouldEqual, "session test_string {token: secret}")
+	})
+}
+
+func TestMemoryStoreMarshalJSON(t *testing.T) {
+	Convey("Test memory store JSON representation of a session", t, func() {
+		now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		clock := func() time.Time { return now }
+		mstore := NewMemoryStore(WithoutGC(), WithClock(clock), WithRedactedKeys("token"))
+		store, err := mstore.Create(context.Background(), "test_marshal_json", 10)
+		So(err, ShouldBeNil)
+		So(store.(ValueStore).SetAll(map[string]interface{}{"user": "foo", "token": "secret"}), ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		data, err := json.Marshal(store)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `{"sid":"***","expires_at":"2024-01-02T03:04:15Z","values":{"token":"***","user":"foo"}}`)
+
+		mstore = NewMemoryStore(WithoutGC(), WithShowSID())
+		store, err = mstore.Create(context.Background(), "test_marshal_json", NoExpiry)
+		So(err, ShouldBeNil)
+		store.Set("token", "secret")
+		data, err = json.Marshal(store)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `{"sid":"test_marshal_json","expires_at":null,"values":{"token":"secret"}}`)
+	})
+}
+
+func TestMemoryStoreRotate(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test memory store rotate the session id in place", t, func() {
+		store, err := mstore.Create(context.Background(), "test_rotate", 10)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		So(store.Save(), ShouldBeNil)
+
+		So(store.(Rotator).Rotate("test_rotate2"), ShouldBeNil)
+		So(store.SessionID(), ShouldEqual, "test_rotate2")
+		exists, err := mstore.Check(context.Background(), "test_rotate")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+
+		store.Set("foo", "baz")
+		So(store.Save(), ShouldBeNil)
+		store, err = mstore.Update(context.Background(), "test_rotate2", 10)
+		So(err, ShouldBeNil)
+		foo, _ := store.GetString("foo")
+		So(foo, ShouldEqual, "baz")
+
+		store, err = mstore.Create(context.Background(), "test_rotate3", 10)
+		So(err, ShouldBeNil)
+		So(store.(Rotator).Rotate("test_rotate4"), ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+		exists, err = mstore.Check(context.Background(), "test_rotate4")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeTrue)
+	})
+
+	Convey("Test memory store rotate does not overwrite an existing session", t, func() {
+		ctx := context.Background()
+		other, err := mstore.Create(ctx, "test_rotate_taken", 10)
+		So(err, ShouldBeNil)
+		other.Set("owner", "other")
+		So(other.Save(), ShouldBeNil)
+		So(mstore.(Freezer).Freeze(ctx, "test_rotate_taken"), ShouldBeNil)
+
+		store, err := mstore.Create(ctx, "test_rotate_mine", 10)
+		So(err, ShouldBeNil)
+		store.Set("owner", "me")
+		So(store.Save(), ShouldBeNil)
+		So(store.(Rotator).Rotate("test_rotate_taken"), ShouldEqual, ErrSessionExists)
+		So(store.SessionID(), ShouldEqual, "test_rotate_mine")
+		_, err = mstore.Refresh(ctx, "test_rotate_mine", "test_rotate_taken", 10)
+		So(err, ShouldEqual, ErrSessionExists)
+
+		So(mstore.(Freezer).Unfreeze(ctx, "test_rotate_taken"), ShouldBeNil)
+		other, err = mstore.Update(ctx, "test_rotate_taken", 10)
+		So(err, ShouldBeNil)
+		owner, _ := other.GetString("owner")
+		So(owner, ShouldEqual, "other")
+
+		// moving a session to its own session id keeps it
+		So(store.(Rotator).Rotate("test_rotate_mine"), ShouldBeNil)
+		store, err = mstore.Refresh(ctx, "test_rotate_mine", "test_rotate_mine", 10)
+		So(err, ShouldBeNil)
+		owner, _ = store.GetString("owner")
+		So(owner, ShouldEqual, "me")
+		exists, err := mstore.Check(ctx, "test_rotate_mine")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeTrue)
+	})
+}
+
+func TestMemoryStoreCaseInsensitiveKeys(t *testing.T) {
+	mstore := NewMemoryStore(WithCaseInsensitiveKeys(), WithKeySchema(map[string]reflect.Kind{"User-Id": reflect.Int}))
+
+	Convey("Test memory store case-insensitive session keys", t, func() {
+		store, err := mstore.Create(context.Background(), "test_case_insensitive_keys", 10)
+		So(err, ShouldBeNil)
+
+		store.Set("User-Id", 42)
+		So(store.(ValueStore).SetChecked("USER-ID", "42"), ShouldEqual, ErrTypeMismatch)
+		userID, ok := store.GetInt("user-id")
+		So(ok, ShouldBeTrue)
+		So(userID, ShouldEqual, 42)
+		So(store.(ValueStore).SetAll(map[string]interface{}{"Theme": "dark"}), ShouldBeNil)
+		ok, err = store.(ValueStore).SetIfAbsent("THEME", "light")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+		So(store.(ValueStore).Keys(), ShouldHaveLength, 2)
+		So(store.(ValueStore).Keys(), ShouldContain, "user-id")
+		So(store.(ValueStore).Keys(), ShouldContain, "theme")
+
+		So(store.Delete("USER-id"), ShouldEqual, 42)
+		theme, ok := store.(ValueStore).Pop("tHeMe")
+		So(ok, ShouldBeTrue)
+		So(theme, ShouldEqual, "dark")
+		So(store.(ValueStore).Keys(), ShouldBeEmpty)
+	})
+}
+
+func TestMemoryStoreBulkLoad(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test memory store bulk load sessions", t, func() {
+		err := mstore.(BulkLoader).BulkLoad(context.Background(), map[string]SessionData{
+			"test_bulk_load1": {Values: map[string]interface{}{"foo": "bar"}, ExpiresAt: time.Now().Add(time.Minute)},
+			"test_bulk_load2": {ExpiresAt: time.Now().Add(-time.Minute)},
+			"test_bulk_load3": {Values: map[string]interface{}{"foo": "baz"}},
+		})
+		So(err, ShouldBeNil)
+
+		store, err := mstore.Update(context.Background(), "test_bulk_load1", 10)
+		So(err, ShouldBeNil)
+		foo, _ := store.GetString("foo")
+		So(foo, ShouldEqual, "bar")
+
+		exists, err := mstore.Check(context.Background(), "test_bulk_load2")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+
+		ttl, err := TimeToLive(context.Background(), mstore, "test_bulk_load3")
+		So(err, ShouldBeNil)
+		So(ttl, ShouldBeBetweenOrEqual, time.Second*7199, time.Second*7200)
+	})
+
+	Convey("Test memory store bulk load checks the sessions like a save", t, func() {
+		mstore := NewMemoryStore(
+			WithMaxTTL(time.Minute),
+			WithGlobalMaxSessions(2, RejectNewSessions),
+			WithSaveHook(func(sid string, values map[string]interface{}) error {
+				if _, ok := values["invalid"]; ok {
+					return ErrInvalidEnumValue
+				}
+				return nil
+			}),
+		)
+
+		err := mstore.(BulkLoader).BulkLoad(context.Background(), map[string]SessionData{
+			"test_bulk_load_max_ttl": {ExpiresAt: time.Now().Add(time.Hour)},
+		})
+		So(err, ShouldBeNil)
+		ttl, err := TimeToLive(context.Background(), mstore, "test_bulk_load_max_ttl")
+		So(err, ShouldBeNil)
+		So(ttl, ShouldBeLessThanOrEqualTo, time.Minute)
+
+		err = mstore.(BulkLoader).BulkLoad(context.Background(), map[string]SessionData{
+			"test_bulk_load_hook": {Values: map[string]interface{}{"invalid": true}},
+		})
+		So(err, ShouldEqual, ErrInvalidEnumValue)
+
+		err = mstore.(BulkLoader).BulkLoad(context.Background(), map[string]SessionData{
+			"test_bulk_load_full1": {},
+			"test_bulk_load_full2": {},
+		})
+		So(err, ShouldEqual, ErrStoreFull)
+		n, _ := Count(context.Background(), mstore)
+		So(n, ShouldEqual, 2)
+	})
+}
+
+func TestMemoryStorePromote(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test memory store promote anonymous sessions", t, func() {
+		for _, sid := range []string{"test_promote", "test_promote2"} {
+			store, err := mstore.Create(context.Background(), sid, 60)
+			So(err, ShouldBeNil)
+			store.Set("cart", "foo")
+			So(store.Save(), ShouldBeNil)
+			So(Authenticated(store), ShouldBeFalse)
+		}
+
+		store, err := mstore.(Promoter).Promote(context.Background(), "test_promote", 3600)
+		So(err, ShouldBeNil)
+		So(store.SessionID(), ShouldEqual, "test_promote")
+		So(Authenticated(store), ShouldBeTrue)
+		cart, _ := store.GetString("cart")
+		So(cart, ShouldEqual, "foo")
+		ttl, err := TimeToLive(context.Background(), mstore, "test_promote")
+		So(err, ShouldBeNil)
+		So(ttl, ShouldBeGreaterThan, time.Minute*59)
+
+		store, err = mstore.(Promoter).Promote(context.Background(), "test_promote2", 3600, WithNewSessionID("test_promote3"))
+		So(err, ShouldBeNil)
+		So(store.SessionID(), ShouldEqual, "test_promote3")
+		So(Authenticated(store), ShouldBeTrue)
+		exists, err := mstore.Check(context.Background(), "test_promote2")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+		store, err = mstore.Update(context.Background(), "test_promote3", 3600)
+		So(err, ShouldBeNil)
+		So(Authenticated(store), ShouldBeTrue)
+
+		_, err = mstore.(Promoter).Promote(context.Background(), "test_promote4", 3600, WithNewSessionID("test_promote5"))
+		So(err, ShouldEqual, ErrSessionNotFound)
+		exists, err = mstore.Check(context.Background(), "test_promote5")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+	})
+}
+
+func TestMemoryStoreMergeOnSave(t *testing.T) {
+	mstore := NewMemoryStore(WithMergeOnSave())
+
+	Convey("Test memory store merge changed values on save", t, func() {
+		sid := "test_merge_on_save"
+		store, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(ValueStore).SetAll(map[string]interface{}{"foo": "bar", "baz": "qux"}), ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		first, err := mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		second, err := mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+
+		first.Set("first", 1)
+		first.Delete("baz")
+		second.Set("second", 2)
+		So(first.Save(), ShouldBeNil)
+		So(second.Save(), ShouldBeNil)
+
+		store, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(ValueStore).Keys(), ShouldHaveLength, 3)
+		for key, value := range map[string]interface{}{"foo": "bar", "first": 1, "second": 2} {
+			v, ok := store.Get(key)
+			So(ok, ShouldBeTrue)
+			So(v, ShouldEqual, value)
+		}
+		So(second.(ValueStore).Keys(), ShouldHaveLength, 3)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				store, err := mstore.Update(context.Background(), sid, 10)
+				if err == nil {
+					store.Set(fmt.Sprintf("key%d", i), i)
+					store.Save()
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		store, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(ValueStore).Keys(), ShouldHaveLength, 13)
+	})
+}
+
+func TestMemoryStoreRefreshThreshold(t *testing.T) {
+	var nearExpiry []string
+	clock := &testClock{}
+	mstore := NewMemoryStore(WithClock(clock.now), WithoutGC(), WithRefreshThreshold(time.Second*5, func(s Store) {
+		nearExpiry = append(nearExpiry, s.SessionID())
+	}))
+
+	Convey("Test memory store callback for sessions near expiry", t, func() {
+		store, err := mstore.Create(context.Background(), "test_refresh_threshold", 10)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		_, err = mstore.Update(context.Background(), "test_refresh_threshold", 10)
+		So(err, ShouldBeNil)
+		So(nearExpiry, ShouldBeEmpty)
+
+		clock.advance(mstore, time.Second*6)
+		_, err = mstore.Update(context.Background(), "test_refresh_threshold", 10)
+		So(err, ShouldBeNil)
+		So(nearExpiry, ShouldResemble, []string{"test_refresh_threshold"})
+	})
+}
+
+func TestMemoryStoreLoadValidator(t *testing.T) {
+	logger := &testLogger{}
+	mstore := NewMemoryStore(WithLogger(logger), WithLoadValidator(func(values map[string]interface{}) error {
+		if _, ok := values["user_id"].(int); !ok {
+			return errors.New("user_id is not an int")
+		}
+		return nil
+	}))
+
+	Convey("Test memory store validate session values on load", t, func() {
+		for sid, userID := range map[string]interface{}{"test_load_validator": 42, "test_load_validator2": "42"} {
+			store, err := mstore.Create(context.Background(), sid, 10)
+			So(err, ShouldBeNil)
+			store.Set("user_id", userID)
+			So(store.Save(), ShouldBeNil)
+		}
+
+		store, err := mstore.Update(context.Background(), "test_load_validator", 10)
+		So(err, ShouldBeNil)
+		userID, _ := store.GetInt("user_id")
+		So(userID, ShouldEqual, 42)
+
+		_, err = mstore.Update(context.Background(), "test_load_validator2", 10)
+		So(err, ShouldEqual, ErrSessionNotFound)
+		So(logger.logs, ShouldResemble, []string{"[WARN] session: invalid session values: user_id is not an int"})
+	})
+}
+
+func TestMemoryStoreConcurrentValues(t *testing.T) {
+	mstore := NewMemoryStore(WithConcurrentValues())
+
+	Convey("Test memory store with concurrent session values", t, func() {
+		testManagerStore(mstore)
+
+		store, err := mstore.Create(context.Background(), "test_concurrent_values", 10)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				store.Set(fmt.Sprintf("key%d", i), i)
+				store.Get("foo")
+			}(i)
+		}
+		wg.Wait()
+		So(store.(ValueStore).Keys(), ShouldHaveLength, 11)
+		So(store.Flush(), ShouldBeNil)
+		_, ok := store.Get("foo")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Test memory store reads of concurrent session values while they are reset", t, func() {
+		st, err := mstore.Create(context.Background(), "test_concurrent_values_reset", 10)
+		So(err, ShouldBeNil)
+		st.Set("foo", "bar")
+		So(st.Save(), ShouldBeNil)
+
+		// a read sees either the values before or after the reset, never a partially filled copy
+		stop := make(chan struct{})
+		var missing atomic.Int64
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if _, ok := st.Get("foo"); !ok {
+						missing.Add(1)
+					}
+				}
+			}()
+		}
+		for i := 0; i < 200; i++ {
+			st.(*store).Reset(context.Background(), "test_concurrent_values_reset", 10, map[string]interface{}{"foo": i})
+		}
+		close(stop)
+		wg.Wait()
+		So(missing.Load(), ShouldEqual, 0)
+	})
+}
+
+// Reads of a single session by many goroutines, compare with and without concurrent
+// values on the target machine, the read lock contention grows with the number of CPUs
+func benchmarkStoreGet(b *testing.B, opt ...MemoryStoreOption) {
+	store, err := NewMemoryStore(opt...).Create(context.Background(), "benchmark_store_get", 10)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 16; i++ {
+		store.Set(fmt.Sprintf("key%d", i), i)
+	}
+
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			store.Get("key8")
+		}
+	})
+}
+
+func BenchmarkStoreGet(b *testing.B) {
+	benchmarkStoreGet(b)
+}
+
+func BenchmarkStoreGetConcurrentValues(b *testing.B) {
+	benchmarkStoreGet(b, WithConcurrentValues())
+}
+
+// The allocations of a session with a single key compared to a session with several keys. The
+// changes of a single key are tracked without allocating a map, which took a session with a single
+// key from 2424 B and 20 allocs/op to 1176 B and 10 allocs/op (1832 B and 14 allocs/op with 4 keys).
+// Holding the single value inline in the session store and the stored session took it further
+// from 880 B and 6 allocs/op to 672 B and 4 allocs/op, a session with 4 keys stays at 10 allocs/op.
+func BenchmarkSessionKeys(b *testing.B) {
+	for _, n := range []int{1, 4} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			mstore := NewMemoryStore(WithoutGC())
+			ctx := context.Background()
+			keys := []string{"user_id", "foo", "bar", "baz"}[:n]
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				store, _ := mstore.Create(ctx, "bench_keys", 10)
+				for _, key := range keys {
+					store.Set(key, "value")
+				}
+				store.Save()
+				store, _ = mstore.Update(ctx, "bench_keys", 10)
+				store.Set("user_id", "value")
+				store.Save()
+			}
+		})
+	}
+}
+
+func TestSessionSingleKey(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test a session with a single key holds the value inline", t, func() {
+		sid := "test_single_key"
+		st, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		st.Set("user_id", "foo")
+		So(st.Save(), ShouldBeNil)
+		So(st.(*store).values.m, ShouldBeNil)
+
+		st, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		user, _ := st.GetString("user_id")
+		So(user, ShouldEqual, "foo")
+		dt, _ := mstore.(*memoryStore).data.Load(sid)
+		So(dt.(*dataItem).values.m, ShouldBeNil)
+
+		// the second key moves the values to a map
+		st.Set("foo", "bar")
+		So(st.(*store).values.m, ShouldResemble, map[string]interface{}{"user_id": "foo", "foo": "bar"})
+		So(st.Save(), ShouldBeNil)
+		st.Delete("foo")
+		So(st.(ValueStore).Keys(), ShouldResemble, []string{"user_id"})
+		So(st.Save(), ShouldBeNil)
+
+		st, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(st.(ValueStore).Keys(), ShouldResemble, []string{"user_id"})
+	})
+}
+
+func TestMemoryStoreReplace(t *testing.T) {
+	mstore := NewMemoryStore(WithMaxKeys(2))
+
+	Convey("Test memory store replace all session values", t, func() {
+		sid := "test_replace"
+		store, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(ValueStore).SetAll(map[string]interface{}{"foo": "bar", "baz": "qux"}), ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		values := map[string]interface{}{"name": "foo"}
+		So(store.(ValueStore).Replace(values), ShouldBeNil)
+		values["name"] = "bar"
+		So(store.(ValueStore).Keys(), ShouldResemble, []string{"name"})
+		So(store.(VersionedStore).Version(), ShouldEqual, 2)
+
+		store, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(ValueStore).Keys(), ShouldResemble, []string{"name"})
+		name, _ := store.GetString("name")
+		So(name, ShouldEqual, "foo")
+
+		So(store.(ValueStore).Replace(map[string]interface{}{"a": 1, "b": 2, "c": 3}), ShouldEqual, ErrTooManyKeys)
+		So(store.(ValueStore).Keys(), ShouldResemble, []string{"name"})
+
+		sub := store.(SubStorer).SubStore("sub")
+		sub.Set("foo", "bar")
+		So(sub.(ValueStore).Replace(map[string]interface{}{"baz": "qux"}), ShouldBeNil)
+		So(sub.(ValueStore).Keys(), ShouldResemble, []string{"baz"})
+		So(store.(ValueStore).Keys(), ShouldHaveLength, 2)
+	})
+}
+
+func TestMemoryStoreRelease(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test memory store reuse of released session stores", t, func() {
+		st, err := mstore.Create(context.Background(), "test_release", 10)
+		So(err, ShouldBeNil)
+		st.Set("foo", "bar")
+		So(st.Save(), ShouldBeNil)
+		mstore.(StorePool).Release(st)
+
+		st, err = mstore.Update(context.Background(), "test_release", 10)
+		So(err, ShouldBeNil)
+		So(st.SessionID(), ShouldEqual, "test_release")
+		foo, _ := st.GetString("foo")
+		So(foo, ShouldEqual, "bar")
+		mstore.(StorePool).Release(st)
+
+		st, err = mstore.Create(context.Background(), "test_release2", 10)
+		So(err, ShouldBeNil)
+		So(st.SessionID(), ShouldEqual, "test_release2")
+		So(st.(ValueStore).Keys(), ShouldBeEmpty)
+		So(st.(VersionedStore).Version(), ShouldEqual, 0)
+
+		vstore := st.(*store)
+		vstore.Reset(context.Background(), "test_release3", 10, map[string]interface{}{"foo": "baz"})
+		So(st.SessionID(), ShouldEqual, "test_release3")
+		foo, _ = st.GetString("foo")
+		So(foo, ShouldEqual, "baz")
+		So(vstore.dirty.keys(), ShouldBeEmpty)
+
+		// stores of other storages are ignored
+		mstore.(StorePool).Release(NewTimeoutStore(mstore, time.Second).(*timeoutStore).wrap(context.Background(), st))
+		So(vstore.released, ShouldBeFalse)
+	})
+
+	Convey("Test memory store ignores releasing a session store twice", t, func() {
+		st, err := mstore.Create(context.Background(), "test_release_twice", 10)
+		So(err, ShouldBeNil)
+		mstore.(StorePool).Release(st)
+		mstore.(StorePool).Release(st)
+
+		first, err := mstore.Create(context.Background(), "test_release_twice1", 10)
+		So(err, ShouldBeNil)
+		second, err := mstore.Create(context.Background(), "test_release_twice2", 10)
+		So(err, ShouldBeNil)
+		So(first, ShouldNotEqual, second)
+		So(first.SessionID(), ShouldEqual, "test_release_twice1")
+	})
+}
+
+func TestMemoryStoreLock(t *testing.T) {
+	mstore := NewMemoryStore().(*memoryStore)
+
+	Convey("Test memory store session locks", t, func() {
+		first, err := mstore.Create(context.Background(), "test_lock", 10)
+		So(err, ShouldBeNil)
+		second, err := mstore.Create(context.Background(), "test_lock", 10)
+		So(err, ShouldBeNil)
+
+		unlock, err := first.(SessionLocker).Lock(context.Background())
+		So(err, ShouldBeNil)
+		first.Set("foo", "bar")
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+		_, err = second.(SessionLocker).Lock(ctx)
+		So(err, ShouldResemble, context.DeadlineExceeded)
+
+		locked := make(chan func())
+		go func() {
+			unlock, err := second.(SessionLocker).Lock(context.Background())
+			if err == nil {
+				locked <- unlock
+			}
+		}()
+		select {
+		case <-locked:
+			t.Fatal("lock acquired while held by another store")
+		case <-time.After(time.Millisecond * 50):
+		}
+		unlock()
+		unlock()
+		(<-locked)()
+
+		mstore.locksMu.Lock()
+		So(mstore.locks, ShouldBeEmpty)
+		mstore.locksMu.Unlock()
+	})
+}
+
+func TestMemoryStoreGCWorkers(t *testing.T) {
+	clock := &testClock{}
+	mstore := NewMemoryStore(WithClock(clock.now), WithoutGC(), WithGCWorkers(4)).(*memoryStore)
+
+	Convey("Test memory store sweep with gc workers", t, func() {
+		for i := 0; i < 1000; i++ {
+			_, _, err := mstore.save(fmt.Sprintf("test_gc_workers_%d", i), mapOf(map[string]interface{}{"n": i}), 1, nil)
+			So(err, ShouldBeNil)
+		}
+		_, _, err := mstore.save("test_gc_workers_alive", valueMap{}, 10, nil)
+		So(err, ShouldBeNil)
+
+		So(clock.advance(mstore, time.Second*2), ShouldEqual, 1000)
+		So(mstore.data.Len(), ShouldEqual, 1)
+
+		ok, err := mstore.Check(context.Background(), "test_gc_workers_alive")
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+	})
+}
+
+// Sweep wall time by the number of expired sessions and gc workers
+func BenchmarkSweep(b *testing.B) {
+	for _, entries := range []int{10000, 100000} {
+		for _, workers := range []int{1, 4, 8} {
+			b.Run(fmt.Sprintf("entries=%d/workers=%d", entries, workers), func(b *testing.B) {
+				clock := &testClock{}
+				mstore := NewMemoryStore(WithClock(clock.now), WithoutGC(), WithGCWorkers(workers)).(*memoryStore)
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					for j := 0; j < entries; j++ {
+						mstore.save(strconv.Itoa(j), valueMap{}, 1, nil)
+					}
+					clock.offset.Add(int64(time.Second * 2))
+					b.StartTimer()
+
+					if n := mstore.sweep(); n != entries {
+						b.Fatalf("swept %d of %d sessions", n, entries)
+					}
+				}
+			})
+		}
+	}
+}
+
+type typedPoint struct {
+	X, Y int
+}
+
+func TestMemoryStoreSetTyped(t *testing.T) {
+	RegisterType(typedPoint{})
+	mstore := NewMemoryStore(WithCodec(JSONCodec), WithKeySchema(map[string]reflect.Kind{"count": reflect.Int}))
+
+	Convey("Test memory store typed session values", t, func() {
+		sid := "test_set_typed"
+		store, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(store.(TypedStore).SetTyped("count", 42), ShouldBeNil)
+		So(store.(TypedStore).SetTyped("id", int64(7)), ShouldBeNil)
+		So(store.(TypedStore).SetTyped("point", typedPoint{X: 1, Y: 2}), ShouldBeNil)
+		So(store.(TypedStore).SetTyped("nothing", nil), ShouldBeNil)
+		store.Set("plain", 42)
+		So(store.(SubStorer).SubStore("sub").(TypedStore).SetTyped("count", 3), ShouldBeNil)
+		So(store.(TypedStore).SetTyped("count", "42"), ShouldEqual, ErrTypeMismatch)
+		So(store.Save(), ShouldBeNil)
+
+		store, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+
+		count, ok := store.GetInt("count")
+		So(ok, ShouldBeTrue)
+		So(count, ShouldEqual, 42)
+		v, ok := store.(TypedStore).GetTyped("id")
+		So(ok, ShouldBeTrue)
+		So(v, ShouldEqual, int64(7))
+		v, ok = store.(TypedStore).GetTyped("point")
+		So(ok, ShouldBeTrue)
+		So(v, ShouldResemble, typedPoint{X: 1, Y: 2})
+		var p typedPoint
+		So(store.(ValueStore).GetInto("point", &p), ShouldBeNil)
+		So(p, ShouldResemble, typedPoint{X: 1, Y: 2})
+		v, ok = store.(TypedStore).GetTyped("nothing")
+		So(ok, ShouldBeTrue)
+		So(v, ShouldBeNil)
+		count, ok = store.(SubStorer).SubStore("sub").GetInt("count")
+		So(ok, ShouldBeTrue)
+		So(count, ShouldEqual, 3)
+
+		// values set without a tag come back as the storage decoded them
+		v, ok = store.(TypedStore).GetTyped("plain")
+		So(ok, ShouldBeTrue)
+		So(v, ShouldEqual, float64(42))
+		_, ok = store.GetInt("plain")
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestMemoryStoreCount(t *testing.T) {
+	clock := &testClock{}
+	mstore := NewMemoryStore(WithClock(clock.now), WithoutGC()).(*memoryStore)
+
+	Convey("Test memory store count sessions", t, func() {
+		ctx := context.Background()
+		for _, sid := range []string{"test_count_1", "test_count_2", "test_count_3"} {
+			store, err := mstore.Create(ctx, sid, 10)
+			So(err, ShouldBeNil)
+			So(store.Save(), ShouldBeNil)
+			So(store.Save(), ShouldBeNil)
+		}
+		_, _, err := mstore.save("test_count_short", valueMap{}, 1, nil)
+		So(err, ShouldBeNil)
+
+		n, err := mstore.Count(ctx)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 4)
+
+		So(mstore.Delete(ctx, "test_count_1"), ShouldBeNil)
+		So(mstore.Delete(ctx, "test_count_1"), ShouldBeNil)
+		_, err = mstore.Refresh(ctx, "test_count_2", "test_count_4", 10)
+		So(err, ShouldBeNil)
+		_, created, err := mstore.LoadOrCreate(ctx, "test_count_3", 10)
+		So(err, ShouldBeNil)
+		So(created, ShouldBeFalse)
+		n, _ = mstore.Count(ctx)
+		So(n, ShouldEqual, 3)
+
+		So(clock.advance(mstore, time.Second*2), ShouldEqual, 1)
+		n, _ = mstore.Count(ctx)
+		So(n, ShouldEqual, 2)
+
+		So(mstore.Close(), ShouldBeNil)
+		_, err = mstore.Count(ctx)
+		So(err, ShouldEqual, ErrStoreClosed)
+	})
+}
+
+func TestMemoryStoreOnChange(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test memory store session value change callbacks", t, func() {
+		sid := "test_on_change"
+		st, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+
+		var changes [][2]interface{}
+		st.(ChangeTracker).OnChange("count", func(old, new interface{}) {
+			// the store is unlocked when the callback is invoked
+			v, _ := st.Get("count")
+			So(v, ShouldEqual, new)
+			changes = append(changes, [2]interface{}{old, new})
+		})
+		var subChanges [][2]interface{}
+		st.(SubStorer).SubStore("sub").(ChangeTracker).OnChange("name", func(old, new interface{}) {
+			subChanges = append(subChanges, [2]interface{}{old, new})
+		})
+
+		st.Set("count", 1)
+		st.Set("count", 1)
+		st.Set("other", 1)
+		So(st.(ValueStore).SetAll(map[string]interface{}{"count": 2}), ShouldBeNil)
+		So(st.Delete("count"), ShouldEqual, 2)
+		st.Set("count", 3)
+		So(st.Flush(), ShouldBeNil)
+		So(changes, ShouldResemble, [][2]interface{}{{nil, 1}, {1, 2}, {2, nil}, {nil, 3}, {3, nil}})
+
+		sub := st.(SubStorer).SubStore("sub")
+		sub.Set("other", "foo")
+		sub.Set("name", "foo")
+		So(sub.Delete("name"), ShouldEqual, "foo")
+		So(subChanges, ShouldResemble, [][2]interface{}{{nil, "foo"}, {"foo", nil}})
+
+		// the callbacks are not persisted
+		So(st.Save(), ShouldBeNil)
+		st, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		st.Set("count", 4)
+		So(len(changes), ShouldEqual, 5)
+	})
+}
+
+func TestMemoryStoreStream(t *testing.T) {
+	mstore := NewMemoryStore(WithCodec(JSONCodec))
+
+	Convey("Test memory store streamed session values", t, func() {
+		sid := "test_stream"
+		st, err := mstore.Create(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		So(st.(StreamStore).SetStream("report", strings.NewReader("large report")), ShouldBeNil)
+		So(st.(SubStorer).SubStore("sub").(StreamStore).SetStream("report", strings.NewReader("sub report")), ShouldBeNil)
+		st.Set("name", "foo")
+		So(st.Save(), ShouldBeNil)
+
+		st, err = mstore.Update(context.Background(), sid, 10)
+		So(err, ShouldBeNil)
+		r, ok := st.(StreamStore).GetStream("report")
+		So(ok, ShouldBeTrue)
+		data, err := io.ReadAll(r)
+		So(err, ShouldBeNil)
+		So(r.Close(), ShouldBeNil)
+		So(string(data), ShouldEqual, "large report")
+
+		r, ok = st.(SubStorer).SubStore("sub").(StreamStore).GetStream("report")
+		So(ok, ShouldBeTrue)
+		data, _ = io.ReadAll(r)
+		So(string(data), ShouldEqual, "sub report")
+
+		_, ok = st.(StreamStore).GetStream("name")
+		So(ok, ShouldBeFalse)
+		_, ok = st.(StreamStore).GetStream("missing")
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestMemoryStoreAge(t *testing.T) {
+	clock := &testClock{}
+	mstore := NewMemoryStore(WithClock(clock.now), WithoutGC()).(*memoryStore)
+
+	Convey("Test memory store session age", t, func() {
+		ctx := context.Background()
+		sid := "test_age"
+		store, err := mstore.Create(ctx, sid, 100)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		clock.advance(mstore, time.Second*10)
+		store, err = mstore.Update(ctx, sid, 100)
+		So(err, ShouldBeNil)
+		createdAt := store.(AgeReporter).CreatedAt()
+		So(store.(AgeReporter).Age(), ShouldBeGreaterThanOrEqualTo, time.Second*10)
+		So(store.Save(), ShouldBeNil)
+
+		clock.advance(mstore, time.Second*10)
+		store, _, err = mstore.LoadOrCreate(ctx, sid, 100)
+		So(err, ShouldBeNil)
+		So(store.(AgeReporter).CreatedAt(), ShouldEqual, createdAt)
+		So(store.(AgeReporter).Age(), ShouldBeGreaterThanOrEqualTo, time.Second*20)
+
+		saved, err := store.(VersionedStore).SaveReturn()
+		So(err, ShouldBeNil)
+		So(saved.(AgeReporter).CreatedAt(), ShouldEqual, createdAt)
+
+		// a refreshed session is created again
+		store, err = mstore.Refresh(ctx, sid, "test_age_new", 100)
+		So(err, ShouldBeNil)
+		So(store.(AgeReporter).Age(), ShouldBeLessThan, time.Second)
+
+		clock.advance(mstore, time.Second*10)
+		So(store.(Rotator).Rotate(sid), ShouldBeNil)
+		So(store.(AgeReporter).Age(), ShouldBeLessThan, time.Second)
+	})
+}
+
+func TestMemoryStoreSetValidation(t *testing.T) {
+	mstore := NewMemoryStore(WithCodec(JSONCodec), WithSetValidation())
+
+	Convey("Test memory store set validation", t, func() {
+		store, err := mstore.Create(context.Background(), "test_set_validation", 10)
+		So(err, ShouldBeNil)
+
+		So(store.(ValueStore).SetChecked("ch", make(chan int)), ShouldNotBeNil)
+		So(store.(ValueStore).SetChecked("fn", map[string]interface{}{"fn": func() {}}), ShouldNotBeNil)
+		_, err = store.(ValueStore).SetIfAbsent("ch", make(chan int))
+		So(err, ShouldNotBeNil)
+		So(store.(ValueStore).SetAll(map[string]interface{}{"foo": "bar", "ch": make(chan int)}), ShouldNotBeNil)
+		So(store.(SubStorer).SubStore("sub").(ValueStore).SetChecked("ch", make(chan int)), ShouldNotBeNil)
+		So(store.(ValueStore).Keys(), ShouldBeEmpty)
+
+		store.Set("foo", "bar")
+		store.(SubStorer).SubStore("sub").Set("foo", "bar")
+		So(store.Save(), ShouldBeNil)
+	})
+
+	Convey("Test memory store set validation without a codec", t, func() {
+		store, err := NewMemoryStore(WithSetValidation()).Create(context.Background(), "test_set_validation", 10)
+		So(err, ShouldBeNil)
+		store.Set("ch", make(chan int))
+	})
+}
+
+func TestMemoryStoreFreeze(t *testing.T) {
+	clock := &testClock{}
+	mstore := NewMemoryStore(WithClock(clock.now), WithoutGC()).(*memoryStore)
+
+	Convey("Test memory store frozen sessions", t, func() {
+		ctx := context.Background()
+		sid := "test_freeze"
+		store, err := mstore.Create(ctx, sid, 10)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		So(store.Save(), ShouldBeNil)
+
+		status, err := mstore.Status(ctx, sid)
+		So(err, ShouldBeNil)
+		So(status, ShouldEqual, StatusActive)
+
+		So(mstore.Freeze(ctx, sid), ShouldBeNil)
+		So(mstore.Freeze(ctx, sid), ShouldBeNil)
+		status, _ = mstore.Status(ctx, sid)
+		So(status, ShouldEqual, StatusFrozen)
+		So(status.String(), ShouldEqual, "frozen")
+
+		ok, err := mstore.Check(ctx, sid)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+		_, err = mstore.Update(ctx, sid, 10)
+		So(err, ShouldEqual, ErrSessionNotFound)
+		_, _, err = mstore.LoadOrCreate(ctx, sid, 10)
+		So(err, ShouldEqual, ErrSessionFrozen)
+		_, err = mstore.Create(ctx, sid, 10)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldEqual, ErrSessionFrozen)
+		So(store.(Rotator).Rotate(sid+"_rotated"), ShouldEqual, ErrSessionFrozen)
+		So(store.SessionID(), ShouldEqual, sid)
+		n, _ := mstore.Count(ctx)
+		So(n, ShouldEqual, 0)
+
+		// a frozen session does not expire
+		So(clock.advance(mstore, time.Second*20), ShouldEqual, 0)
+		status, _ = mstore.Status(ctx, sid)
+		So(status, ShouldEqual, StatusFrozen)
+
+		So(mstore.Unfreeze(ctx, sid), ShouldBeNil)
+		So(mstore.Unfreeze(ctx, sid), ShouldBeNil)
+		store, err = mstore.Update(ctx, sid, 10)
+		So(err, ShouldBeNil)
+		foo, _ := store.GetString("foo")
+		So(foo, ShouldEqual, "bar")
+		ttl, err := mstore.TimeToLive(ctx, sid)
+		So(err, ShouldBeNil)
+		So(ttl, ShouldBeGreaterThan, time.Second*9)
+
+		So(mstore.Freeze(ctx, sid), ShouldBeNil)
+		So(mstore.Delete(ctx, sid), ShouldBeNil)
+		status, _ = mstore.Status(ctx, sid)
+		So(status, ShouldEqual, StatusNotFound)
+		So(mstore.Unfreeze(ctx, sid), ShouldEqual, ErrSessionNotFound)
+		So(mstore.Freeze(ctx, sid), ShouldEqual, ErrSessionNotFound)
+		n, _ = mstore.Count(ctx)
+		So(n, ShouldEqual, 0)
+	})
+}
+
+type clientIPKey struct{}
+
+func TestMemoryStoreCreateRateLimit(t *testing.T) {
+	keyFn := func(ctx context.Context) string {
+		ip, _ := ctx.Value(clientIPKey{}).(string)
+		return ip
+	}
+	clock := &testClock{}
+	mstore := NewMemoryStore(WithClock(clock.now), WithoutGC(), WithCreateRateLimit(keyFn, 2, time.Minute)).(*memoryStore)
+
+	Convey("Test memory store create rate limit", t, func() {
+		ctx := context.WithValue(context.Background(), clientIPKey{}, "10.0.0.1")
+		other := context.WithValue(context.Background(), clientIPKey{}, "10.0.0.2")
+
+		for i := 0; i < 2; i++ {
+			_, err := mstore.Create(ctx, "test_rate_limit_"+strconv.Itoa(i), 10)
+			So(err, ShouldBeNil)
+		}
+		_, err := mstore.Create(ctx, "test_rate_limit_2", 10)
+		So(err, ShouldEqual, ErrRateLimited)
+
+		// other clients and sessions without a key are not limited
+		_, err = mstore.Create(other, "test_rate_limit_other", 10)
+		So(err, ShouldBeNil)
+		_, err = mstore.Create(context.Background(), "test_rate_limit_nokey", 10)
+		So(err, ShouldBeNil)
+
+		clock.advance(mstore, time.Second*30)
+		_, err = mstore.Create(ctx, "test_rate_limit_3", 10)
+		So(err, ShouldBeNil)
+		_, err = mstore.Create(ctx, "test_rate_limit_4", 10)
+		So(err, ShouldEqual, ErrRateLimited)
+
+		// the full buckets are dropped by the gc
+		clock.advance(mstore, time.Minute*2)
+		So(mstore.limiter.buckets, ShouldBeEmpty)
+		_, err = mstore.Create(ctx, "test_rate_limit_5", 10)
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestMemoryStoreLifetimeHistogram(t *testing.T) {
+	clock := &testClock{}
+	mstore := NewMemoryStore(WithClock(clock.now), WithoutGC()).(*memoryStore)
+
+	Convey("Test memory store session lifetime histogram", t, func() {
+		ctx := context.Background()
+		for _, sid := range []string{"test_lifetime_1", "test_lifetime_2", "test_lifetime_3"} {
+			store, err := mstore.Create(ctx, sid, 600)
+			So(err, ShouldBeNil)
+			So(store.Save(), ShouldBeNil)
+		}
+
+		clock.advance(mstore, time.Second*30)
+		So(mstore.Delete(ctx, "test_lifetime_1"), ShouldBeNil)
+		clock.advance(mstore, time.Minute*2)
+		n, err := mstore.DeleteWhere(ctx, func(sid string, _ map[string]interface{}, _ time.Time) bool {
+			return sid == "test_lifetime_2"
+		})
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+		So(clock.advance(mstore, time.Minute*10), ShouldEqual, 1)
+
+		buckets := mstore.LifetimeHistogram()
+		So(buckets, ShouldHaveLength, 11)
+		So(buckets[0], ShouldResemble, Bucket{UpperBound: time.Minute, Count: 1})
+		So(buckets[1], ShouldResemble, Bucket{UpperBound: time.Minute * 5, Count: 2})
+		So(buckets[2], ShouldResemble, Bucket{UpperBound: time.Minute * 15, Count: 3})
+		So(buckets[10].Count, ShouldEqual, 3)
+	})
+}
+
+func TestMemoryStoreTransient(t *testing.T) {
+	Convey("Test memory store transient session values", t, func() {
+		ctx := context.Background()
+		for _, mstore := range []ManagerStore{
+			NewMemoryStore(),
+			NewMemoryStore(WithMergeOnSave()),
+			NewEncryptedStore(NewMemoryStore(), []byte("secret")),
+		} {
+			sid := "test_transient"
+			store, err := mstore.Create(ctx, sid, 10)
+			So(err, ShouldBeNil)
+			store.Set("foo", "bar")
+			store.(ValueStore).SetTransient("perms", []string{"read"})
+			sub := store.(SubStorer).SubStore("profile")
+			sub.Set("name", "foo")
+			sub.(ValueStore).SetTransient("role", "admin")
+			So(store.Save(), ShouldBeNil)
+
+			perms, ok := store.Get("perms")
+			So(ok, ShouldBeTrue)
+			So(perms, ShouldResemble, []string{"read"})
+			role, _ := sub.GetString("role")
+			So(role, ShouldEqual, "admin")
+
+			loaded, err := mstore.Update(ctx, sid, 10)
+			So(err, ShouldBeNil)
+			foo, _ := loaded.GetString("foo")
+			So(foo, ShouldEqual, "bar")
+			_, ok = loaded.Get("perms")
+			So(ok, ShouldBeFalse)
+			name, _ := loaded.(SubStorer).SubStore("profile").GetString("name")
+			So(name, ShouldEqual, "foo")
+			_, ok = loaded.(SubStorer).SubStore("profile").Get("role")
+			So(ok, ShouldBeFalse)
+
+			// a transient value that is set again is saved
+			store.Set("perms", []string{"write"})
+			sub.Set("role", "user")
+			So(store.Save(), ShouldBeNil)
+			loaded, err = mstore.Update(ctx, sid, 10)
+			So(err, ShouldBeNil)
+			_, ok = loaded.Get("perms")
+			So(ok, ShouldBeTrue)
+			role, _ = loaded.(SubStorer).SubStore("profile").GetString("role")
+			So(role, ShouldEqual, "user")
+		}
+	})
+}
+
+func TestMemoryStoreChanges(t *testing.T) {
+	Convey("Test memory store changes of the session values", t, func() {
+		ctx := context.Background()
+		for _, mstore := range []ManagerStore{
+			NewMemoryStore(),
+			NewEncryptedStore(NewMemoryStore(), []byte("secret")),
+		} {
+			sid := "test_changes"
+			store, err := mstore.Create(ctx, sid, 10)
+			So(err, ShouldBeNil)
+			So(store.(ValueStore).SetAll(map[string]interface{}{"foo": "bar", "baz": 1, "qux": true}), ShouldBeNil)
+			So(store.Save(), ShouldBeNil)
+			So(store.(ChangeTracker).Changes(), ShouldBeEmpty)
+
+			store, err = mstore.Update(ctx, sid, 10)
+			So(err, ShouldBeNil)
+			store.Set("foo", "bar2")
+			store.Set("foo", "bar3")
+			store.Delete("baz")
+			store.Set("new", "value")
+			store.Set("tmp", "value")
+			store.Delete("tmp")
+			So(store.(ChangeTracker).Changes(), ShouldResemble, []Change{
+				{Key: "baz", Old: 1, Op: ChangeDelete},
+				{Key: "foo", Old: "bar", New: "bar3", Op: ChangeUpdate},
+				{Key: "new", New: "value", Op: ChangeCreate},
+			})
+			So(ChangeUpdate.String(), ShouldEqual, "update")
+
+			So(store.Save(), ShouldBeNil)
+			So(store.(ChangeTracker).Changes(), ShouldBeEmpty)
+
+			So(store.Flush(), ShouldBeNil)
+			So(store.(ChangeTracker).Changes(), ShouldBeEmpty)
+			store.Set("foo", "bar")
+			So(store.(ChangeTracker).Changes(), ShouldResemble, []Change{{Key: "foo", New: "bar", Op: ChangeCreate}})
+		}
+	})
+}
+
+type testRole int
+
+const (
+	testRoleUser testRole = iota + 1
+	testRoleAdmin
+)
+
+func TestMemoryStoreEnum(t *testing.T) {
+	Convey("Test memory store enum session values", t, func() {
+		ctx := context.Background()
+		for _, opts := range [][]MemoryStoreOption{nil, {WithCodec(JSONCodec)}} {
+			mstore := NewMemoryStore(append(opts, WithEnum("role", testRoleUser, testRoleAdmin))...)
+			store, err := mstore.Create(ctx, "test_enum", 10)
+			So(err, ShouldBeNil)
+			So(store.(ValueStore).SetChecked("role", testRole(3)), ShouldEqual, ErrInvalidEnumValue)
+			So(store.(ValueStore).SetChecked("role", 1), ShouldEqual, ErrInvalidEnumValue)
+			So(store.(ValueStore).SetChecked("role", []string{"admin"}), ShouldEqual, ErrInvalidEnumValue)
+			So(store.(ValueStore).SetAll(map[string]interface{}{"foo": "bar", "role": testRole(0)}), ShouldEqual, ErrInvalidEnumValue)
+			store.Set("role", testRoleAdmin)
+			store.Set("other", testRole(3))
+			So(store.Save(), ShouldBeNil)
+
+			store, err = mstore.Update(ctx, "test_enum", 10)
+			So(err, ShouldBeNil)
+			role, ok := GetEnum[testRole](store, "role")
+			So(ok, ShouldBeTrue)
+			So(role, ShouldEqual, testRoleAdmin)
+			_, ok = GetEnum[testRole](store, "missing")
+			So(ok, ShouldBeFalse)
+
+			// numbers that can not be represented exactly are not converted
+			store.Set("ratio", 1.5)
+			store.Set("big", 1e20)
+			store.Set("negative", -1)
+			store.Set("level", 300)
+			So(store.Save(), ShouldBeNil)
+			store, err = mstore.Update(ctx, "test_enum", 10)
+			So(err, ShouldBeNil)
+			_, ok = GetEnum[testRole](store, "ratio")
+			So(ok, ShouldBeFalse)
+			_, ok = GetEnum[testRole](store, "big")
+			So(ok, ShouldBeFalse)
+			_, ok = GetEnum[uint8](store, "negative")
+			So(ok, ShouldBeFalse)
+			_, ok = GetEnum[int8](store, "level")
+			So(ok, ShouldBeFalse)
+			level, ok := GetEnum[int16](store, "level")
+			So(ok, ShouldBeTrue)
+			So(level, ShouldEqual, 300)
+		}
+	})
+}
+
+func TestMemoryStoreRefreshOrCreate(t *testing.T) {
+	clock := &testClock{}
+	mstore := NewMemoryStore(WithClock(clock.now), WithoutGC()).(*memoryStore)
+
+	Convey("Test memory store refresh or create a session", t, func() {
+		ctx := context.Background()
+		store, err := mstore.Create(ctx, "test_refresh_or_create", 10)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		So(store.Save(), ShouldBeNil)
+
+		store, refreshed, err := mstore.RefreshOrCreate(ctx, "test_refresh_or_create", "test_refresh_or_create_new", 10)
+		So(err, ShouldBeNil)
+		So(refreshed, ShouldBeTrue)
+		foo, _ := store.GetString("foo")
+		So(foo, ShouldEqual, "bar")
+		ok, _ := mstore.Check(ctx, "test_refresh_or_create")
+		So(ok, ShouldBeFalse)
+
+		// the old session is gone, so a new session is created
+		store, refreshed, err = mstore.RefreshOrCreate(ctx, "test_refresh_or_create", "test_refresh_or_create_2", 10)
+		So(err, ShouldBeNil)
+		So(refreshed, ShouldBeFalse)
+		So(store.(ValueStore).Keys(), ShouldBeEmpty)
+
+		// an expired session that is not swept yet is not refreshed
+		clock.offset.Add(int64(time.Second * 11))
+		_, refreshed, err = mstore.RefreshOrCreate(ctx, "test_refresh_or_create_new", "test_refresh_or_create_3", 10)
+		So(err, ShouldBeNil)
+		So(refreshed, ShouldBeFalse)
+
+		// concurrent refreshes of the same session refresh it once
+		store, err = mstore.Create(ctx, "test_refresh_or_create_race", 10)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+		var (
+			wg sync.WaitGroup
+			n  atomic.Int32
+		)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, refreshed, _ := mstore.RefreshOrCreate(ctx, "test_refresh_or_create_race", "test_refresh_or_create_race_"+strconv.Itoa(i), 10)
+				if refreshed {
+					n.Add(1)
+				}
+			}(i)
+		}
+		wg.Wait()
+		So(n.Load(), ShouldEqual, 1)
+	})
+}
+
+func TestMemoryStoreStringInterning(t *testing.T) {
+	mstore := NewMemoryStore(WithStringInterning()).(*memoryStore)
+
+	Convey("Test memory store shares equal string values", t, func() {
+		ctx := context.Background()
+		a, err := mstore.Create(ctx, "test_interning_a", 10)
+		So(err, ShouldBeNil)
+		b, err := mstore.Create(ctx, "test_interning_b", 10)
+		So(err, ShouldBeNil)
+		a.Set("role", strings.Repeat("admin", 2))
+		b.Set("role", strings.Repeat("admin", 2))
+
+		ra, _ := a.GetString("role")
+		rb, _ := b.GetString("role")
+		So(ra, ShouldEqual, "adminadmin")
+		So(unsafe.StringData(ra), ShouldEqual, unsafe.StringData(rb))
+
+		// the table is bounded
+		for i := 0; i < internTableSize*2; i++ {
+			a.Set("tenant", strconv.Itoa(i))
+		}
+		So(mstore.interned.len(), ShouldEqual, internTableSize)
+
+		// long strings are not interned
+		long := strings.Repeat("x", maxInternLen+1)
+		a.Set("token", long)
+		So(mstore.interned.len(), ShouldEqual, internTableSize)
+	})
+
+	Convey("Test memory store shares the string values of the keys", t, func() {
+		mstore := NewMemoryStore(WithStringInterning("Role"), WithCaseInsensitiveKeys()).(*memoryStore)
+		store, err := mstore.Create(context.Background(), "test_interning_keys", 10)
+		So(err, ShouldBeNil)
+		store.Set("role", "admin")
+		store.Set("name", "gopher")
+		So(mstore.interned.len(), ShouldEqual, 1)
+	})
+}
+
+// The memory of the string values of sessions sharing a small set of strings, and of
+// sessions with unique strings that gain nothing from the table
+func BenchmarkStringInterning(b *testing.B) {
+	for _, distinct := range []int{100, 100000} {
+		for _, interning := range []bool{false, true} {
+			b.Run(fmt.Sprintf("distinct=%d/interning=%v", distinct, interning), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					var opts []MemoryStoreOption
+					if interning {
+						opts = append(opts, WithStringInterning())
+					}
+					mstore := NewMemoryStore(append(opts, WithoutGC())...)
+					ctx := context.Background()
+
+					var before, after runtime.MemStats
+					runtime.GC()
+					runtime.ReadMemStats(&before)
+					stores := make([]Store, 100000)
+					for j := range stores {
+						stores[j], _ = mstore.Create(ctx, "bench_interning_"+strconv.Itoa(j), 10)
+						stores[j].Set("role", fmt.Sprintf("role-%027d", j%distinct))
+						stores[j].Set("tenant", fmt.Sprintf("tenant-%025d", j%distinct))
+					}
+					runtime.GC()
+					runtime.ReadMemStats(&after)
+					b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(len(stores)), "B/session")
+					runtime.KeepAlive(stores)
+				}
+			})
+		}
+	}
+}
+
+func TestMemoryStoreTombstones(t *testing.T) {
+	clock := &testClock{}
+	mstore := NewMemoryStore(WithClock(clock.now), WithoutGC(), WithTombstones(time.Minute)).(*memoryStore)
+
+	Convey("Test memory store tombstones of deleted sessions", t, func() {
+		ctx := context.Background()
+		sid := "test_tombstones"
+		store, err := mstore.Create(ctx, sid, 600)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		So(store.Save(), ShouldBeNil)
+
+		So(mstore.Delete(ctx, sid), ShouldBeNil)
+		ok, err := mstore.Check(ctx, sid)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+		status, _ := mstore.Status(ctx, sid)
+		So(status, ShouldEqual, StatusDeleted)
+		n, _ := mstore.Count(ctx)
+		So(n, ShouldEqual, 0)
+
+		// a stale copy of the session is not stored again
+		So(store.Save(), ShouldEqual, ErrSessionDeleted)
+		_, _, err = mstore.LoadOrCreate(ctx, sid, 10)
+		So(err, ShouldEqual, ErrSessionDeleted)
+		So(mstore.BulkLoad(ctx, map[string]SessionData{sid: {Values: map[string]interface{}{"foo": "bar"}}}), ShouldBeNil)
+		ok, _ = mstore.Check(ctx, sid)
+		So(ok, ShouldBeFalse)
+
+		clock.advance(mstore, time.Minute)
+		_, ok = mstore.tombstones.Load(sid)
+		So(ok, ShouldBeFalse)
+		status, _ = mstore.Status(ctx, sid)
+		So(status, ShouldEqual, StatusNotFound)
+		So(store.Save(), ShouldBeNil)
+	})
+
+	Convey("Test memory store tombstones with a concurrent save", t, func() {
+		ctx := context.Background()
+		for i := 0; i < 200; i++ {
+			sid := fmt.Sprintf("test_tombstones_concurrent_%d", i)
+			store, err := mstore.Create(ctx, sid, 600)
+			So(err, ShouldBeNil)
+			if i%2 == 0 {
+				// an existing session as well as a new session
+				So(store.Save(), ShouldBeNil)
+			}
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				mstore.Delete(ctx, sid)
+			}()
+			go func() {
+				defer wg.Done()
+				store.Save()
+			}()
+			wg.Wait()
+
+			ok, err := mstore.Check(ctx, sid)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		}
+	})
+}
+
+func TestMemoryStoreGetAny(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test memory store get session values without the boolean", t, func() {
+		store, err := mstore.Create(context.Background(), "test_get_any", 10)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		store.(SubStorer).SubStore("sub").Set("count", 1)
+
+		So(store.(ValueStore).GetAny("foo"), ShouldEqual, "bar")
+		So(store.(ValueStore).GetAny("missing"), ShouldBeNil)
+		So(store.(SubStorer).SubStore("sub").(ValueStore).GetAny("count"), ShouldEqual, 1)
+
+		So(MustGet[string](store, "foo"), ShouldEqual, "bar")
+		So(MustGet[int](store.(SubStorer).SubStore("sub"), "count"), ShouldEqual, 1)
+		So(func() { MustGet[string](store, "missing") }, ShouldPanicWith, `session: key "missing" is not set`)
+		So(func() { MustGet[int](store, "foo") }, ShouldPanicWith, `session: value of key "foo" is a string, not a int`)
+	})
+}
+
+func TestMemoryStoreRotatedRetention(t *testing.T) {
+	clock := &testClock{}
+	mstore := NewMemoryStore(WithClock(clock.now), WithoutGC(), WithRotatedRetention(time.Minute, 2)).(*memoryStore)
+
+	Convey("Test memory store rejects refreshed away session ids", t, func() {
+		ctx := context.Background()
+		store, err := mstore.Create(ctx, "test_rotated_1", 600)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		_, err = mstore.Refresh(ctx, "test_rotated_1", "test_rotated_2", 600)
+		So(err, ShouldBeNil)
+		ok, err := mstore.Check(ctx, "test_rotated_1")
+		So(err, ShouldEqual, ErrSessionRotated)
+		So(ok, ShouldBeFalse)
+		_, err = mstore.Update(ctx, "test_rotated_1", 600)
+		So(err, ShouldEqual, ErrSessionRotated)
+
+		store, err = mstore.Update(ctx, "test_rotated_2", 600)
+		So(err, ShouldBeNil)
+		So(store.(Rotator).Rotate("test_rotated_3"), ShouldBeNil)
+		_, err = mstore.Check(ctx, "test_rotated_2")
+		So(err, ShouldEqual, ErrSessionRotated)
+
+		// refreshing a session that does not exist retains nothing
+		_, err = mstore.Refresh(ctx, "test_rotated_missing", "test_rotated_4", 600)
+		So(err, ShouldBeNil)
+		_, err = mstore.Check(ctx, "test_rotated_missing")
+		So(err, ShouldBeNil)
+
+		// the session id with the earliest end of its window is dropped when full
+		clock.advance(mstore, time.Second)
+		So(store.(Rotator).Rotate("test_rotated_5"), ShouldBeNil)
+		So(mstore.rotated.Len(), ShouldEqual, 2)
+		_, err = mstore.Check(ctx, "test_rotated_1")
+		So(err, ShouldBeNil)
+		_, err = mstore.Check(ctx, "test_rotated_3")
+		So(err, ShouldEqual, ErrSessionRotated)
+
+		clock.advance(mstore, time.Minute)
+		So(mstore.rotated.Len(), ShouldEqual, 0)
+		_, err = mstore.Check(ctx, "test_rotated_3")
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestMemoryStoreGetFirst(t *testing.T) {
+	mstore := NewMemoryStore()
+
+	Convey("Test memory store get the value of the first key that is set", t, func() {
+		store, err := mstore.Create(context.Background(), "test_get_first", 10)
+		So(err, ShouldBeNil)
+		store.Set("uid", "old")
+
+		v, ok := store.(ValueStore).GetFirst("user_id", "uid")
+		So(ok, ShouldBeTrue)
+		So(v, ShouldEqual, "old")
+
+		store.Set("user_id", "new")
+		v, ok = store.(ValueStore).GetFirst("user_id", "uid")
+		So(ok, ShouldBeTrue)
+		So(v, ShouldEqual, "new")
+
+		_, ok = store.(ValueStore).GetFirst("missing", "other")
+		So(ok, ShouldBeFalse)
+		_, ok = store.(ValueStore).GetFirst()
+		So(ok, ShouldBeFalse)
+
+		sub := store.(SubStorer).SubStore("sub")
+		sub.Set("b", 2)
+		v, ok = sub.(ValueStore).GetFirst("a", "b")
+		So(ok, ShouldBeTrue)
+		So(v, ShouldEqual, 2)
+	})
+}
+
+func TestMemoryStoreGlobalMaxSessions(t *testing.T) {
+	Convey("Test memory store rejects new sessions when full", t, func() {
+		ctx := context.Background()
+		mstore := NewMemoryStore(WithoutGC(), WithGlobalMaxSessions(2, RejectNewSessions))
+		for _, sid := range []string{"test_full_1", "test_full_2"} {
+			store, err := mstore.Create(ctx, sid, 600)
+			So(err, ShouldBeNil)
+			So(store.Save(), ShouldBeNil)
+		}
+
+		_, err := mstore.Create(ctx, "test_full_3", 600)
+		So(err, ShouldEqual, ErrStoreFull)
+		_, _, err = LoadOrCreate(ctx, mstore, "test_full_3", 600)
+		So(err, ShouldEqual, ErrStoreFull)
+
+		// the stored sessions are kept and can still be saved
+		store, _, err := LoadOrCreate(ctx, mstore, "test_full_1", 600)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		So(store.Save(), ShouldBeNil)
+		n, _ := Count(ctx, mstore)
+		So(n, ShouldEqual, 2)
+
+		So(mstore.Delete(ctx, "test_full_2"), ShouldBeNil)
+		_, err = mstore.Create(ctx, "test_full_3", 600)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Test memory store evicts the least recently used session when full", t, func() {
+		ctx := context.Background()
+		clock := &testClock{}
+		mstore := NewMemoryStore(WithClock(clock.now), WithoutGC(), WithGlobalMaxSessions(2, EvictLeastRecentlyUsed)).(*memoryStore)
+		for _, sid := range []string{"test_lru_1", "test_lru_2"} {
+			store, err := mstore.Create(ctx, sid, 600)
+			So(err, ShouldBeNil)
+			So(store.Save(), ShouldBeNil)
+			clock.advance(mstore, time.Second)
+		}
+		_, err := mstore.Update(ctx, "test_lru_1", 600)
+		So(err, ShouldBeNil)
+
+		store, err := mstore.Create(ctx, "test_lru_3", 600)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+		n, _ := mstore.Count(ctx)
+		So(n, ShouldEqual, 2)
+		ok, _ := mstore.Check(ctx, "test_lru_2")
+		So(ok, ShouldBeFalse)
+		ok, _ = mstore.Check(ctx, "test_lru_1")
+		So(ok, ShouldBeTrue)
+
+		// frozen sessions are never evicted
+		So(mstore.Freeze(ctx, "test_lru_1"), ShouldBeNil)
+		So(mstore.Freeze(ctx, "test_lru_3"), ShouldBeNil)
+		store, err = mstore.Create(ctx, "test_lru_4", 600)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldEqual, ErrStoreFull)
+
+		// an unfrozen session can be evicted again
+		So(mstore.Unfreeze(ctx, "test_lru_1"), ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+		ok, _ = mstore.Check(ctx, "test_lru_1")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Test memory store keeps the lru queue bounded by the number of sessions", t, func() {
+		ctx := context.Background()
+		clock := &testClock{}
+		mstore := NewMemoryStore(WithClock(clock.now), WithoutGC(), WithGlobalMaxSessions(10, EvictLeastRecentlyUsed)).(*memoryStore)
+		for _, sid := range []string{"test_lru_queue_1", "test_lru_queue_2"} {
+			_, _, err := mstore.save(sid, valueMap{}, 600, nil)
+			So(err, ShouldBeNil)
+		}
+		for i := 0; i < 5000; i++ {
+			clock.offset.Add(1)
+			if _, err := mstore.Update(ctx, "test_lru_queue_1", 600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		So(len(mstore.lru.entries), ShouldBeLessThanOrEqualTo, lruQueueMinSize+1)
+
+		// the stale entries of the updated session are skipped
+		e, ok := mstore.lru.pop()
+		for ok && !mstore.lruLive(e) {
+			e, ok = mstore.lru.pop()
+		}
+		So(ok, ShouldBeTrue)
+		So(e.item.sid, ShouldEqual, "test_lru_queue_2")
+	})
+
+	Convey("Test memory store sweeps expired sessions before rejecting new sessions", t, func() {
+		ctx := context.Background()
+		clock := &testClock{}
+		mstore := NewMemoryStore(WithClock(clock.now), WithoutGC(), WithGlobalMaxSessions(2, RejectNewSessions)).(*memoryStore)
+		for _, sid := range []string{"test_full_expired_1", "test_full_expired_2"} {
+			_, _, err := mstore.save(sid, valueMap{}, 1, nil)
+			So(err, ShouldBeNil)
+		}
+		clock.offset.Add(int64(time.Second * 2))
+
+		store, err := mstore.Create(ctx, "test_full_expired_3", 600)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+		n, _ := mstore.Count(ctx)
+		So(n, ShouldEqual, 1)
+	})
+
+	Convey("Test memory store concurrent saves of new sessions do not exceed the maximum", t, func() {
+		for _, policy := range []RejectOrEvict{RejectNewSessions, EvictLeastRecentlyUsed} {
+			mstore := NewMemoryStore(WithoutGC(), WithGlobalMaxSessions(5, policy)).(*memoryStore)
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					mstore.save(fmt.Sprintf("test_full_concurrent_%d", i), valueMap{}, 600, nil)
+				}(i)
+			}
+			wg.Wait()
+			So(mstore.data.Len(), ShouldBeLessThanOrEqualTo, 5)
+			So(mstore.reserved.Load(), ShouldEqual, 0)
+		}
+	})
+}
+
+func TestMemoryStoreGetMany(t *testing.T) {
+	mstore := NewMemoryStore(WithCaseInsensitiveKeys())
+
+	Convey("Test memory store get several session values at once", t, func() {
+		store, err := mstore.Create(context.Background(), "test_get_many", 10)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		store.Set("count", 1)
+
+		So(store.(ValueStore).GetMany("Foo", "count", "missing"), ShouldResemble, map[string]interface{}{"Foo": "bar", "count": 1})
+		So(store.(ValueStore).GetMany(), ShouldBeEmpty)
+
+		sub := store.(SubStorer).SubStore("sub")
+		sub.Set("a", 1)
+		So(sub.(ValueStore).GetMany("a", "b"), ShouldResemble, map[string]interface{}{"a": 1})
+	})
+
+	Convey("Test memory store get several session values at once leaves out expired values", t, func() {
+		now := time.Now()
+		mstore := NewMemoryStore(WithoutGC(), WithClock(func() time.Time { return now })).(*memoryStore)
+		var expired []string
+		onExpire := func(key string, value interface{}) {
+			expired = append(expired, fmt.Sprintf("%s=%v", key, value))
+		}
+
+		store, err := mstore.Create(context.Background(), "test_get_many_expired", 600)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		So(store.(ValueStore).SetWithTTLAndCallback("token", "abc", time.Minute, onExpire), ShouldBeNil)
+		So(store.(ValueStore).SetWithTTLAndCallback("long", "def", time.Hour, onExpire), ShouldBeNil)
+		sub := store.(SubStorer).SubStore("sub")
+		sub.Set("a", 1)
+		So(sub.(ValueStore).SetWithTTLAndCallback("code", 42, time.Minute, onExpire), ShouldBeNil)
+		So(store.(ValueStore).GetMany("foo", "token", "long"), ShouldResemble, map[string]interface{}{"foo": "bar", "token": "abc", "long": "def"})
+
+		now = now.Add(time.Minute)
+		So(store.(ValueStore).GetMany("foo", "token", "long"), ShouldResemble, map[string]interface{}{"foo": "bar", "long": "def"})
+		So(sub.(ValueStore).GetMany("a", "code"), ShouldResemble, map[string]interface{}{"a": 1})
+		So(expired, ShouldResemble, []string{"token=abc", "code=42"})
+		_, ok := store.Get("token")
+		So(ok, ShouldBeFalse)
+		So(expired, ShouldHaveLength, 2)
+	})
+}
+
+func TestMemoryStoreFlags(t *testing.T) {
+	Convey("Test memory store feature flags of a session", t, func() {
+		ctx := context.Background()
+		for _, mstore := range []ManagerStore{
+			NewMemoryStore(WithStickyFlags("beta")),
+			NewMemoryStore(WithStickyFlags("beta"), WithCodec(JSONCodec)),
+		} {
+			store, err := mstore.Create(ctx, "test_flags", 10)
+			So(err, ShouldBeNil)
+			So(store.(FlagStore).Flag("beta"), ShouldBeFalse)
+			So(store.(FlagStore).Flags(), ShouldBeEmpty)
+
+			So(store.(FlagStore).SetFlag("beta", true), ShouldBeNil)
+			So(store.(FlagStore).SetFlag("dark_mode", true), ShouldBeNil)
+			So(store.(FlagStore).SetFlag("alpha", true), ShouldBeNil)
+			So(store.(FlagStore).SetFlag("alpha", false), ShouldBeNil)
+			store.Set("foo", "bar")
+			So(store.Save(), ShouldBeNil)
+
+			// flags do not collide with session values
+			_, ok := store.Get("beta")
+			So(ok, ShouldBeFalse)
+
+			store, err = mstore.Update(ctx, "test_flags", 10)
+			So(err, ShouldBeNil)
+			So(store.(FlagStore).Flag("beta"), ShouldBeTrue)
+			So(store.(FlagStore).Flag("alpha"), ShouldBeFalse)
+			So(store.(FlagStore).Flags(), ShouldResemble, map[string]bool{"beta": true, "dark_mode": true})
+
+			// only sticky flags survive a flush
+			So(store.Flush(), ShouldBeNil)
+			store, err = mstore.Update(ctx, "test_flags", 10)
+			So(err, ShouldBeNil)
+			So(store.(FlagStore).Flags(), ShouldResemble, map[string]bool{"beta": true})
+			_, ok = store.Get("foo")
+			So(ok, ShouldBeFalse)
+
+			So(store.(FlagStore).SetFlag("beta", false), ShouldBeNil)
+			So(store.(ValueStore).Keys(), ShouldBeEmpty)
+		}
+	})
+}
+
+func TestMemoryStoreCloseDrain(t *testing.T) {
+	Convey("Test memory store close waits for the saves in progress", t, func() {
+		ctx := context.Background()
+		entered, release := make(chan struct{}), make(chan struct{})
+		mstore := NewMemoryStore(WithSaveHook(func(sid string, values map[string]interface{}) error {
+			close(entered)
+			<-release
+			return nil
+		})).(*memoryStore)
+
+		store, err := mstore.Create(ctx, "test_close_drain", 600)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		saved := make(chan error, 1)
+		go func() {
+			saved <- store.Save()
+		}()
+		<-entered
+
+		closed := make(chan error, 1)
+		go func() {
+			closed <- mstore.Close()
+		}()
+		select {
+		case <-closed:
+			t.Fatal("closed before the save completed")
+		case <-time.After(time.Millisecond * 50):
+		}
+		// new writes are rejected while draining
+		So(mstore.Delete(ctx, "test_close_drain"), ShouldEqual, ErrStoreClosed)
+
+		close(release)
+		So(<-closed, ShouldBeNil)
+		So(<-saved, ShouldBeNil)
+		dt, ok := mstore.data.Load("test_close_drain")
+		So(ok, ShouldBeTrue)
+		So(dt.(*dataItem).values.at("foo"), ShouldEqual, "bar")
+	})
+
+	Convey("Test memory store close gives up waiting after the timeout", t, func() {
+		entered, release := make(chan struct{}), make(chan struct{})
+		defer close(release)
+		logger := &testLogger{}
+		mstore := NewMemoryStore(WithoutGC(), WithLogger(logger), WithCloseTimeout(time.Millisecond*10),
+			WithSaveHook(func(sid string, values map[string]interface{}) error {
+				close(entered)
+				<-release
+				return nil
+			}))
+
+		store, err := mstore.Create(context.Background(), "test_close_timeout", 600)
+		So(err, ShouldBeNil)
+		go store.Save()
+		<-entered
+		So(mstore.Close(), ShouldBeNil)
+		So(logger.logs, ShouldHaveLength, 1)
+	})
+
+	Convey("Test memory store close with concurrent saves", t, func() {
+		for i := 0; i < 50; i++ {
+			logger := &testLogger{}
+			mstore := NewMemoryStore(WithoutGC(), WithLogger(logger)).(*memoryStore)
+			var wg sync.WaitGroup
+			for j := 0; j < 8; j++ {
+				wg.Add(1)
+				go func(j int) {
+					defer wg.Done()
+					store, err := mstore.Create(context.Background(), fmt.Sprintf("test_close_concurrent_%d", j), 600)
+					if err == nil {
+						store.Save()
+					}
+				}(j)
+			}
+			So(mstore.Close(), ShouldBeNil)
+			wg.Wait()
+			So(mstore.writes.Load(), ShouldEqual, 0)
+			So(logger.logs, ShouldBeEmpty)
+		}
+	})
+}
+
+func TestMemoryStoreMinIDEntropy(t *testing.T) {
+	mstore := NewMemoryStore(WithMinIDEntropy(16))
+
+	Convey("Test memory store rejects weak session ids", t, func() {
+		ctx := context.Background()
+		strong := newUUID()
+		store, err := mstore.Create(ctx, strong, 10)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+		_, err = mstore.Create(ctx, base64.RawURLEncoding.EncodeToString([]byte("0123456789abcdef")), 10)
+		So(err, ShouldBeNil)
+
+		for _, sid := range []string{
+			"1234",
+			"0123456789abcdef",
+			"00000000-0000-0000-0000-000000000000",
+			base64.RawURLEncoding.EncodeToString([]byte("0123456789")),
+		} {
+			_, err = mstore.Create(ctx, sid, 10)
+			So(err, ShouldEqual, ErrWeakSessionID)
+			exists, err := mstore.Check(ctx, sid)
+			So(err, ShouldEqual, ErrWeakSessionID)
+			So(exists, ShouldBeFalse)
+			_, err = mstore.Update(ctx, sid, 10)
+			So(err, ShouldEqual, ErrWeakSessionID)
+			_, _, err = LoadOrCreate(ctx, mstore, sid, 10)
+			So(err, ShouldEqual, ErrWeakSessionID)
+			_, err = mstore.Refresh(ctx, strong, sid, 10)
+			So(err, ShouldEqual, ErrWeakSessionID)
+			So(store.(Rotator).Rotate(sid), ShouldEqual, ErrWeakSessionID)
+		}
+		So(store.SessionID(), ShouldEqual, strong)
+	})
+}
+
+func TestMemoryStoreDirty(t *testing.T) {
+	Convey("Test memory store reports unsaved changes", t, func() {
+		ctx := context.Background()
+		for _, mstore := range []ManagerStore{
+			NewMemoryStore(),
+			NewEncryptedStore(NewMemoryStore(), []byte("secret")),
+		} {
+			store, err := mstore.Create(ctx, "test_dirty", 10)
+			So(err, ShouldBeNil)
+			So(store.(ChangeTracker).Dirty(), ShouldBeFalse)
+			store.Set("foo", "bar")
+			So(store.(ChangeTracker).Dirty(), ShouldBeTrue)
+			So(store.Save(), ShouldBeNil)
+			So(store.(ChangeTracker).Dirty(), ShouldBeFalse)
+
+			store, err = mstore.Update(ctx, "test_dirty", 10)
+			So(err, ShouldBeNil)
+			So(store.(ChangeTracker).Dirty(), ShouldBeFalse)
+			store.Get("foo")
+			store.Delete("missing")
+			So(store.(ChangeTracker).Dirty(), ShouldBeFalse)
+			store.Delete("foo")
+			So(store.(ChangeTracker).Dirty(), ShouldBeTrue)
+			So(store.Save(), ShouldBeNil)
+
+			So(store.(SubStorer).SubStore("sub").(ValueStore).SetAll(map[string]interface{}{"a": 1}), ShouldBeNil)
+			So(store.(ChangeTracker).Dirty(), ShouldBeTrue)
+			So(store.Flush(), ShouldBeNil)
+			So(store.(ChangeTracker).Dirty(), ShouldBeFalse)
+		}
+	})
+}
+
+func TestMemoryStoreWithContext(t *testing.T) {
+	Convey("Test memory store rebinds the context of a session store", t, func() {
+		type ctxKey struct{}
+		ctx := context.WithValue(context.Background(), ctxKey{}, "tenant")
+		for _, mstore := range []ManagerStore{
+			NewMemoryStore(),
+			NewEncryptedStore(NewMemoryStore(), []byte("secret")),
+			NewShardedStore([]ManagerStore{NewMemoryStore(), NewMemoryStore()}),
+		} {
+			store, err := mstore.Create(context.Background(), "test_with_context", 10)
+			So(err, ShouldBeNil)
+			bound := store.(ContextBinder).WithContext(ctx)
+			So(bound, ShouldNotEqual, store)
+			So(bound.Context().Value(ctxKey{}), ShouldEqual, "tenant")
+			So(store.Context().Value(ctxKey{}), ShouldBeNil)
+
+			// the copy shares the session values
+			bound.Set("foo", "bar")
+			So(bound.Save(), ShouldBeNil)
+			foo, _ := store.GetString("foo")
+			So(foo, ShouldEqual, "bar")
+
+			sub := bound.(SubStorer).SubStore("sub")
+			So(sub.Context().Value(ctxKey{}), ShouldEqual, "tenant")
+			So(sub.(ContextBinder).WithContext(context.Background()).Context().Value(ctxKey{}), ShouldBeNil)
+			So(sub.Context().Value(ctxKey{}), ShouldEqual, "tenant")
+		}
+	})
+
+	Convey("Test memory store operations return the error of a done context", t, func() {
+		mstore := NewMemoryStore()
+		store, err := mstore.Create(context.Background(), "test_done_context", 10)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = mstore.Check(ctx, "test_done_context")
+		So(err, ShouldEqual, context.Canceled)
+		_, err = mstore.Update(ctx, "test_done_context", 10)
+		So(err, ShouldEqual, context.Canceled)
+		So(mstore.Delete(ctx, "test_done_context"), ShouldEqual, context.Canceled)
+		n, err := mstore.(ConditionalDeleter).DeleteWhere(ctx, func(string, map[string]interface{}, time.Time) bool {
+			return true
+		})
+		So(err, ShouldEqual, context.Canceled)
+		So(n, ShouldEqual, 0)
+		_, _, err = mstore.(SessionLister).ListSessions(ctx, "", 10)
+		So(err, ShouldEqual, context.Canceled)
+
+		exists, err := mstore.Check(context.Background(), "test_done_context")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeTrue)
+	})
+}
+
+func TestMemoryStoreKeyTTL(t *testing.T) {
+	Convey("Test memory store session values with a TTL and callback", t, func() {
+		ctx := context.Background()
+		now := time.Now()
+		mstore := NewMemoryStore(WithoutGC(), WithClock(func() time.Time { return now })).(*memoryStore)
+		var expired []string
+		onExpire := func(key string, value interface{}) {
+			expired = append(expired, fmt.Sprintf("%s=%v", key, value))
+		}
+
+		store, err := mstore.Create(ctx, "test_key_ttl", 600)
+		So(err, ShouldBeNil)
+		So(store.(ValueStore).SetWithTTLAndCallback("token", "abc", 0, onExpire), ShouldEqual, ErrInvalidTTL)
+		So(store.(ValueStore).SetWithTTLAndCallback("token", "abc", time.Minute, func(key string, value interface{}) {
+			// the callback runs without the lock held, so it can use the store
+			_, ok := store.Get("token")
+			So(ok, ShouldBeFalse)
+			onExpire(key, value)
+		}), ShouldBeNil)
+		So(store.(ValueStore).SetWithTTLAndCallback("reset", "def", time.Minute, onExpire), ShouldBeNil)
+		store.Set("reset", "kept")
+		So(store.(SubStorer).SubStore("sub").(ValueStore).SetWithTTLAndCallback("code", 42, time.Minute, onExpire), ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		v, ok := store.Get("token")
+		So(ok, ShouldBeTrue)
+		So(v, ShouldEqual, "abc")
+
+		// lazily purged by a get of the key
+		now = now.Add(time.Minute)
+		_, ok = store.Get("token")
+		So(ok, ShouldBeFalse)
+		So(expired, ShouldResemble, []string{"token=abc"})
+		_, ok = store.Get("token")
+		So(ok, ShouldBeFalse)
+		So(expired, ShouldHaveLength, 1)
+		reset, _ := store.GetString("reset")
+		So(reset, ShouldEqual, "kept")
+
+		// actively purged by the gc
+		mstore.sweep()
+		So(expired, ShouldResemble, []string{"token=abc", "code=42"})
+		store, err = mstore.Update(ctx, "test_key_ttl", 600)
+		So(err, ShouldBeNil)
+		_, ok = store.(SubStorer).SubStore("sub").Get("code")
+		So(ok, ShouldBeFalse)
+		_, ok = store.Get(expiresKey)
+		So(ok, ShouldBeFalse)
+		So(mstore.keyCallbacks, ShouldBeEmpty)
+	})
+
+	Convey("Test memory store callbacks of values with a TTL move with the session", t, func() {
+		ctx := context.Background()
+		now := time.Now()
+		mstore := NewMemoryStore(WithoutGC(), WithCodec(JSONCodec), WithClock(func() time.Time { return now })).(*memoryStore)
+		var expired []string
+		store, err := mstore.Create(ctx, "test_key_ttl_old", 600)
+		So(err, ShouldBeNil)
+		So(store.(ValueStore).SetWithTTLAndCallback("token", "abc", time.Minute, func(key string, value interface{}) {
+			expired = append(expired, key)
+		}), ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+		So(store.(Rotator).Rotate("test_key_ttl_new"), ShouldBeNil)
+
+		now = now.Add(time.Minute)
+		mstore.sweep()
+		So(expired, ShouldResemble, []string{"token"})
+
+		So(store.(ValueStore).SetWithTTLAndCallback("token", "abc", time.Minute, func(key string, value interface{}) {
+			expired = append(expired, key)
+		}), ShouldBeNil)
+		So(mstore.Delete(ctx, "test_key_ttl_new"), ShouldBeNil)
+		So(mstore.keyCallbacks, ShouldBeEmpty)
+	})
+}
+
+func TestMemoryStoreIdleSessions(t *testing.T) {
+	now := time.Now()
+	mstore := NewMemoryStore(WithoutGC(), WithClock(func() time.Time { return now }))
+
+	Convey("Test memory store finds and deletes idle sessions", t, func() {
+		ctx := context.Background()
+		stores := make(map[string]Store)
+		for _, sid := range []string{"test_idle_a", "test_idle_b", "test_idle_c"} {
+			store, err := mstore.Create(ctx, sid, 3600)
+			So(err, ShouldBeNil)
+			store.Set("foo", "bar")
+			So(store.Save(), ShouldBeNil)
+			stores[sid] = store
+		}
+
+		now = now.Add(time.Minute * 5)
+		_, err := mstore.Update(ctx, "test_idle_b", 3600)
+		So(err, ShouldBeNil)
+		now = now.Add(time.Minute * 5)
+		stores["test_idle_a"].Get("foo")
+
+		idle, err := mstore.(IdleReaper).IdleSince(ctx, time.Minute*3)
+		So(err, ShouldBeNil)
+		So(idle, ShouldResemble, []string{"test_idle_c", "test_idle_b"})
+		idle, err = mstore.(IdleReaper).IdleSince(ctx, time.Minute*7)
+		So(err, ShouldBeNil)
+		So(idle, ShouldResemble, []string{"test_idle_c"})
+
+		n, err := mstore.(IdleReaper).ReapIdle(ctx, time.Minute*7)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+		ok, _ := mstore.Check(ctx, "test_idle_c")
+		So(ok, ShouldBeFalse)
+		ok, _ = mstore.Check(ctx, "test_idle_a")
+		So(ok, ShouldBeTrue)
+		ok, _ = mstore.Check(ctx, "test_idle_b")
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("Test memory store session set if absent is an access", t, func() {
+		ctx := context.Background()
+		store, err := mstore.Create(ctx, "test_idle_set_if_absent", 3600)
+		So(err, ShouldBeNil)
+		So(store.Save(), ShouldBeNil)
+
+		now = now.Add(time.Minute * 5)
+		set, err := store.(ValueStore).SetIfAbsent("foo", "bar")
+		So(err, ShouldBeNil)
+		So(set, ShouldBeTrue)
+		idle, err := mstore.(IdleReaper).IdleSince(ctx, time.Minute*3)
+		So(err, ShouldBeNil)
+		So(idle, ShouldNotContain, "test_idle_set_if_absent")
+	})
+}
+
+func TestMemoryStoreMaxValueBytes(t *testing.T) {
+	mstore := NewMemoryStore(WithCodec(JSONCodec), WithMaxValueBytes(64))
+
+	Convey("Test memory store rejects oversized session values", t, func() {
+		store, err := mstore.Create(context.Background(), "test_max_value_bytes", 10)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+		store.Set("count", math.MaxInt64)
+
+		large := strings.Repeat("x", 100)
+		So(store.(ValueStore).SetChecked("foo", large), ShouldEqual, ErrValueTooLarge)
+		So(store.(ValueStore).SetAll(map[string]interface{}{"a": 1, "b": []string{large}}), ShouldEqual, ErrValueTooLarge)
+		So(store.(SubStorer).SubStore("sub").(ValueStore).SetChecked("foo", large), ShouldEqual, ErrValueTooLarge)
+
+		// the session is unchanged
+		foo, _ := store.GetString("foo")
+		So(foo, ShouldEqual, "bar")
+		_, ok := store.Get("a")
+		So(ok, ShouldBeFalse)
+		So(store.(ValueStore).Keys(), ShouldHaveLength, 2)
+	})
+
+	Convey("Test memory store without a codec does not check the size of session values", t, func() {
+		store, err := NewMemoryStore(WithMaxValueBytes(64)).Create(context.Background(), "test_max_value_bytes", 10)
+		So(err, ShouldBeNil)
+		store.Set("foo", strings.Repeat("x", 100))
+	})
+}
+
+func TestRefreshChecked(t *testing.T) {
+	Convey("Test refreshing a session reports whether the old session existed", t, func() {
+		ctx := context.Background()
+		for _, mstore := range []ManagerStore{
+			NewMemoryStore(),
+			NewShardedStore([]ManagerStore{NewMemoryStore(), NewMemoryStore()}),
+		} {
+			store, err := mstore.Create(ctx, "test_refresh_checked", 10)
+			So(err, ShouldBeNil)
+			store.Set("foo", "bar")
+			So(store.Save(), ShouldBeNil)
+
+			store, refreshed, err := RefreshChecked(ctx, mstore, "test_refresh_checked", "test_refresh_checked_new", 10)
+			So(err, ShouldBeNil)
+			So(refreshed, ShouldBeTrue)
+			foo, _ := store.GetString("foo")
+			So(foo, ShouldEqual, "bar")
+
+			store, refreshed, err = RefreshChecked(ctx, mstore, "test_refresh_checked", "test_refresh_checked_other", 10)
+			So(err, ShouldBeNil)
+			So(refreshed, ShouldBeFalse)
+			So(store.SessionID(), ShouldEqual, "test_refresh_checked_other")
+			_, ok := store.Get("foo")
+			So(ok, ShouldBeFalse)
+		}
+	})
+}
@@ -0,0 +1,432 @@
+package session
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var _ sessionStore = &subStore{}
+
+// A view of the session values in a nested map, saving goes through the root store
+type subStore struct {
+	sessionStore
+	s    *store
+	path []string
+}
+
+// Get the sub store of the decorated session store, so saving it goes through the decorator
+func subStoreOf(root sessionStore, sub Store) Store {
+	switch ss := sub.(type) {
+	case *subStore:
+		return &subStore{sessionStore: root, s: ss.s, path: ss.path}
+	case *basicStore:
+		if ns, ok := ss.Store.(*nestedStore); ok {
+			return &basicStore{Store: &nestedStore{Store: root, name: ns.name}}
+		}
+	}
+	return sub
+}
+
+// The copy is a view of the root store bound to the context
+func (ss *subStore) WithContext(ctx context.Context) Store {
+	return &subStore{sessionStore: extendStore(ss.sessionStore.WithContext(ctx)), s: ss.s, path: ss.path}
+}
+
+// get the nested map, nil if it does not exist yet, the caller must hold the lock
+func (ss *subStore) values() map[string]interface{} {
+	m, _ := ss.s.values.at(ss.path[0]).(map[string]interface{})
+	for _, name := range ss.path[1:] {
+		if m, _ = m[name].(map[string]interface{}); m == nil {
+			return nil
+		}
+	}
+	return m
+}
+
+// reports whether a session value on the path of the sub store is not a nested map,
+// the caller must hold the lock
+func (ss *subStore) conflicts() bool {
+	v, ok := ss.s.values.get(ss.path[0])
+	for i := 1; ok; i++ {
+		m, isMap := v.(map[string]interface{})
+		if !isMap {
+			return true
+		}
+		if i == len(ss.path) {
+			return false
+		}
+		v, ok = m[ss.path[i]]
+	}
+	return false
+}
+
+// change a copy of the nested map and replace the session value with it,
+// creating the nested map when it does not exist, the caller must hold the lock.
+// A value on the path that is not a nested map is left as is with ErrTypeMismatch.
+func (ss *subStore) update(fn func(map[string]interface{})) error {
+	if reservedKey(ss.path[0]) {
+		return ErrReservedKey
+	}
+	if ss.conflicts() {
+		return ErrTypeMismatch
+	}
+	if err := ss.s.checkKeys(ss.path[0]); err != nil {
+		return err
+	}
+	top, _ := ss.s.values.at(ss.path[0]).(map[string]interface{})
+	ss.s.setValue(ss.path[0], updateNested(top, ss.path[1:], fn))
+	return nil
+}
+
+func updateNested(m map[string]interface{}, path []string, fn func(map[string]interface{})) map[string]interface{} {
+	c := make(map[string]interface{}, len(m)+1)
+	for key, value := range m {
+		c[key] = value
+	}
+	if len(path) == 0 {
+		fn(c)
+		return c
+	}
+	sub, _ := c[path[0]].(map[string]interface{})
+	c[path[0]] = updateNested(sub, path[1:], fn)
+	return c
+}
+
+// A value that is rejected is logged and not set
+func (ss *subStore) Set(key string, value interface{}) {
+	if err := ss.SetChecked(key, value); err != nil {
+		ss.s.mstore.opts.logger.Printf("[WARN] session: value %q of %s not set: %v", key, strings.Join(ss.path, "/"), err)
+	}
+}
+
+func (ss *subStore) SetChecked(key string, value interface{}) error {
+	key = ss.s.key(key)
+	if err := ss.s.checkSerializable(key, value); err != nil {
+		return err
+	}
+	ss.s.mu.Lock()
+	defer ss.s.unlock()
+
+	if err := ss.update(func(m map[string]interface{}) {
+		m[key] = value
+	}); err != nil {
+		return err
+	}
+	ss.s.unmarkTransient(ss.keyPath(key))
+	ss.s.clearExpires(ss.keyPath(key))
+	return nil
+}
+
+func (ss *subStore) SetWithTTLAndCallback(key string, value interface{}, ttl time.Duration, onExpire func(key string, value interface{})) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	key = ss.s.key(key)
+	if err := ss.s.checkSerializable(key, value); err != nil {
+		return err
+	}
+	ss.s.mu.Lock()
+	defer ss.s.unlock()
+
+	if err := ss.s.checkKeys(ss.path[0], expiresKey); err != nil {
+		return err
+	}
+	if err := ss.update(func(m map[string]interface{}) {
+		m[key] = value
+	}); err != nil {
+		return err
+	}
+	ss.s.unmarkTransient(ss.keyPath(key))
+	ss.s.setExpires(ss.keyPath(key), ttl, onExpire)
+	return nil
+}
+
+// get the path of the key from the root of the session values
+func (ss *subStore) keyPath(key string) []string {
+	return append(ss.path[:len(ss.path):len(ss.path)], key)
+}
+
+// The nested map is created as a session value which is saved, only the value is transient.
+// The value is not set when a session value on the path is not a nested map.
+func (ss *subStore) SetTransient(key string, value interface{}) {
+	key = ss.s.key(key)
+	ss.s.mu.Lock()
+	defer ss.s.unlock()
+
+	if reservedKey(ss.path[0]) || ss.conflicts() {
+		ss.s.mstore.opts.logger.Printf("[WARN] session: transient value %q not set, %s is not a nested map", key, strings.Join(ss.path, "/"))
+		return
+	}
+	top, _ := ss.s.values.at(ss.path[0]).(map[string]interface{})
+	ss.s.setValue(ss.path[0], updateNested(top, ss.path[1:], func(m map[string]interface{}) {
+		m[key] = value
+	}))
+	ss.s.markTransient(ss.keyPath(key))
+}
+
+func (ss *subStore) SetIfAbsent(key string, value interface{}) (bool, error) {
+	key = ss.s.key(key)
+	ss.s.mu.Lock()
+	defer ss.s.unlock()
+
+	if _, ok := ss.values()[key]; ok {
+		return false, nil
+	}
+	if err := ss.s.checkSerializable(key, value); err != nil {
+		return false, err
+	}
+	err := ss.update(func(m map[string]interface{}) {
+		m[key] = value
+	})
+	return err == nil, err
+}
+
+func (ss *subStore) SetAll(values map[string]interface{}) error {
+	if ss.s.mstore.opts.ignoreCase {
+		values = lowerKeys(values)
+	}
+	for key, value := range values {
+		if err := ss.s.checkSerializable(key, value); err != nil {
+			return err
+		}
+	}
+	ss.s.mu.Lock()
+	defer ss.s.unlock()
+
+	if err := ss.update(func(m map[string]interface{}) {
+		for key, value := range values {
+			m[key] = value
+		}
+	}); err != nil {
+		return err
+	}
+	for key := range values {
+		ss.s.unmarkTransient(ss.keyPath(key))
+	}
+	return nil
+}
+
+func (ss *subStore) Get(key string) (interface{}, bool) {
+	key = ss.s.key(key)
+	ss.s.mu.RLock()
+	val, ok := ss.values()[key]
+	expired := ok && ss.s.expiredLocked(ss.keyPath(key))
+	ss.s.mu.RUnlock()
+
+	if expired {
+		ss.s.purgeExpired(ss.keyPath(key))
+		return nil, false
+	}
+	if ok && ss.s.mstore.opts.copyOnGet {
+		val = deepCopy(val)
+	}
+	return val, ok
+}
+
+func (ss *subStore) GetAny(key string) interface{} {
+	v, _ := ss.Get(key)
+	return v
+}
+
+func (ss *subStore) GetFirst(keys ...string) (interface{}, bool) {
+	for _, key := range keys {
+		if v, ok := ss.Get(key); ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func (ss *subStore) GetMany(keys ...string) map[string]interface{} {
+	values := make(map[string]interface{}, len(keys))
+	var expired []string
+	ss.s.mu.RLock()
+	m := ss.values()
+	for _, key := range keys {
+		k := ss.s.key(key)
+		if val, ok := m[k]; ok {
+			if ss.s.expiredLocked(ss.keyPath(k)) {
+				expired = append(expired, k)
+			} else {
+				values[key] = val
+			}
+		}
+	}
+	ss.s.mu.RUnlock()
+
+	for _, k := range expired {
+		ss.s.purgeExpired(ss.keyPath(k))
+	}
+
+	if ss.s.mstore.opts.copyOnGet {
+		for key, val := range values {
+			values[key] = deepCopy(val)
+		}
+	}
+	return values
+}
+
+func (ss *subStore) SetTyped(key string, value interface{}) error {
+	return ss.SetChecked(key, tagValue(value))
+}
+
+func (ss *subStore) GetTyped(key string) (interface{}, bool) {
+	return getTyped(ss, key)
+}
+
+func (ss *subStore) SetStream(key string, r io.Reader) error {
+	return setStream(ss, key, r)
+}
+
+func (ss *subStore) GetStream(key string) (io.ReadCloser, bool) {
+	return getStream(ss, key)
+}
+
+func (ss *subStore) GetString(key string) (string, bool) {
+	return getString(ss, key)
+}
+
+func (ss *subStore) GetInt(key string) (int, bool) {
+	return getInt(ss, key)
+}
+
+func (ss *subStore) GetBool(key string) (bool, bool) {
+	return getBool(ss, key)
+}
+
+func (ss *subStore) SetUUID(key string, id uuid.UUID) error {
+	return ss.SetChecked(key, id.String())
+}
+
+func (ss *subStore) GetUUID(key string) (uuid.UUID, bool) {
+	return getUUID(ss, key)
+}
+
+func (ss *subStore) GetInto(key string, dst interface{}) error {
+	return getInto(ss, key, dst)
+}
+
+func (ss *subStore) Keys() []string {
+	ss.s.mu.RLock()
+	values := ss.values()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	ss.s.mu.RUnlock()
+
+	if ss.s.mstore.opts.sortedKeys {
+		sort.Strings(keys)
+	}
+	return keys
+}
+
+func (ss *subStore) Delete(key string) interface{} {
+	v, _ := ss.Pop(key)
+	return v
+}
+
+func (ss *subStore) DeletePrefix(prefix string) int {
+	prefix = ss.s.key(prefix)
+	ss.s.mu.Lock()
+	defer ss.s.unlock()
+
+	var keys []string
+	for key := range ss.values() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return 0
+	}
+
+	ss.update(func(m map[string]interface{}) {
+		for _, key := range keys {
+			delete(m, key)
+		}
+	})
+	return len(keys)
+}
+
+func (ss *subStore) Pop(key string) (interface{}, bool) {
+	key = ss.s.key(key)
+	ss.s.mu.Lock()
+	defer ss.s.unlock()
+
+	v, ok := ss.values()[key]
+	if ok {
+		ss.update(func(m map[string]interface{}) {
+			delete(m, key)
+		})
+	}
+	return v, ok
+}
+
+// Clear the values of the sub store and save the session
+func (ss *subStore) Flush() error {
+	ss.DeletePrefix("")
+	return ss.Save()
+}
+
+// Replace the values of the sub store and save the session
+func (ss *subStore) Replace(values map[string]interface{}) error {
+	if ss.s.mstore.opts.ignoreCase {
+		values = lowerKeys(values)
+	}
+	ss.s.mu.Lock()
+	err := ss.update(func(m map[string]interface{}) {
+		for key := range m {
+			delete(m, key)
+		}
+		for key, value := range values {
+			m[key] = value
+		}
+	})
+	ss.s.unlock()
+	if err != nil {
+		return err
+	}
+	return ss.Save()
+}
+
+// The callback is registered for the top level session value of the sub store,
+// and invoked when the value of the key in the nested map changes
+func (ss *subStore) OnChange(key string, fn func(old, new interface{})) {
+	key = ss.s.key(key)
+	path := ss.path[1:]
+	ss.s.OnChange(ss.path[0], func(old, new interface{}) {
+		o, n := nestedValue(old, path, key), nestedValue(new, path, key)
+		if !reflect.DeepEqual(o, n) {
+			fn(o, n)
+		}
+	})
+}
+
+// get the value of the key in the nested map at the path, nil if it does not exist
+func nestedValue(v interface{}, path []string, key string) interface{} {
+	m, _ := v.(map[string]interface{})
+	for _, name := range path {
+		if m, _ = m[name].(map[string]interface{}); m == nil {
+			return nil
+		}
+	}
+	return m[key]
+}
+
+func (ss *subStore) SubStore(name string) Store {
+	path := append(append([]string(nil), ss.path...), ss.s.key(name))
+	return &subStore{sessionStore: ss.sessionStore, s: ss.s, path: path}
+}
+
+func (ss *subStore) String() string {
+	ss.s.mu.RLock()
+	defer ss.s.mu.RUnlock()
+	return formatSession(ss.s.mstore.opts, ss.s.SessionID()+"/"+strings.Join(ss.path, "/"), ss.values())
+}
@@ -0,0 +1,93 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSubStore(t *testing.T) {
+	mstore := NewMemoryStore(WithSortedKeys())
+
+	Convey("Test sub store of a session", t, func() {
+		store, err := mstore.Create(context.Background(), "test_sub_store", 10)
+		So(err, ShouldBeNil)
+		store.Set("foo", "bar")
+
+		sub := store.(SubStorer).SubStore("plugin")
+		_, ok := sub.Get("foo")
+		So(ok, ShouldBeFalse)
+		So(sub.Delete("foo"), ShouldBeNil)
+		So(store.(ValueStore).Keys(), ShouldResemble, []string{"foo"})
+
+		sub.Set("foo", "baz")
+		So(sub.(ValueStore).SetAll(map[string]interface{}{"count": 1, "enabled": true}), ShouldBeNil)
+		So(store.(ValueStore).Keys(), ShouldResemble, []string{"foo", "plugin"})
+		So(sub.(ValueStore).Keys(), ShouldResemble, []string{"count", "enabled", "foo"})
+		foo, _ := sub.GetString("foo")
+		So(foo, ShouldEqual, "baz")
+		count, _ := sub.GetInt("count")
+		So(count, ShouldEqual, 1)
+		foo, _ = store.GetString("foo")
+		So(foo, ShouldEqual, "bar")
+
+		nested := sub.(SubStorer).SubStore("nested")
+		nested.Set("foo", "qux")
+		So(sub.(ValueStore).Keys(), ShouldResemble, []string{"count", "enabled", "foo", "nested"})
+		So(sub.Save(), ShouldBeNil)
+
+		store, err = mstore.Update(context.Background(), "test_sub_store", 10)
+		So(err, ShouldBeNil)
+		foo, _ = store.(SubStorer).SubStore("plugin").(SubStorer).SubStore("nested").GetString("foo")
+		So(foo, ShouldEqual, "qux")
+
+		sub = store.(SubStorer).SubStore("plugin")
+		So(sub.Delete("count"), ShouldEqual, 1)
+		v, ok := sub.(ValueStore).Pop("enabled")
+		So(ok, ShouldBeTrue)
+		So(v, ShouldEqual, true)
+		So(sub.Flush(), ShouldBeNil)
+		So(sub.(ValueStore).Keys(), ShouldBeEmpty)
+		foo, _ = store.GetString("foo")
+		So(foo, ShouldEqual, "bar")
+	})
+
+	Convey("Test sub store does not replace a session value that is not a nested map", t, func() {
+		store, err := mstore.Create(context.Background(), "test_sub_store_conflict", 10)
+		So(err, ShouldBeNil)
+		store.Set("plugin", "bar")
+
+		sub := store.(SubStorer).SubStore("plugin")
+		So(sub.(ValueStore).SetChecked("foo", "baz"), ShouldEqual, ErrTypeMismatch)
+		So(sub.(ValueStore).SetAll(map[string]interface{}{"foo": "baz"}), ShouldEqual, ErrTypeMismatch)
+		ok, err := sub.(ValueStore).SetIfAbsent("foo", "baz")
+		So(err, ShouldEqual, ErrTypeMismatch)
+		So(ok, ShouldBeFalse)
+		So(sub.(ValueStore).Replace(map[string]interface{}{"foo": "baz"}), ShouldEqual, ErrTypeMismatch)
+		So(sub.(SubStorer).SubStore("nested").(ValueStore).SetChecked("foo", "baz"), ShouldEqual, ErrTypeMismatch)
+		sub.(ValueStore).SetTransient("foo", "baz")
+		So(sub.(ValueStore).Keys(), ShouldBeEmpty)
+
+		plugin, _ := store.GetString("plugin")
+		So(plugin, ShouldEqual, "bar")
+
+		store.(SubStorer).SubStore("nested").Set("plugin", "qux")
+		So(store.(SubStorer).SubStore("nested").(SubStorer).SubStore("plugin").(ValueStore).SetChecked("foo", "baz"), ShouldEqual, ErrTypeMismatch)
+	})
+
+	Convey("Test sub store keeps the TTL of a value when a write is rejected", t, func() {
+		st, err := mstore.Create(context.Background(), "test_sub_store_conflict_ttl", 10)
+		So(err, ShouldBeNil)
+		plugin := st.(SubStorer).SubStore("plugin")
+		nested := plugin.(SubStorer).SubStore("nested")
+		So(nested.(ValueStore).SetWithTTLAndCallback("foo", "bar", time.Minute, nil), ShouldBeNil)
+		plugin.Set("nested", "qux")
+
+		So(nested.(ValueStore).SetChecked("foo", "baz"), ShouldEqual, ErrTypeMismatch)
+		So(nested.(ValueStore).SetAll(map[string]interface{}{"foo": "baz"}), ShouldEqual, ErrTypeMismatch)
+		expires := st.(*store).values.at(expiresKey)
+		So(expires, ShouldContainKey, "plugin\x00nested\x00foo")
+	})
+}
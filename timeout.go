@@ -0,0 +1,214 @@
+package session
+
+import (
+	"context"
+	"time"
+)
+
+var (
+	_ managerStore = &timeoutStore{}
+	_ sessionStore = &timeoutSessionStore{}
+)
+
+// Create a session storage that runs every operation of inner with a timeout,
+// an operation that does not complete in time returns context.DeadlineExceeded
+func NewTimeoutStore(inner ManagerStore, d time.Duration) ManagerStore {
+	return &timeoutStore{inner: inner, timeout: d}
+}
+
+type timeoutStore struct {
+	inner   ManagerStore
+	timeout time.Duration
+}
+
+// Run fn with a timeout, without waiting for fn to return once the timeout expired.
+// fn is not run when the context is already done.
+func withTimeout[T any](ctx context.Context, d time.Duration, fn func(context.Context) (T, error)) (T, error) {
+	if err := ctx.Err(); err != nil {
+		var zero T
+		return zero, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	type result struct {
+		v   T
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		v, err := fn(ctx)
+		ch <- result{v, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.v, r.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+func (s *timeoutStore) wrap(ctx context.Context, store Store) Store {
+	return &timeoutSessionStore{sessionStore: extendStore(store), ts: s, ctx: ctx}
+}
+
+func (s *timeoutStore) Check(ctx context.Context, sid string) (bool, error) {
+	return withTimeout(ctx, s.timeout, func(ctx context.Context) (bool, error) {
+		return s.inner.Check(ctx, sid)
+	})
+}
+
+func (s *timeoutStore) Create(ctx context.Context, sid string, expired int64) (Store, error) {
+	store, err := withTimeout(ctx, s.timeout, func(ctx context.Context) (Store, error) {
+		return s.inner.Create(ctx, sid, expired)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.wrap(ctx, store), nil
+}
+
+func (s *timeoutStore) Update(ctx context.Context, sid string, expired int64) (Store, error) {
+	store, err := withTimeout(ctx, s.timeout, func(ctx context.Context) (Store, error) {
+		return s.inner.Update(ctx, sid, expired)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.wrap(ctx, store), nil
+}
+
+func (s *timeoutStore) LoadOrCreate(ctx context.Context, sid string, expired int64) (Store, bool, error) {
+	var created bool
+	store, err := withTimeout(ctx, s.timeout, func(ctx context.Context) (Store, error) {
+		store, ok, err := LoadOrCreate(ctx, s.inner, sid, expired)
+		created = ok
+		return store, err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return s.wrap(ctx, store), created, nil
+}
+
+func (s *timeoutStore) Delete(ctx context.Context, sid string) error {
+	_, err := withTimeout(ctx, s.timeout, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, s.inner.Delete(ctx, sid)
+	})
+	return err
+}
+
+func (s *timeoutStore) Refresh(ctx context.Context, oldsid, sid string, expired int64) (Store, error) {
+	store, err := withTimeout(ctx, s.timeout, func(ctx context.Context) (Store, error) {
+		return s.inner.Refresh(ctx, oldsid, sid, expired)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.wrap(ctx, store), nil
+}
+
+func (s *timeoutStore) TimeToLive(ctx context.Context, sid string) (time.Duration, error) {
+	return withTimeout(ctx, s.timeout, func(ctx context.Context) (time.Duration, error) {
+		return TimeToLive(ctx, s.inner, sid)
+	})
+}
+
+func (s *timeoutStore) Count(ctx context.Context) (int, error) {
+	return withTimeout(ctx, s.timeout, func(ctx context.Context) (int, error) {
+		return Count(ctx, s.inner)
+	})
+}
+
+func (s *timeoutStore) Ping(ctx context.Context) error {
+	_, err := withTimeout(ctx, s.timeout, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, Ping(ctx, s.inner)
+	})
+	return err
+}
+
+func (s *timeoutStore) Close() error {
+	return s.inner.Close()
+}
+
+// A session store that saves with a timeout
+type timeoutSessionStore struct {
+	sessionStore
+	ts  *timeoutStore
+	ctx context.Context
+}
+
+// The session store keeps the caller context rather than the one with the timeout
+func (s *timeoutSessionStore) Context() context.Context {
+	return s.ctx
+}
+
+func (s *timeoutSessionStore) Manager() ManagerStore {
+	return s.ts
+}
+
+func (s *timeoutSessionStore) unwrap() []Store {
+	return []Store{s.sessionStore}
+}
+
+func (s *timeoutSessionStore) WithContext(ctx context.Context) Store {
+	return s.ts.wrap(ctx, s.sessionStore.WithContext(ctx))
+}
+
+func (s *timeoutSessionStore) Save() error {
+	_, err := withTimeout(s.ctx, s.ts.timeout, func(context.Context) (struct{}, error) {
+		return struct{}{}, s.sessionStore.Save()
+	})
+	return err
+}
+
+func (s *timeoutSessionStore) SaveReturn() (Store, error) {
+	store, err := withTimeout(s.ctx, s.ts.timeout, func(context.Context) (Store, error) {
+		return s.sessionStore.SaveReturn()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.ts.wrap(s.ctx, store), nil
+}
+
+func (s *timeoutSessionStore) SaveDirty() error {
+	_, err := withTimeout(s.ctx, s.ts.timeout, func(context.Context) (struct{}, error) {
+		return struct{}{}, s.sessionStore.SaveDirty()
+	})
+	return err
+}
+
+func (s *timeoutSessionStore) Flush() error {
+	_, err := withTimeout(s.ctx, s.ts.timeout, func(context.Context) (struct{}, error) {
+		return struct{}{}, s.sessionStore.Flush()
+	})
+	return err
+}
+
+func (s *timeoutSessionStore) SaveIfVersion(expected uint64) error {
+	_, err := withTimeout(s.ctx, s.ts.timeout, func(context.Context) (struct{}, error) {
+		return struct{}{}, s.sessionStore.SaveIfVersion(expected)
+	})
+	return err
+}
+
+func (s *timeoutSessionStore) Rotate(newsid string) error {
+	_, err := withTimeout(s.ctx, s.ts.timeout, func(context.Context) (struct{}, error) {
+		return struct{}{}, s.sessionStore.Rotate(newsid)
+	})
+	return err
+}
+
+func (s *timeoutSessionStore) SubStore(name string) Store {
+	return subStoreOf(s, s.sessionStore.SubStore(name))
+}
+
+func (s *timeoutSessionStore) Replace(values map[string]interface{}) error {
+	_, err := withTimeout(s.ctx, s.ts.timeout, func(context.Context) (struct{}, error) {
+		return struct{}{}, s.sessionStore.Replace(values)
+	})
+	return err
+}
@@ -0,0 +1,55 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// A session storage whose Check blocks for the delay
+type slowStore struct {
+	ManagerStore
+	delay time.Duration
+}
+
+func (s *slowStore) Check(ctx context.Context, sid string) (bool, error) {
+	time.Sleep(s.delay)
+	return s.ManagerStore.Check(ctx, sid)
+}
+
+func TestTimeoutStore(t *testing.T) {
+	mstore := NewTimeoutStore(&slowStore{ManagerStore: NewMemoryStore(), delay: time.Millisecond * 200}, time.Millisecond*50)
+
+	Convey("Test timeout storage operations", t, func() {
+		_, err := mstore.Check(context.Background(), "test_timeout_store")
+		So(err, ShouldResemble, context.DeadlineExceeded)
+
+		type ctxKey struct{}
+		ctx := context.WithValue(context.Background(), ctxKey{}, "bar")
+		store, err := mstore.Create(ctx, "test_timeout_store", 10)
+		So(err, ShouldBeNil)
+		So(store.Context(), ShouldEqual, ctx)
+		So(store.Context().Err(), ShouldBeNil)
+		store.Set("foo", "bar")
+		So(store.Save(), ShouldBeNil)
+
+		// saving a copy uses its context, the session store keeps its own
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		bound := store.(ContextBinder).WithContext(canceled)
+		So(bound, ShouldNotEqual, store)
+		So(bound.Context(), ShouldEqual, canceled)
+		So(bound.Save(), ShouldEqual, context.Canceled)
+		So(store.Context(), ShouldEqual, ctx)
+	})
+}
+
+func TestTimeoutManagerStore(t *testing.T) {
+	mstore := NewTimeoutStore(NewMemoryStore(), time.Second)
+
+	Convey("Test timeout storage management operations", t, func() {
+		testManagerStore(mstore)
+	})
+}
@@ -0,0 +1,193 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The keys of a session value tagged with its type by SetTyped
+const (
+	typedTypeKey  = "$type"
+	typedValueKey = "$value"
+)
+
+// The types of tagged values by type name, extended by RegisterType
+var typedTypes sync.Map
+
+func init() {
+	for _, v := range []interface{}{
+		false, "", []byte(nil),
+		int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0),
+		time.Time{}, time.Duration(0), uuid.UUID{},
+		[]string(nil), []interface{}(nil), map[string]interface{}(nil),
+	} {
+		registerTypeName(v)
+	}
+	// tagged values are stored as a map
+	RegisterType(map[string]interface{}{})
+}
+
+func registerTypeName(v interface{}) {
+	t := reflect.TypeOf(v)
+	typedTypes.Store(t.String(), t)
+}
+
+// Tag the value with the name of its concrete type
+func tagValue(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		typedTypeKey:  reflect.TypeOf(value).String(),
+		typedValueKey: value,
+	}
+}
+
+// Get the value of a tagged value converted back to its type, other values are returned as they are.
+// A value of an unknown type is returned as it was read from the storage.
+func untagValue(value interface{}) interface{} {
+	m, ok := value.(map[string]interface{})
+	if !ok || len(m) != 2 {
+		return value
+	}
+	name, ok := m[typedTypeKey].(string)
+	if !ok {
+		return value
+	}
+	v, ok := m[typedValueKey]
+	if !ok {
+		return value
+	}
+
+	t, ok := typedTypes.Load(name)
+	if !ok {
+		return v
+	}
+	if converted, ok := convertValue(v, t.(reflect.Type)); ok {
+		return converted
+	}
+	return v
+}
+
+// Convert a value read from the storage to the type, decoding it as JSON when it is not convertible
+func convertValue(v interface{}, t reflect.Type) (interface{}, bool) {
+	val := reflect.ValueOf(v)
+	if !val.IsValid() {
+		return reflect.Zero(t).Interface(), true
+	}
+	if val.Type() == t {
+		return v, true
+	}
+	if isNumber(val.Kind()) && isNumber(t.Kind()) {
+		return val.Convert(t).Interface(), true
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, false
+	}
+	ptr := reflect.New(t)
+	if err := json.Unmarshal(data, ptr.Interface()); err != nil {
+		return nil, false
+	}
+	return ptr.Elem().Interface(), true
+}
+
+func isNumber(k reflect.Kind) bool {
+	return (k >= reflect.Int && k <= reflect.Uint64) || k == reflect.Float32 || k == reflect.Float64
+}
+
+// Get the session value, converting a tagged value back to its type
+func getTyped(g getter, key string) (interface{}, bool) {
+	v, ok := g.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return untagValue(v), true
+}
+
+// GetEnum get the session value as a T, converting a number read from a serializing storage
+// to T when T is a numeric type, such as an enum type of ints. A number that is not integral
+// or out of the range of T is not converted.
+func GetEnum[T comparable](s Store, key string) (T, bool) {
+	var zero T
+	v, ok := getTyped(s, key)
+	if !ok {
+		return zero, false
+	}
+	if t, ok := v.(T); ok {
+		return t, true
+	}
+
+	converted, err := convertNumber(reflect.ValueOf(v), reflect.TypeOf(zero))
+	if err != nil {
+		return zero, false
+	}
+	return converted.Interface().(T), true
+}
+
+// Convert the number to the numeric type, returns ErrTypeMismatch when either is not a number or
+// the number can not be represented exactly by the type, such as 1.5 or 300 for an int8
+func convertNumber(val reflect.Value, typ reflect.Type) (reflect.Value, error) {
+	if !val.IsValid() || typ == nil || !isNumber(val.Kind()) || !isNumber(typ.Kind()) {
+		return reflect.Value{}, ErrTypeMismatch
+	}
+
+	target := reflect.New(typ).Elem()
+	switch {
+	case val.CanFloat() && !target.CanFloat():
+		f := val.Float()
+		if f != math.Trunc(f) || math.IsInf(f, 0) {
+			return reflect.Value{}, ErrTypeMismatch
+		}
+		if target.CanInt() && (f < math.MinInt64 || f >= math.MaxInt64 || target.OverflowInt(int64(f))) {
+			return reflect.Value{}, ErrTypeMismatch
+		}
+		if target.CanUint() && (f < 0 || f >= math.MaxUint64 || target.OverflowUint(uint64(f))) {
+			return reflect.Value{}, ErrTypeMismatch
+		}
+	case val.CanInt() && target.CanInt():
+		if target.OverflowInt(val.Int()) {
+			return reflect.Value{}, ErrTypeMismatch
+		}
+	case val.CanInt() && target.CanUint():
+		if val.Int() < 0 || target.OverflowUint(uint64(val.Int())) {
+			return reflect.Value{}, ErrTypeMismatch
+		}
+	case val.CanUint() && target.CanInt():
+		if val.Uint() > math.MaxInt64 || target.OverflowInt(int64(val.Uint())) {
+			return reflect.Value{}, ErrTypeMismatch
+		}
+	case val.CanUint() && target.CanUint():
+		if target.OverflowUint(val.Uint()) {
+			return reflect.Value{}, ErrTypeMismatch
+		}
+	case val.CanFloat() && target.CanFloat():
+		if target.OverflowFloat(val.Float()) {
+			return reflect.Value{}, ErrTypeMismatch
+		}
+	}
+	return val.Convert(typ), nil
+}
+
+// MustGet get the session value as a T, it panics when the key is not set or the value is not a T.
+// It is meant for values that are always set, where a missing value is a programming error.
+func MustGet[T any](s Store, key string) T {
+	v, ok := s.Get(key)
+	if !ok {
+		panic(fmt.Sprintf("session: key %q is not set", key))
+	}
+	t, ok := v.(T)
+	if !ok {
+		panic(fmt.Sprintf("session: value of key %q is a %T, not a %v", key, v, reflect.TypeOf((*T)(nil)).Elem()))
+	}
+	return t
+}
@@ -2,8 +2,11 @@ package session
 
 import (
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
 	"io"
+	"reflect"
+	"strings"
 )
 
 // create a UUID, reference: https://github.com/google/uuid
@@ -26,3 +29,122 @@ func newUUID() string {
 
 	return string(dst)
 }
+
+// reports whether the session id decodes to less than n bytes, or more than half of
+// its characters are the same character, such as the nil UUID
+func weakSessionID(sid string, n int) bool {
+	if sessionIDBytes(sid) < n {
+		return true
+	}
+
+	var counts [256]int
+	for i := 0; i < len(sid); i++ {
+		counts[sid[i]]++
+		if counts[sid[i]] > len(sid)/2 {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the number of bytes of the session id, decoding hex (with dashes, such as UUIDs) and base64
+func sessionIDBytes(sid string) int {
+	if h := strings.ReplaceAll(sid, "-", ""); len(h)%2 == 0 {
+		if _, err := hex.DecodeString(h); err == nil {
+			return len(h) / 2
+		}
+	}
+	trimmed := strings.TrimRight(sid, "=")
+	for _, enc := range []*base64.Encoding{base64.RawURLEncoding, base64.RawStdEncoding} {
+		if b, err := enc.DecodeString(trimmed); err == nil {
+			return len(b)
+		}
+	}
+	return len(sid)
+}
+
+// create a deep copy of the slices, maps, pointers, arrays and structs of a value,
+// unexported struct fields are copied shallowly. A slice, map or pointer that is reached
+// again is copied once, so values with cycles are copied with the same cycles.
+func deepCopy(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return copyValue(reflect.ValueOf(v), make(map[copyRef]reflect.Value)).Interface()
+}
+
+// The identity of a slice, map or pointer that is copied
+type copyRef struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+func copyValue(v reflect.Value, copies map[copyRef]reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		ref := copyRef{ptr: v.Pointer(), typ: v.Type(), len: v.Len()}
+		if c, ok := copies[ref]; ok {
+			return c
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		copies[ref] = c
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i), copies))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		ref := copyRef{ptr: v.Pointer(), typ: v.Type()}
+		if c, ok := copies[ref]; ok {
+			return c
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		copies[ref] = c
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), copyValue(iter.Value(), copies))
+		}
+		return c
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		ref := copyRef{ptr: v.Pointer(), typ: v.Type()}
+		if c, ok := copies[ref]; ok {
+			return c
+		}
+		c := reflect.New(v.Type().Elem())
+		copies[ref] = c
+		c.Elem().Set(copyValue(v.Elem(), copies))
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(copyValue(v.Elem(), copies))
+		return c
+	case reflect.Array:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i), copies))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(copyValue(v.Field(i), copies))
+			}
+		}
+		return c
+	}
+	return v
+}